@@ -10,13 +10,22 @@ import (
 	"os/exec"
 	"testing"
 
+	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 	"golang.org/x/sync/errgroup"
 )
 
 func BenchmarkGoFuseRead(b *testing.B) {
+	benchmarkGoFuseRead(b, nil)
+}
+
+func BenchmarkGoFuseReadIOUring(b *testing.B) {
+	benchmarkGoFuseRead(b, ioUringOptions())
+}
+
+func benchmarkGoFuseRead(b *testing.B, opts *fs.Options) {
 	fs := &readFS{}
-	wd, clean := setupFs(fs, b.N)
+	wd, clean := setupFs(fs, b.N, opts)
 	defer clean()
 
 	jobs := 32
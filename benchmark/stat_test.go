@@ -22,8 +22,10 @@ import (
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 )
 
-func setupFs(node fs.InodeEmbedder, N int) (string, func()) {
-	opts := &fs.Options{}
+func setupFs(node fs.InodeEmbedder, N int, opts *fs.Options) (string, func()) {
+	if opts == nil {
+		opts = &fs.Options{}
+	}
 	opts.Debug = testutil.VerboseTest()
 	mountPoint := testutil.TempDir()
 	server, err := fs.Mount(mountPoint, node, opts)
@@ -67,7 +69,7 @@ func TestNewStatFs(t *testing.T) {
 		fs.AddFile(n, fuse.Attr{Mode: syscall.S_IFREG})
 	}
 
-	wd, clean := setupFs(fs, 1)
+	wd, clean := setupFs(fs, 1, nil)
 	defer clean()
 
 	names, err := ioutil.ReadDir(wd)
@@ -109,7 +111,23 @@ func TestNewStatFs(t *testing.T) {
 	}
 }
 
+// ioUringOptions mounts the benchmark file systems with
+// MountOptions.EnableIOUring, to compare with the default loop.
+func ioUringOptions() *fs.Options {
+	opts := &fs.Options{}
+	opts.EnableIOUring = true
+	return opts
+}
+
 func BenchmarkGoFuseStat(b *testing.B) {
+	benchmarkGoFuseStat(b, nil)
+}
+
+func BenchmarkGoFuseStatIOUring(b *testing.B) {
+	benchmarkGoFuseStat(b, ioUringOptions())
+}
+
+func benchmarkGoFuseStat(b *testing.B, opts *fs.Options) {
 	b.StopTimer()
 	fs := &StatFS{}
 
@@ -120,7 +138,7 @@ func BenchmarkGoFuseStat(b *testing.B) {
 		fs.AddFile(fn, fuse.Attr{Mode: syscall.S_IFREG})
 	}
 
-	wd, clean := setupFs(fs, b.N)
+	wd, clean := setupFs(fs, b.N, opts)
 	defer clean()
 
 	for i, l := range files {
@@ -145,6 +163,14 @@ func readdir(d string) error {
 }
 
 func BenchmarkGoFuseReaddir(b *testing.B) {
+	benchmarkGoFuseReaddir(b, nil)
+}
+
+func BenchmarkGoFuseReaddirIOUring(b *testing.B) {
+	benchmarkGoFuseReaddir(b, ioUringOptions())
+}
+
+func benchmarkGoFuseReaddir(b *testing.B, opts *fs.Options) {
 	b.StopTimer()
 	fs := &StatFS{}
 
@@ -156,7 +182,7 @@ func BenchmarkGoFuseReaddir(b *testing.B) {
 		dirSet[filepath.Dir(fn)] = struct{}{}
 	}
 
-	wd, clean := setupFs(fs, b.N)
+	wd, clean := setupFs(fs, b.N, opts)
 	defer clean()
 
 	var dirs []string
@@ -0,0 +1,92 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// cuseecho creates a character device through CUSE, which reads back
+// what was written to it, like a pipe. It usually needs root:
+//
+//	cuseecho -name cuse-echo &
+//	echo hello > /dev/cuse-echo
+//	head -c 6 /dev/cuse-echo
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// echoDevice is a CUSE device that buffers the data written to it
+// until it is read.
+type echoDevice struct {
+	server *fuse.Server
+
+	mu   sync.Mutex
+	data []byte
+	// poll handles of waiters for data.
+	khs []uint64
+}
+
+func (d *echoDevice) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	out.OpenFlags = fuse.FOPEN_DIRECT_IO | fuse.FOPEN_NONSEEKABLE
+	return fuse.OK
+}
+
+func (d *echoDevice) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := copy(buf, d.data)
+	d.data = d.data[n:]
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+func (d *echoDevice) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	d.mu.Lock()
+	d.data = append(d.data, data...)
+	khs := d.khs
+	d.khs = nil
+	d.mu.Unlock()
+	for _, kh := range khs {
+		d.server.PollNotify(kh)
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+func (d *echoDevice) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, bufOut []byte) fuse.Status {
+	return fuse.Status(syscall.ENOTTY)
+}
+
+func (d *echoDevice) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out.Revents = unix.POLLOUT
+	if len(d.data) > 0 {
+		out.Revents |= unix.POLLIN
+	} else if in.Flags&fuse.FUSE_POLL_SCHEDULE_NOTIFY != 0 {
+		d.khs = append(d.khs, in.Kh)
+	}
+	return fuse.OK
+}
+
+func (d *echoDevice) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	name := flag.String("name", "cuse-echo", "name of the device")
+	flag.Parse()
+
+	dev := &echoDevice{}
+	opts := &fuse.CuseOptions{DevName: *name}
+	opts.Debug = *debug
+	server, err := fuse.NewCuseServer(dev, opts)
+	if err != nil {
+		log.Fatalf("NewCuseServer: %v", err)
+	}
+	dev.server = server
+	server.Serve()
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// isArchived tells whether objects of 'storageClass' have to be restored before they can be downloaded.
+func isArchived(storageClass string) bool {
+	switch storageClass {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+		return true
+	}
+	return false
+}
+
+// restoreState is the state of the restore of an archived object, as per its x-amz-restore header.
+type restoreState int
+
+const (
+	notRestored restoreState = iota
+	restoring
+	restored
+)
+
+func restoreStateOf(header *string) restoreState {
+	switch {
+	case strings.Contains(aws.StringValue(header), `ongoing-request="false"`):
+		return restored
+	case strings.Contains(aws.StringValue(header), `ongoing-request="true"`):
+		return restoring
+	}
+	return notRestored
+}
+
+// checkRestored tells whether the archived object 'key' can be read, which takes a restored copy of it. Otherwise,
+// with 'restoreOnOpen', a restore is requested and EAGAIN returned, so that opening the file can be retried later;
+// without it, 'archivedErrno' is returned.
+func (b *s3Bucket) checkRestored(ctx context.Context, key string) syscall.Errno {
+	head, err := b.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &b.name, Key: &key})
+	if err != nil {
+		log.Printf("failed to query object '%v' in s3 bucket '%v': %v", key, b.name, err)
+		return toErrno(ctx, err)
+	}
+	class := aws.StringValue(head.StorageClass)
+	state := restoreStateOf(head.Restore)
+	if !isArchived(class) || state == restored {
+		return 0
+	}
+
+	if !b.opts.restoreOnOpen {
+		if state == restoring {
+			log.Printf("object '%v' in s3 bucket '%v' is stored in %v, and is being restored", key, b.name, class)
+		} else {
+			log.Printf("object '%v' in s3 bucket '%v' is stored in %v, and has to be restored to be read", key, b.name, class)
+		}
+		return b.archivedErrno()
+	}
+	if state == restoring {
+		return syscall.EAGAIN
+	}
+	if _, err := b.backend.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket:         &b.name,
+		Key:            &key,
+		RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(b.opts.restoreDays)},
+	}); err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "RestoreAlreadyInProgress" {
+			log.Printf("failed to restore object '%v' in s3 bucket '%v': %v", key, b.name, err)
+			return toErrno(ctx, err)
+		}
+	}
+	log.Printf("restoring object '%v' in s3 bucket '%v' from %v for %d days", key, b.name, class, b.opts.restoreDays)
+	return syscall.EAGAIN
+}
+
+func (b *s3Bucket) archivedErrno() syscall.Errno {
+	if b.opts.archivedEACCES {
+		return syscall.EACCES
+	}
+	return syscall.EREMOTE
+}
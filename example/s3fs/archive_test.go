@@ -0,0 +1,87 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestArchived(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putArchived("cold", "frozen", s3.StorageClassGlacier)
+	fake.putArchived("colder", "frozen", s3.StorageClassDeepArchive)
+	fake.put("warm", "hot")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+	readDirNames(t, mnt)
+
+	for _, name := range []string{"cold", "colder"} {
+		if _, err := ioutil.ReadFile(mnt + "/" + name); !errors.Is(err, syscall.EREMOTE) {
+			t.Errorf("ReadFile(%v): got %v, want EREMOTE", name, err)
+		}
+	}
+	if got, err := getxattr(t, mnt+"/cold", xattrStorageClass); err != nil || got != s3.StorageClassGlacier {
+		t.Errorf("Getxattr: got %q, %v, want %q", got, err, s3.StorageClassGlacier)
+	}
+	if got := fake.count("RestoreObject"); got != 0 {
+		t.Errorf("got %d RestoreObject calls, want 0", got)
+	}
+
+	fake.restored("cold")
+	if got, err := ioutil.ReadFile(mnt + "/cold"); err != nil || string(got) != "frozen" {
+		t.Errorf("ReadFile of restored object: got %q, %v, want %q", got, err, "frozen")
+	}
+	if got, err := ioutil.ReadFile(mnt + "/warm"); err != nil || string(got) != "hot" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hot")
+	}
+}
+
+func TestArchivedEACCES(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putArchived("cold", "frozen", s3.StorageClassGlacier)
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, archivedEACCES: true}))
+	defer clean()
+
+	if _, err := ioutil.ReadFile(mnt + "/cold"); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("ReadFile: got %v, want EACCES", err)
+	}
+}
+
+func TestRestoreOnOpen(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putArchived("cold", "frozen", s3.StorageClassDeepArchive)
+
+	opts := bucketOptions{cacheTTL: time.Hour, restoreOnOpen: true, restoreDays: 2}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	for i := 0; i < 2; i++ {
+		if _, err := ioutil.ReadFile(mnt + "/cold"); !errors.Is(err, syscall.EAGAIN) {
+			t.Errorf("ReadFile: got %v, want EAGAIN", err)
+		}
+	}
+	if got := fake.count("RestoreObject"); got != 1 {
+		t.Errorf("got %d RestoreObject calls, want 1", got)
+	}
+	if got, err := getxattr(t, mnt+"/cold", xattrRestore); err != nil || got != `ongoing-request="true"` {
+		t.Errorf("Getxattr: got %q, %v", got, err)
+	}
+
+	fake.restored("cold")
+	if got, err := ioutil.ReadFile(mnt + "/cold"); err != nil || string(got) != "frozen" {
+		t.Errorf("ReadFile of restored object: got %q, %v, want %q", got, err, "frozen")
+	}
+}
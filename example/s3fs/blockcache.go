@@ -0,0 +1,135 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+)
+
+// blockID identifies a block of a given version of an object. As the cache may be shared by several buckets, keys are
+// qualified with the name of their bucket, see blockKey.
+type blockID struct {
+	key   string
+	etag  string
+	index int64
+}
+
+type block struct {
+	id   blockID
+	data []byte
+}
+
+// blockCache keeps the most recently read blocks of objects, up to a total size.
+type blockCache struct {
+	blockSize int64
+	capacity  int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *block, most recently used first
+	byID  map[blockID]*list.Element
+	byKey map[string]map[blockID]*list.Element
+
+	hits, misses uint64
+}
+
+// newBlockCache creates a cache of blocks of 'blockSize' bytes, holding at most 'capacity' bytes.
+func newBlockCache(blockSize, capacity int64) *blockCache {
+	return &blockCache{
+		blockSize: blockSize,
+		capacity:  capacity,
+		lru:       list.New(),
+		byID:      map[blockID]*list.Element{},
+		byKey:     map[string]map[blockID]*list.Element{},
+	}
+}
+
+// get returns the block 'id', if cached.
+func (c *blockCache) get(id blockID) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.byID[id]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*block).data, true
+}
+
+// has tells whether the block 'id' is cached, without counting it as a read.
+func (c *blockCache) has(id blockID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.byID[id]
+	return ok
+}
+
+// put caches 'data' as the block 'id', evicting the least recently used blocks to make room.
+func (c *blockCache) put(id blockID, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int64(len(data)) > c.capacity {
+		return
+	}
+	if e, ok := c.byID[id]; ok {
+		c.remove(e)
+	}
+	for c.size+int64(len(data)) > c.capacity {
+		c.remove(c.lru.Back())
+	}
+
+	e := c.lru.PushFront(&block{id: id, data: data})
+	c.byID[id] = e
+	if c.byKey[id.key] == nil {
+		c.byKey[id.key] = map[blockID]*list.Element{}
+	}
+	c.byKey[id.key][id] = e
+	c.size += int64(len(data))
+}
+
+// drop evicts all blocks of the object 'key'. It is a no-op on a nil cache.
+func (c *blockCache) drop(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.byKey[key] {
+		c.remove(e)
+	}
+}
+
+func (c *blockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*block)
+	delete(c.byID, b.id)
+	if blocks := c.byKey[b.id.key]; blocks != nil {
+		delete(blocks, b.id)
+		if len(blocks) == 0 {
+			delete(c.byKey, b.id.key)
+		}
+	}
+	c.size -= int64(len(b.data))
+}
+
+// stats returns how many reads were served from the cache and how many were not, and the size of the cached blocks.
+func (c *blockCache) stats() (hits, misses uint64, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+// logStats logs how effective the cache was.
+func (c *blockCache) logStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Printf("block cache: %d hits, %d misses, %d bytes in %d blocks", c.hits, c.misses, c.size, c.lru.Len())
+}
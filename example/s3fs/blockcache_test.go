@@ -0,0 +1,86 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	c := newBlockCache(4, 8)
+	a, b, d := blockID{"k", "e", 0}, blockID{"k", "e", 1}, blockID{"k", "e", 2}
+	c.put(a, []byte("aaaa"))
+	c.put(b, []byte("bbbb"))
+	if _, ok := c.get(a); !ok {
+		t.Fatalf("block a missing")
+	}
+
+	// b is now the least recently used block.
+	c.put(d, []byte("dddd"))
+	if _, ok := c.get(b); ok {
+		t.Errorf("block b was not evicted")
+	}
+	if got, ok := c.get(a); !ok || string(got) != "aaaa" {
+		t.Errorf("got %q, %v, want %q", got, ok, "aaaa")
+	}
+	if c.size != 8 {
+		t.Errorf("got size %d, want 8", c.size)
+	}
+	if c.hits != 2 || c.misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 2 and 1", c.hits, c.misses)
+	}
+
+	c.put(blockID{"other", "e", 0}, []byte("o"))
+	c.drop("k")
+	if c.lru.Len() != 1 || c.size != 1 {
+		t.Errorf("got %d blocks of %d bytes after drop, want 1 of 1", c.lru.Len(), c.size)
+	}
+}
+
+func TestReadCached(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "0123456789")
+
+	blocks := newBlockCache(4, 1<<20)
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, blocks: blocks})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"file"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(got) != "0123456789" {
+			t.Fatalf("ReadFile: got %q, %v", got, err)
+		}
+	}
+	// The blocks missing for a read are downloaded together.
+	if got := fake.count("GetObject"); got != 1 {
+		t.Errorf("got %d GetObject calls, want 1", got)
+	}
+	blocks.mu.Lock()
+	hits := blocks.hits
+	blocks.mu.Unlock()
+	if hits == 0 {
+		t.Errorf("the second read did not hit the cache")
+	}
+
+	// Overwriting the object changes its ETag, so a refresh must drop its blocks.
+	fake.put("file", "abcdefghij")
+	bucket.refresh(context.Background())
+	blocks.mu.Lock()
+	n := blocks.lru.Len()
+	blocks.mu.Unlock()
+	if n != 0 {
+		t.Errorf("got %d cached blocks after refresh, want 0", n)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(got) != "abcdefghij" {
+		t.Errorf("ReadFile after refresh: got %q, %v", got, err)
+	}
+}
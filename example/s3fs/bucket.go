@@ -0,0 +1,843 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+// delimiter separates the components of a key that are presented as directories.
+const delimiter = "/"
+
+// bucketOptions tunes how a bucket is queried.
+type bucketOptions struct {
+	// prefix restricts the filesystem to the keys under it, or is empty to expose the whole bucket.
+	prefix string
+
+	// cacheTTL is how long a listing fetched from s3 is reused.
+	cacheTTL time.Duration
+
+	// negativeTTL is how long the kernel may cache that a name does not exist, sparing s3 queries when it is looked
+	// up again, e.g. by shell completion.
+	negativeTTL time.Duration
+
+	// maxKeys is the page size of listings, or 0 to leave it up to s3.
+	maxKeys int64
+
+	// maxCachedEntries is the largest number of children of a directory kept as its listing, or 0 for no limit.
+	// Larger directories are listed page by page every time they are read.
+	maxCachedEntries int
+
+	// partSize is the size of the parts of multipart uploads, or 0 to store objects with a single request.
+	partSize int64
+
+	// spoolDir is where the content of files being written is kept until it is uploaded, or empty for the default
+	// directory for temporary files.
+	spoolDir string
+
+	// maxTruncateSize is the largest size objects may be truncated to, other than zero.
+	maxTruncateSize int64
+
+	// verifyChecksums checks objects downloaded in full against their checksums.
+	verifyChecksums bool
+
+	// readOnly rejects every operation that would modify the bucket with EROFS.
+	readOnly bool
+
+	// showVersions exposes the past versions of objects under versionsDirName in the root.
+	showVersions bool
+
+	// archivedEACCES fails opening archived objects that are not restored with EACCES rather than EREMOTE.
+	archivedEACCES bool
+
+	// preserveTimes stores the modification times set on files in their metadata, which takes copying objects onto
+	// themselves, and queries the metadata of every file looked up to find them.
+	preserveTimes bool
+
+	// restoreOnOpen requests the restore of archived objects, for 'restoreDays', when they are opened.
+	restoreOnOpen bool
+	restoreDays   int64
+
+	// sse is the server-side encryption requested for uploads, s3.ServerSideEncryptionAes256 or
+	// s3.ServerSideEncryptionAwsKms, or empty for the default encryption of the bucket. sseKMSKeyID selects the KMS
+	// key of the latter, or is empty for the default one.
+	sse         string
+	sseKMSKeyID string
+
+	// presignExpiry is how long the URLs handed out by xattrPresignedURL are valid, or 0 to not hand out any.
+	presignExpiry time.Duration
+
+	// opTimeout bounds every operation that queries s3, or 0 for no bound.
+	opTimeout time.Duration
+
+	// blocks caches the content of objects, possibly shared with other buckets, or is nil to download every read.
+	blocks *blockCache
+
+	// readahead is how many bytes following sequential reads are prefetched into 'blocks', or 0 to not prefetch.
+	readahead int64
+}
+
+// s3Bucket captures the intent to connect to a bucket. It is the root directory of the filesystem.
+type s3Bucket struct {
+	s3Dir
+
+	name    string
+	backend *s3.S3
+	opts    bucketOptions
+	inos    *inodes
+}
+
+// backendOptions selects the s3 service to connect to, and how to authenticate with it.
+type backendOptions struct {
+	// endpoint overrides the s3 endpoint of the region, e.g. for s3-compatible services.
+	endpoint string
+
+	// region and profile override the ones of the environment and shared config files.
+	region  string
+	profile string
+
+	// anonymous sends unsigned requests without looking for credentials, which only works on public buckets.
+	anonymous bool
+
+	// maxRetries is how many times throttled and transient failures are retried, with jittered exponential backoff.
+	maxRetries int
+}
+
+// errBadProfile is returned when the credentials of the requested profile cannot be loaded.
+var errBadProfile = errors.New("unusable profile")
+
+// newS3Backend creates a new s3 service as per 'opts'. The shared config files are honored as by the aws cli. When a
+// profile is requested, its credentials are loaded right away, so a missing or broken profile is reported up front
+// rather than by the first operation. Anonymous requests that are denied are reported as such, as the likely cause is
+// that the bucket is not public.
+func newS3Backend(opts backendOptions) (*s3.S3, error) {
+	config := aws.NewConfig().WithS3ForcePathStyle(true).WithMaxRetries(opts.maxRetries)
+	if opts.endpoint != "" {
+		config = config.WithEndpoint(opts.endpoint)
+	}
+	if opts.region != "" {
+		config = config.WithRegion(opts.region)
+	}
+	if opts.anonymous {
+		config = config.WithCredentials(credentials.AnonymousCredentials)
+	}
+
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           opts.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish session with s3: %v", err)
+	}
+	if opts.profile != "" && !opts.anonymous {
+		if _, err := session.Config.Credentials.Get(); err != nil {
+			return nil, fmt.Errorf("%w '%v': %v", errBadProfile, opts.profile, err)
+		}
+	}
+	backend := s3.New(session)
+	if opts.anonymous {
+		backend.Handlers.UnmarshalError.PushBackNamed(request.NamedHandler{Name: "s3fs.AnonymousDenied", Fn: explainDenied})
+	}
+	return backend, nil
+}
+
+// explainDenied rewords the message of the error of an anonymous request that was denied. The code and status are
+// kept, so the error maps to the same errno.
+func explainDenied(r *request.Request) {
+	reqErr, ok := r.Error.(awserr.RequestFailure)
+	if !ok || reqErr.StatusCode() != http.StatusForbidden {
+		return
+	}
+	r.Error = awserr.NewRequestFailure(
+		awserr.New(reqErr.Code(), "anonymous request denied, the bucket may not be public: "+reqErr.Message(), reqErr.OrigErr()),
+		reqErr.StatusCode(), reqErr.RequestID())
+}
+
+// newS3Bucket exposes the bucket 'bucketName' served by 'backend', or the part of it under 'opts.prefix'.
+func newS3Bucket(backend *s3.S3, bucketName string, opts bucketOptions) *s3Bucket {
+	if opts.prefix != "" && !strings.HasSuffix(opts.prefix, delimiter) {
+		opts.prefix += delimiter
+	}
+	b := &s3Bucket{name: bucketName, backend: backend, opts: opts, inos: &inodes{}}
+	b.s3Dir.bucket = b
+	b.s3Dir.prefix = opts.prefix
+	return b
+}
+
+// s3Dir is a directory made up by all keys sharing a common prefix, up to the next delimiter.
+type s3Dir struct {
+	fs.Inode
+
+	bucket *s3Bucket
+
+	// prefix is the full path to this directory terminated by the delimiter, or for the root, the prefix the bucket is
+	// mounted at, which may be empty.
+	prefix string
+
+	mu       sync.Mutex
+	listing  *s3Listing
+	listedAt time.Time
+
+	// edits counts the changes made to the directory through the mount, so that a listing fetched concurrently is
+	// not kept over them.
+	edits int
+
+	// page holds the last pages of keys fetched by a stream over the directory, as of 'pageAt', so that the kernel
+	// can look up the entries it just read without querying s3 again.
+	page   *s3Listing
+	pageAt time.Time
+
+	// pending holds files that are being created, and are not stored in s3 yet.
+	pending map[string]*s3Object
+
+	// probes remembers what the metadata of children told, e.g. whether they are symlinks.
+	probes map[string]metaProbe
+}
+
+var _ = (fs.NodeGetattrer)((*s3Dir)(nil))
+var _ = (fs.NodeCreater)((*s3Dir)(nil))
+var _ = (fs.NodeMkdirer)((*s3Dir)(nil))
+var _ = (fs.NodeUnlinker)((*s3Dir)(nil))
+var _ = (fs.NodeRmdirer)((*s3Dir)(nil))
+var _ = (fs.NodeRenamer)((*s3Dir)(nil))
+var _ = (fs.NodeLookuper)((*s3Dir)(nil))
+var _ = (fs.NodeReaddirer)((*s3Dir)(nil))
+
+// s3Listing captures the direct children of a directory.
+type s3Listing struct {
+	files map[string]*s3.Object
+	dirs  map[string]bool
+}
+
+// has reports whether 'name' is a child in the listing.
+func (l *s3Listing) has(name string) bool {
+	_, ok := l.files[name]
+	return ok || l.dirs[name]
+}
+
+// fetchLocked queries s3 for the children of the directory, and keeps them as the last listing unless there are more
+// than maxCachedEntries. The listing is fetched page by page, and an error on any page fails the whole listing
+// rather than leaving it truncated. It must be called with 'mu' held, so concurrent lookups wait for the outcome.
+func (d *s3Dir) fetchLocked(ctx context.Context) (*s3Listing, error) {
+	listing := &s3Listing{
+		files: map[string]*s3.Object{},
+		dirs:  map[string]bool{},
+	}
+	in := &s3.ListObjectsV2Input{
+		Bucket:    &d.bucket.name,
+		Prefix:    &d.prefix,
+		Delimiter: aws.String(delimiter),
+	}
+	if d.bucket.opts.maxKeys > 0 {
+		in.MaxKeys = aws.Int64(d.bucket.opts.maxKeys)
+	}
+	for {
+		out, err := d.bucket.backend.ListObjectsV2WithContext(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		d.addPage(listing, out)
+		if !aws.BoolValue(out.IsTruncated) {
+			break
+		}
+		if out.NextContinuationToken == nil {
+			return nil, fmt.Errorf("truncated listing of '%v' without a continuation token", d.prefix)
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+
+	d.listing, d.listedAt = listing, time.Now()
+	if max := d.bucket.opts.maxCachedEntries; max > 0 && len(listing.files)+len(listing.dirs) > max {
+		d.listing = nil
+	}
+	return listing, nil
+}
+
+// addPage merges a page of keys under the directory into 'listing'.
+func (d *s3Dir) addPage(listing *s3Listing, out *s3.ListObjectsV2Output) {
+	for _, obj := range out.Contents {
+		if name := strings.TrimPrefix(*obj.Key, d.prefix); name != "" {
+			if listing.dirs[name] {
+				d.warnConflict(name)
+				continue
+			}
+			listing.files[name] = obj
+		}
+	}
+	for _, p := range out.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, d.prefix), delimiter)
+		if name == "" {
+			// Keys with consecutive delimiters cannot be represented as paths.
+			continue
+		}
+		if _, ok := listing.files[name]; ok {
+			d.warnConflict(name)
+			delete(listing.files, name)
+		}
+		listing.dirs[name] = true
+	}
+}
+
+func (d *s3Dir) warnConflict(name string) {
+	log.Printf("key '%v%v' in s3 bucket '%v' is both an object and a prefix, presenting it as a directory",
+		d.prefix, name, d.bucket.name)
+}
+
+// cached looks up 'name' in the last listing, reporting whether that listing is still within cacheTTL. Otherwise, a
+// child found in the last pages read by a stream within cacheTTL is reported as well.
+func (d *s3Dir) cached(name string) (obj *s3.Object, isDir bool, fresh bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listing != nil && time.Since(d.listedAt) < d.bucket.opts.cacheTTL {
+		return d.listing.files[name], d.listing.dirs[name], true
+	}
+	if d.page != nil && time.Since(d.pageAt) < d.bucket.opts.cacheTTL && d.page.has(name) {
+		return d.page.files[name], d.page.dirs[name], true
+	}
+	return nil, false, false
+}
+
+// editedLocked records that the directory was changed through the mount. It must be called with 'mu' held.
+func (d *s3Dir) editedLocked() {
+	d.edits++
+	d.page = nil
+}
+
+// stored records that the child 'name' was written to s3 as 'content'.
+func (d *s3Dir) stored(name string, o *s3Object, content *s3.Object) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending[name] == o {
+		delete(d.pending, name)
+	}
+	d.editedLocked()
+	d.bucket.opts.blocks.drop(d.bucket.blockKey(d.prefix + name))
+	if d.listing != nil && !d.listing.dirs[name] {
+		d.listing.files[name] = content
+	}
+}
+
+// released drops the child 'name' from the pending files, if it never made it to s3.
+func (d *s3Dir) released(name string, o *s3Object) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending[name] == o {
+		delete(d.pending, name)
+	}
+}
+
+// forget drops 'name' from the last listing, along with any cached content.
+func (d *s3Dir) forget(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.editedLocked()
+	d.bucket.opts.blocks.drop(d.bucket.blockKey(d.prefix + name))
+	if d.listing != nil {
+		delete(d.listing.files, name)
+		delete(d.listing.dirs, name)
+	}
+}
+
+// pendingChild returns the file 'name' if it is being created.
+func (d *s3Dir) pendingChild(name string) *s3Object {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending[name]
+}
+
+// stat asks s3 about the single child 'name', which is a directory if there exists at least one key prefixed by it.
+func (d *s3Dir) stat(ctx context.Context, name string) (obj *s3.Object, isDir bool, err error) {
+	key := d.prefix + name
+	out, err := d.bucket.backend.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &d.bucket.name,
+		Prefix:  aws.String(key + delimiter),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(out.Contents) > 0 {
+		return nil, true, nil
+	}
+
+	head, err := d.bucket.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &d.bucket.name, Key: &key})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	// Spare querying the object again to find out whether it is a symlink, or when it was modified.
+	d.probed(name, probeOf(head))
+	return &s3.Object{
+		Key:          &key,
+		Size:         head.ContentLength,
+		LastModified: head.LastModified,
+		ETag:         head.ETag,
+		StorageClass: head.StorageClass,
+	}, false, nil
+}
+
+func (d *s3Dir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0755 // drwxr-xr-x
+	return 0
+}
+
+// Readdir lists the directory from the last listing if it is recent enough, and otherwise streams it from s3.
+func (d *s3Dir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	d.mu.Lock()
+	listing := d.listing
+	fresh := listing != nil && time.Since(d.listedAt) < d.bucket.opts.cacheTTL
+	d.mu.Unlock()
+	if fresh {
+		return fs.NewListDirStream(append(d.entries(listing), d.pendingEntries(listing)...)), 0
+	}
+
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	s, err := d.stream(ctx)
+	if err != nil {
+		log.Printf("failed to list '%v' in s3 bucket '%v': %v", d.prefix, d.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	return s, 0
+}
+
+// entries returns the directory entries of the children in 'listing', sorted by name, so that a stream started again
+// to seek back returns them in the same order. Their inode numbers are only reserved once they are looked up, so that
+// listing a large directory does not grow the inode table.
+func (d *s3Dir) entries(listing *s3Listing) []fuse.DirEntry {
+	inos := d.bucket.inos
+	entries := make([]fuse.DirEntry, 0, len(listing.files)+len(listing.dirs))
+	for name := range listing.dirs {
+		ino := inos.peek(inoObject + d.prefix + name + delimiter)
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR, Ino: ino})
+	}
+	for name, obj := range listing.files {
+		mode := uint32(fuse.S_IFREG)
+		if d.knownLink(name, obj) {
+			mode = fuse.S_IFLNK
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode, Ino: inos.peek(inoObject + d.prefix + name)})
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func sortEntries(entries []fuse.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+}
+
+// pendingEntries returns the directory entries of the files being created that are not in any of 'listings', which
+// may be nil, sorted by name.
+func (d *s3Dir) pendingEntries(listings ...*s3Listing) []fuse.DirEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var entries []fuse.DirEntry
+next:
+	for name := range d.pending {
+		for _, l := range listings {
+			if l != nil && l.has(name) {
+				continue next
+			}
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	sortEntries(entries)
+	return entries
+}
+
+// Lookup resolves 'name' against a fresh listing if there is one, or else asks s3 about that single child. Names that
+// do not exist are cached by the kernel for negativeTTL.
+func (d *s3Dir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	if name == versionsDirName && d == &d.bucket.s3Dir && d.bucket.opts.showVersions {
+		out.Mode = 0555
+		if ch := d.GetChild(name); ch != nil {
+			if _, ok := ch.Operations().(*s3VersionsDir); ok {
+				return ch, 0
+			}
+		}
+		return d.NewInode(ctx, newVersionsDir(d.bucket, d.prefix), d.bucket.inos.stableAttr(fuse.S_IFDIR, inoVersions, d.prefix)), 0
+	}
+	if o := d.pendingChild(name); o != nil {
+		o.fillAttr(&out.Attr)
+		return o.EmbeddedInode(), 0
+	}
+
+	obj, isDir, fresh := d.cached(name)
+	if !fresh {
+		var err error
+		if obj, isDir, err = d.stat(ctx, name); err != nil {
+			log.Printf("failed to query '%v%v' in s3 bucket '%v': %v", d.prefix, name, d.bucket.name, err)
+			return nil, toErrno(ctx, err)
+		}
+	}
+
+	switch {
+	case isDir:
+		out.Mode = 0755
+		// Keep the existing inode, if any, so that its listing survives repeated lookups.
+		if ch := d.GetChild(name); ch != nil {
+			if _, ok := ch.Operations().(*s3Dir); ok {
+				return ch, 0
+			}
+		}
+		child := &s3Dir{bucket: d.bucket, prefix: d.prefix + name + delimiter}
+		return d.NewInode(ctx, child, d.bucket.inos.stableAttr(fuse.S_IFDIR, inoObject, child.prefix)), 0
+	case obj != nil:
+		p, err := d.probe(ctx, name, obj)
+		if err != nil {
+			log.Printf("failed to query object '%v%v' in s3 bucket '%v': %v", d.prefix, name, d.bucket.name, err)
+			return nil, toErrno(ctx, err)
+		}
+		if p.link {
+			ch, child := d.newSymlinkInode(ctx, name, obj, nil)
+			child.fillAttr(&out.Attr)
+			return ch, 0
+		}
+		ch, child := d.newObjectInode(ctx, name, obj)
+		child.fillAttr(&out.Attr)
+		return ch, 0
+	default:
+		out.SetEntryTimeout(d.bucket.opts.negativeTTL)
+		return nil, syscall.ENOENT
+	}
+}
+
+// newObjectInode returns the inode of the file 'name' with the metadata 'content'. The fs package hands out the
+// existing node if its inode number is still in use, e.g. by an open file, in which case it is brought up to date.
+func (d *s3Dir) newObjectInode(ctx context.Context, name string, content *s3.Object) (*fs.Inode, *s3Object) {
+	child := &s3Object{bucket: d.bucket, dir: d, name: name, content: content}
+	ch := d.NewInode(ctx, child, d.bucket.inos.stableAttr(fuse.S_IFREG, inoObject, d.prefix+name))
+	if o := ch.Operations().(*s3Object); o != child {
+		o.update(d, name, content)
+		return ch, o
+	}
+	return ch, child
+}
+
+// newSymlinkInode is like newObjectInode for symlinks, whose target may already be known.
+func (d *s3Dir) newSymlinkInode(ctx context.Context, name string, content *s3.Object, target []byte) (*fs.Inode, *s3Symlink) {
+	child := &s3Symlink{bucket: d.bucket, content: content, target: target}
+	ch := d.NewInode(ctx, child, d.bucket.inos.stableAttr(fuse.S_IFLNK, inoObject, d.prefix+name))
+	if l := ch.Operations().(*s3Symlink); l != child {
+		l.update(content, target)
+		return ch, l
+	}
+	return ch, child
+}
+
+// Create makes a new, empty file, which is only stored in s3 once its handle is flushed.
+func (d *s3Dir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if d.bucket.opts.readOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	key := d.prefix + name
+	ch, child := d.newObjectInode(ctx, name, &s3.Object{
+		Key:          &key,
+		Size:         aws.Int64(0),
+		LastModified: aws.Time(time.Now()),
+	})
+	child.fillAttr(&out.Attr)
+
+	d.mu.Lock()
+	if d.pending == nil {
+		d.pending = map[string]*s3Object{}
+	}
+	d.pending[name] = child
+	d.mu.Unlock()
+
+	return ch, newS3Writer(child, true), 0, 0
+}
+
+// Mkdir creates the directory 'name'. As directories only exist through the keys under their prefix, an empty
+// directory marker object is stored with the directory name and a trailing delimiter, like the AWS console does.
+func (d *s3Dir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if d.bucket.opts.readOnly {
+		return nil, syscall.EROFS
+	}
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+
+	prefix := d.prefix + name + delimiter
+	sse, kmsKeyID := d.bucket.encryption()
+	if _, err := d.bucket.backend.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               &d.bucket.name,
+		Key:                  &prefix,
+		Body:                 bytes.NewReader(nil),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	}); err != nil {
+		log.Printf("failed to create directory marker '%v' in s3 bucket '%v': %v", prefix, d.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+
+	d.mu.Lock()
+	d.editedLocked()
+	if d.listing != nil {
+		delete(d.listing.files, name)
+		d.listing.dirs[name] = true
+	}
+	d.mu.Unlock()
+
+	out.Mode = 0755
+	child := &s3Dir{bucket: d.bucket, prefix: prefix}
+	return d.NewInode(ctx, child, d.bucket.inos.stableAttr(fuse.S_IFDIR, inoObject, prefix)), 0
+}
+
+// Unlink deletes the object 'name'.
+func (d *s3Dir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if d.bucket.opts.readOnly {
+		return syscall.EROFS
+	}
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	key := d.prefix + name
+	if _, err := d.bucket.backend.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &d.bucket.name,
+		Key:    &key,
+	}); err != nil {
+		log.Printf("failed to delete object '%v' in s3 bucket '%v': %v", key, d.bucket.name, err)
+		return toErrno(ctx, err)
+	}
+	d.forget(name)
+	return 0
+}
+
+// Rmdir removes the directory 'name', which only succeeds if there are no keys left under its prefix. The directory
+// marker object, if any, is deleted along with it.
+func (d *s3Dir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if d.bucket.opts.readOnly {
+		return syscall.EROFS
+	}
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	prefix := d.prefix + name + delimiter
+	if ch := d.GetChild(name); ch != nil {
+		if dir, ok := ch.Operations().(*s3Dir); ok && dir.hasPending() {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	out, err := d.bucket.backend.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &d.bucket.name,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int64(2),
+	})
+	if err != nil {
+		log.Printf("failed to list '%v' in s3 bucket '%v': %v", prefix, d.bucket.name, err)
+		return toErrno(ctx, err)
+	}
+	for _, obj := range out.Contents {
+		if *obj.Key != prefix {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	if len(out.Contents) > 0 {
+		if _, err := d.bucket.backend.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: &d.bucket.name,
+			Key:    &prefix,
+		}); err != nil {
+			log.Printf("failed to delete object '%v' in s3 bucket '%v': %v", prefix, d.bucket.name, err)
+			return toErrno(ctx, err)
+		}
+	}
+	d.forget(name)
+	return 0
+}
+
+// Rename moves the object 'name' to 'newName' in 'newParent' by copying it server-side and deleting the original.
+// Renaming a directory would take a copy per key below it, so it fails with EXDEV, which makes tools like mv fall
+// back to copying and deleting the files one by one. So does moving files to another bucket.
+func (d *s3Dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if d.bucket.opts.readOnly {
+		return syscall.EROFS
+	}
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	dst := toDir(newParent)
+	if dst == nil || dst.bucket != d.bucket {
+		return syscall.EXDEV
+	}
+	ch := d.GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	obj, ok := ch.Operations().(*s3Object)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	if flags&unix.RENAME_NOREPLACE != 0 {
+		existing, isDir, fresh := dst.cached(newName)
+		if !fresh {
+			var err error
+			if existing, isDir, err = dst.stat(ctx, newName); err != nil {
+				log.Printf("failed to query '%v%v' in s3 bucket '%v': %v", dst.prefix, newName, d.bucket.name, err)
+				return toErrno(ctx, err)
+			}
+		}
+		if existing != nil || isDir {
+			return syscall.EEXIST
+		}
+	}
+
+	src, key := d.prefix+name, dst.prefix+newName
+	sse, kmsKeyID := d.bucket.encryption()
+	out, err := d.bucket.backend.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:               &d.bucket.name,
+		Key:                  &key,
+		CopySource:           aws.String(copySource(d.bucket.name, src)),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		log.Printf("failed to copy object '%v' to '%v' in s3 bucket '%v': %v", src, key, d.bucket.name, err)
+		return toErrno(ctx, err)
+	}
+	if _, err := d.bucket.backend.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &d.bucket.name,
+		Key:    &src,
+	}); err != nil {
+		log.Printf("failed to delete object '%v' in s3 bucket '%v' after copying it to '%v': %v", src, d.bucket.name, key, err)
+		return toErrno(ctx, err)
+	}
+
+	d.mu.Lock()
+	p, probed := d.probes[name]
+	d.mu.Unlock()
+	probed = probed && p.etag == aws.StringValue(obj.snapshot().ETag)
+	d.forget(name)
+	obj.moved(dst, newName)
+	d.bucket.inos.moved(inoObject, src, key)
+	content := *obj.snapshot()
+	if out.CopyObjectResult != nil {
+		content.ETag = out.CopyObjectResult.ETag
+		content.LastModified = out.CopyObjectResult.LastModified
+	}
+	// The copy keeps the metadata of the object, and thereby its modification time.
+	if probed {
+		p.etag = aws.StringValue(content.ETag)
+		dst.probed(newName, p)
+	}
+	obj.stored(&content)
+	return 0
+}
+
+// walk calls 'visit' on every directory known to the kernel, parents before their children.
+func (b *s3Bucket) walk(visit func(d *s3Dir)) {
+	queue := []*s3Dir{&b.s3Dir}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+
+		visit(d)
+		for _, ch := range d.Children() {
+			if dir, ok := ch.Operations().(*s3Dir); ok {
+				queue = append(queue, dir)
+			}
+		}
+	}
+}
+
+// toDir returns the directory implemented by 'n', if any.
+func toDir(n fs.InodeEmbedder) *s3Dir {
+	switch n := n.(type) {
+	case *s3Dir:
+		return n
+	case *s3Bucket:
+		return &n.s3Dir
+	}
+	return nil
+}
+
+// copySource returns the URL-encoded source of a CopyObject request for 'key' in 'bucket'.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (d *s3Dir) hasPending() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending) > 0
+}
+
+// blockKey returns the key the blocks of the object 'key' are cached under.
+func (b *s3Bucket) blockKey(key string) string {
+	return b.name + delimiter + key
+}
+
+// withTimeout bounds an operation on the filesystem by the configured timeout.
+func (b *s3Bucket) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.opts.opTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.opts.opTimeout)
+}
+
+// encryption returns the server-side encryption to request for uploads, or nil to leave it to the bucket.
+func (b *s3Bucket) encryption() (sse, kmsKeyID *string) {
+	if b.opts.sse == "" {
+		return nil, nil
+	}
+	if b.opts.sseKMSKeyID != "" {
+		kmsKeyID = aws.String(b.opts.sseKMSKeyID)
+	}
+	return aws.String(b.opts.sse), kmsKeyID
+}
+
+// isPreconditionFailed tells whether 'err' is s3 rejecting a conditional request.
+func isPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// isNotFound reports whether s3 replied that the requested resource does not exist.
+func isNotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
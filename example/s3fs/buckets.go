@@ -0,0 +1,114 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// s3Buckets is the root directory of a mount of several buckets, holding a directory per bucket. Buckets only share
+// the connection to s3 and the inode numbers, and are otherwise listed, cached and refreshed on their own.
+type s3Buckets struct {
+	fs.Inode
+
+	buckets []*s3Bucket
+	inos    *inodes
+
+	mu sync.Mutex
+
+	// mounted holds the buckets that could be listed when mounting.
+	mounted []*s3Bucket
+}
+
+var _ = (fs.NodeOnAdder)((*s3Buckets)(nil))
+var _ = (fs.NodeGetattrer)((*s3Buckets)(nil))
+var _ = (fs.NodeStatfser)((*s3Buckets)(nil))
+
+// newS3Buckets exposes 'buckets' as the directories named after them. Inode numbers are handed out for all of them
+// together, so that nodes of different buckets never share one.
+func newS3Buckets(buckets []*s3Bucket) *s3Buckets {
+	r := &s3Buckets{buckets: buckets, inos: &inodes{}}
+	for _, b := range buckets {
+		b.inos = r.inos.scoped(b.name + delimiter)
+	}
+	return r
+}
+
+// OnAdd lists the root of every bucket, all at once. A bucket that cannot be listed, e.g. because it does not exist
+// or access to it is denied, is presented as an empty directory rather than failing the whole mount.
+func (r *s3Buckets) OnAdd(ctx context.Context) {
+	errs := make([]error, len(r.buckets))
+	var wg sync.WaitGroup
+	for i, b := range r.buckets {
+		wg.Add(1)
+		go func(i int, b *s3Bucket) {
+			defer wg.Done()
+			errs[i] = b.listRoot(ctx)
+		}(i, b)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, b := range r.buckets {
+		attr := r.inos.stableAttr(fuse.S_IFDIR, inoBucket, b.name)
+		if err := errs[i]; err != nil {
+			log.Printf("failed to list s3 bucket '%v', presenting it as an empty directory: %v", b.name, err)
+			r.AddChild(b.name, r.NewPersistentInode(ctx, &s3EmptyDir{}, attr), false)
+			continue
+		}
+		r.AddChild(b.name, r.NewPersistentInode(ctx, b, attr), false)
+		r.mounted = append(r.mounted, b)
+	}
+}
+
+// listRoot lists the root directory of the bucket.
+func (b *s3Bucket) listRoot(ctx context.Context) error {
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.fetchLocked(ctx)
+	return err
+}
+
+func (r *s3Buckets) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0755 // drwxr-xr-x
+	return 0
+}
+
+// Statfs reports the usage of all buckets together.
+func (r *s3Buckets) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	r.mu.Lock()
+	mounted := r.mounted
+	r.mu.Unlock()
+
+	var objects, bytes uint64
+	for _, b := range mounted {
+		n, size := b.usage()
+		objects += n
+		bytes += size
+	}
+	fillStatfs(out, objects, bytes)
+	return 0
+}
+
+// s3EmptyDir stands for a bucket that could not be listed when mounting.
+type s3EmptyDir struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*s3EmptyDir)(nil))
+
+func (d *s3EmptyDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555 // dr-xr-xr-x
+	return 0
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMultipleBuckets(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	other, stopOther := newFakeS3()
+	defer stopOther()
+	other.bucket = "other"
+	other.put("a", "world")
+	other.put("dir/b", "!")
+
+	opts := bucketOptions{cacheTTL: time.Hour}
+	root := newS3Buckets([]*s3Bucket{
+		newS3Bucket(fake.backend(t), testBucket, opts),
+		newS3Bucket(other.backend(t), "other", opts),
+		newS3Bucket(fake.backend(t), "missing", opts),
+	})
+	mnt, clean := testMount(t, root)
+	defer clean()
+
+	// The bucket that does not exist is presented as an empty directory.
+	if got, want := readDirNames(t, mnt), []string{"missing", "other", testBucket}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := readDirNames(t, mnt+"/missing"); len(got) != 0 {
+		t.Errorf("missing: got %v, want no entries", got)
+	}
+	if got, want := readDirNames(t, mnt+"/other"), []string{"a", "dir"}; !equalStrings(got, want) {
+		t.Errorf("other: got %v, want %v", got, want)
+	}
+	for path, want := range map[string]string{testBucket + "/a": "hello", "other/a": "world", "other/dir/b": "!"} {
+		if got, err := ioutil.ReadFile(mnt + "/" + path); err != nil || string(got) != want {
+			t.Errorf("ReadFile(%v): got %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	// Objects with the same key in different buckets are different files.
+	var st, otherSt syscall.Stat_t
+	if err := syscall.Stat(mnt+"/"+testBucket+"/a", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := syscall.Stat(mnt+"/other/a", &otherSt); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Ino == otherSt.Ino {
+		t.Errorf("objects of different buckets share ino %d", st.Ino)
+	}
+
+	err := os.Rename(mnt+"/"+testBucket+"/a", mnt+"/other/c")
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		t.Errorf("Rename across buckets: got %v, want EXDEV", err)
+	}
+	if got := other.count("CopyObject"); got != 0 {
+		t.Errorf("got %d CopyObject calls, want 0", got)
+	}
+}
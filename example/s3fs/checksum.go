@@ -0,0 +1,55 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errChecksum is returned when downloaded data does not match the checksums of the object.
+var errChecksum = errors.New("checksum mismatch")
+
+// verifyChecksums checks 'data', the whole content of an object as downloaded by 'out', against the MD5 digest in its
+// ETag and any additional checksum s3 returned. Checksums of multipart objects, which digest the digests of the parts
+// rather than the content, are skipped.
+func verifyChecksums(data []byte, out *s3.GetObjectOutput) error {
+	// The ETag of an object uploaded in one go is the hex-encoded MD5 digest of its content.
+	if etag := strings.Trim(aws.StringValue(out.ETag), `"`); len(etag) == hex.EncodedLen(md5.Size) && !strings.Contains(etag, "-") {
+		sum := md5.Sum(data)
+		if actual := hex.EncodeToString(sum[:]); actual != etag {
+			return fmt.Errorf("%w: expected MD5 %v, got %v", errChecksum, etag, actual)
+		}
+	}
+
+	for _, c := range []struct {
+		name     string
+		expected *string
+		hash     hash.Hash
+	}{
+		{"SHA256", out.ChecksumSHA256, sha256.New()},
+		{"CRC32", out.ChecksumCRC32, crc32.NewIEEE()},
+	} {
+		expected := aws.StringValue(c.expected)
+		if expected == "" || strings.Contains(expected, "-") {
+			continue
+		}
+		c.hash.Write(data)
+		if actual := base64.StdEncoding.EncodeToString(c.hash.Sum(nil)); actual != expected {
+			return fmt.Errorf("%w: expected %v %v, got %v", errChecksum, c.name, expected, actual)
+		}
+	}
+	return nil
+}
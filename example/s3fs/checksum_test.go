@@ -0,0 +1,42 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+	for _, verify := range []bool{true, false} {
+		t.Run(fmt.Sprintf("verify=%v", verify), func(t *testing.T) {
+			fake, stop := newFakeS3()
+			defer stop()
+			fake.put("md5", "hello world")
+			fake.putChecksummed("sha256", "hello world")
+
+			mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, verifyChecksums: verify}))
+			defer clean()
+
+			for _, name := range []string{"md5", "sha256"} {
+				if got, err := ioutil.ReadFile(mnt + "/" + name); err != nil || string(got) != "hello world" {
+					t.Errorf("ReadFile(%v): got %q, %v", name, got, err)
+				}
+
+				fake.corrupt(name)
+				_, err := ioutil.ReadFile(mnt + "/" + name)
+				if verify && !errors.Is(err, syscall.EIO) {
+					t.Errorf("ReadFile(%v) of corrupted object: got %v, want EIO", name, err)
+				} else if !verify && err != nil {
+					t.Errorf("ReadFile(%v) of corrupted object: got %v, want no verification", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// sniffLen is how many bytes of content http.DetectContentType considers.
+const sniffLen = 512
+
+// detectContentType returns the content type to upload the content 'src' with: the one set on the handle if any, and
+// otherwise the one of the extension of the key, falling back to the one sniffed from the content.
+func (w *s3Writer) detectContentType(src io.ReaderAt) string {
+	if w.contentType != "" {
+		return w.contentType
+	}
+	if t := mime.TypeByExtension(path.Ext(w.key())); t != "" {
+		return t
+	}
+	head := make([]byte, min64(sniffLen, w.size))
+	n, _ := src.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
+
+// setContentType sets the content type to upload the content with, if there is content to upload, and reports
+// whether there was.
+func (w *s3Writer) setContentType(t string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return false
+	}
+	w.contentType = t
+	return true
+}
+
+// attachContentType sets the content type 't' on the handles writing the object that have content to store, so it
+// is stored with the content rather than the one detected. It reports whether there was any.
+func (o *s3Object) attachContentType(t string) bool {
+	attached := false
+	for _, w := range o.openWriters() {
+		if w.setContentType(t) {
+			attached = true
+		}
+	}
+	return attached
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestContentType(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	opts := bucketOptions{cacheTTL: time.Hour, partSize: 4}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+	contentType := func(key string) string {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.objects[key].contentType
+	}
+
+	for name, tc := range map[string]struct{ data, want string }{
+		"page.html": {"<p>hi", "text/html; charset=utf-8"},
+		"image":     {"\x89PNG\r\n\x1a\n", "image/png"},
+		"notes":     {"just text", "text/plain; charset=utf-8"},
+	} {
+		if err := ioutil.WriteFile(mnt+"/"+name, []byte(tc.data), 0644); err != nil {
+			t.Fatalf("WriteFile(%q): %v", name, err)
+		}
+		if got := contentType(name); got != tc.want {
+			t.Errorf("%q: got content type %q, want %q", name, got, tc.want)
+		}
+	}
+
+	// Setting the content type while writing overrides the detected one, also for multipart uploads.
+	uploads := fake.count("CreateMultipartUpload")
+	f, err := os.Create(mnt + "/custom.html")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write([]byte("<p>hello</p>")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := unix.Setxattr(mnt+"/custom.html", xattrContentType, []byte("application/x-custom"), 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := fake.count("CreateMultipartUpload"); got != uploads+1 {
+		t.Errorf("got %d CreateMultipartUpload calls, want %d", got, uploads+1)
+	}
+	if got := contentType("custom.html"); got != "application/x-custom" {
+		t.Errorf("got content type %q, want %q", got, "application/x-custom")
+	}
+	if got, err := getxattr(t, mnt+"/custom.html", xattrContentType); err != nil || got != "application/x-custom" {
+		t.Errorf("Getxattr: got %q, %v, want %q", got, err, "application/x-custom")
+	}
+
+	// Once stored, the content type can no longer be changed.
+	if err := unix.Setxattr(mnt+"/custom.html", xattrContentType, []byte("text/plain"), 0); err != syscall.EPERM {
+		t.Errorf("Setxattr after Close: got %v, want EPERM", err)
+	}
+}
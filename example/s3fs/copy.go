@@ -0,0 +1,101 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var _ = (fs.NodeCopyFileRanger)((*s3Object)(nil))
+
+// CopyFileRange copies the whole object onto the empty file 'out' server-side, so that 'cp' does not download and
+// upload it again. Other copies are rejected with ENOTSUP, so that the kernel falls back to reading and writing the
+// files. As the number of bytes copied is reported in 32 bits, copies are at most 4 GiB, which s3 copies with a single
+// CopyObject.
+func (o *s3Object) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle,
+	offOut uint64, len uint64, flags uint64) (uint32, syscall.Errno) {
+	if o.bucket.opts.readOnly {
+		return 0, syscall.EROFS
+	}
+	w, ok := fhOut.(*s3Writer)
+	if !ok || offIn != 0 || offOut != 0 || flags != 0 {
+		return 0, syscall.ENOTSUP
+	}
+	v, ok := copyable(fhIn)
+	if !ok || v.etag == "" || v.versionID != "" || uint64(v.size) > len || v.size > math.MaxUint32 {
+		return 0, syscall.ENOTSUP
+	}
+	if v.size == 0 {
+		return 0, 0
+	}
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.spool != nil && w.size > 0 || w.spool == nil && !w.empty && w.obj.size() > 0 {
+		return 0, syscall.ENOTSUP
+	}
+	b := w.bucket()
+	key := w.key()
+	sse, kmsKeyID := b.encryption()
+	res, err := b.backend.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:               &b.name,
+		Key:                  &key,
+		CopySource:           aws.String(copySource(b.name, v.key)),
+		CopySourceIfMatch:    aws.String(v.etag),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if isPreconditionFailed(err) {
+		// The source was overwritten since it was opened, which reading it handles.
+		return 0, syscall.ENOTSUP
+	}
+	if err != nil {
+		log.Printf("failed to copy object '%v' to '%v' in s3 bucket '%v': %v", v.key, key, b.name, err)
+		return 0, toErrno(ctx, err)
+	}
+
+	// The handle now starts out from the copy, which there is no need to store again.
+	w.dropSpool()
+	w.empty, w.dirty = false, false
+	var etag *string
+	if res.CopyObjectResult != nil {
+		etag = res.CopyObjectResult.ETag
+	}
+	w.obj.stored(&s3.Object{
+		Key:          aws.String(key),
+		Size:         aws.Int64(v.size),
+		LastModified: aws.Time(time.Now()),
+		ETag:         etag,
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	return uint32(v.size), 0
+}
+
+// copyable returns the version of the object opened as 'f', unless the handle holds content that is not stored yet.
+func copyable(f fs.FileHandle) (version, bool) {
+	switch h := f.(type) {
+	case *s3Handle:
+		return h.version(), true
+	case *s3Writer:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.dirty || h.spool != nil || h.empty {
+			return version{}, false
+		}
+		return h.obj.version(), true
+	}
+	return version{}, false
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileRange copies 'len' bytes from 'src' at 'srcOff' to a new file 'dst' at 'dstOff'.
+func copyFileRange(t *testing.T, src string, srcOff int64, dst string, dstOff int64, len int) int {
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	n, err := unix.CopyFileRange(int(in.Fd()), &srcOff, int(out.Fd()), &dstOff, len, 0)
+	if err != nil {
+		t.Fatalf("CopyFileRange: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return n
+}
+
+func TestCopyFileRange(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if n := copyFileRange(t, mnt+"/a", 0, mnt+"/b", 0, 1<<20); n != 11 {
+		t.Errorf("copied %d bytes, want 11", n)
+	}
+	if got := fake.count("CopyObject"); got != 1 {
+		t.Errorf("got %d CopyObject calls, want 1", got)
+	}
+	if got := fake.count("PutObject"); got != 0 {
+		t.Errorf("got %d PutObject calls, want 0", got)
+	}
+	if got, _ := fake.get("b"); got != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(mnt+"/b", &st); err != nil || st.Size != 11 {
+		t.Errorf("Stat: got size %d, %v, want 11", st.Size, err)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/b"); err != nil || string(got) != "hello world" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello world")
+	}
+}
+
+func TestCopyFileRangePartial(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	// A partial copy is made by reading and writing the files.
+	if n := copyFileRange(t, mnt+"/a", 6, mnt+"/b", 0, 5); n != 5 {
+		t.Errorf("copied %d bytes, want 5", n)
+	}
+	if got := fake.count("CopyObject"); got != 0 {
+		t.Errorf("got %d CopyObject calls, want 0", got)
+	}
+	if got, _ := fake.get("b"); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+}
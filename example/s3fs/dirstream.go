@@ -0,0 +1,203 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3DirStream lists a directory as the kernel reads it, a page of keys at a time, so that listing a large directory
+// only ever holds a page of entries in memory. Rewinding the directory starts a new stream, and each stream pages
+// on its own, so streams over the same directory do not interfere.
+//
+// If the directory turns out to have no more than maxCachedEntries children, the pages are kept as its listing, as
+// if it was listed at once.
+type s3DirStream struct {
+	dir *s3Dir
+	in  *s3.ListObjectsV2Input
+
+	// entries is what is left to return of the current page.
+	entries []fuse.DirEntry
+
+	// held are the files at the end of the current page that may turn out to also be a prefix on the next page, so
+	// they are only returned with the next page, as directories if need be.
+	held map[string]*s3.Object
+
+	// last is the previous page, which the kernel may still be looking up entries of.
+	last *s3Listing
+
+	// more is set while there are pages left to fetch.
+	more bool
+
+	// errno is the outcome of a failed page, returned by every subsequent Next.
+	errno syscall.Errno
+
+	// listing accumulates the pages, until there are more than maxCachedEntries.
+	listing   *s3Listing
+	startedAt time.Time
+	edits     int
+}
+
+var _ = (fs.DirStream)((*s3DirStream)(nil))
+
+// stream starts listing the directory. The first page is fetched right away, so that failing to list the directory
+// at all fails opening it.
+func (d *s3Dir) stream(ctx context.Context) (*s3DirStream, error) {
+	d.mu.Lock()
+	edits := d.edits
+	d.mu.Unlock()
+
+	s := &s3DirStream{
+		dir: d,
+		in: &s3.ListObjectsV2Input{
+			Bucket:    &d.bucket.name,
+			Prefix:    &d.prefix,
+			Delimiter: aws.String(delimiter),
+		},
+		held:      map[string]*s3.Object{},
+		listing:   &s3Listing{files: map[string]*s3.Object{}, dirs: map[string]bool{}},
+		startedAt: time.Now(),
+		edits:     edits,
+	}
+	if d.bucket.opts.maxKeys > 0 {
+		s.in.MaxKeys = aws.Int64(d.bucket.opts.maxKeys)
+	}
+	if err := s.fetch(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fetch queries the next page of keys.
+func (s *s3DirStream) fetch(ctx context.Context) error {
+	d := s.dir
+	out, err := d.bucket.backend.ListObjectsV2WithContext(ctx, s.in)
+	if err != nil {
+		return err
+	}
+	page := &s3Listing{files: s.held, dirs: map[string]bool{}}
+	d.addPage(page, out)
+	recent := &s3Listing{files: map[string]*s3.Object{}, dirs: map[string]bool{}}
+	for _, l := range []*s3Listing{s.last, page} {
+		if l == nil {
+			continue
+		}
+		for name, obj := range l.files {
+			recent.files[name] = obj
+		}
+		for name := range l.dirs {
+			recent.dirs[name] = true
+		}
+	}
+	s.last = page
+	d.mu.Lock()
+	d.page, d.pageAt = recent, time.Now()
+	d.mu.Unlock()
+
+	s.held = map[string]*s3.Object{}
+	s.more = aws.BoolValue(out.IsTruncated)
+	if s.more {
+		if out.NextContinuationToken == nil {
+			return fmt.Errorf("truncated listing of '%v' without a continuation token", d.prefix)
+		}
+		s.in.ContinuationToken = out.NextContinuationToken
+
+		// Keys come in order, so a file is only also a prefix on the next page if that prefix sorts after the
+		// last key of this one.
+		last := lastKey(out)
+		for name, obj := range page.files {
+			if d.prefix+name+delimiter > last {
+				s.held[name] = obj
+			}
+		}
+	}
+
+	visible := &s3Listing{files: map[string]*s3.Object{}, dirs: page.dirs}
+	for name, obj := range page.files {
+		if _, ok := s.held[name]; !ok {
+			visible.files[name] = obj
+		}
+	}
+	s.entries = d.entries(visible)
+	s.keep(visible)
+	if !s.more {
+		s.entries = append(s.entries, d.pendingEntries(s.listing, page)...)
+		s.done()
+	}
+	return nil
+}
+
+// keep adds 'page' to the accumulated listing, or drops the listing once it grows too large to keep.
+func (s *s3DirStream) keep(page *s3Listing) {
+	if s.listing == nil {
+		return
+	}
+	for name, obj := range page.files {
+		s.listing.files[name] = obj
+	}
+	for name := range page.dirs {
+		s.listing.dirs[name] = true
+	}
+	if max := s.dir.bucket.opts.maxCachedEntries; max > 0 && len(s.listing.files)+len(s.listing.dirs) > max {
+		s.listing = nil
+	}
+}
+
+// done keeps the accumulated listing as the listing of the directory, unless the directory was modified or listed
+// since the stream started.
+func (s *s3DirStream) done() {
+	d := s.dir
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s.listing != nil && d.edits == s.edits && !d.listedAt.After(s.startedAt) {
+		d.listing, d.listedAt = s.listing, s.startedAt
+	}
+	s.listing = nil
+}
+
+func (s *s3DirStream) HasNext() bool {
+	for len(s.entries) == 0 && s.more && s.errno == 0 {
+		ctx, cancel := s.dir.bucket.withTimeout(context.Background())
+		if err := s.fetch(ctx); err != nil {
+			log.Printf("failed to list '%v' in s3 bucket '%v': %v", s.dir.prefix, s.dir.bucket.name, err)
+			s.errno = toErrno(ctx, err)
+		}
+		cancel()
+	}
+	return len(s.entries) > 0 || s.errno != 0
+}
+
+func (s *s3DirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if s.errno != 0 {
+		return fuse.DirEntry{}, s.errno
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	return e, 0
+}
+
+func (s *s3DirStream) Close() {}
+
+// lastKey returns the largest key or prefix of a page.
+func lastKey(out *s3.ListObjectsV2Output) string {
+	var last string
+	if n := len(out.Contents); n > 0 {
+		last = aws.StringValue(out.Contents[n-1].Key)
+	}
+	if n := len(out.CommonPrefixes); n > 0 && aws.StringValue(out.CommonPrefixes[n-1].Prefix) > last {
+		last = aws.StringValue(out.CommonPrefixes[n-1].Prefix)
+	}
+	return last
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStreamLarge(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	var want []string
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("%04d", i)
+		fake.put(name, "x")
+		want = append(want, name)
+	}
+
+	opts := bucketOptions{cacheTTL: time.Hour, maxKeys: 100, maxCachedEntries: 500}
+	bucket := newS3Bucket(fake.backend(t), testBucket, opts)
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	for i := 0; i < 2; i++ {
+		if got := readDirNames(t, mnt); !equalStrings(got, want) {
+			t.Errorf("listing #%d: got %d entries, want %d", i, len(got), len(want))
+		}
+	}
+	// The directory is too large to be kept, so it is listed again.
+	if got := fake.count("ListObjects"); got != 20 {
+		t.Errorf("got %d ListObjects calls, want 20", got)
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if bucket.listing != nil {
+		t.Errorf("kept a listing of %d entries", len(bucket.listing.files))
+	}
+}
+
+func TestStreamConflict(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "x")
+	fake.put("a/x", "x")
+	fake.put("b", "x")
+
+	// With one key per page, 'a' and the prefix 'a/' come on different pages.
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxKeys: 1})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a", "b"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/a", &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("Stat(a): got mode %o, %v, want a directory", st.Mode, err)
+	}
+}
+
+func TestStreamRewind(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("%d", i)
+		fake.put(name, "x")
+		want = append(want, name)
+	}
+
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxKeys: 3})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	open := func() *os.File {
+		f, err := os.Open(mnt)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return f
+	}
+	readAll := func(f *os.File) []string {
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			t.Fatalf("Readdirnames: %v", err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// Streams over the same directory page on their own.
+	f1, f2 := open(), open()
+	defer f1.Close()
+	defer f2.Close()
+	if got := readAll(f1); !equalStrings(got, want) {
+		t.Errorf("first stream: got %v, want %v", got, want)
+	}
+	if got := readAll(f2); !equalStrings(got, want) {
+		t.Errorf("second stream: got %v, want %v", got, want)
+	}
+
+	fake.put("new", "x")
+	bucket.mu.Lock()
+	bucket.listing = nil
+	bucket.mu.Unlock()
+	if _, err := f1.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	want = append(want, "new")
+	sort.Strings(want)
+	if got := readAll(f1); !equalStrings(got, want) {
+		t.Errorf("after rewinding: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// toErrno maps an error returned by s3 for a request made with 'ctx' to an errno as errnoFromS3 does. The context
+// takes precedence, as the errors of interrupted requests do not always tell why they were.
+func toErrno(ctx context.Context, err error) syscall.Errno {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errnoFromS3(ctxErr)
+	}
+	return errnoFromS3(err)
+}
+
+// errnoFromS3 maps an error returned by s3, or by the sdk on its way there, to the closest errno:
+//
+//   - ENOENT for missing buckets and objects,
+//   - EACCES for denied requests, including those with bad credentials,
+//   - EAGAIN for throttling and timeouts that outlasted the retries,
+//   - EFBIG for uploads that are too large, and E2BIG for metadata that is,
+//   - EINTR for requests interrupted by the kernel, and EIO for those that timed out,
+//   - EIO otherwise, e.g. for network errors.
+//
+// Responses to HEAD requests have no body, hence no error code, so those are mapped by their HTTP status.
+func errnoFromS3(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	for cause := err; cause != nil; cause = unwrap(cause) {
+		switch cause {
+		case context.Canceled:
+			return syscall.EINTR
+		case context.DeadlineExceeded:
+			return syscall.EIO
+		}
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey:
+			return syscall.ENOENT
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return syscall.EACCES
+		case "SlowDown", "RequestTimeout":
+			return syscall.EAGAIN
+		case "EntityTooLarge":
+			return syscall.EFBIG
+		case "RequestEntityTooLarge", "MetadataTooLarge":
+			return syscall.E2BIG
+		}
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return syscall.ENOENT
+		case http.StatusForbidden:
+			return syscall.EACCES
+		case http.StatusServiceUnavailable:
+			return syscall.EAGAIN
+		}
+	}
+	return syscall.EIO
+}
+
+// unwrap returns the error 'err' wraps, whether by the conventions of the standard library or of the sdk.
+func unwrap(err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.OrigErr()
+	}
+	return errors.Unwrap(err)
+}
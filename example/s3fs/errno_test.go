@@ -0,0 +1,71 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestErrnoFromS3(t *testing.T) {
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "request-id")
+	}
+	for _, tc := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{failure("NoSuchBucket", http.StatusNotFound), syscall.ENOENT},
+		{failure("NoSuchKey", http.StatusNotFound), syscall.ENOENT},
+		{failure("NotFound", http.StatusNotFound), syscall.ENOENT},
+		{failure("AccessDenied", http.StatusForbidden), syscall.EACCES},
+		{failure("InvalidAccessKeyId", http.StatusForbidden), syscall.EACCES},
+		{failure("SignatureDoesNotMatch", http.StatusForbidden), syscall.EACCES},
+		{failure("Forbidden", http.StatusForbidden), syscall.EACCES},
+		{failure("SlowDown", http.StatusServiceUnavailable), syscall.EAGAIN},
+		{failure("RequestTimeout", http.StatusBadRequest), syscall.EAGAIN},
+		{failure("EntityTooLarge", http.StatusBadRequest), syscall.EFBIG},
+		{failure("RequestEntityTooLarge", http.StatusRequestEntityTooLarge), syscall.E2BIG},
+		{failure("MetadataTooLarge", http.StatusBadRequest), syscall.E2BIG},
+		{failure("InternalError", http.StatusInternalServerError), syscall.EIO},
+		{failure("PreconditionFailed", http.StatusPreconditionFailed), syscall.EIO},
+		{awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), syscall.EINTR},
+		{awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded), syscall.EIO},
+		{fmt.Errorf("reading body: %w", context.Canceled), syscall.EINTR},
+		{awserr.New(request.ErrCodeSerialization, "failed to decode", syscall.ECONNRESET), syscall.EIO},
+		{awserr.New("RequestError", "send request failed", &url.Error{Op: "Get", URL: "http://s3", Err: syscall.ECONNREFUSED}), syscall.EIO},
+		{errors.New("unexpected"), syscall.EIO},
+	} {
+		if got := errnoFromS3(tc.err); got != tc.want {
+			t.Errorf("errnoFromS3(%v): got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestToErrnoContext(t *testing.T) {
+	err := awserr.New("RequestError", "send request failed", errors.New("net/http: request canceled"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := toErrno(ctx, err); got != syscall.EINTR {
+		t.Errorf("canceled: got %v, want EINTR", got)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if got := toErrno(ctx, err); got != syscall.EIO {
+		t.Errorf("timed out: got %v, want EIO", got)
+	}
+	if got := toErrno(context.Background(), awserr.New("AccessDenied", "denied", nil)); got != syscall.EACCES {
+		t.Errorf("got %v, want EACCES", got)
+	}
+}
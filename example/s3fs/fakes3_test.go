@@ -0,0 +1,828 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testBucket = "test-bucket"
+
+// fakeObject is an object stored in fakeS3.
+type fakeObject struct {
+	data        []byte
+	modTime     time.Time
+	contentType string
+	meta        map[string]string
+
+	// fixedETag, if set, is returned instead of the digest of the data, as for multipart uploads.
+	fixedETag string
+
+	// sha256 is the additional checksum stored with the object, if any.
+	sha256 string
+
+	// versionID and deleteMarker describe an entry of the history of a key in a versioned bucket.
+	versionID    string
+	deleteMarker bool
+
+	// storageClass is the storage class of the object, or empty for STANDARD, and restore the value of the
+	// x-amz-restore header of archived objects.
+	storageClass string
+	restore      string
+
+	// sse and sseKMSKeyID are the server-side encryption of the object, if any.
+	sse         string
+	sseKMSKeyID string
+}
+
+// encryptWith sets the server-side encryption of the object as requested by the headers 'h'.
+func (o *fakeObject) encryptWith(h http.Header) {
+	o.sse = h.Get("X-Amz-Server-Side-Encryption")
+	o.sseKMSKeyID = h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+}
+
+// restored tells whether the content of the object can be downloaded.
+func (o *fakeObject) restored() bool {
+	switch o.storageClass {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+		return strings.Contains(o.restore, `ongoing-request="false"`)
+	}
+	return true
+}
+
+func (o *fakeObject) etag() string {
+	if o.fixedETag != "" {
+		return o.fixedETag
+	}
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeS3 is a minimal, in-memory implementation of the subset of the s3 REST API used by s3fs. It serves a single
+// bucket, and counts the calls made to each API so that tests can assert on the traffic generated by the mount.
+type fakeS3 struct {
+	server *httptest.Server
+
+	// bucket is the name of the only bucket served.
+	bucket string
+
+	// region, if set, is the region of the bucket, and requests signed for another one are redirected, as by s3.
+	region string
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	calls   map[string]int
+
+	// ranges records the Range headers of GetObject calls.
+	ranges []string
+
+	// listings records the query of ListObjects calls.
+	listings []url.Values
+
+	// failContinuations fails every listing request but the first page.
+	failContinuations bool
+
+	// failing holds the APIs that are denied.
+	failing map[string]bool
+
+	// private denies unsigned requests, as s3 does for buckets that are not public.
+	private bool
+
+	// requireSSE denies uploads that do not request server-side encryption, as a bucket policy may.
+	requireSSE bool
+
+	uploads  map[string]*fakeUpload
+	uploadID int
+
+	// history holds the versions of every key, oldest first, once versioning is enabled. Only the put and delete
+	// helpers add versions.
+	history map[string][]*fakeObject
+}
+
+// fakeUpload is an ongoing multipart upload.
+type fakeUpload struct {
+	key   string
+	parts map[int][]byte
+
+	// header is the header of the request that created the upload.
+	header http.Header
+}
+
+func newFakeS3() (*fakeS3, func()) {
+	f := &fakeS3{
+		bucket:  testBucket,
+		objects: map[string]*fakeObject{},
+		calls:   map[string]int{},
+		failing: map[string]bool{},
+		uploads: map[string]*fakeUpload{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f, f.server.Close
+}
+
+// backend returns an s3 client talking to the fake.
+func (f *fakeS3) backend(t *testing.T) *s3.S3 {
+	return testBackend(t, f.server.URL)
+}
+
+// testBackend returns an s3 client talking to 'endpoint'.
+func testBackend(t *testing.T, endpoint string) *s3.S3 {
+	session, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(endpoint).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithS3ForcePathStyle(true))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	return s3.New(session)
+}
+
+func (f *fakeS3) put(key, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: []byte(data), modTime: time.Now().Truncate(time.Second)}
+	f.addVersion(key, f.objects[key])
+}
+
+// enableVersioning makes the fake keep the history of keys.
+func (f *fakeS3) enableVersioning() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.history = map[string][]*fakeObject{}
+}
+
+func (f *fakeS3) addVersion(key string, obj *fakeObject) {
+	if f.history == nil {
+		return
+	}
+	obj.versionID = fmt.Sprintf("v%d", len(f.history[key])+1)
+	f.history[key] = append(f.history[key], obj)
+}
+
+// putMeta stores an object along with its user metadata.
+func (f *fakeS3) putMeta(key, data string, meta map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: []byte(data), modTime: time.Now().Truncate(time.Second), meta: meta}
+}
+
+// putArchived stores an object in the archived storage class 'class'.
+func (f *fakeS3) putArchived(key, data, class string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: []byte(data), modTime: time.Now().Truncate(time.Second), storageClass: class}
+}
+
+// putEncrypted stores an object encrypted server-side with 'sse'.
+func (f *fakeS3) putEncrypted(key, data, sse string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: []byte(data), modTime: time.Now().Truncate(time.Second), sse: sse}
+}
+
+// restored completes the restore of an archived object.
+func (f *fakeS3) restored(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key].restore = `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+}
+
+// encryption returns the server-side encryption of an object.
+func (f *fakeS3) encryption(key string) (sse, kmsKeyID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj := f.objects[key]; obj != nil {
+		return obj.sse, obj.sseKMSKeyID
+	}
+	return "", ""
+}
+
+// meta returns the user metadata of an object.
+func (f *fakeS3) meta(key string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj := f.objects[key]; obj != nil {
+		return obj.meta
+	}
+	return nil
+}
+
+// putChecksummed stores an object like a multipart upload with SHA256 checksums would, so that its ETag is not the
+// digest of its content.
+func (f *fakeS3) putChecksummed(key, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := sha256.Sum256([]byte(data))
+	f.objects[key] = &fakeObject{
+		data:      []byte(data),
+		modTime:   time.Now().Truncate(time.Second),
+		fixedETag: `"0123456789abcdef0123456789abcdef-1"`,
+		sha256:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// corrupt flips a byte of an object, keeping its ETag and checksums.
+func (f *fakeS3) corrupt(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := f.objects[key]
+	obj.fixedETag = obj.etag()
+	obj.data[0] ^= 0xff
+}
+
+func (f *fakeS3) delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, key)
+	f.addVersion(key, &fakeObject{modTime: time.Now().Truncate(time.Second), deleteMarker: true})
+}
+
+func (f *fakeS3) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	if !ok {
+		return "", false
+	}
+	return string(obj.data), true
+}
+
+// fail makes every subsequent call to 'api' fail.
+func (f *fakeS3) failAPI(api string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[api] = true
+}
+
+func (f *fakeS3) count(api string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[api]
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != f.bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if f.region != "" && !strings.Contains(r.Header.Get("Authorization"), "/"+f.region+"/") {
+		w.Header().Set("X-Amz-Bucket-Region", f.region)
+		f.fail(w, http.StatusMovedPermanently, "PermanentRedirect")
+		return
+	}
+
+	query := r.URL.Query()
+	has := func(param string) bool {
+		_, ok := query[param]
+		return ok
+	}
+	var api string
+	switch {
+	case key == "" && r.Method == http.MethodGet && has("versions"):
+		api = "ListObjectVersions"
+	case key == "" && r.Method == http.MethodGet:
+		api = "ListObjects"
+	case key == "" && r.Method == http.MethodHead:
+		api = "HeadBucket"
+	case r.Method == http.MethodHead:
+		api = "HeadObject"
+	case r.Method == http.MethodGet:
+		api = "GetObject"
+	case r.Method == http.MethodPost && has("restore"):
+		api = "RestoreObject"
+	case r.Method == http.MethodPost && has("uploads"):
+		api = "CreateMultipartUpload"
+	case r.Method == http.MethodPut && has("uploadId"):
+		api = "UploadPart"
+	case r.Method == http.MethodPost && has("uploadId"):
+		api = "CompleteMultipartUpload"
+	case r.Method == http.MethodDelete && has("uploadId"):
+		api = "AbortMultipartUpload"
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		api = "CopyObject"
+	case r.Method == http.MethodPut:
+		api = "PutObject"
+	case r.Method == http.MethodDelete:
+		api = "DeleteObject"
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	f.calls[api]++
+	if f.failing[api] || f.private && r.Header.Get("Authorization") == "" {
+		f.fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	switch api {
+	case "PutObject", "CopyObject", "CreateMultipartUpload":
+		if f.requireSSE && r.Header.Get("X-Amz-Server-Side-Encryption") == "" {
+			f.fail(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+	}
+
+	switch api {
+	case "HeadBucket":
+		w.WriteHeader(http.StatusOK)
+	case "ListObjects":
+		f.listObjects(w, r)
+	case "ListObjectVersions":
+		f.listObjectVersions(w, r)
+	case "HeadObject":
+		f.headObject(w, key)
+	case "GetObject":
+		f.getObject(w, r, key)
+	case "PutObject":
+		f.putObject(w, r, key)
+	case "CreateMultipartUpload":
+		f.createMultipartUpload(w, r, key)
+	case "UploadPart":
+		f.uploadPart(w, r)
+	case "CompleteMultipartUpload":
+		f.completeMultipartUpload(w, r)
+	case "AbortMultipartUpload":
+		f.abortMultipartUpload(w, r)
+	case "CopyObject":
+		f.copyObject(w, r, key)
+	case "RestoreObject":
+		f.restoreObject(w, key)
+	case "DeleteObject":
+		// Like s3, deleting a missing key succeeds.
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+type fakeListing struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeListingEntry
+	CommonPrefixes        []fakeCommonPrefix
+}
+
+type fakeCommonPrefix struct {
+	Prefix string
+}
+
+type fakeListingEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+// listObjects implements ListObjectsV2. Continuation tokens are the last key or common prefix of the previous page.
+func (f *fakeS3) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f.listings = append(f.listings, query)
+	if query.Get("list-type") != "2" {
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	prefix, delim, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	if token != "" && f.failContinuations {
+		f.fail(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		fmt.Sscanf(v, "%d", &maxKeys)
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) || (token != "" && k <= token) {
+			continue
+		}
+		if delim != "" && strings.HasSuffix(token, delim) && strings.HasPrefix(k, token) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := fakeListing{Name: f.bucket, Prefix: prefix, Delimiter: delim, ContinuationToken: token}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		entry, isPrefix := k, false
+		if delim != "" {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				entry, isPrefix = k[:len(prefix)+i+len(delim)], true
+			}
+		}
+		if seen[entry] {
+			continue
+		}
+		if out.KeyCount == maxKeys {
+			out.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		out.KeyCount++
+		out.NextContinuationToken = entry
+		if isPrefix {
+			out.CommonPrefixes = append(out.CommonPrefixes, fakeCommonPrefix{Prefix: entry})
+			continue
+		}
+		obj := f.objects[k]
+		storageClass := obj.storageClass
+		if storageClass == "" {
+			storageClass = s3.StorageClassStandard
+		}
+		out.Contents = append(out.Contents, fakeListingEntry{
+			Key:          k,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339),
+			ETag:         obj.etag(),
+			Size:         len(obj.data),
+			StorageClass: storageClass,
+		})
+	}
+	if !out.IsTruncated {
+		out.NextContinuationToken = ""
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&out)
+}
+
+func (f *fakeS3) writeObjectHeaders(w http.ResponseWriter, obj *fakeObject) {
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+	w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", obj.etag())
+	// Like s3, default to a generic content type.
+	contentType := obj.contentType
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	for k, v := range obj.meta {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	if obj.storageClass != "" {
+		w.Header().Set("X-Amz-Storage-Class", obj.storageClass)
+	}
+	if obj.restore != "" {
+		w.Header().Set("X-Amz-Restore", obj.restore)
+	}
+	if obj.sse != "" {
+		w.Header().Set("X-Amz-Server-Side-Encryption", obj.sse)
+	}
+	if obj.sseKMSKeyID != "" {
+		w.Header().Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", obj.sseKMSKeyID)
+	}
+}
+
+// metaOf returns the user metadata in the headers of a request.
+func metaOf(h http.Header) map[string]string {
+	meta := map[string]string{}
+	for k := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[strings.ToLower(k[len("x-amz-meta-"):])] = h.Get(k)
+		}
+	}
+	return meta
+}
+
+type fakeVersionListing struct {
+	XMLName             xml.Name `xml:"ListVersionsResult"`
+	Name                string
+	Prefix              string
+	IsTruncated         bool
+	NextKeyMarker       string             `xml:",omitempty"`
+	NextVersionIdMarker string             `xml:",omitempty"`
+	Versions            []fakeVersionEntry `xml:"Version"`
+	DeleteMarkers       []fakeVersionEntry `xml:"DeleteMarker"`
+	CommonPrefixes      []fakeCommonPrefix
+}
+
+type fakeVersionEntry struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int
+	StorageClass string `xml:",omitempty"`
+}
+
+// listObjectVersions implements ListObjectVersions, listing the versions of every key newest first. Pages end at
+// max-keys entries, and the markers are the key and version ID of the last one.
+func (f *fakeS3) listObjectVersions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delim := query.Get("prefix"), query.Get("delimiter")
+	keyMarker, versionMarker := query.Get("key-marker"), query.Get("version-id-marker")
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		fmt.Sscanf(v, "%d", &maxKeys)
+	}
+
+	keys := make([]string, 0, len(f.history))
+	for k := range f.history {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type entry struct {
+		key       string
+		obj       *fakeObject
+		isLatest  bool
+		isPrefix  bool
+		versionID string
+	}
+	var entries []entry
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if delim != "" {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				if p := k[:len(prefix)+i+len(delim)]; !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{key: p, isPrefix: true})
+				}
+				continue
+			}
+		}
+		history := f.history[k]
+		for i := len(history) - 1; i >= 0; i-- {
+			entries = append(entries, entry{key: k, obj: history[i], isLatest: i == len(history)-1, versionID: history[i].versionID})
+		}
+	}
+	if keyMarker != "" {
+		for i, e := range entries {
+			if e.key == keyMarker && e.versionID == versionMarker {
+				entries = entries[i+1:]
+				break
+			}
+		}
+	}
+
+	out := fakeVersionListing{Name: f.bucket, Prefix: prefix}
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		last := entries[maxKeys-1]
+		out.IsTruncated, out.NextKeyMarker, out.NextVersionIdMarker = true, last.key, last.versionID
+	}
+	for _, e := range entries {
+		if e.isPrefix {
+			out.CommonPrefixes = append(out.CommonPrefixes, fakeCommonPrefix{Prefix: e.key})
+			continue
+		}
+		v := fakeVersionEntry{
+			Key:          e.key,
+			VersionId:    e.versionID,
+			IsLatest:     e.isLatest,
+			LastModified: e.obj.modTime.UTC().Format(time.RFC3339),
+		}
+		if e.obj.deleteMarker {
+			out.DeleteMarkers = append(out.DeleteMarkers, v)
+			continue
+		}
+		v.ETag, v.Size, v.StorageClass = e.obj.etag(), len(e.obj.data), "STANDARD"
+		out.Versions = append(out.Versions, v)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&out)
+}
+
+func (f *fakeS3) headObject(w http.ResponseWriter, key string) {
+	obj := f.objects[key]
+	if obj == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.writeObjectHeaders(w, obj)
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj := f.objects[key]
+	if vid := r.URL.Query().Get("versionId"); vid != "" {
+		obj = nil
+		for _, v := range f.history[key] {
+			if v.versionID == vid && !v.deleteMarker {
+				obj = v
+			}
+		}
+	}
+	if obj == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != obj.etag() {
+		f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	if !obj.restored() {
+		f.fail(w, http.StatusForbidden, "InvalidObjectState")
+		return
+	}
+	f.writeObjectHeaders(w, obj)
+
+	rng := r.Header.Get("Range")
+	if rng == "" && obj.sha256 != "" && r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+		w.Header().Set("X-Amz-Checksum-Sha256", obj.sha256)
+	}
+	if rng == "" {
+		w.Write(obj.data)
+		return
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || start >= len(obj.data) {
+		f.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= len(obj.data) {
+		end = len(obj.data) - 1
+	}
+	f.ranges = append(f.ranges, rng)
+	w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(obj.data[start : end+1])
+}
+
+// restoreObject starts restoring an archived object, which only completes once a test calls 'restored'.
+func (f *fakeS3) restoreObject(w http.ResponseWriter, key string) {
+	obj := f.objects[key]
+	if obj == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if obj.restore == `ongoing-request="true"` {
+		f.fail(w, http.StatusConflict, "RestoreAlreadyInProgress")
+		return
+	}
+	obj.restore = `ongoing-request="true"`
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	obj := &fakeObject{
+		data:        data,
+		modTime:     time.Now().Truncate(time.Second),
+		contentType: r.Header.Get("Content-Type"),
+		meta:        metaOf(r.Header),
+	}
+	obj.encryptWith(r.Header)
+	f.objects[key] = obj
+	w.Header().Set("ETag", obj.etag())
+}
+
+func (f *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil || !strings.HasPrefix(src, f.bucket+"/") {
+		f.fail(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	obj := f.objects[strings.TrimPrefix(src, f.bucket+"/")]
+	if obj == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != obj.etag() {
+		f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	cp := &fakeObject{data: obj.data, modTime: time.Now().Truncate(time.Second), contentType: obj.contentType, meta: obj.meta}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		cp.contentType, cp.meta = r.Header.Get("Content-Type"), metaOf(r.Header)
+	}
+	cp.encryptWith(r.Header)
+	f.objects[key] = cp
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<CopyObjectResult><LastModified>%s</LastModified><ETag>%s</ETag></CopyObjectResult>",
+		cp.modTime.UTC().Format(time.RFC3339), cp.etag())
+}
+
+func (f *fakeS3) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	f.uploadID++
+	id := fmt.Sprint(f.uploadID)
+	f.uploads[id] = &fakeUpload{key: key, parts: map[int][]byte{}, header: r.Header}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId>"+
+		"</InitiateMultipartUploadResult>", f.bucket, key, id)
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request) {
+	upload := f.uploads[r.URL.Query().Get("uploadId")]
+	if upload == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var num int
+	fmt.Sscanf(r.URL.Query().Get("partNumber"), "%d", &num)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	upload.parts[num] = data
+	w.Header().Set("ETag", (&fakeObject{data: data}).etag())
+}
+
+func (f *fakeS3) completeMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("uploadId")
+	upload := f.uploads[id]
+	if upload == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.fail(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data []byte
+	for i, p := range req.Parts {
+		part, ok := upload.parts[p.PartNumber]
+		if !ok || p.PartNumber != i+1 {
+			f.fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, part...)
+	}
+	delete(f.uploads, id)
+	obj := &fakeObject{
+		data:        data,
+		modTime:     time.Now().Truncate(time.Second),
+		contentType: upload.header.Get("Content-Type"),
+		meta:        metaOf(upload.header),
+	}
+	obj.encryptWith(upload.header)
+	f.objects[upload.key] = obj
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag>"+
+		"</CompleteMultipartUploadResult>", f.bucket, upload.key, obj.etag())
+}
+
+func (f *fakeS3) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("uploadId")
+	if f.uploads[id] == nil {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	delete(f.uploads, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pendingUploads returns the number of multipart uploads that were neither completed nor aborted.
+func (f *fakeS3) pendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
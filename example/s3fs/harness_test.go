@@ -0,0 +1,100 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fs/fstest"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func harnessNames(ents []fuse.DirEntry) []string {
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// TestHarness runs the bucket in the fstest harness, which needs no mount.
+func TestHarness(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "hello")
+	fake.put("dir/sub/deep", "deeper")
+	fake.put("dir/other", "world")
+
+	h := fstest.New(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}), &fs.Options{})
+	defer h.Close()
+
+	ents, err := h.Readdir("")
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	if got, want := harnessNames(ents), []string{"dir", "file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir: got %v, want %v", got, want)
+	}
+	if ents, err := h.Readdir("dir"); err != nil || !reflect.DeepEqual(harnessNames(ents), []string{"other", "sub"}) {
+		t.Errorf("Readdir dir: got %v, %v", ents, err)
+	}
+
+	if out, err := h.Lookup("dir/sub/deep"); err != nil || out.Size != 6 {
+		t.Errorf("Lookup: got size %d, %v, want 6", out.Size, err)
+	}
+	if _, err := h.Lookup("missing"); err != syscall.ENOENT {
+		t.Errorf("Lookup missing: got %v, want ENOENT", err)
+	}
+	if _, err := h.Lookup("file/below"); err != syscall.ENOTDIR {
+		t.Errorf("Lookup below a file: got %v, want ENOTDIR", err)
+	}
+	if data, err := h.Read("dir/other", 1, 3); err != nil || string(data) != "orl" {
+		t.Errorf("Read: got %q, %v, want %q", data, err, "orl")
+	}
+}
+
+func TestHarnessCachedListing(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "hello")
+
+	h := fstest.New(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}), &fs.Options{})
+	defer h.Close()
+	h.SkipChecks = true
+
+	for i := 0; i < 3; i++ {
+		if _, err := h.Readdir(""); err != nil {
+			t.Fatalf("Readdir: %v", err)
+		}
+	}
+	if got := fake.count("ListObjects"); got != 1 {
+		t.Errorf("got %d listings, want 1", got)
+	}
+}
+
+// TestHarnessPagedListing checks the offsets of listings that are too large to cache, and are streamed page by page.
+func TestHarnessPagedListing(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		fake.put(name, name)
+		want = append(want, name)
+	}
+
+	opts := bucketOptions{cacheTTL: time.Hour, maxKeys: 3, maxCachedEntries: 2}
+	h := fstest.New(t, newS3Bucket(fake.backend(t), testBucket, opts), &fs.Options{})
+	defer h.Close()
+
+	if ents, err := h.Readdir(""); err != nil || !reflect.DeepEqual(harnessNames(ents), want) {
+		t.Errorf("Readdir: got %v, %v, want %v", harnessNames(ents), err, want)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Kinds of nodes, prefixed to the names their inode numbers are derived from, so that nodes of different kinds never
+// share a name, e.g. an object and one of the versions exposed under versionsDirName.
+const (
+	inoObject   = "o:" // files, symlinks and directories, by key
+	inoVersions = "d:" // directories of the versions tree, by prefix
+	inoHistory  = "h:" // directories of the versions of an object, by key
+	inoVersion  = "v:" // versions of objects, by version ID and key
+	inoBucket   = "b:" // directories of the buckets of a mount, by bucket name
+)
+
+// inodes hands out inode numbers derived from the names of nodes, so that they are the same across mounts and
+// refreshes, as tools like rsync or 'find -inum' expect. Numbers are a hash of the name; in the unlikely case of a
+// collision, the name is hashed again with a salt. Names are remembered for the lifetime of the mount, so that a name
+// keeps its number and no two names share one.
+type inodes struct {
+	mu     sync.Mutex
+	byIno  map[uint64]string
+	byName map[string]uint64
+
+	// shared, if set, hands out the numbers instead, for the names prefixed with 'scope', so that the buckets of a
+	// mount share the numbers without any two of their nodes sharing one.
+	shared *inodes
+	scope  string
+}
+
+// scoped returns the inodes handing out the numbers of 'n' for the names prefixed with 'scope'.
+func (n *inodes) scoped(scope string) *inodes {
+	return &inodes{shared: n, scope: scope}
+}
+
+// stableAttr returns the attributes of an inode of type 'mode' for the name 'kind'+'name'.
+func (n *inodes) stableAttr(mode uint32, kind, name string) fs.StableAttr {
+	return fs.StableAttr{Mode: mode, Ino: n.ino(kind + name)}
+}
+
+func (n *inodes) ino(name string) uint64 {
+	if n.shared != nil {
+		return n.shared.ino(n.scope + name)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ino, ok := n.byName[name]; ok {
+		return ino
+	}
+	if n.byIno == nil {
+		n.byIno, n.byName = map[uint64]string{}, map[string]uint64{}
+	}
+	for salt := 0; ; salt++ {
+		ino := hashIno(name, salt)
+		if _, taken := n.byIno[ino]; !taken {
+			n.byIno[ino], n.byName[name] = name, ino
+			return ino
+		}
+	}
+}
+
+// peek returns the inode number of 'name' without reserving it, i.e. the one it gets once looked up, unless another
+// name takes it first.
+func (n *inodes) peek(name string) uint64 {
+	if n.shared != nil {
+		return n.shared.peek(n.scope + name)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ino, ok := n.byName[name]; ok {
+		return ino
+	}
+	for salt := 0; ; salt++ {
+		ino := hashIno(name, salt)
+		if _, taken := n.byIno[ino]; !taken {
+			return ino
+		}
+	}
+}
+
+// moved records that the node named 'kind'+'from' is now known as 'kind'+'to', and keeps its inode number. The number
+// of 'from' stays taken, as the kernel may still refer to it, so a new node under that name gets another one.
+func (n *inodes) moved(kind, from, to string) {
+	if n.shared != nil {
+		n.shared.moved(n.scope+kind, from, to)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ino, ok := n.byName[kind+from]
+	if !ok {
+		return
+	}
+	delete(n.byName, kind+from)
+	n.byIno[ino], n.byName[kind+to] = kind+to, ino
+}
+
+// hashIno hashes 'name' into the inode numbers left to file systems: 1 is the root, and the numbers from 1<<63 on
+// are handed out by the fs package to nodes without one.
+func hashIno(name string, salt int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	if salt > 0 {
+		fmt.Fprintf(h, "\x00%d", salt)
+	}
+	ino := h.Sum64() &^ (1 << 63)
+	if ino < 2 {
+		ino += 2
+	}
+	return ino
+}
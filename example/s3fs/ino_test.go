@@ -0,0 +1,81 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStableInodes(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "a")
+	fake.put("dir/b", "b")
+
+	paths := []string{"a", "dir", "dir/b"}
+	inos := func() map[string]uint64 {
+		mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+		defer clean()
+
+		got := map[string]uint64{}
+		for _, p := range paths {
+			var st syscall.Stat_t
+			if err := syscall.Stat(mnt+"/"+p, &st); err != nil {
+				t.Fatalf("Stat(%v): %v", p, err)
+			}
+			got[p] = st.Ino
+		}
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		for _, e := range entries {
+			if ino := e.Sys().(*syscall.Stat_t).Ino; ino != got[e.Name()] {
+				t.Errorf("%v: got ino %d from listing, want %d", e.Name(), ino, got[e.Name()])
+			}
+		}
+		return got
+	}
+
+	first, second := inos(), inos()
+	seen := map[uint64]string{}
+	for _, p := range paths {
+		if first[p] != second[p] {
+			t.Errorf("%v: got ino %d, then %d", p, first[p], second[p])
+		}
+		if other, ok := seen[first[p]]; ok {
+			t.Errorf("%v and %v share ino %d", p, other, first[p])
+		}
+		seen[first[p]] = p
+	}
+}
+
+func TestInodeCollision(t *testing.T) {
+	var n inodes
+	a := n.ino("a")
+	if a != hashIno("a", 0) {
+		t.Errorf("got %d, want the hash of the name", a)
+	}
+
+	// Pretend that another name hashes to the same number as "b".
+	n.byIno[hashIno("b", 0)] = "c"
+	if got, want := n.ino("b"), hashIno("b", 1); got != want {
+		t.Errorf("got %d, want salted hash %d", got, want)
+	}
+	if got := n.ino("a"); got != a {
+		t.Errorf("got %d for the same name, want %d", got, a)
+	}
+
+	n.moved("", "a", "z")
+	if got := n.ino("z"); got != a {
+		t.Errorf("got %d after rename, want %d", got, a)
+	}
+	if got := n.ino("a"); got == a {
+		t.Errorf("new node reused the number of the renamed one")
+	}
+}
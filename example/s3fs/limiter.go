@@ -0,0 +1,61 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// limiter bounds the number of requests to s3 in flight, so that bursts of operations, e.g. a recursive grep, do not
+// get throttled.
+type limiter struct {
+	slots    chan struct{}
+	inFlight int64
+	waiting  int64
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{slots: make(chan struct{}, max)}
+}
+
+// install makes every request of 'backend' take a slot. A slot is held for each attempt, from right after signing
+// until the response headers are in, so that retries back off without holding one. Waiting for a slot gives up when
+// the context of the request is done.
+func (l *limiter) install(backend *s3.S3) {
+	backend.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "s3fs.Acquire", Fn: l.acquire})
+	backend.Handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{Name: "s3fs.Release", Fn: l.release})
+}
+
+func (l *limiter) acquire(r *request.Request) {
+	if r.Error != nil || r.ExpireTime != 0 {
+		// Failed and presigned requests are not sent, so they would not release a slot.
+		return
+	}
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.inFlight, 1)
+	case <-r.Context().Done():
+		r.Error = awserr.New(request.CanceledErrorCode, "request context canceled", r.Context().Err())
+	}
+}
+
+func (l *limiter) release(r *request.Request) {
+	atomic.AddInt64(&l.inFlight, -1)
+	<-l.slots
+}
+
+// logStats logs how busy the slots are.
+func (l *limiter) logStats() {
+	log.Printf("s3 requests: %d in flight of at most %d, %d waiting",
+		atomic.LoadInt64(&l.inFlight), cap(l.slots), atomic.LoadInt64(&l.waiting))
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLimiter(t *testing.T) {
+	var inFlight, peak int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	backend := testBackend(t, server.URL)
+	l := newLimiter(2)
+	l.install(backend)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := backend.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")}); err != nil {
+				t.Errorf("HeadObject: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt64(&peak); got != 2 {
+		t.Errorf("got %d requests in flight at most, want 2", got)
+	}
+	if got := atomic.LoadInt64(&l.inFlight); got != 0 {
+		t.Errorf("got %d requests in flight after completion, want 0", got)
+	}
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	backend := testBackend(t, server.URL)
+	l := newLimiter(1)
+	l.install(backend)
+
+	go backend.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("busy")})
+	for atomic.LoadInt64(&l.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")}); err == nil {
+		t.Error("HeadObject succeeded without a slot")
+	}
+	if got := atomic.LoadInt64(&l.inFlight); got != 1 {
+		t.Errorf("got %d requests in flight, want 1", got)
+	}
+	if got := atomic.LoadInt64(&l.waiting); got != 0 {
+		t.Errorf("got %d requests waiting, want 0", got)
+	}
+}
@@ -1,29 +1,166 @@
-// This program exposes a FUSE backed by an aws s3 bucket where one can **only** list objects contained in the bucket.
+// This program exposes a FUSE backed by an aws s3 bucket where one can list, read, write and delete objects
+// contained in the bucket.
 //
-// For simplicity, the implementation eagerly caches metadata of all objects upon mounting and **never** refreshes it.
-// Therefore, changes made to the bucket *after* mounting it into fs will not be visible to the latter.
+// Keys are split on "/" into a directory hierarchy, e.g. 'photos/2023/img.jpg' is presented as the file 'img.jpg'
+// inside the directory 'photos/2023'. A key that is also the prefix of other keys ('a' next to 'a/b') is presented as
+// a directory.
+//
+// With -prefix, only the keys under the given prefix are exposed, as if it was the whole bucket: 'team-a' mounts
+// 'team-a/docs/x' as 'docs/x', and files written to the mount are stored under the prefix. A prefix without keys is
+// mounted as an empty directory.
+//
+// Several buckets can be mounted at once by repeating -bucket, or with a comma-separated list, in which case the root
+// holds a directory per bucket. Buckets share the connection to s3 and the options, prefix included, and are otherwise
+// listed, cached and refreshed on their own. Each one is listed when mounting, and one that cannot be, e.g. because it
+// does not exist, is presented as an empty directory and the error logged. Files cannot be renamed across buckets.
+//
+// Inode numbers are derived from the keys of objects, so they are the same across mounts, as tools like rsync or
+// 'find -inum' expect.
+//
+// Metadata is fetched from s3 on demand: listing a directory queries the keys under its prefix, following as many
+// pages of -max-keys entries as needed, and the result is reused for -cache-ttl before s3 is queried again. Resolving
+// a single name outside of that window only asks s3 about the corresponding key, so mounting is instant regardless of
+// the size of the bucket. That a name does not exist is cached by the kernel for -negative-ttl, so that shell
+// completion or repeatedly probing for a missing file does not query s3 each time.
+//
+// Directories are streamed to the kernel as their pages of keys come in, so listing a huge prefix only ever holds a
+// page of keys in memory. Only directories of up to -max-cached-entries children are kept as a listing once read,
+// and larger ones are listed again every time they are read, and not refreshed.
+//
+// With -refresh-interval, directories that were listed are re-listed in the background, so that objects created or
+// deleted by other clients show up, or vanish, even when -cache-ttl is long. A failing refresh keeps the previous
+// listing. The kernel caches names for -entry-timeout and attributes for -attr-timeout, and is told to drop what a
+// refresh finds deleted or replaced, along with the cached pages of replaced files, so that long timeouts do not
+// keep stale results around past the next refresh.
+//
+// Reading a file downloads the blocks of -cache-block-size bytes covering the requested range that are not cached
+// with a single ranged GET request, and keeps them in a cache of up to -cache-size bytes shared by all files, so
+// repeated and sequential reads are served from memory. Objects are never held in memory as a whole, so files of any
+// size can be read with memory bounded by the cache. While a file is read sequentially, the next -readahead bytes are
+// prefetched into the cache in the background. Blocks are tied to the ETag of the object, and dropped once the object
+// is overwritten, deleted or found to have changed by a refresh. With -cache-size=0, reads download exactly the
+// requested bytes.
+//
+// Downloads are conditional on the ETag the object had when it was listed or opened, so a read never mixes versions
+// of an object. When an object turns out to have been overwritten, its new version is queried and the read retried,
+// and the kernel drops what it cached of the file.
+//
+// A read covering a whole object, as is common for small files, downloads it with a plain GET, and with
+// -verify-checksums the content is checked against the MD5 digest in the ETag and any additional checksum (SHA256,
+// CRC32) stored with the object. A mismatch fails the read with EIO. Ranged reads cannot be verified, as checksums
+// cover whole objects.
+//
+// The bucket is mounted read-only unless -rw is given, in which case files can be written, removed and renamed as
+// follows. Read-only mounts are enforced by the kernel, and every operation modifying the bucket fails with EROFS
+// regardless.
+//
+// Since s3 objects can only be replaced as a whole, files being written are spooled to a temporary file in
+// -spool-dir, where they can be written at any offset and read back, and uploaded when they are closed: with a single
+// request up to -part-size bytes, and in parts of -part-size bytes beyond. Closing a file reports any upload error,
+// and the spool file is removed either way. Modifying an existing file without truncating it first downloads it to
+// the spool file, which is only supported up to -max-truncate-size to avoid surprise downloads of large objects.
+//
+// Uploads, including the copies made by renames and metadata changes, are encrypted server-side as per -sse and
+// -sse-kms-key-id, or else as the bucket defaults to. A bucket policy rejecting them fails closing the file with
+// EACCES, and logs why.
+//
+// Truncating a file that is not open for writing to zero stores an empty object. Truncating it to any other size
+// rewrites the object with its retained bytes, padded with zeros when growing, within the same limit.
+//
+// Modification times set on files, e.g. by 'touch -d' or 'rsync -t', are stored in their 'x-amz-meta-mtime' metadata,
+// as seconds since the epoch: along with the upload of a file being written, and otherwise by copying the object onto
+// itself. Files are presented with that time rather than the one they were last stored at, which takes querying the
+// metadata of every file looked up, once per ETag. -no-preserve-times spares both, and ignores the times set.
+//
+// Objects archived in the GLACIER or DEEP_ARCHIVE storage classes can only be read once restored. Opening one that
+// is not fails with EREMOTE, or EACCES with -archived-eacces, and logs that it has to be restored first, e.g. with
+// 'aws s3api restore-object'. With -restore-on-open, opening it requests the restore instead, for -restore-days, and
+// fails with EAGAIN until the restored copy is available.
+//
+// Removing a file deletes its object. Directories only exist as long as there are keys under their prefix, so
+// creating one stores an empty marker object named after the directory with a trailing "/", as the AWS console
+// does. Markers are never presented as files, and directories can only be removed once empty.
+//
+// Renaming a file copies its object server-side to the new key and deletes the original, which s3 only supports for
+// objects of up to 5 GiB. Renaming a directory fails with EXDEV, so that mv falls back to moving its files one by one.
+//
+// Copying a whole file of up to 4 GiB onto an empty one with copy_file_range(2), as 'cp' does, copies its object
+// server-side rather than downloading and uploading it. Other copies fall back to reading and writing the files.
+//
+// The metadata of an object is exposed as extended attributes: 'user.s3.content-type', 'user.s3.etag',
+// 'user.s3.storage-class', for archived objects 'user.s3.restore' and for encrypted ones 'user.s3.sse' are read-only,
+// while user metadata ('x-amz-meta-*' headers) is exposed under 'user.s3.meta.', and setting or removing it copies
+// the object onto itself with the new metadata.
+//
+// Files are uploaded with the content type of the extension of their name, or else the one sniffed from their first
+// 512 bytes, so that the objects can be served over HTTP as they are. Setting 'user.s3.content-type' on a file while
+// it is being written, before it is closed, stores it with that content type instead.
+//
+// The virtual extended attribute 'user.s3.presigned-url' holds a URL to download the object without credentials,
+// valid for -presign-expiry, e.g. to share a file with 'getfattr --only-values -n user.s3.presigned-url FILE'. Every
+// read signs a fresh URL, so the value changes each time. With -presign-expiry=0, the attribute does not exist.
+//
+// 'df' reports the number and total size of the objects in the directories listed so far, as of their last listing
+// or refresh, along with an unbounded amount of free space.
+//
+// With -show-versions, the past versions of the objects of a versioned bucket are exposed read-only under the hidden
+// directory '.versions' in the root, which mirrors the hierarchy of the bucket with a directory per object holding a
+// file per version, named after its version ID: 'mnt/.versions/docs/x/<versionId>'. Versions are only listed once
+// '.versions' is browsed, and delete markers are left out.
+//
+// Symlinks are stored the way s3fs-fuse stores them: as objects holding the target, with the mode of a symlink in
+// their 'x-amz-meta-mode' metadata. Since that takes querying the metadata of every object, only objects of up to
+// 4096 bytes are queried for it, once per ETag, and larger ones are always presented as regular files.
+//
+// Requests that s3 throttles, e.g. with 'SlowDown', or that fail for transient reasons are retried up to -max-retries
+// times with jittered exponential backoff. Every operation that queries s3, retries included, is bounded by
+// -op-timeout, after which it fails with EIO, so an unresponsive endpoint does not leave processes hanging on the
+// mount. Missing objects yield ENOENT, denied requests EACCES, throttling that outlasts the retries EAGAIN, uploads
+// and metadata that are too large EFBIG and E2BIG, interrupted requests EINTR, and other failures EIO.
+//
+// At most -max-concurrency requests to s3 are in flight at once, so that bursts of operations, e.g. 'grep -r', do not
+// get throttled; the others wait for their turn, or until they are interrupted. With -stats-interval, the number of
+// requests in flight and waiting is logged periodically, along with the effectiveness of the cache, to help tuning it.
+//
+// With -metrics-addr, metrics are served over HTTP at '/metrics' in the text format of Prometheus: the number of
+// attempts, errors and bytes sent and received of every s3 API, and histograms of their latency, along with the
+// latency of every operation of the kernel, the number of replies to them by errno, and the hits and misses of the
+// cache.
+//
+// SIGINT and SIGTERM unmount the filesystem and exit once in-flight operations are done, and a second signal exits
+// right away. With -auto-unmount, the filesystem is also unmounted if the process dies otherwise.
+//
+// The bucket is reached through -endpoint, or $AWS_ENDPOINT, and otherwise the s3 endpoint of -region. Credentials
+// and region come from the environment and the shared aws config files, as for the aws cli, optionally from a given
+// -profile, which must exist. Public buckets can be mounted without any credentials with -anonymous, or its alias
+// -no-sign-request as the aws cli names it, which sends unsigned requests; those denied are logged as a hint that the
+// bucket may not be public.
+//
+// Before mounting, every bucket is queried to check that it exists and can be reached with the credentials at hand,
+// and the mount is aborted with a diagnosis otherwise, e.g. that there are no credentials, that the bucket does not
+// exist, or that it is in another region than -region. With -verify-write, read-write mounts also check that objects
+// can be written by storing and deleting an empty object under the key '.s3fs-preflight-*'. -skip-preflight skips the
+// checks, for endpoints that do not allow querying buckets.
 //
 // # Possible improvements
 //
-// 1. Support fetching s3 on demand, with a cli flag to cache it,
-// 2. Bound fs operations to a sensible timeout,
-// 3. Add other relevant fs operations,
-// 4. Add support for auto-umount.
+// 1. Add other relevant fs operations.
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -34,101 +171,325 @@ const (
 	EXOSFILE      = 72
 )
 
-// s3Bucket captures the intent to connect to a bucket.
-type s3Bucket struct {
-	fs.Inode
-
-	name    string
-	backend *s3.S3
-}
-
-// newS3Bucket creates a new s3 service on 'endpoint' for the given 'bucketName'.
-func newS3Bucket(bucketName, endpoint string) (fs.InodeEmbedder, error) {
-	session, err := session.NewSession(aws.NewConfig().WithEndpoint(endpoint))
-	if err != nil {
-		return nil, fmt.Errorf("failed to establish session with s3: %v", err)
-	}
-	backend := s3.New(session, aws.NewConfig().WithS3ForcePathStyle(true))
-	return &s3Bucket{name: bucketName, backend: backend}, nil
-}
-
-// OnAdd eagerly builds an fs view over the contents of the bucket.
-func (b *s3Bucket) OnAdd(ctx context.Context) {
-	if out, err := b.backend.ListObjects(&s3.ListObjectsInput{Bucket: &b.name}); err != nil {
-		log.Printf("failed to query s3 bucket '%v': %v", b.name, err)
-	} else {
-		parent := &b.Inode
-		for _, obj := range out.Contents {
-			child := parent.NewPersistentInode(ctx, &s3Object{content: obj}, fs.StableAttr{})
-			parent.AddChild(*obj.Key, child, true)
-		}
-	}
-}
-
-// s3Object is an entry in the bucket.
-type s3Object struct {
-	fs.Inode
-
-	content *s3.Object
-}
-
-func (o *s3Object) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Mode = 0444 // -r--r--r--
-	out.Nlink = 1
-	out.Mtime = uint64(o.content.LastModified.Unix())
-	out.Atime = uint64(0)
-	out.Ctime = uint64(0)
-	out.Size = uint64(*o.content.Size)
-	out.Blksize = 0
-	out.Blocks = 0
-	return 0
-}
-
 // cli is the set of options to start up this app.
 type cli struct {
-	mountPoint string
-	bucketName string
-	endpoint   string
+	mountPoint  string
+	bucketNames []string
+	prefix      string
+	backend     backendOptions
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	maxKeys     int64
+	maxCached   int
+	partSize    int64
+	spoolDir    string
+	sse         string
+	sseKMSKeyID string
+	maxTruncate int64
+	refresh     time.Duration
+	entryTTL    time.Duration
+	attrTTL     time.Duration
+	opTimeout   time.Duration
+	presign     time.Duration
+	maxRequests int
+	stats       time.Duration
+	metricsAddr string
+	autoUnmount bool
+	versions    bool
+	archivedErr bool
+	restoreOpen bool
+	restoreDays int64
+	keepTimes   bool
+	readOnly    bool
+	preflight   bool
+	verifyWrite bool
+	verify      bool
+	blockSize   int64
+	cacheSize   int64
+	readahead   int64
 }
 
 // newCli exposes the command-line interface to users.
 func newCli() cli {
-	bucketName := flag.String("bucket", "", "bucket name")
+	var bucketNames namesFlag
+	flag.Var(&bucketNames, "bucket", "bucket name, repeated or comma-separated to mount several buckets as directories")
+	prefix := flag.String("prefix", "", "only expose the keys under this prefix, e.g. 'team-a/'")
+	endpoint := flag.String("endpoint", os.Getenv("AWS_ENDPOINT"), "s3 endpoint, defaults to $AWS_ENDPOINT or the one of the region")
+	region := flag.String("region", "", "aws region, defaults to the one of the environment or profile")
+	profile := flag.String("profile", "", "profile of the shared aws config and credentials files to use")
+	var anonymous bool
+	flag.BoolVar(&anonymous, "anonymous", false, "send unsigned requests without looking for credentials, for public buckets")
+	flag.BoolVar(&anonymous, "no-sign-request", false, "alias of -anonymous")
+	cacheTTL := flag.Duration("cache-ttl", time.Minute, "how long a bucket listing is reused before querying s3 again")
+	negativeTTL := flag.Duration("negative-ttl", time.Second, "how long the kernel caches that a name does not exist, 0 to disable")
+	maxKeys := flag.Int64("max-keys", 0, "number of keys fetched per listing request, 0 for the s3 default of 1000")
+	maxCached := flag.Int("max-cached-entries", 100000, "largest directories, in entries, whose listing is cached, 0 for no limit")
+	partSize := flag.Int64("part-size", 8<<20, "size in bytes of the parts of uploads, at least 5 MiB")
+	spoolDir := flag.String("spool-dir", "", "directory holding files being written until they are uploaded, defaults to $TMPDIR")
+	sse := flag.String("sse", "", "server-side encryption requested for uploads, "+s3.ServerSideEncryptionAes256+" or "+s3.ServerSideEncryptionAwsKms+", defaults to that of the bucket")
+	sseKMSKeyID := flag.String("sse-kms-key-id", "", "KMS key to encrypt uploads with, with -sse="+s3.ServerSideEncryptionAwsKms+", defaults to the aws managed key")
+	maxTruncate := flag.Int64("max-truncate-size", 64<<20, "largest size in bytes files may be truncated to, other than 0")
+	refresh := flag.Duration("refresh-interval", 0, "how often listed directories are refreshed in the background, 0 to disable")
+	entryTTL := flag.Duration("entry-timeout", time.Second, "how long the kernel caches names, including those of objects that are gone")
+	attrTTL := flag.Duration("attr-timeout", time.Second, "how long the kernel caches the attributes of files")
+	maxRetries := flag.Int("max-retries", 3, "how many times throttled or failed requests to s3 are retried")
+	opTimeout := flag.Duration("op-timeout", 30*time.Second, "how long an operation may wait for s3, 0 to wait forever")
+	presign := flag.Duration("presign-expiry", 15*time.Minute, "how long the URLs in the "+xattrPresignedURL+" extended attribute are valid, 0 to disable it")
+	maxRequests := flag.Int("max-concurrency", 16, "number of requests to s3 that may be in flight at once")
+	stats := flag.Duration("stats-interval", 0, "how often to log statistics on requests and caching, 0 to disable")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve metrics on at /metrics, e.g. 'localhost:9100', empty to disable")
+	verify := flag.Bool("verify-checksums", true, "check files read in full against the checksums of their objects")
+	ro := flag.Bool("ro", false, "mount read-only, which is the default")
+	rw := flag.Bool("rw", false, "mount read-write, allowing to modify the bucket")
+	skipPreflight := flag.Bool("skip-preflight", false, "mount without checking that the buckets exist and can be reached")
+	verifyWrite := flag.Bool("verify-write", false, "check that objects can be written before mounting read-write, by storing and deleting one")
+	noPreserveTimes := flag.Bool("no-preserve-times", false, "ignore modification times set on files rather than copying their objects to store them")
+	archivedEACCES := flag.Bool("archived-eacces", false, "fail opening archived objects that are not restored with EACCES rather than EREMOTE")
+	restoreOnOpen := flag.Bool("restore-on-open", false, "request the restore of archived objects when they are opened, which fails with EAGAIN until done")
+	restoreDays := flag.Int64("restore-days", 1, "number of days restored copies of archived objects are kept, with -restore-on-open")
+	versions := flag.Bool("show-versions", false, "expose past versions of objects under the hidden directory "+versionsDirName)
+	autoUnmount := flag.Bool("auto-unmount", false, "unmount when the process exits, even if it crashes")
+	blockSize := flag.Int64("cache-block-size", 1<<20, "size in bytes of the blocks objects are read and cached in")
+	cacheSize := flag.Int64("cache-size", 256<<20, "total size in bytes of cached blocks, 0 to disable caching")
+	readahead := flag.Int64("readahead", 4<<20, "bytes prefetched into the cache following sequential reads, 0 to disable")
 
 	flag.Parse()
 
 	bailIf := func(check bool, cause string) {
 		if check {
-			fmt.Fprintf(os.Stderr, "oops! %v.\n\nusage:\n  s3fs -bucket=BUCKET MOUNTPOINT", cause)
+			fmt.Fprintf(os.Stderr, "oops! %v.\n\nusage:\n  s3fs -bucket=BUCKET [OPTION]... MOUNTPOINT\n\noptions:\n", cause)
+			flag.PrintDefaults()
 			os.Exit(EXUSAGE)
 		}
 	}
 
 	bailIf(len(flag.Args()) < 1, "MOUNTPOINT was not provided")
-	bailIf(*bucketName == "", "BUCKET was not provided")
+	bailIf(len(bucketNames) == 0, "BUCKET was not provided")
+	bailIf(bucketNames.duplicate() != "", "bucket '"+bucketNames.duplicate()+"' is given more than once")
+	bailIf(*ro && *rw, "-ro and -rw are mutually exclusive")
+	bailIf(*verifyWrite && !*rw, "-verify-write requires -rw")
+	bailIf(*verifyWrite && *skipPreflight, "-verify-write and -skip-preflight are mutually exclusive")
+	bailIf(anonymous && *profile != "", "-anonymous and -profile are mutually exclusive")
+	bailIf(*negativeTTL < 0, "-negative-ttl must not be negative")
+	bailIf(*maxKeys < 0, "-max-keys must not be negative")
+	bailIf(*maxCached < 0, "-max-cached-entries must not be negative")
+	bailIf(*partSize < minPartSize, "-part-size must be at least 5 MiB")
+	bailIf(*sse != "" && *sse != s3.ServerSideEncryptionAes256 && *sse != s3.ServerSideEncryptionAwsKms,
+		"-sse must be "+s3.ServerSideEncryptionAes256+" or "+s3.ServerSideEncryptionAwsKms)
+	bailIf(*sseKMSKeyID != "" && *sse != s3.ServerSideEncryptionAwsKms, "-sse-kms-key-id requires -sse="+s3.ServerSideEncryptionAwsKms)
+	bailIf(*maxTruncate < 0, "-max-truncate-size must not be negative")
+	bailIf(*refresh < 0, "-refresh-interval must not be negative")
+	bailIf(*entryTTL < 0, "-entry-timeout must not be negative")
+	bailIf(*attrTTL < 0, "-attr-timeout must not be negative")
+	bailIf(*restoreDays <= 0, "-restore-days must be positive")
+	bailIf(*maxRetries < 0, "-max-retries must not be negative")
+	bailIf(*opTimeout < 0, "-op-timeout must not be negative")
+	bailIf(*presign < 0, "-presign-expiry must not be negative")
+	bailIf(*maxRequests <= 0, "-max-concurrency must be positive")
+	bailIf(*stats < 0, "-stats-interval must not be negative")
+	bailIf(*blockSize <= 0, "-cache-block-size must be positive")
+	bailIf(*cacheSize < 0, "-cache-size must not be negative")
+	bailIf(*readahead < 0, "-readahead must not be negative")
+	bailIf(*cacheSize > 0 && *readahead > *cacheSize, "-readahead must not exceed -cache-size")
 
 	return cli{
-		mountPoint: flag.Arg(0),
-		bucketName: *bucketName,
-		endpoint:   os.Getenv("AWS_ENDPOINT"),
+		mountPoint:  flag.Arg(0),
+		bucketNames: bucketNames,
+		prefix:      *prefix,
+		backend: backendOptions{
+			endpoint:   *endpoint,
+			region:     *region,
+			profile:    *profile,
+			anonymous:  anonymous,
+			maxRetries: *maxRetries,
+		},
+		cacheTTL:    *cacheTTL,
+		negativeTTL: *negativeTTL,
+		maxKeys:     *maxKeys,
+		maxCached:   *maxCached,
+		partSize:    *partSize,
+		spoolDir:    *spoolDir,
+		sse:         *sse,
+		sseKMSKeyID: *sseKMSKeyID,
+		maxTruncate: *maxTruncate,
+		refresh:     *refresh,
+		entryTTL:    *entryTTL,
+		attrTTL:     *attrTTL,
+		opTimeout:   *opTimeout,
+		presign:     *presign,
+		maxRequests: *maxRequests,
+		stats:       *stats,
+		metricsAddr: *metricsAddr,
+		autoUnmount: *autoUnmount,
+		versions:    *versions,
+		archivedErr: *archivedEACCES,
+		restoreOpen: *restoreOnOpen,
+		restoreDays: *restoreDays,
+		keepTimes:   !*noPreserveTimes,
+		readOnly:    !*rw,
+		preflight:   !*skipPreflight,
+		verifyWrite: *verifyWrite,
+		verify:      *verify,
+		blockSize:   *blockSize,
+		cacheSize:   *cacheSize,
+		readahead:   *readahead,
 	}
 }
 
 func main() {
 	cli := newCli()
 
-	bucket, err := newS3Bucket(cli.bucketName, cli.endpoint)
+	backend, err := newS3Backend(cli.backend)
+	if errors.Is(err, errBadProfile) {
+		fmt.Fprintf(os.Stderr, "oops! %v.\n", err)
+		os.Exit(EXUSAGE)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to open s3 connection to bucket '%v': %v", cli.bucketName, err)
+		fmt.Fprintf(os.Stderr, "unable to open s3 connection to bucket '%v': %v", strings.Join(cli.bucketNames, ","), err)
 		os.Exit(EXUNAVAILABLE)
 	}
+	requests := newLimiter(cli.maxRequests)
+	requests.install(backend)
+	var blocks *blockCache
+	if cli.cacheSize > 0 {
+		blocks = newBlockCache(cli.blockSize, cli.cacheSize)
+	}
+	var stats *metrics
+	if cli.metricsAddr != "" {
+		stats = newMetrics(blocks)
+		stats.install(backend)
+		stop, err := serveMetrics(cli.metricsAddr, stats)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to serve metrics on '%v': %v", cli.metricsAddr, err)
+			os.Exit(EXUNAVAILABLE)
+		}
+		defer stop()
+	}
+	bucketOpts := bucketOptions{
+		prefix:           cli.prefix,
+		cacheTTL:         cli.cacheTTL,
+		negativeTTL:      cli.negativeTTL,
+		maxKeys:          cli.maxKeys,
+		maxCachedEntries: cli.maxCached,
+		partSize:         cli.partSize,
+		spoolDir:         cli.spoolDir,
+		sse:              cli.sse,
+		sseKMSKeyID:      cli.sseKMSKeyID,
+		maxTruncateSize:  cli.maxTruncate,
+		opTimeout:        cli.opTimeout,
+		presignExpiry:    cli.presign,
+		verifyChecksums:  cli.verify,
+		readOnly:         cli.readOnly,
+		showVersions:     cli.versions,
+		archivedEACCES:   cli.archivedErr,
+		restoreOnOpen:    cli.restoreOpen,
+		restoreDays:      cli.restoreDays,
+		preserveTimes:    cli.keepTimes,
+		blocks:           blocks,
+		readahead:        cli.readahead,
+	}
+	buckets := make([]*s3Bucket, len(cli.bucketNames))
+	for i, name := range cli.bucketNames {
+		buckets[i] = newS3Bucket(backend, name, bucketOpts)
+	}
+	if cli.preflight {
+		for _, b := range buckets {
+			ctx, cancel := b.withTimeout(context.Background())
+			err := b.preflight(ctx, cli.verifyWrite)
+			cancel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unable to mount s3 bucket '%v': %v.\n", b.name, err)
+				os.Exit(EXUNAVAILABLE)
+			}
+		}
+	}
+	var root fs.InodeEmbedder = buckets[0]
+	if len(buckets) > 1 {
+		root = newS3Buckets(buckets)
+	}
 
-	server, err := fs.Mount(cli.mountPoint, bucket, &fs.Options{})
+	opts := &fs.Options{EntryTimeout: &cli.entryTTL, AttrTimeout: &cli.attrTTL}
+	if cli.autoUnmount {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "auto_unmount")
+	}
+	if cli.readOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	server, err := mount(cli.mountPoint, root, opts, stats)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "unable to mount at '%v': %v", cli.mountPoint, err)
 		os.Exit(EXOSFILE)
 	}
-	log.Printf("mounted s3 bucket '%v' at '%v'", cli.bucketName, cli.mountPoint)
+	log.Printf("mounted s3 bucket '%v' at '%v'", strings.Join(cli.bucketNames, ","), cli.mountPoint)
+
+	if cli.refresh > 0 {
+		for _, b := range buckets {
+			stop := b.startRefresh(cli.refresh)
+			defer stop()
+		}
+	}
+	if cli.stats > 0 {
+		stop := startStats(cli.stats, requests, blocks)
+		defer stop()
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go unmountOnSignal(server, sigs, os.Exit)
 
 	server.Wait()
+	if blocks != nil {
+		blocks.logStats()
+	}
+}
+
+// namesFlag is a list of names, given by repeating a flag or as a comma-separated list.
+type namesFlag []string
+
+func (f *namesFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *namesFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*f = append(*f, name)
+		}
+	}
+	return nil
+}
+
+// duplicate returns a name given more than once, if any.
+func (f namesFlag) duplicate() string {
+	seen := map[string]bool{}
+	for _, name := range f {
+		if seen[name] {
+			return name
+		}
+		seen[name] = true
+	}
+	return ""
+}
+
+// startStats logs statistics on 'requests' and 'blocks', if any, each 'interval', until the returned func is called.
+func startStats(interval time.Duration, requests *limiter, blocks *blockCache) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				requests.logStats()
+				if blocks != nil {
+					blocks.logStats()
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
 }
@@ -0,0 +1,809 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+func testMount(t *testing.T, root fs.InodeEmbedder) (string, func()) {
+	t.Helper()
+	return testMountOptions(t, root, &fs.Options{})
+}
+
+// testMountOptions is like testMount, with the given options.
+func testMountOptions(t *testing.T, root fs.InodeEmbedder, opts *fs.Options) (string, func()) {
+	t.Helper()
+
+	mntDir := testutil.TempDir()
+	opts.Debug = testutil.VerboseTest()
+
+	server, err := fs.Mount(mntDir, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mntDir, func() {
+		if err := server.Unmount(); err != nil {
+			t.Fatalf("Unmount: %v", err)
+		}
+		os.Remove(mntDir)
+	}
+}
+
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLazyListing(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	fake.put("b", "world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+	if got := fake.count("ListObjects"); got != 0 {
+		t.Errorf("mounting issued %d ListObjects calls, want 0", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got, want := readDirNames(t, mnt), []string{"a", "b"}; !equalStrings(got, want) {
+			t.Errorf("listing #%d: got %v, want %v", i, got, want)
+		}
+	}
+	if got := fake.count("ListObjects"); got != 1 {
+		t.Errorf("got %d ListObjects calls, want 1", got)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/a", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Size != 5 {
+		t.Errorf("got size %d, want 5", st.Size)
+	}
+}
+
+func TestLookupMissing(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/missing", &st); err != syscall.ENOENT {
+		t.Errorf("Stat(missing): got %v, want ENOENT", err)
+	}
+	if err := syscall.Stat(mnt+"/a", &st); err != nil {
+		t.Errorf("Stat(a): %v", err)
+	}
+	fake.mu.Lock()
+	for _, q := range fake.listings {
+		if q.Get("max-keys") != "1" {
+			t.Errorf("lookups issued an unbounded listing %v", q)
+		}
+	}
+	fake.mu.Unlock()
+	if got := fake.count("HeadObject"); got == 0 {
+		t.Errorf("lookups did not issue HeadObject calls")
+	}
+}
+
+func TestLookupMissingCached(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	opts := bucketOptions{cacheTTL: time.Hour, negativeTTL: time.Hour}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	var st syscall.Stat_t
+	for i := 0; i < 3; i++ {
+		if err := syscall.Stat(mnt+"/missing", &st); err != syscall.ENOENT {
+			t.Fatalf("Stat #%d: got %v, want ENOENT", i, err)
+		}
+	}
+	if got := fake.count("HeadObject"); got != 1 {
+		t.Errorf("got %d HeadObject calls, want 1", got)
+	}
+	if got := fake.count("ListObjects"); got != 1 {
+		t.Errorf("got %d ListObjects calls, want 1", got)
+	}
+
+	// The kernel creates files over cached missing names.
+	if err := ioutil.WriteFile(mnt+"/missing", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/missing"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestListingExpires(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	ttl := 100 * time.Millisecond
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: ttl}))
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fake.put("b", "world")
+	if got, want := readDirNames(t, mnt), []string{"a"}; !equalStrings(got, want) {
+		t.Errorf("within TTL: got %v, want %v", got, want)
+	}
+
+	time.Sleep(ttl)
+	if got, want := readDirNames(t, mnt), []string{"a", "b"}; !equalStrings(got, want) {
+		t.Errorf("after TTL: got %v, want %v", got, want)
+	}
+	if got := fake.count("ListObjects"); got != 2 {
+		t.Errorf("got %d ListObjects calls, want 2", got)
+	}
+}
+
+func TestRead(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file.txt", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if got, err := ioutil.ReadFile(mnt + "/file.txt"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(got) != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+
+	f, err := os.Open(mnt + "/file.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	heads := fake.count("HeadObject")
+
+	buf := make([]byte, 100)
+	if n, err := f.ReadAt(buf, 6); err != io.EOF || string(buf[:n]) != "world" {
+		t.Errorf("ReadAt(6): got %q, %v, want %q, EOF", buf[:n], err, "world")
+	}
+	if n, err := f.ReadAt(buf, 20); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past EOF: got %d, %v, want 0, EOF", n, err)
+	}
+
+	fake.mu.Lock()
+	ranges := fake.ranges
+	fake.mu.Unlock()
+	for _, r := range ranges {
+		if r == "" {
+			t.Errorf("GetObject without Range header")
+		}
+	}
+	if got := fake.count("HeadObject"); got != heads {
+		t.Errorf("reads issued %d HeadObject calls, want 0", got-heads)
+	}
+}
+
+func TestReadDeleted(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file.txt", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	f, err := os.Open(mnt + "/file.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	fake.delete("file.txt")
+	buf := make([]byte, 5)
+	if _, err := f.Read(buf); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Read of deleted object: got %v, want ENOENT", err)
+	}
+}
+
+func TestReadOverwritten(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file.txt", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	// The listing holds on to the ETag of the original object. Looking it up queries whether it is a symlink, and the
+	// failed read queries the new version.
+	readDirNames(t, mnt)
+	fake.put("file.txt", "HELLO WORLD")
+	if got, err := ioutil.ReadFile(mnt + "/file.txt"); err != nil || string(got) != "HELLO WORLD" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "HELLO WORLD")
+	}
+	if got := fake.count("HeadObject"); got != 2 {
+		t.Errorf("got %d HeadObject calls, want 2", got)
+	}
+
+	// The first read of a shrunk object may be padded to the size the kernel knew, but the new version is recorded
+	// for the next ones.
+	fake.put("file.txt", "bye")
+	ioutil.ReadFile(mnt + "/file.txt")
+	if got, err := ioutil.ReadFile(mnt + "/file.txt"); err != nil || string(got) != "bye" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "bye")
+	}
+	if got := fake.count("HeadObject"); got != 3 {
+		t.Errorf("got %d HeadObject calls, want 3", got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "hello world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxTruncateSize: 16}))
+	defer clean()
+
+	for _, tc := range []struct {
+		size int64
+		want string
+	}{
+		{5, "hello"},
+		{8, "hello\x00\x00\x00"},
+		{0, ""},
+	} {
+		if err := os.Truncate(mnt+"/file", tc.size); err != nil {
+			t.Fatalf("Truncate(%d): %v", tc.size, err)
+		}
+		if got, _ := fake.get("file"); got != tc.want {
+			t.Errorf("Truncate(%d): got %q, want %q", tc.size, got, tc.want)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(mnt+"/file", &st); err != nil || st.Size != tc.size {
+			t.Errorf("Truncate(%d): got size %d, %v", tc.size, st.Size, err)
+		}
+	}
+	if err := os.Truncate(mnt+"/file", 17); !errors.Is(err, syscall.ENOTSUP) {
+		t.Errorf("Truncate beyond the limit: got %v, want ENOTSUP", err)
+	}
+
+	// This is what truncate(1) does on a new file.
+	f, err := os.OpenFile(mnt+"/new", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if err := f.Truncate(3); err != nil {
+		t.Errorf("Ftruncate: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if got, _ := fake.get("new"); got != "\x00\x00\x00" {
+		t.Errorf("got %q, want 3 zero bytes", got)
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("photos/2023/img.jpg", "jpeg")
+	fake.put("photos/2023/raw/img.cr2", "raw")
+	fake.put("photos/index.html", "html")
+	fake.put("a", "file")
+	fake.put("a/b", "nested")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a", "photos"}; !equalStrings(got, want) {
+		t.Errorf("root: got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/photos/2023"), []string{"img.jpg", "raw"}; !equalStrings(got, want) {
+		t.Errorf("photos/2023: got %v, want %v", got, want)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/photos/2023/img.jpg"); err != nil {
+		t.Errorf("ReadFile: %v", err)
+	} else if string(got) != "jpeg" {
+		t.Errorf("got %q, want %q", got, "jpeg")
+	}
+
+	if fi, err := os.Stat(mnt + "/a"); err != nil {
+		t.Errorf("Stat(a): %v", err)
+	} else if !fi.IsDir() {
+		t.Errorf("a is both an object and a prefix, got mode %v, want a directory", fi.Mode())
+	}
+	if got, want := readDirNames(t, mnt+"/a"), []string{"b"}; !equalStrings(got, want) {
+		t.Errorf("a: got %v, want %v", got, want)
+	}
+}
+
+func TestHierarchyLookup(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("x/y/z", "deep")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	// Resolving a path without ever listing its parents.
+	if got, err := ioutil.ReadFile(mnt + "/x/y/z"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(got) != "deep" {
+		t.Errorf("got %q, want %q", got, "deep")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/x/missing", &st); err != syscall.ENOENT {
+		t.Errorf("Stat(x/missing): got %v, want ENOENT", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("team-a/", "")
+	fake.put("team-a/docs/x", "hello")
+	fake.put("team-a/y", "world")
+	fake.put("team-b/z", "other")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{prefix: "team-a", cacheTTL: time.Hour, partSize: 1024}))
+	defer clean()
+
+	if got, err := ioutil.ReadFile(mnt + "/y"); err != nil || string(got) != "world" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "world")
+	}
+	if got, want := readDirNames(t, mnt), []string{"docs", "y"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/docs/x"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+	if err := ioutil.WriteFile(mnt+"/new", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, ok := fake.get("team-a/new"); !ok || got != "new" {
+		t.Errorf("got %q, %v, want %q", got, ok, "new")
+	}
+
+	fake.mu.Lock()
+	listings := fake.listings
+	fake.mu.Unlock()
+	for _, q := range listings {
+		if p := q.Get("prefix"); !strings.HasPrefix(p, "team-a/") {
+			t.Errorf("listing of prefix %q outside of the mounted prefix", p)
+		}
+	}
+}
+
+func TestPrefixEmpty(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{prefix: "missing/", cacheTTL: time.Hour}))
+	defer clean()
+
+	if got := readDirNames(t, mnt); len(got) != 0 {
+		t.Errorf("got %v, want an empty directory", got)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	var want []string
+	for i := 0; i < 2500; i++ {
+		name := fmt.Sprintf("%04d", i)
+		fake.put(name, "x")
+		want = append(want, name)
+	}
+	for i := 0; i < 10; i++ {
+		fake.put(fmt.Sprintf("dir/%d", i), "x")
+	}
+	want = append(want, "dir")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxKeys: 1000}))
+	defer clean()
+
+	if got := readDirNames(t, mnt); !equalStrings(got, want) {
+		t.Errorf("got %d entries, want %d", len(got), len(want))
+	}
+	if got := fake.count("ListObjects"); got != 3 {
+		t.Errorf("got %d ListObjects calls, want 3", got)
+	}
+}
+
+func TestPaginationFailure(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	for i := 0; i < 10; i++ {
+		fake.put(fmt.Sprintf("%d", i), "x")
+	}
+	fake.failContinuations = true
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxKeys: 3}))
+	defer clean()
+
+	if _, err := ioutil.ReadDir(mnt); !errors.Is(err, syscall.EIO) {
+		t.Errorf("ReadDir: got %v, want EIO", err)
+	}
+}
+
+func TestUnlink(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	fake.put("b", "world")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a", "b"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := os.Remove(mnt + "/a"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, ok := fake.get("a"); ok {
+		t.Errorf("object was not deleted")
+	}
+	if got, want := readDirNames(t, mnt), []string{"b"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := os.Remove(mnt + "/a"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Remove(deleted): got %v, want ENOENT", err)
+	}
+
+	fake.failAPI("DeleteObject")
+	if err := os.Remove(mnt + "/b"); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Remove(denied): got %v, want EACCES", err)
+	}
+}
+
+func TestRmdir(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("dir/a", "hello")
+	fake.put("marked/", "")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"dir", "marked"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := syscall.Rmdir(mnt + "/dir"); err != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir(non-empty): got %v, want ENOTEMPTY", err)
+	}
+	if err := os.Remove(mnt + "/dir/a"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := syscall.Rmdir(mnt + "/dir"); err != nil {
+		t.Errorf("Rmdir: %v", err)
+	}
+
+	if err := syscall.Rmdir(mnt + "/marked"); err != nil {
+		t.Errorf("Rmdir(marked): %v", err)
+	}
+	if _, ok := fake.get("marked/"); ok {
+		t.Errorf("directory marker was not deleted")
+	}
+	if got := readDirNames(t, mnt); len(got) != 0 {
+		t.Errorf("got %v, want no entries", got)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, partSize: 1024}))
+	defer clean()
+
+	if got := readDirNames(t, mnt); len(got) != 0 {
+		t.Errorf("got %v, want no entries", got)
+	}
+	if err := os.Mkdir(mnt+"/newdir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if got, ok := fake.get("newdir/"); !ok || got != "" {
+		t.Errorf("got marker %q, %v, want an empty object", got, ok)
+	}
+	if got, want := readDirNames(t, mnt), []string{"newdir"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := readDirNames(t, mnt+"/newdir"); len(got) != 0 {
+		t.Errorf("got %v, want no entries", got)
+	}
+	if err := os.Mkdir(mnt+"/newdir", 0755); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("Mkdir(existing): got %v, want EEXIST", err)
+	}
+
+	if err := ioutil.WriteFile(mnt+"/newdir/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := syscall.Rmdir(mnt + "/newdir"); err != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir(non-empty): got %v, want ENOTEMPTY", err)
+	}
+	if err := os.Remove(mnt + "/newdir/file"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := syscall.Rmdir(mnt + "/newdir"); err != nil {
+		t.Errorf("Rmdir: %v", err)
+	}
+	if _, ok := fake.get("newdir/"); ok {
+		t.Errorf("directory marker was not deleted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	fake.put("b", "world")
+	fake.put("dir/c", "!")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if err := os.Rename(mnt+"/a", mnt+"/dir/a with space"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, ok := fake.get("a"); ok {
+		t.Errorf("source object was not deleted")
+	}
+	if got, _ := fake.get("dir/a with space"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	if got, err := ioutil.ReadFile(mnt + "/dir/a with space"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, mnt+"/b", unix.AT_FDCWD, mnt+"/dir/c", unix.RENAME_NOREPLACE); err != syscall.EEXIST {
+		t.Errorf("Renameat2(RENAME_NOREPLACE): got %v, want EEXIST", err)
+	}
+	if err := os.Rename(mnt+"/b", mnt+"/dir/c"); err != nil {
+		t.Fatalf("Rename onto existing: %v", err)
+	}
+	if got, _ := fake.get("dir/c"); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+
+	if err := os.Rename(mnt+"/dir", mnt+"/other"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Rename(dir): got %v, want EXDEV", err)
+	}
+}
+
+// TestTimeout checks that an endpoint that never responds does not hang the mount.
+func TestReadOnly(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "hello")
+	fake.put("dir/x", "world")
+
+	// Without the "ro" mount option, so that the bucket has to reject modifications itself.
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, partSize: 1024, readOnly: true}))
+	defer clean()
+
+	if got, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+	for name, op := range map[string]func() error{
+		"create":      func() error { return ioutil.WriteFile(mnt+"/new", []byte("x"), 0644) },
+		"open":        func() error { _, err := os.OpenFile(mnt+"/file", os.O_WRONLY, 0); return err },
+		"truncate":    func() error { return os.Truncate(mnt+"/file", 0) },
+		"unlink":      func() error { return os.Remove(mnt + "/file") },
+		"mkdir":       func() error { return os.Mkdir(mnt+"/newdir", 0755) },
+		"rmdir":       func() error { return syscall.Rmdir(mnt + "/dir") },
+		"rename":      func() error { return os.Rename(mnt+"/file", mnt+"/moved") },
+		"setxattr":    func() error { return unix.Setxattr(mnt+"/file", xattrMetaPrefix+"k", []byte("v"), 0) },
+		"removexattr": func() error { return unix.Removexattr(mnt+"/file", xattrMetaPrefix+"k") },
+	} {
+		if err := op(); !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%v: got %v, want EROFS", name, err)
+		}
+	}
+	for _, api := range []string{"PutObject", "CopyObject", "DeleteObject"} {
+		if got := fake.count(api); got != 0 {
+			t.Errorf("got %d %v calls, want 0", got, api)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+
+	opts := bucketOptions{cacheTTL: time.Hour, opTimeout: 100 * time.Millisecond}
+	mnt, clean := testMount(t, newS3Bucket(testBackend(t, "http://"+l.Addr().String()), testBucket, opts))
+	defer clean()
+
+	start := time.Now()
+	if _, err := ioutil.ReadDir(mnt); !errors.Is(err, syscall.EIO) {
+		t.Errorf("ReadDir: got %v, want EIO", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/a", &st); err != syscall.EIO {
+		t.Errorf("Stat: got %v, want EIO", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("operations took %v", d)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setenv sets the environment variables in 'vars' for the duration of a test, and returns a func restoring them.
+func setenv(t *testing.T, vars map[string]string) func() {
+	old := map[string]*string{}
+	for k, v := range vars {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("Setenv: %v", err)
+		}
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestBackendProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBackendProfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/config", []byte("[profile test]\nregion = eu-west-3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/credentials", []byte("[test]\naws_access_key_id = id\naws_secret_access_key = secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setenv(t, map[string]string{
+		"AWS_CONFIG_FILE":             dir + "/config",
+		"AWS_SHARED_CREDENTIALS_FILE": dir + "/credentials",
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_PROFILE":                 "",
+		"AWS_REGION":                  "",
+	})()
+
+	backend, err := newS3Backend(backendOptions{profile: "test"})
+	if err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	}
+	if got := *backend.Config.Region; got != "eu-west-3" {
+		t.Errorf("got region %q, want the one of the profile", got)
+	}
+	if backend, err = newS3Backend(backendOptions{profile: "test", region: "us-west-2"}); err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	} else if got := *backend.Config.Region; got != "us-west-2" {
+		t.Errorf("got region %q, want the one of the flag", got)
+	}
+
+	if _, err := newS3Backend(backendOptions{profile: "missing"}); !errors.Is(err, errBadProfile) {
+		t.Errorf("missing profile: got %v, want errBadProfile", err)
+	}
+	if backend, err = newS3Backend(backendOptions{anonymous: true}); err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	} else if backend.Config.Credentials != credentials.AnonymousCredentials {
+		t.Errorf("anonymous backend signs requests")
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	defer setenv(t, map[string]string{
+		"AWS_CONFIG_FILE":             "/nonexistent/config",
+		"AWS_SHARED_CREDENTIALS_FILE": "/nonexistent/credentials",
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+	})()
+	backend, err := newS3Backend(backendOptions{endpoint: fake.server.URL, region: "us-east-1", anonymous: true})
+	if err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	}
+	mnt, clean := testMount(t, newS3Bucket(backend, testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+	if got := readDirNames(t, mnt); !equalStrings(got, []string{"a"}) {
+		t.Errorf("got %v, want [a]", got)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/a"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+
+	// Denied requests hint at the bucket not being public.
+	fake.mu.Lock()
+	fake.private = true
+	fake.mu.Unlock()
+	ctx := context.Background()
+	_, err = backend.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(testBucket)})
+	if err == nil || !strings.Contains(err.Error(), "may not be public") {
+		t.Errorf("got %v, want a hint that the bucket may not be public", err)
+	}
+	if got := toErrno(ctx, err); got != syscall.EACCES {
+		t.Errorf("got %v, want EACCES", got)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+// latencyBounds are the upper bounds of the buckets of latency histograms, in seconds.
+var latencyBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations of a duration in the buckets of latencyBounds.
+type histogram struct {
+	counts []uint64 // per bound, and beyond the last one
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(dt time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBounds)+1)
+	}
+	secs := dt.Seconds()
+	i := sort.SearchFloat64s(latencyBounds, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+// apiMetrics are the metrics of the requests to an s3 API.
+type apiMetrics struct {
+	attempts      uint64
+	errors        uint64
+	sentBytes     uint64
+	receivedBytes uint64
+	latency       histogram
+}
+
+// metrics collects statistics on the requests to s3 and the operations of the kernel, and serves them in the text
+// format of Prometheus.
+type metrics struct {
+	blocks *blockCache
+
+	mu       sync.Mutex
+	apis     map[string]*apiMetrics
+	started  map[*request.Request]time.Time
+	ops      map[string]*histogram
+	statuses map[opStatus]uint64
+}
+
+// opStatus is an operation of the kernel and the status it was answered with.
+type opStatus struct {
+	op     string
+	status string
+}
+
+var _ = (fuse.LatencyMap)((*metrics)(nil))
+var _ = (fuse.StatusMap)((*metrics)(nil))
+
+// newMetrics collects metrics, including on the effectiveness of 'blocks', which may be nil.
+func newMetrics(blocks *blockCache) *metrics {
+	return &metrics{
+		blocks:   blocks,
+		apis:     map[string]*apiMetrics{},
+		started:  map[*request.Request]time.Time{},
+		ops:      map[string]*histogram{},
+		statuses: map[opStatus]uint64{},
+	}
+}
+
+// install counts every attempt of every request of 'backend', whatever its API. Attempts are timed from right before
+// they are sent until the response headers are in, so that the latency does not include waiting for the limiter.
+func (m *metrics) install(backend *s3.S3) {
+	backend.Handlers.Send.PushFrontNamed(request.NamedHandler{Name: "s3fs.MetricsStart", Fn: m.start})
+	backend.Handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{Name: "s3fs.MetricsComplete", Fn: m.complete})
+}
+
+func (m *metrics) start(r *request.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[r] = time.Now()
+}
+
+func (m *metrics) complete(r *request.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	api := m.apis[r.Operation.Name]
+	if api == nil {
+		api = &apiMetrics{}
+		m.apis[r.Operation.Name] = api
+	}
+	api.attempts++
+	if r.Error != nil {
+		api.errors++
+	}
+	if r.HTTPRequest != nil && r.HTTPRequest.ContentLength > 0 {
+		api.sentBytes += uint64(r.HTTPRequest.ContentLength)
+	}
+	if r.HTTPResponse != nil && r.HTTPResponse.ContentLength > 0 && r.Error == nil {
+		api.receivedBytes += uint64(r.HTTPResponse.ContentLength)
+	}
+	if start, ok := m.started[r]; ok {
+		api.latency.observe(time.Since(start))
+		delete(m.started, r)
+	}
+}
+
+// Add records that the kernel operation 'name' took 'dt'.
+func (m *metrics) Add(name string, dt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.ops[name]
+	if h == nil {
+		h = &histogram{}
+		m.ops[name] = h
+	}
+	h.observe(dt)
+}
+
+// AddStatus records that the kernel operation 'name' was answered with 'status'.
+func (m *metrics) AddStatus(name string, status fuse.Status) {
+	s := "OK"
+	if status != fuse.OK {
+		s = unix.ErrnoName(syscall.Errno(status))
+		if s == "" {
+			s = fmt.Sprint(int32(status))
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[opStatus{op: name, status: s}]++
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes out all metrics, sorted by name and labels.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	apis := make([]string, 0, len(m.apis))
+	for name := range m.apis {
+		apis = append(apis, name)
+	}
+	sort.Strings(apis)
+	counter := func(name, help string, value func(a *apiMetrics) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, api := range apis {
+			fmt.Fprintf(w, "%s{api=%q} %d\n", name, api, value(m.apis[api]))
+		}
+	}
+	counter("s3fs_s3_requests_total", "Attempts of requests to s3, retries included.",
+		func(a *apiMetrics) uint64 { return a.attempts })
+	counter("s3fs_s3_errors_total", "Attempts of requests to s3 that failed.",
+		func(a *apiMetrics) uint64 { return a.errors })
+	counter("s3fs_s3_sent_bytes_total", "Bytes of request bodies sent to s3.",
+		func(a *apiMetrics) uint64 { return a.sentBytes })
+	counter("s3fs_s3_received_bytes_total", "Bytes of response bodies received from s3.",
+		func(a *apiMetrics) uint64 { return a.receivedBytes })
+
+	name := "s3fs_s3_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of the attempts of requests to s3, up to the response headers.\n# TYPE %s histogram\n", name, name)
+	for _, api := range apis {
+		writeHistogram(w, name, fmt.Sprintf("api=%q", api), &m.apis[api].latency)
+	}
+
+	ops := make([]string, 0, len(m.ops))
+	for op := range m.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	name = "s3fs_fuse_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of the operations of the kernel.\n# TYPE %s histogram\n", name, name)
+	for _, op := range ops {
+		writeHistogram(w, name, fmt.Sprintf("op=%q", op), m.ops[op])
+	}
+
+	statuses := make([]opStatus, 0, len(m.statuses))
+	for s := range m.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].op != statuses[j].op {
+			return statuses[i].op < statuses[j].op
+		}
+		return statuses[i].status < statuses[j].status
+	})
+	name = "s3fs_fuse_replies_total"
+	fmt.Fprintf(w, "# HELP %s Replies to the operations of the kernel, by status.\n# TYPE %s counter\n", name, name)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s{op=%q,status=%q} %d\n", name, s.op, s.status, m.statuses[s])
+	}
+
+	if m.blocks != nil {
+		hits, misses, size := m.blocks.stats()
+		fmt.Fprintf(w, "# HELP s3fs_cache_hits_total Reads of blocks served from the cache.\n# TYPE s3fs_cache_hits_total counter\n")
+		fmt.Fprintf(w, "s3fs_cache_hits_total %d\n", hits)
+		fmt.Fprintf(w, "# HELP s3fs_cache_misses_total Reads of blocks downloaded from s3.\n# TYPE s3fs_cache_misses_total counter\n")
+		fmt.Fprintf(w, "s3fs_cache_misses_total %d\n", misses)
+		fmt.Fprintf(w, "# HELP s3fs_cache_bytes Bytes of blocks in the cache.\n# TYPE s3fs_cache_bytes gauge\n")
+		fmt.Fprintf(w, "s3fs_cache_bytes %d\n", size)
+	}
+}
+
+// writeHistogram writes out the histogram 'h' of the metric 'name' with 'labels', as cumulative buckets.
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range latencyBounds {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// serveMetrics serves 'm' at '/metrics' on 'addr', until the returned func is called.
+func serveMetrics(addr string, m *metrics) (stop func(), err error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve(listener)
+	return func() { server.Close() }, nil
+}
+
+// mount is like fs.Mount, but has the server record its operations in 'm', if not nil, from the first one on.
+func mount(dir string, root fs.InodeEmbedder, opts *fs.Options, m *metrics) (*fuse.Server, error) {
+	server, err := fuse.NewServer(fs.NewNodeFS(root, opts), dir, &opts.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		server.RecordLatencies(m)
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	blocks := newBlockCache(1<<20, 8<<20)
+	backend := fake.backend(t)
+	m := newMetrics(blocks)
+	m.install(backend)
+	bucket := newS3Bucket(backend, testBucket, bucketOptions{cacheTTL: time.Hour, blocks: blocks})
+
+	mnt := testutil.TempDir()
+	defer os.Remove(mnt)
+	server, err := mount(mnt, bucket, &fs.Options{}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	if got, err := ioutil.ReadFile(mnt + "/a"); err != nil || string(got) != "hello" {
+		t.Fatalf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/missing", &st); err != syscall.ENOENT {
+		t.Fatalf("Stat: got %v, want ENOENT", err)
+	}
+
+	wants := []string{
+		"s3fs_s3_requests_total{api=\"GetObject\"} 1\n",
+		"s3fs_s3_errors_total{api=\"GetObject\"} 0\n",
+		"s3fs_s3_received_bytes_total{api=\"GetObject\"} 5\n",
+		"s3fs_s3_request_duration_seconds_count{api=\"GetObject\"} 1\n",
+		"s3fs_s3_request_duration_seconds_bucket{api=\"GetObject\",le=\"+Inf\"} 1\n",
+		// Querying the missing object fails.
+		"s3fs_s3_errors_total{api=\"HeadObject\"} 1\n",
+		"s3fs_fuse_replies_total{op=\"LOOKUP\",status=\"ENOENT\"} ",
+		"s3fs_fuse_replies_total{op=\"READ\",status=\"OK\"} ",
+		"s3fs_fuse_request_duration_seconds_count{op=\"READ\"} ",
+		"s3fs_cache_hits_total ",
+	}
+	// Replies are counted after they are sent, so the last ones may not be in yet.
+	var got string
+	var missing []string
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		got = rec.Body.String()
+		missing = missing[:0]
+		for _, want := range wants {
+			if !strings.Contains(got, want) {
+				missing = append(missing, want)
+			}
+		}
+		if len(missing) == 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, want := range missing {
+		t.Errorf("metrics lack %q:\n%s", want, got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// metaMtime is the user metadata holding the modification time set on an object through the mount, as seconds since
+// the epoch with a fractional part of nanoseconds. Whole seconds, as stored by s3fs-fuse, are understood too.
+const metaMtime = "mtime"
+
+func formatMtime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func parseMtime(s string) (time.Time, error) {
+	secs, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		secs, frac = s[:i], s[i+1:]
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec uint64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		if nsec, err = strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 32); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, int64(nsec)), nil
+}
+
+// mtimeMeta returns the modification time held by the user metadata 'meta', or the zero time if there is none.
+func mtimeMeta(meta map[string]*string) time.Time {
+	for k, v := range meta {
+		if strings.EqualFold(k, metaMtime) {
+			t, err := parseMtime(aws.StringValue(v))
+			if err != nil {
+				return time.Time{}
+			}
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// mtime returns the modification time of the child 'name' with the metadata 'content': the one stored with it if it
+// is known, and otherwise when it was last stored in s3.
+func (d *s3Dir) mtime(name string, content *s3.Object) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.probes[name]; ok && !p.mtime.IsZero() && p.etag == aws.StringValue(content.ETag) {
+		return p.mtime
+	}
+	return aws.TimeValue(content.LastModified)
+}
+
+// attachMtime sets the modification time 't' on the handles writing the object that have content to store, as the
+// kernel does not tell which handle, if any, the time is set through. It reports whether there was any.
+func (o *s3Object) attachMtime(t time.Time) bool {
+	attached := false
+	for _, w := range o.openWriters() {
+		if w.setMtime(t) {
+			attached = true
+		}
+	}
+	return attached
+}
+
+// setMtime stores the modification time 't' in the metadata of the object, by copying it onto itself.
+func (o *s3Object) setMtime(ctx context.Context, t time.Time) syscall.Errno {
+	etag, errno := o.replaceMeta(ctx, func(meta map[string]*string) syscall.Errno {
+		meta[metaMtime] = aws.String(formatMtime(t))
+		return 0
+	})
+	if errno != 0 {
+		return errno
+	}
+	dir, name := o.location()
+	dir.probed(name, metaProbe{etag: etag, mtime: t})
+	return 0
+}
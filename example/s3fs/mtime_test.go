@@ -0,0 +1,147 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMtime(t *testing.T) {
+	for s, want := range map[string]time.Time{
+		"1500000000":           time.Unix(1500000000, 0),
+		"1500000000.5":         time.Unix(1500000000, 500000000),
+		"1500000000.123456789": time.Unix(1500000000, 123456789),
+	} {
+		if got, err := parseMtime(s); err != nil || !got.Equal(want) {
+			t.Errorf("parseMtime(%q): got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "x", "1500000000.x", "1500000000.-5"} {
+		if got, err := parseMtime(s); err == nil {
+			t.Errorf("parseMtime(%q): got %v, want an error", s, got)
+		}
+	}
+	if got, want := formatMtime(time.Unix(1500000000, 5)), "1500000000.000000005"; got != want {
+		t.Errorf("formatMtime: got %q, want %q", got, want)
+	}
+}
+
+// statMtime returns the modification time of 'path'.
+func statMtime(t *testing.T, path string) time.Time {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	return time.Unix(st.Mtim.Unix())
+}
+
+func TestPreserveTimes(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	opts := bucketOptions{cacheTTL: time.Hour, preserveTimes: true}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	mtime := time.Unix(1500000000, 123456789)
+	if err := os.Chtimes(mnt+"/a", time.Now(), mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got := fake.count("CopyObject"); got != 1 {
+		t.Errorf("got %d CopyObject calls, want 1", got)
+	}
+	if got, want := fake.meta("a")[metaMtime], "1500000000.123456789"; got != want {
+		t.Errorf("got metadata %q, want %q", got, want)
+	}
+	if got := statMtime(t, mnt+"/a"); !got.Equal(mtime) {
+		t.Errorf("got mtime %v, want %v", got, mtime)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/a"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+
+	// Another mount finds the time in the metadata.
+	other, cleanOther := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer cleanOther()
+	if got := readDirNames(t, other); !equalStrings(got, []string{"a"}) {
+		t.Errorf("got %v, want [a]", got)
+	}
+	if got := statMtime(t, other+"/a"); !got.Equal(mtime) {
+		t.Errorf("other mount: got mtime %v, want %v", got, mtime)
+	}
+}
+
+// futimens sets the access and modification times of the open file 'f' to 't'.
+func futimens(f *os.File, t time.Time) error {
+	ts := [2]unix.Timespec{unix.NsecToTimespec(t.UnixNano()), unix.NsecToTimespec(t.UnixNano())}
+	_, _, errno := unix.Syscall6(unix.SYS_UTIMENSAT, f.Fd(), 0, uintptr(unsafe.Pointer(&ts[0])), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestPreserveTimesWriting(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	opts := bucketOptions{cacheTTL: time.Hour, partSize: 4, preserveTimes: true}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	// Setting the time of a file being written, as 'cp -p' does, stores it along with the upload.
+	for _, data := range []string{"abc", "hello world"} {
+		f, err := os.Create(mnt + "/a")
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		mtime := time.Unix(1500000000, int64(len(data)))
+		if err := futimens(f, mtime); err != nil {
+			t.Fatalf("futimens: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if got, want := fake.meta("a")[metaMtime], formatMtime(mtime); got != want {
+			t.Errorf("%q: got metadata %q, want %q", data, got, want)
+		}
+		if got := statMtime(t, mnt+"/a"); !got.Equal(mtime) {
+			t.Errorf("%q: got mtime %v, want %v", data, got, mtime)
+		}
+	}
+	if got := fake.count("CopyObject"); got != 0 {
+		t.Errorf("got %d CopyObject calls, want 0", got)
+	}
+}
+
+func TestNoPreserveTimes(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if err := os.Chtimes(mnt+"/a", time.Now(), time.Unix(1500000000, 0)); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got := fake.count("CopyObject"); got != 0 {
+		t.Errorf("got %d CopyObject calls, want 0", got)
+	}
+	if _, ok := fake.meta("a")[metaMtime]; ok {
+		t.Errorf("stored the modification time")
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Object is an entry in the bucket.
+type s3Object struct {
+	fs.Inode
+
+	bucket *s3Bucket
+
+	mu sync.Mutex
+
+	// dir and name locate the object, and change when it is renamed.
+	dir  *s3Dir
+	name string
+
+	content *s3.Object
+
+	// xattrs caches the extended attributes of the object, once fetched.
+	xattrs map[string][]byte
+
+	// writers holds the handles open for writing the object.
+	writers map[*s3Writer]bool
+}
+
+var _ = (fs.NodeGetattrer)((*s3Object)(nil))
+var _ = (fs.NodeSetattrer)((*s3Object)(nil))
+var _ = (fs.NodeOpener)((*s3Object)(nil))
+
+func (o *s3Object) location() (*s3Dir, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dir, o.name
+}
+
+func (o *s3Object) key() string {
+	dir, name := o.location()
+	return dir.prefix + name
+}
+
+// moved records that the object was renamed to 'name' in 'dir'.
+func (o *s3Object) moved(dir *s3Dir, name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.dir, o.name = dir, name
+	key := dir.prefix + name
+	content := *o.content
+	content.Key = &key
+	o.content = &content
+}
+
+// update records the location and metadata of the object as of a lookup.
+func (o *s3Object) update(dir *s3Dir, name string, content *s3.Object) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if aws.StringValue(content.ETag) != aws.StringValue(o.content.ETag) {
+		o.xattrs = nil
+	}
+	o.dir, o.name, o.content = dir, name, content
+}
+
+// stored records that 'content' was written to the object.
+func (o *s3Object) stored(content *s3.Object) {
+	o.mu.Lock()
+	o.content = content
+	o.xattrs = nil
+	dir, name := o.dir, o.name
+	o.mu.Unlock()
+	dir.stored(name, o, content)
+}
+
+// revalidated records 'content', the current version of the object as found when reading it. Unlike stored, this is
+// no change made through the mount, so the directory is left alone, and nothing changes if the ETag is the same.
+func (o *s3Object) revalidated(content *s3.Object) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if aws.StringValue(content.ETag) == aws.StringValue(o.content.ETag) {
+		return
+	}
+	o.content = content
+	o.xattrs = nil
+}
+
+// opened records that 'w' was opened for writing the object.
+func (o *s3Object) opened(w *s3Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.writers == nil {
+		o.writers = map[*s3Writer]bool{}
+	}
+	o.writers[w] = true
+}
+
+// openWriters returns the handles open for writing the object.
+func (o *s3Object) openWriters() []*s3Writer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	writers := make([]*s3Writer, 0, len(o.writers))
+	for w := range o.writers {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+// released records that the handle 'w' writing to the object was closed.
+func (o *s3Object) released(w *s3Writer) {
+	o.mu.Lock()
+	delete(o.writers, w)
+	o.mu.Unlock()
+	dir, name := o.location()
+	dir.released(name, o)
+}
+
+func (o *s3Object) fillAttr(out *fuse.Attr) {
+	o.mu.Lock()
+	dir, name, content := o.dir, o.name, o.content
+	o.mu.Unlock()
+	mtime := dir.mtime(name, content)
+
+	out.Mode = 0644 // -rw-r--r--
+	out.Nlink = 1
+	out.Mtime = uint64(mtime.Unix())
+	out.Mtimensec = uint32(mtime.Nanosecond())
+	out.Atime = uint64(0)
+	out.Ctime = uint64(0)
+	out.Size = uint64(*content.Size)
+	out.Blksize = 0
+	out.Blocks = 0
+}
+
+func (o *s3Object) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	o.fillAttr(&out.Attr)
+	if w, ok := f.(*s3Writer); ok {
+		if size, ok := w.spooledSize(); ok {
+			out.Size = uint64(size)
+		}
+	}
+	return 0
+}
+
+// Setattr only supports changing the size and the times of objects. Within a handle writing the object, the spooled
+// content is truncated, and stored on Flush. Otherwise, truncating to zero, which is how the kernel opens a file with
+// O_TRUNC, stores an empty object right away, and other sizes rewrite the object, which means downloading the
+// retained bytes, so they are limited to 'maxTruncateSize'.
+//
+// The modification time is stored in the metadata of the object: along with the content spooled by the handles writing
+// it, if there is any to store, and otherwise by copying the object onto itself, unless 'preserveTimes' is off, in
+// which case it is ignored. Access times are not kept.
+func (o *s3Object) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if o.bucket.opts.readOnly {
+		return syscall.EROFS
+	}
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+	size, hasSize := in.GetSize()
+	mtime, hasMtime := in.GetMTime()
+	if _, hasAtime := in.GetATime(); !hasSize && !hasMtime && !hasAtime {
+		return syscall.ENOTSUP
+	}
+
+	w, _ := f.(*s3Writer)
+	if hasSize {
+		var errno syscall.Errno
+		if w != nil {
+			errno = w.truncate(ctx, int64(size))
+		} else {
+			errno = o.truncate(ctx, int64(size))
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+	if hasMtime && !o.attachMtime(mtime) && o.bucket.opts.preserveTimes {
+		if errno := o.setMtime(ctx, mtime); errno != 0 {
+			return errno
+		}
+	}
+
+	o.fillAttr(&out.Attr)
+	if w != nil {
+		if size, ok := w.spooledSize(); ok {
+			out.Size = uint64(size)
+		}
+	}
+	if hasSize {
+		out.Size = size
+	}
+	if hasMtime {
+		out.Mtime, out.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+	}
+	return 0
+}
+
+// truncate replaces the object with its first 'size' bytes, padded with zeros if it is shorter.
+func (o *s3Object) truncate(ctx context.Context, size int64) syscall.Errno {
+	cur := o.size()
+	if size == cur {
+		return 0
+	}
+	if size > o.bucket.opts.maxTruncateSize {
+		return syscall.ENOTSUP
+	}
+
+	key := o.key()
+	data := make([]byte, size)
+	if keep := min64(cur, size); keep > 0 {
+		if _, err := o.bucket.download(ctx, o.version(), data[:keep], 0); err != nil {
+			log.Printf("failed to read object '%v' in s3 bucket '%v' to truncate it: %v", key, o.bucket.name, err)
+			return toErrno(ctx, err)
+		}
+	}
+
+	sse, kmsKeyID := o.bucket.encryption()
+	out, err := o.bucket.backend.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               &o.bucket.name,
+		Key:                  &key,
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		log.Printf("failed to truncate object '%v' in s3 bucket '%v': %v", key, o.bucket.name, err)
+		return toErrno(ctx, err)
+	}
+	o.stored(&s3.Object{
+		Key:          &key,
+		Size:         aws.Int64(size),
+		LastModified: aws.Time(time.Now()),
+		ETag:         out.ETag,
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	return 0
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// snapshot returns the current metadata of the object.
+func (o *s3Object) snapshot() *s3.Object {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.content
+}
+
+func (o *s3Object) size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return *o.content.Size
+}
+
+// Open hands out a handle for either reading or writing the object. Writing replaces the object as a whole with the
+// content spooled by the handle, and appending is not supported. Archived objects can only be opened for reading once
+// they are restored.
+func (o *s3Object) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		if o.bucket.opts.readOnly {
+			return nil, 0, syscall.EROFS
+		}
+		if flags&syscall.O_APPEND != 0 {
+			return nil, 0, syscall.ENOTSUP
+		}
+		return newS3Writer(o, false), 0, 0
+	}
+
+	v := o.version()
+	if isArchived(aws.StringValue(o.snapshot().StorageClass)) {
+		ctx, cancel := o.bucket.withTimeout(ctx)
+		defer cancel()
+		if errno := o.bucket.checkRestored(ctx, v.key); errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	h := &s3Handle{obj: o, v: v}
+	if o.bucket.opts.blocks != nil && o.bucket.opts.readahead > 0 {
+		h.ahead = newReadahead(o.bucket)
+	}
+	return h, 0, 0
+}
+
+// version identifies the content of an object as of some listing or query.
+type version struct {
+	key  string
+	size int64
+	etag string
+
+	// versionID selects a past version of the object in a versioned bucket, or is empty for the current one.
+	versionID string
+}
+
+func (o *s3Object) version() version {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return version{key: *o.content.Key, size: *o.content.Size, etag: aws.StringValue(o.content.ETag)}
+}
+
+// s3Handle is an object opened for reading. It remembers the version of the object as of opening it, so reads never
+// have to query its metadata again, and only ever return the content of that version.
+type s3Handle struct {
+	obj *s3Object
+
+	// ahead prefetches blocks following sequential reads, or is nil.
+	ahead *readahead
+
+	mu sync.Mutex
+	v  version
+}
+
+var _ = (fs.FileReader)((*s3Handle)(nil))
+var _ = (fs.FileReleaser)((*s3Handle)(nil))
+
+func (h *s3Handle) version() version {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.v
+}
+
+// Read returns the bytes in [off, off+len(dest)), truncated to the size of the object. They are served from the block
+// cache if there is one, and downloaded otherwise. While reads are sequential, the blocks following them are
+// prefetched into the cache. If the object was overwritten since its version was known, the
+// handle moves on to the new version, and the read is retried once.
+func (h *s3Handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	b := h.obj.bucket
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+
+	v := h.version()
+	n, err := b.read(ctx, v, dest, off)
+	if isPreconditionFailed(err) {
+		if v, err = h.revalidate(ctx, v.key); err == nil {
+			n, err = b.read(ctx, v, dest, off)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to read object '%v' in s3 bucket '%v': %v", v.key, b.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	if h.ahead != nil {
+		h.ahead.observe(v, off, n)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// Release stops prefetching for the handle.
+func (h *s3Handle) Release(ctx context.Context) syscall.Errno {
+	if h.ahead != nil {
+		h.ahead.stop()
+	}
+	return 0
+}
+
+// read fills 'dest' with the bytes of 'v' at 'off', truncated to its size.
+func (b *s3Bucket) read(ctx context.Context, v version, dest []byte, off int64) (int, error) {
+	end := off + int64(len(dest))
+	if end > v.size {
+		end = v.size
+	}
+	if off >= end {
+		return 0, nil
+	}
+
+	if cache := b.opts.blocks; cache != nil && v.etag != "" {
+		return b.readCached(ctx, cache, v, dest[:end-off], off)
+	}
+	return b.download(ctx, v, dest[:end-off], off)
+}
+
+// revalidate queries the current version of the object 'key', and records it on the inode and the handle. The kernel
+// is told to drop the pages and attributes it cached for the previous version.
+func (h *s3Handle) revalidate(ctx context.Context, key string) (version, error) {
+	b := h.obj.bucket
+	head, err := b.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &b.name,
+		Key:    &key,
+	})
+	if err != nil {
+		return version{}, err
+	}
+	storageClass := head.StorageClass
+	if storageClass == nil {
+		storageClass = aws.String(s3.StorageClassStandard)
+	}
+	h.obj.revalidated(&s3.Object{
+		Key:          &key,
+		Size:         head.ContentLength,
+		LastModified: head.LastModified,
+		ETag:         head.ETag,
+		StorageClass: storageClass,
+	})
+
+	dir, name := h.obj.location()
+	dir.probed(name, probeOf(head))
+
+	v := version{key: key, size: aws.Int64Value(head.ContentLength), etag: aws.StringValue(head.ETag)}
+	h.mu.Lock()
+	h.v = v
+	h.mu.Unlock()
+
+	// The kernel waits for pending reads of the pages before invalidating them, so notifying it from within this
+	// read would deadlock.
+	go h.obj.NotifyContent(0, -1)
+	return v, nil
+}
+
+// readCached fills 'dest' with the bytes of 'v' at 'off' from the blocks of 'cache'. The blocks that are missing are
+// downloaded with a single ranged GET spanning them, so reading a block-aligned range costs at most one request, and
+// memory use is bound by the size of the read and of the cache, whatever the size of the object.
+func (b *s3Bucket) readCached(ctx context.Context, cache *blockCache, v version, dest []byte, off int64) (int, error) {
+	first := off / cache.blockSize
+	blocks := make([][]byte, (off+int64(len(dest))-1)/cache.blockSize-first+1)
+	from, to := -1, -1
+	for i := range blocks {
+		data, ok := cache.get(b.blockID(v, first+int64(i)))
+		if !ok {
+			if from < 0 {
+				from = i
+			}
+			to = i
+		}
+		blocks[i] = data
+	}
+
+	if from >= 0 {
+		start := (first + int64(from)) * cache.blockSize
+		end := min64((first+int64(to)+1)*cache.blockSize, v.size)
+		data := make([]byte, end-start)
+		m, err := b.download(ctx, v, data, start)
+		if err != nil {
+			return 0, err
+		}
+		data = data[:m]
+		for i := from; i <= to && len(data) > 0; i++ {
+			size := min64(cache.blockSize, int64(len(data)))
+			blk := data[:size:size]
+			data = data[size:]
+			if blocks[i] == nil {
+				cache.put(b.blockID(v, first+int64(i)), blk)
+				blocks[i] = blk
+			}
+		}
+	}
+
+	n := 0
+	for i, data := range blocks {
+		pos, start := off+int64(n), (first+int64(i))*cache.blockSize
+		if pos-start >= int64(len(data)) {
+			break
+		}
+		n += copy(dest[n:], data[pos-start:])
+	}
+	return n, nil
+}
+
+// blockID identifies the block 'index' of 'v' in the block cache.
+func (b *s3Bucket) blockID(v version, index int64) blockID {
+	return blockID{key: b.blockKey(v.key), etag: v.etag, index: index}
+}
+
+// download reads the bytes of 'v' at 'off' into 'dest' with a ranged GET, or a plain one if that is the whole object,
+// in which case it is checked against the checksums of the object if 'verifyChecksums' is set. It fails with
+// PreconditionFailed if the object no longer has the ETag of 'v'.
+func (b *s3Bucket) download(ctx context.Context, v version, dest []byte, off int64) (int, error) {
+	in := &s3.GetObjectInput{
+		Bucket: &b.name,
+		Key:    &v.key,
+	}
+	whole := off == 0 && int64(len(dest)) == v.size
+	if !whole {
+		in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(dest))-1))
+	} else if b.opts.verifyChecksums {
+		in.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	if v.etag != "" {
+		in.IfMatch = &v.etag
+	}
+	if v.versionID != "" {
+		in.VersionId = &v.versionID
+	}
+	out, err := b.backend.GetObjectWithContext(ctx, in)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+
+	n, err := io.ReadFull(out.Body, dest)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return n, err
+	}
+	if whole && b.opts.verifyChecksums {
+		if err := verifyChecksums(dest[:n], out); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
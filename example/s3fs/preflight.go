@@ -0,0 +1,79 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// preflightKey is the prefix of the key of the object written and deleted by preflight to check that the bucket can
+// be written to.
+const preflightKey = ".s3fs-preflight-"
+
+// preflight checks that the bucket exists and can be reached with the credentials at hand before it is mounted, and
+// with 'verifyWrite' that objects can be stored in it, by writing an empty object and deleting it. The error explains
+// the likely cause of a failure.
+func (b *s3Bucket) preflight(ctx context.Context, verifyWrite bool) error {
+	req, _ := b.backend.HeadBucketRequest(&s3.HeadBucketInput{Bucket: &b.name})
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		var region string
+		if req.HTTPResponse != nil {
+			region = req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+		}
+		return b.diagnose(err, region)
+	}
+	if !verifyWrite {
+		return nil
+	}
+
+	key := b.opts.prefix + preflightKey + strconv.FormatInt(time.Now().UnixNano(), 36)
+	sse, kmsKeyID := b.encryption()
+	if _, err := b.backend.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               &b.name,
+		Key:                  &key,
+		Body:                 bytes.NewReader(nil),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	}); err != nil {
+		return fmt.Errorf("unable to write object '%v' to s3 bucket '%v', check the bucket policy or mount read-only: %v", key, b.name, err)
+	}
+	if _, err := b.backend.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: &b.name, Key: &key}); err != nil {
+		return fmt.Errorf("unable to delete object '%v' from s3 bucket '%v', check the bucket policy: %v", key, b.name, err)
+	}
+	return nil
+}
+
+// diagnose explains the error 'err' of querying the bucket, which s3 replied is in 'region' if not empty.
+func (b *s3Bucket) diagnose(err error, region string) error {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoCredentialProviders" {
+		return fmt.Errorf("no credentials found for s3 bucket '%v', set them in the environment or the shared aws config files, or use -anonymous for public buckets", b.name)
+	}
+	if region != "" && region != aws.StringValue(b.backend.Config.Region) {
+		return fmt.Errorf("s3 bucket '%v' is in region '%v', not '%v', use -region=%v", b.name, region, aws.StringValue(b.backend.Config.Region), region)
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("s3 bucket '%v' does not exist", b.name)
+		case http.StatusForbidden:
+			if b.backend.Config.Credentials == credentials.AnonymousCredentials {
+				return fmt.Errorf("access to s3 bucket '%v' is denied to anonymous requests, the bucket may not be public", b.name)
+			}
+			return fmt.Errorf("access to s3 bucket '%v' is denied, check the credentials and the bucket policy", b.name)
+		}
+	}
+	return fmt.Errorf("unable to reach s3 bucket '%v': %v", b.name, err)
+}
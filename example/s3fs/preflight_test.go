@@ -0,0 +1,83 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreflight(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	ctx := context.Background()
+	opts := bucketOptions{cacheTTL: time.Hour, prefix: "dir/"}
+
+	if err := newS3Bucket(fake.backend(t), testBucket, opts).preflight(ctx, true); err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+	if got := fake.count("PutObject"); got != 1 {
+		t.Errorf("got %d PutObject calls, want 1", got)
+	}
+	if got := fake.count("DeleteObject"); got != 1 {
+		t.Errorf("got %d DeleteObject calls, want 1", got)
+	}
+	fake.mu.Lock()
+	left := len(fake.objects)
+	fake.mu.Unlock()
+	if left != 0 {
+		t.Errorf("preflight left %d objects behind", left)
+	}
+
+	check := func(name string, b *s3Bucket, verifyWrite bool, want string) {
+		t.Helper()
+		if err := b.preflight(ctx, verifyWrite); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error mentioning %q", name, err, want)
+		}
+	}
+	check("missing", newS3Bucket(fake.backend(t), "missing", opts), false, "does not exist")
+
+	fake.failAPI("PutObject")
+	check("read-only", newS3Bucket(fake.backend(t), testBucket, opts), true, "unable to write")
+	if err := newS3Bucket(fake.backend(t), testBucket, opts).preflight(ctx, false); err != nil {
+		t.Errorf("preflight without writing: %v", err)
+	}
+
+	fake.failAPI("HeadBucket")
+	check("denied", newS3Bucket(fake.backend(t), testBucket, opts), false, "denied, check the credentials")
+
+	fake.mu.Lock()
+	fake.region = "eu-west-1"
+	fake.mu.Unlock()
+	check("region", newS3Bucket(fake.backend(t), testBucket, opts), false, "is in region 'eu-west-1', not 'us-east-1'")
+}
+
+func TestPreflightNoCredentials(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	defer setenv(t, map[string]string{
+		"AWS_CONFIG_FILE":             "/nonexistent/config",
+		"AWS_SHARED_CREDENTIALS_FILE": "/nonexistent/credentials",
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+	})()
+	backend, err := newS3Backend(backendOptions{endpoint: fake.server.URL, region: "us-east-1"})
+	if err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	}
+	err = newS3Bucket(backend, testBucket, bucketOptions{}).preflight(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("got %v, want an error mentioning missing credentials", err)
+	}
+	if got := fake.count("HeadBucket"); got != 0 {
+		t.Errorf("got %d HeadBucket calls, want 0", got)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// readahead tracks the reads of a handle, and while they are sequential, prefetches the blocks following them into
+// the cache, one at a time so prefetching takes at most one of the requests that may be in flight at once. A read at
+// another offset than where the previous one ended stops prefetching until reads are sequential again.
+type readahead struct {
+	bucket *s3Bucket
+	cache  *blockCache
+
+	// ctx is cancelled when the handle is released, which stops prefetching.
+	ctx    context.Context
+	cancel func()
+
+	mu sync.Mutex
+	v  version
+
+	// next is the offset right after the previous read.
+	next int64
+
+	// fetch and until are the first block to prefetch, and the block after the last one.
+	fetch, until int64
+
+	// running tells whether a goroutine is prefetching.
+	running bool
+}
+
+func newReadahead(b *s3Bucket) *readahead {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readahead{bucket: b, cache: b.opts.blocks, ctx: ctx, cancel: cancel, next: -1}
+}
+
+// observe records the read of 'n' bytes of 'v' at 'off', and prefetches what follows if the read started where the
+// previous one ended.
+func (r *readahead) observe(v version, off int64, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sequential := off == r.next && r.v == v
+	r.v, r.next = v, off+int64(n)
+	if !sequential {
+		r.fetch, r.until = 0, 0
+		return
+	}
+
+	bs := r.cache.blockSize
+	if first := r.next / bs; r.fetch < first {
+		r.fetch = first
+	}
+	r.until = (min64(r.next+r.bucket.opts.readahead, v.size) + bs - 1) / bs
+	if !r.running && r.fetch < r.until {
+		r.running = true
+		go r.run()
+	}
+}
+
+// run prefetches blocks until the ones wanted are cached, the handle is released, or a download fails. Failures are
+// not reported, as the reads that need the block download it again.
+func (r *readahead) run() {
+	for {
+		r.mu.Lock()
+		if r.fetch >= r.until || r.ctx.Err() != nil {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		v, index := r.v, r.fetch
+		r.fetch++
+		r.mu.Unlock()
+
+		if err := r.prefetch(v, index); err != nil {
+			r.mu.Lock()
+			r.running = false
+			r.fetch, r.until = 0, 0
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// prefetch downloads the block 'index' of 'v' into the cache, unless it is there already.
+func (r *readahead) prefetch(v version, index int64) error {
+	b := r.bucket
+	id := b.blockID(v, index)
+	if r.cache.has(id) {
+		return nil
+	}
+	ctx, cancel := b.withTimeout(r.ctx)
+	defer cancel()
+
+	start := index * r.cache.blockSize
+	data := make([]byte, min64(start+r.cache.blockSize, v.size)-start)
+	n, err := b.download(ctx, v, data, start)
+	if err != nil {
+		return err
+	}
+	r.cache.put(id, data[:n])
+	return nil
+}
+
+// stop stops prefetching. A download in flight is cancelled rather than waited for.
+func (r *readahead) stop() {
+	r.cancel()
+}
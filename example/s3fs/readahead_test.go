@@ -0,0 +1,112 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// waitIdle waits for 'r' to be done prefetching.
+func waitIdle(t *testing.T, r *readahead) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		running := r.running
+		r.mu.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still prefetching")
+		}
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	data := strings.Repeat("0123456789abcdef", 4)
+	fake.put("a", data)
+
+	blocks := newBlockCache(4, 1<<20)
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{blocks: blocks, readahead: 16})
+	obj := &s3Object{bucket: bucket, content: &s3.Object{
+		Key:  aws.String("a"),
+		Size: aws.Int64(int64(len(data))),
+		ETag: aws.String(fake.objects["a"].etag()),
+	}}
+	f, _, errno := obj.Open(context.Background(), syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+	h := f.(*s3Handle)
+	read := func(off int64) {
+		t.Helper()
+		buf := make([]byte, 4)
+		res, errno := h.Read(context.Background(), buf, off)
+		if errno != 0 {
+			t.Fatalf("Read(%d): %v", off, errno)
+		}
+		if got, _ := res.Bytes(nil); string(got) != data[off:off+4] {
+			t.Fatalf("Read(%d): got %q, want %q", off, got, data[off:off+4])
+		}
+	}
+	cached := func(index int64) bool {
+		return blocks.has(bucket.blockID(h.version(), index))
+	}
+
+	// The second of two sequential reads prefetches the 16 bytes following it.
+	read(0)
+	waitIdle(t, h.ahead)
+	if cached(1) {
+		t.Errorf("prefetched after a single read")
+	}
+	read(4)
+	waitIdle(t, h.ahead)
+	for i := int64(2); i < 6; i++ {
+		if !cached(i) {
+			t.Errorf("block %d was not prefetched", i)
+		}
+	}
+	if cached(6) {
+		t.Errorf("prefetched beyond the readahead")
+	}
+	calls := fake.count("GetObject")
+	if calls != 6 {
+		t.Errorf("got %d GetObject calls, want 6", calls)
+	}
+	read(8)
+	waitIdle(t, h.ahead)
+	if got := fake.count("GetObject"); got != calls+1 {
+		t.Errorf("got %d GetObject calls, want %d to prefetch one more block", got, calls+1)
+	}
+
+	// Random reads do not prefetch.
+	read(40)
+	waitIdle(t, h.ahead)
+	read(52)
+	waitIdle(t, h.ahead)
+	if cached(11) || cached(14) {
+		t.Errorf("prefetched after random reads")
+	}
+
+	// Releasing the handle stops prefetching.
+	if errno := h.Release(context.Background()); errno != 0 {
+		t.Fatalf("Release: %v", errno)
+	}
+	calls = fake.count("GetObject")
+	read(56)
+	waitIdle(t, h.ahead)
+	if got := fake.count("GetObject"); got != calls+1 {
+		t.Errorf("got %d GetObject calls after Release, want %d", got, calls+1)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// startRefresh re-lists every directory that was listed before each 'interval', until the returned func is called.
+func (b *s3Bucket) startRefresh(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.refresh(ctx)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// refresh walks the directories known to the kernel, and brings them up to date with s3.
+func (b *s3Bucket) refresh(ctx context.Context) {
+	b.walk(func(d *s3Dir) {
+		dirCtx, cancel := b.withTimeout(ctx)
+		err := d.refresh(dirCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to refresh '%v' in s3 bucket '%v', keeping the previous listing: %v", d.prefix, b.name, err)
+		}
+	})
+}
+
+// refresh re-lists the directory if it was listed before, and tells the kernel about the entries that appeared,
+// disappeared or were replaced since, so that it does not serve them from its caches until they time out. On error,
+// the previous listing is kept.
+func (d *s3Dir) refresh(ctx context.Context) error {
+	d.mu.Lock()
+	old := d.listing
+	if old == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	listing, err := d.fetchLocked(ctx)
+	pending := make(map[string]bool, len(d.pending))
+	for name := range d.pending {
+		pending[name] = true
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Notifications are sent without holding 'mu', as the kernel may have to wait for operations on the directory
+	// that are blocked on it.
+	children := d.Children()
+	for name, ch := range children {
+		if _, ok := ch.Operations().(*s3VersionsDir); ok {
+			continue
+		}
+		if !listing.has(name) && !pending[name] {
+			d.RmChild(name)
+			d.NotifyDelete(name, ch)
+		}
+	}
+	for name, prev := range old.files {
+		obj, ok := listing.files[name]
+		if ok && aws.StringValue(obj.ETag) == aws.StringValue(prev.ETag) {
+			continue
+		}
+		d.bucket.opts.blocks.drop(d.bucket.blockKey(d.prefix + name))
+		if !ok || pending[name] {
+			continue
+		}
+		// The object was replaced: the node moves on to the new version, and the kernel drops the pages and
+		// attributes it cached for the previous one, along with the entry, which may not even be a file anymore.
+		if ch := children[name]; ch != nil {
+			switch n := ch.Operations().(type) {
+			case *s3Object:
+				n.update(d, name, obj)
+			case *s3Symlink:
+				n.update(obj, nil)
+			}
+			ch.NotifyContent(0, -1)
+		}
+		d.NotifyEntry(name)
+	}
+	for name := range listing.files {
+		if !old.has(name) {
+			d.NotifyEntry(name)
+		}
+	}
+	for name := range listing.dirs {
+		if !old.has(name) {
+			d.NotifyEntry(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func TestRefresh(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	fake.put("dir/x", "world")
+
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a", "dir"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/dir"), []string{"x"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fake.delete("a")
+	fake.put("b", "new")
+	fake.put("dir/y", "new")
+	bucket.refresh(context.Background())
+
+	if got, want := readDirNames(t, mnt), []string{"b", "dir"}; !equalStrings(got, want) {
+		t.Errorf("after refresh: got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/dir"), []string{"x", "y"}; !equalStrings(got, want) {
+		t.Errorf("after refresh: got %v, want %v", got, want)
+	}
+	if bucket.GetChild("a") != nil {
+		t.Errorf("deleted object is still in the tree")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/a", &st); err != syscall.ENOENT {
+		t.Errorf("Stat(a): got %v, want ENOENT", err)
+	}
+}
+
+func TestRefreshFailure(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fake.failAPI("ListObjects")
+	bucket.refresh(context.Background())
+	if got, want := readDirNames(t, mnt), []string{"a"}; !equalStrings(got, want) {
+		t.Errorf("after failed refresh: got %v, want %v", got, want)
+	}
+}
+
+func TestRefreshInBackground(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	if got := readDirNames(t, mnt); len(got) != 0 {
+		t.Errorf("got %v, want no entries", got)
+	}
+	stopRefresh := bucket.startRefresh(10 * time.Millisecond)
+	defer stopRefresh()
+
+	fake.put("a", "hello")
+	want := []string{"a"}
+	var got []string
+	for i := 0; i < 100; i++ {
+		if got = readDirNames(t, mnt); equalStrings(got, want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRefreshInvalidates(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+	fake.put("b", "old")
+	fake.put("c", "hello")
+
+	// With timeouts this long, the kernel only ever queries the filesystem again when told to.
+	hour := time.Hour
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour})
+	mnt, clean := testMountOptions(t, bucket, &fs.Options{EntryTimeout: &hour, AttrTimeout: &hour})
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"a", "b", "c"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/b", &st); err != nil || st.Size != 3 {
+		t.Fatalf("Stat(b): got size %d, %v, want 3", st.Size, err)
+	}
+	f, err := os.Open(mnt + "/c")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "hello" {
+		t.Fatalf("ReadAt: got %q, %v, want %q", buf, err, "hello")
+	}
+
+	fake.delete("a")
+	fake.put("b", "longer")
+	fake.put("c", "HELLO")
+	bucket.refresh(context.Background())
+
+	if got, want := readDirNames(t, mnt), []string{"b", "c"}; !equalStrings(got, want) {
+		t.Errorf("after refresh: got %v, want %v", got, want)
+	}
+	if err := syscall.Stat(mnt+"/a", &st); err != syscall.ENOENT {
+		t.Errorf("Stat(a): got %v, want ENOENT", err)
+	}
+	if err := syscall.Stat(mnt+"/b", &st); err != nil || st.Size != 6 {
+		t.Errorf("Stat(b): got size %d, %v, want 6", st.Size, err)
+	}
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "HELLO" {
+		t.Errorf("ReadAt after refresh: got %q, %v, want %q", buf, err, "HELLO")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// scriptedS3 answers requests with the statuses and error codes of its script, in order, and then with the last one
+// forever. A code of "" answers with an empty object.
+type scriptedS3 struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	script []scriptedReply
+	calls  int
+}
+
+type scriptedReply struct {
+	status int
+	code   string
+}
+
+func newScriptedS3(script ...scriptedReply) *scriptedS3 {
+	s := &scriptedS3{script: script}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *scriptedS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	reply := s.script[len(s.script)-1]
+	if s.calls < len(s.script) {
+		reply = s.script[s.calls]
+	}
+	s.calls++
+	s.mu.Unlock()
+
+	if reply.code == "" {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(reply.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(reply.status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", reply.code, reply.code)
+}
+
+func (s *scriptedS3) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// backend returns an s3 client talking to the stub, retrying up to 'maxRetries' times with short delays.
+func (s *scriptedS3) backend(t *testing.T, maxRetries int) *s3.S3 {
+	backend := testBackend(t, s.server.URL)
+	backend.Retryer = client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    time.Millisecond,
+		MaxRetryDelay:    5 * time.Millisecond,
+		MinThrottleDelay: time.Millisecond,
+		MaxThrottleDelay: 5 * time.Millisecond,
+	}
+	return backend
+}
+
+var (
+	replyOK       = scriptedReply{http.StatusOK, ""}
+	replySlowDown = scriptedReply{http.StatusServiceUnavailable, "SlowDown"}
+)
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		head      bool
+		script    []scriptedReply
+		wantErrno syscall.Errno
+		wantCalls int
+	}{
+		{name: "throttled", script: []scriptedReply{replySlowDown, replySlowDown, replyOK}, wantCalls: 3},
+		{name: "internal", script: []scriptedReply{{http.StatusInternalServerError, "InternalError"}, replyOK}, wantCalls: 2},
+		{name: "exhausted", script: []scriptedReply{replySlowDown}, wantErrno: syscall.EAGAIN, wantCalls: 4},
+		{name: "exhausted head", head: true, script: []scriptedReply{replySlowDown}, wantErrno: syscall.EAGAIN, wantCalls: 4},
+		{name: "missing", script: []scriptedReply{{http.StatusNotFound, "NoSuchKey"}}, wantErrno: syscall.ENOENT, wantCalls: 1},
+		{name: "missing head", head: true, script: []scriptedReply{{http.StatusNotFound, ""}}, wantErrno: syscall.ENOENT, wantCalls: 1},
+		{name: "denied", script: []scriptedReply{{http.StatusForbidden, "AccessDenied"}}, wantErrno: syscall.EACCES, wantCalls: 1},
+		{name: "denied head", head: true, script: []scriptedReply{{http.StatusForbidden, ""}}, wantErrno: syscall.EACCES, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newScriptedS3(tc.script...)
+			defer stub.server.Close()
+			backend := stub.backend(t, 3)
+
+			ctx := context.Background()
+			var err error
+			if tc.head {
+				_, err = backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")})
+			} else {
+				var out *s3.GetObjectOutput
+				if out, err = backend.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")}); err == nil {
+					out.Body.Close()
+				}
+			}
+			if tc.wantErrno == 0 && err != nil {
+				t.Errorf("got %v, want success", err)
+			}
+			if tc.wantErrno != 0 {
+				if err == nil {
+					t.Errorf("got success, want %v", tc.wantErrno)
+				} else if got := toErrno(ctx, err); got != tc.wantErrno {
+					t.Errorf("got %v (%v), want %v", got, err, tc.wantErrno)
+				}
+			}
+			if got := stub.count(); got != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	stub := newScriptedS3(replySlowDown)
+	defer stub.server.Close()
+	backend := stub.backend(t, 1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")})
+	if got := toErrno(ctx, err); got != syscall.EIO {
+		t.Errorf("got %v (%v), want EIO", got, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("retries took %v", d)
+	}
+	if got := stub.count(); got < 2 {
+		t.Errorf("got %d calls, want retries", got)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	stub := newScriptedS3(replySlowDown)
+	defer stub.server.Close()
+	backend := stub.backend(t, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a")})
+	if got := toErrno(ctx, err); got != syscall.EINTR {
+		t.Errorf("got %v (%v), want EINTR", got, err)
+	}
+}
+
+func TestBackendRetries(t *testing.T) {
+	defer setenv(t, map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret"})()
+
+	backend, err := newS3Backend(backendOptions{endpoint: "http://127.0.0.1:1", region: "us-east-1", maxRetries: 5})
+	if err != nil {
+		t.Fatalf("newS3Backend: %v", err)
+	}
+	if got := backend.MaxRetries(); got != 5 {
+		t.Errorf("got %d retries, want 5", got)
+	}
+}
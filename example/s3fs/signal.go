@@ -0,0 +1,41 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// unmountOnSignal unmounts 'server' on the first of 'sigs', so that the process exits cleanly once in-flight
+// operations are done. Unmounting is retried for as long as the mount is busy, and a second signal calls 'exit'
+// without waiting any further.
+func unmountOnSignal(server *fuse.Server, sigs <-chan os.Signal, exit func(code int)) {
+	sig := <-sigs
+	log.Printf("received %v, unmounting", sig)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("received %v again, exiting without unmounting", sig)
+			exit(1)
+		case <-done:
+		}
+	}()
+
+	for {
+		err := server.Unmount()
+		if err == nil {
+			return
+		}
+		log.Printf("unable to unmount, retrying: %v", err)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
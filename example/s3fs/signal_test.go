@@ -0,0 +1,61 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestUnmountOnSignal(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	mnt := testutil.TempDir()
+	defer os.Remove(mnt)
+	server, err := fs.Mount(mnt, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}), &fs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An open file keeps the mount busy.
+	f, err := os.Open(mnt + "/a")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	sigs := make(chan os.Signal, 2)
+	exited := make(chan int, 1)
+	go unmountOnSignal(server, sigs, func(code int) { exited <- code })
+
+	sigs <- syscall.SIGINT
+	sigs <- syscall.SIGINT
+	select {
+	case code := <-exited:
+		if code == 0 {
+			t.Errorf("forced exit with code 0")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second signal did not force exit")
+	}
+
+	f.Close()
+	unmounted := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(unmounted)
+	}()
+	select {
+	case <-unmounted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not unmounted after the mount became idle")
+	}
+}
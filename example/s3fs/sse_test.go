@@ -0,0 +1,96 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+func TestSSE(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("old", "hello")
+
+	opts := bucketOptions{cacheTTL: time.Hour, partSize: 4, sse: s3.ServerSideEncryptionAwsKms, sseKMSKeyID: "key"}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	if err := ioutil.WriteFile(mnt+"/small", []byte("abc"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(mnt+"/large", []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Mkdir(mnt+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.Symlink("small", mnt+"/link"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if err := os.Rename(mnt+"/old", mnt+"/renamed"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	for _, key := range []string{"small", "large", "dir/", "link", "renamed"} {
+		if sse, kmsKeyID := fake.encryption(key); sse != s3.ServerSideEncryptionAwsKms || kmsKeyID != "key" {
+			t.Errorf("%v: got encryption %q with key %q, want %q with key %q", key, sse, kmsKeyID, s3.ServerSideEncryptionAwsKms, "key")
+		}
+	}
+
+	if got, err := getxattr(t, mnt+"/small", xattrSSE); err != nil || got != s3.ServerSideEncryptionAwsKms {
+		t.Errorf("Getxattr: got %q, %v, want %q", got, err, s3.ServerSideEncryptionAwsKms)
+	}
+	if err := unix.Setxattr(mnt+"/small", xattrSSE, []byte(s3.ServerSideEncryptionAes256), 0); err != syscall.EPERM {
+		t.Errorf("Setxattr: got %v, want EPERM", err)
+	}
+}
+
+func TestSSEKeptOnMetadataChange(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putEncrypted("a", "hello", s3.ServerSideEncryptionAes256)
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	if err := unix.Setxattr(mnt+"/a", xattrMetaPrefix+"color", []byte("red"), 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if sse, _ := fake.encryption("a"); sse != s3.ServerSideEncryptionAes256 {
+		t.Errorf("got encryption %q, want %q", sse, s3.ServerSideEncryptionAes256)
+	}
+	if got, err := getxattr(t, mnt+"/a", xattrSSE); err != nil || got != s3.ServerSideEncryptionAes256 {
+		t.Errorf("Getxattr: got %q, %v, want %q", got, err, s3.ServerSideEncryptionAes256)
+	}
+}
+
+func TestSSERequired(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.requireSSE = true
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	f, err := os.Create(mnt + "/a")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); !os.IsPermission(err) {
+		t.Errorf("Close: got %v, want EACCES", err)
+	}
+	if _, ok := fake.get("a"); ok {
+		t.Errorf("unencrypted object was stored")
+	}
+}
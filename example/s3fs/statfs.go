@@ -0,0 +1,80 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// statfsBlockSize is the block size the usage of the bucket is reported in.
+	statfsBlockSize = 4096
+
+	// statfsFree is the number of free blocks and inodes reported, as buckets have no capacity limit.
+	statfsFree = 1 << 40
+
+	// maxKeyLen is the longest key s3 accepts, in bytes.
+	maxKeyLen = 1024
+)
+
+var _ = (fs.NodeStatfser)((*s3Bucket)(nil))
+var _ = (fs.NodeStatfser)((*s3Dir)(nil))
+
+// Statfs reports the number and total size of the objects in the directories listed so far. It never queries s3, so
+// the numbers are only as recent as the last listing or refresh.
+func (b *s3Bucket) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	objects, bytes := b.usage()
+	fillStatfs(out, objects, bytes)
+	return 0
+}
+
+// usage returns the number and total size of the objects in the directories listed so far.
+func (b *s3Bucket) usage() (objects, bytes uint64) {
+	b.walk(func(d *s3Dir) {
+		n, size := d.usage()
+		objects += n
+		bytes += size
+	})
+	return objects, bytes
+}
+
+// fillStatfs reports a filesystem holding 'objects' totalling 'bytes', with an unbounded amount of free space.
+func fillStatfs(out *fuse.StatfsOut, objects, bytes uint64) {
+	used := (bytes + statfsBlockSize - 1) / statfsBlockSize
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.Blocks = used + statfsFree
+	out.Bfree = statfsFree
+	out.Bavail = statfsFree
+	out.Files = objects + statfsFree
+	out.Ffree = statfsFree
+	out.NameLen = maxKeyLen
+}
+
+// Statfs reports the usage of the whole bucket, as all directories live on the same filesystem.
+func (d *s3Dir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return d.bucket.Statfs(ctx, out)
+}
+
+// usage returns the number and total size of the files in the last listing of the directory.
+func (d *s3Dir) usage() (objects, bytes uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listing == nil {
+		return 0, 0
+	}
+	for _, obj := range d.listing.files {
+		objects++
+		if obj.Size != nil {
+			bytes += uint64(*obj.Size)
+		}
+	}
+	return objects, bytes
+}
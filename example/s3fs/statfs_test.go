@@ -0,0 +1,60 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStatfs(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", strings.Repeat("x", 5000))
+	fake.put("dir/b", "hello")
+
+	bucket := newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	readDirNames(t, mnt)
+	readDirNames(t, mnt+"/dir")
+
+	statfs := func(path string) syscall.Statfs_t {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			t.Fatalf("Statfs(%q): %v", path, err)
+		}
+		return st
+	}
+
+	listings := fake.count("ListObjects")
+	st := statfs(mnt)
+	if got := st.Blocks - st.Bfree; got != 2 {
+		t.Errorf("got %d used blocks, want 2", got)
+	}
+	if got := st.Files - st.Ffree; got != 2 {
+		t.Errorf("got %d objects, want 2", got)
+	}
+	if sub := statfs(mnt + "/dir"); sub.Blocks != st.Blocks || sub.Files != st.Files {
+		t.Errorf("Statfs of a subdirectory differs from the root: %+v, %+v", sub, st)
+	}
+	if got := fake.count("ListObjects"); got != listings {
+		t.Errorf("Statfs listed the bucket: got %d ListObjects calls, want %d", got, listings)
+	}
+
+	fake.put("dir/c", strings.Repeat("x", 10000))
+	bucket.refresh(context.Background())
+	st = statfs(mnt)
+	if got := st.Blocks - st.Bfree; got != 4 {
+		t.Errorf("after refresh: got %d used blocks, want 4", got)
+	}
+	if got := st.Files - st.Ffree; got != 3 {
+		t.Errorf("after refresh: got %d objects, want 3", got)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	sparseKey  = "big"
+	sparseSize = 10 << 30
+	sparseETag = `"0123456789abcdef0123456789abcdef-1280"`
+)
+
+// sparseByte is the byte at 'off' in the sparse object.
+func sparseByte(off int64) byte {
+	return byte(off>>20) ^ byte(off)
+}
+
+// sparseS3 serves the single object sparseKey of sparseSize bytes, generated as it is downloaded, and records the
+// ranges requested.
+type sparseS3 struct {
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (f *sparseS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+testBucket)
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && (path == "" || path == "/") && query.Get("list-type") == "2":
+		out := fakeListing{Name: testBucket, Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter")}
+		if strings.HasPrefix(sparseKey, out.Prefix) {
+			out.KeyCount = 1
+			out.Contents = []fakeListingEntry{{
+				Key:          sparseKey,
+				LastModified: time.Unix(1500000000, 0).UTC().Format(time.RFC3339),
+				ETag:         sparseETag,
+				Size:         sparseSize,
+				StorageClass: "STANDARD",
+			}}
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(&out)
+	case r.Method == http.MethodHead && path == "/"+sparseKey:
+		w.Header().Set("ETag", sparseETag)
+		w.Header().Set("Content-Length", fmt.Sprint(int64(sparseSize)))
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodGet && path == "/"+sparseKey:
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || start > end || end >= sparseSize {
+			http.Error(w, "only ranges are served", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		f.mu.Lock()
+		f.ranges = append(f.ranges, [2]int64{start, end + 1})
+		f.mu.Unlock()
+		w.Header().Set("ETag", sparseETag)
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, int64(sparseSize)))
+		w.WriteHeader(http.StatusPartialContent)
+		buf := make([]byte, 64<<10)
+		for off := start; off <= end; {
+			chunk := buf[:min64(int64(len(buf)), end+1-off)]
+			for i := range chunk {
+				chunk[i] = sparseByte(off + int64(i))
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			off += int64(len(chunk))
+		}
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// peakHeap samples the heap in use until the returned func is called, which returns the largest size seen.
+func peakHeap() func() uint64 {
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		var st runtime.MemStats
+		for {
+			runtime.ReadMemStats(&st)
+			if st.HeapAlloc > max {
+				max = st.HeapAlloc
+			}
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		return <-peak
+	}
+}
+
+func TestReadLargeObject(t *testing.T) {
+	fake := &sparseS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	const blockSize = 1 << 20
+	blocks := newBlockCache(blockSize, 8<<20)
+	bucket := newS3Bucket(testBackend(t, server.URL), testBucket, bucketOptions{cacheTTL: time.Hour, blocks: blocks})
+	mnt, clean := testMount(t, bucket)
+	defer clean()
+
+	f, err := os.Open(mnt + "/" + sparseKey)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || st.Size() != sparseSize {
+		t.Fatalf("Stat: got %v, %v, want size %d", st, err, int64(sparseSize))
+	}
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	peak := peakHeap()
+
+	// Read sequentially from the start, and then around the middle and the end.
+	buf := make([]byte, 1<<20)
+	check := func(off int64, n int) {
+		for i, c := range buf[:n] {
+			if want := sparseByte(off + int64(i)); c != want {
+				t.Fatalf("byte at %d: got %d, want %d", off+int64(i), c, want)
+			}
+		}
+	}
+	var off int64
+	for off < 32<<20 {
+		n, err := io.ReadFull(f, buf)
+		if err != nil {
+			t.Fatalf("Read at %d: %v", off, err)
+		}
+		check(off, n)
+		off += int64(n)
+	}
+	for _, off := range []int64{sparseSize / 2, sparseSize - 3<<20} {
+		n, err := f.ReadAt(buf, off)
+		if err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		check(off, n)
+	}
+	if n, err := f.ReadAt(buf, sparseSize-100); err != io.EOF || n != 100 {
+		t.Fatalf("ReadAt at the end: got %d, %v, want 100 bytes and EOF", n, err)
+	}
+	check(sparseSize-100, 100)
+
+	// The cache holds 8 MiB, and reads are at most 1 MiB.
+	if grown := int64(peak()) - int64(before.HeapAlloc); grown > 48<<20 {
+		t.Errorf("heap grew by %d MiB while reading", grown>>20)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, r := range fake.ranges {
+		if r[0]%blockSize != 0 || r[1]-r[0] > blockSize || r[1] != sparseSize && r[1]%blockSize != 0 {
+			t.Errorf("downloaded [%d, %d), want single aligned blocks", r[0], r[1])
+		}
+	}
+}
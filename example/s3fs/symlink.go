@@ -0,0 +1,212 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// metaMode is the user metadata holding the file mode of an object, as stored by s3fs-fuse: a decimal number.
+	metaMode = "mode"
+
+	// maxLinkLen is the largest body of an object presented as a symlink. Larger objects are presented as files,
+	// whatever their mode.
+	maxLinkLen = 4096
+)
+
+var _ = (fs.NodeSymlinker)((*s3Dir)(nil))
+
+// s3Symlink is an object holding the target of a symlink.
+type s3Symlink struct {
+	fs.Inode
+
+	bucket  *s3Bucket
+	content *s3.Object
+
+	mu     sync.Mutex
+	target []byte
+}
+
+var _ = (fs.NodeGetattrer)((*s3Symlink)(nil))
+var _ = (fs.NodeReadlinker)((*s3Symlink)(nil))
+
+// update records the metadata of the object as of a listing, dropping the target unless it is known to be the same.
+func (l *s3Symlink) update(content *s3.Object, target []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if target == nil && aws.StringValue(content.ETag) == aws.StringValue(l.content.ETag) {
+		target = l.target
+	}
+	l.content, l.target = content, target
+}
+
+func (l *s3Symlink) fillAttr(out *fuse.Attr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out.Mode = fuse.S_IFLNK | 0777 // lrwxrwxrwx
+	out.Nlink = 1
+	out.Mtime = uint64(aws.TimeValue(l.content.LastModified).Unix())
+	out.Size = uint64(aws.Int64Value(l.content.Size))
+}
+
+func (l *s3Symlink) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	l.fillAttr(&out.Attr)
+	return 0
+}
+
+// Readlink returns the body of the object, which is downloaded on first use.
+func (l *s3Symlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	ctx, cancel := l.bucket.withTimeout(ctx)
+	defer cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.target != nil {
+		return l.target, 0
+	}
+	out, err := l.bucket.backend.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:  &l.bucket.name,
+		Key:     l.content.Key,
+		IfMatch: l.content.ETag,
+	})
+	if err != nil {
+		log.Printf("failed to read symlink '%v' in s3 bucket '%v': %v", *l.content.Key, l.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	defer out.Body.Close()
+
+	target, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		log.Printf("failed to read symlink '%v' in s3 bucket '%v': %v", *l.content.Key, l.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	l.target = target
+	return target, 0
+}
+
+// metaProbe records what the metadata of a version of an object tells: whether it is a symlink, and the modification
+// time stored with it, if any.
+type metaProbe struct {
+	etag  string
+	link  bool
+	mtime time.Time
+}
+
+// probe queries the metadata of the child 'obj', unless it is too large to be a symlink and modification times are not
+// preserved. The outcome is remembered for as long as the object keeps its ETag.
+func (d *s3Dir) probe(ctx context.Context, name string, obj *s3.Object) (metaProbe, error) {
+	if aws.Int64Value(obj.Size) > maxLinkLen && !d.bucket.opts.preserveTimes {
+		return metaProbe{}, nil
+	}
+	etag := aws.StringValue(obj.ETag)
+	d.mu.Lock()
+	p, ok := d.probes[name]
+	d.mu.Unlock()
+	if ok && p.etag == etag {
+		return p, nil
+	}
+
+	head, err := d.bucket.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &d.bucket.name,
+		Key:    obj.Key,
+	})
+	if err != nil {
+		return metaProbe{}, err
+	}
+	p = probeOf(head)
+	d.probed(name, p)
+	return p, nil
+}
+
+// probeOf returns what the headers of an object tell about it.
+func probeOf(head *s3.HeadObjectOutput) metaProbe {
+	return metaProbe{
+		etag:  aws.StringValue(head.ETag),
+		link:  aws.Int64Value(head.ContentLength) <= maxLinkLen && isLinkMeta(head.Metadata),
+		mtime: mtimeMeta(head.Metadata),
+	}
+}
+
+// isLinkMeta tells whether the user metadata 'meta' has the mode of a symlink.
+func isLinkMeta(meta map[string]*string) bool {
+	for k, v := range meta {
+		if strings.EqualFold(k, metaMode) {
+			mode, err := strconv.ParseUint(aws.StringValue(v), 10, 32)
+			return err == nil && mode&syscall.S_IFMT == syscall.S_IFLNK
+		}
+	}
+	return false
+}
+
+func (d *s3Dir) probed(name string, p metaProbe) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.probes == nil {
+		d.probes = map[string]metaProbe{}
+	}
+	d.probes[name] = p
+}
+
+// knownLink tells whether the child 'obj' is known to be a symlink, without querying s3.
+func (d *s3Dir) knownLink(name string, obj *s3.Object) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.probes[name]
+	return ok && p.link && p.etag == aws.StringValue(obj.ETag)
+}
+
+// Symlink stores an object with 'target' as its body, and the mode of a symlink, like s3fs-fuse does.
+func (d *s3Dir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if d.bucket.opts.readOnly {
+		return nil, syscall.EROFS
+	}
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	if len(target) > maxLinkLen {
+		return nil, syscall.ENAMETOOLONG
+	}
+
+	key := d.prefix + name
+	sse, kmsKeyID := d.bucket.encryption()
+	res, err := d.bucket.backend.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               &d.bucket.name,
+		Key:                  &key,
+		Body:                 strings.NewReader(target),
+		Metadata:             map[string]*string{metaMode: aws.String(strconv.Itoa(syscall.S_IFLNK | 0777))},
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		log.Printf("failed to create symlink '%v' in s3 bucket '%v': %v", key, d.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	content := &s3.Object{
+		Key:          &key,
+		Size:         aws.Int64(int64(len(target))),
+		LastModified: aws.Time(time.Now()),
+		ETag:         res.ETag,
+		StorageClass: aws.String(s3.StorageClassStandard),
+	}
+	d.stored(name, nil, content)
+	d.probed(name, metaProbe{etag: aws.StringValue(res.ETag), link: true})
+
+	ch, child := d.newSymlinkInode(ctx, name, content, []byte(target))
+	child.fillAttr(&out.Attr)
+	return ch, 0
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSymlink(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	linkMode := strconv.Itoa(syscall.S_IFLNK | 0777)
+	fake.putMeta("link", "target/path", map[string]string{metaMode: linkMode})
+	fake.putMeta("big", strings.Repeat("x", maxLinkLen+1), map[string]string{metaMode: linkMode})
+	fake.put("file", "content")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, partSize: 1024}))
+	defer clean()
+
+	if got, err := os.Readlink(filepath.Join(mnt, "link")); err != nil {
+		t.Fatalf("Readlink: %v", err)
+	} else if want := "target/path"; got != want {
+		t.Errorf("got target %q, want %q", got, want)
+	}
+	for name, wantLink := range map[string]bool{"link": true, "big": false, "file": false} {
+		st, err := os.Lstat(filepath.Join(mnt, name))
+		if err != nil {
+			t.Fatalf("Lstat(%v): %v", name, err)
+		}
+		if got := st.Mode()&os.ModeSymlink != 0; got != wantLink {
+			t.Errorf("%v: got symlink %v, want %v", name, got, wantLink)
+		}
+	}
+
+	if err := os.Symlink("../other", filepath.Join(mnt, "new")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if got, ok := fake.get("new"); !ok || got != "../other" {
+		t.Errorf("got object %q (%v), want %q", got, ok, "../other")
+	}
+	if got := fake.meta("new")[metaMode]; got != linkMode {
+		t.Errorf("got mode %q, want %q", got, linkMode)
+	}
+	if got, err := os.Readlink(filepath.Join(mnt, "new")); err != nil || got != "../other" {
+		t.Errorf("got target %q (%v), want %q", got, err, "../other")
+	}
+}
+
+func TestSymlinkReadOnly(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, readOnly: true}))
+	defer clean()
+
+	if err := os.Symlink("target", filepath.Join(mnt, "link")); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("got %v, want EROFS", err)
+	}
+	if _, ok := fake.get("link"); ok {
+		t.Error("symlink was stored")
+	}
+}
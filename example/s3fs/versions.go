@@ -0,0 +1,271 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// versionsDirName is the hidden directory of the root exposing past versions of objects.
+const versionsDirName = ".versions"
+
+// s3VersionsDir mirrors the directory 'prefix' in the versions tree, where every object is presented as a directory
+// holding its versions. It is only ever created on lookup, so buckets whose versions are not browsed never list them.
+type s3VersionsDir struct {
+	fs.Inode
+
+	bucket *s3Bucket
+	prefix string
+
+	mu       sync.Mutex
+	listing  *versionsListing
+	listedAt time.Time
+}
+
+var _ = (fs.NodeGetattrer)((*s3VersionsDir)(nil))
+var _ = (fs.NodeLookuper)((*s3VersionsDir)(nil))
+var _ = (fs.NodeReaddirer)((*s3VersionsDir)(nil))
+
+// versionsListing is the content of a directory in the versions tree.
+type versionsListing struct {
+	dirs map[string]bool
+
+	// objects holds the versions of every object in the directory, newest first, omitting delete markers.
+	objects map[string][]*s3.ObjectVersion
+}
+
+func newVersionsDir(b *s3Bucket, prefix string) *s3VersionsDir {
+	return &s3VersionsDir{bucket: b, prefix: prefix}
+}
+
+// list returns the versions under the prefix, reusing the last listing for 'cacheTTL'.
+func (d *s3VersionsDir) list(ctx context.Context) (*versionsListing, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listing != nil && time.Since(d.listedAt) < d.bucket.opts.cacheTTL {
+		return d.listing, nil
+	}
+
+	listing := &versionsListing{
+		dirs:    map[string]bool{},
+		objects: map[string][]*s3.ObjectVersion{},
+	}
+	in := &s3.ListObjectVersionsInput{
+		Bucket:    &d.bucket.name,
+		Prefix:    &d.prefix,
+		Delimiter: aws.String(delimiter),
+	}
+	if d.bucket.opts.maxKeys > 0 {
+		in.MaxKeys = aws.Int64(d.bucket.opts.maxKeys)
+	}
+	for {
+		out, err := d.bucket.backend.ListObjectVersionsWithContext(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range out.Versions {
+			if name := strings.TrimPrefix(*v.Key, d.prefix); name != "" {
+				listing.objects[name] = append(listing.objects[name], v)
+			}
+		}
+		for _, p := range out.CommonPrefixes {
+			if name := strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, d.prefix), delimiter); name != "" {
+				listing.dirs[name] = true
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			break
+		}
+		if out.NextKeyMarker == nil {
+			return nil, fmt.Errorf("truncated listing of versions of '%v' without a marker", d.prefix)
+		}
+		in.KeyMarker, in.VersionIdMarker = out.NextKeyMarker, out.NextVersionIdMarker
+	}
+	// Like in the current tree, a key that is also a prefix is presented as a directory.
+	for name := range listing.dirs {
+		delete(listing.objects, name)
+	}
+
+	d.listing, d.listedAt = listing, time.Now()
+	return listing, nil
+}
+
+func (d *s3VersionsDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555 // dr-xr-xr-x
+	return 0
+}
+
+// Readdir lists the subdirectories and the objects with at least one version that is not a delete marker.
+func (d *s3VersionsDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	listing, err := d.list(ctx)
+	if err != nil {
+		log.Printf("failed to list versions of '%v' in s3 bucket '%v': %v", d.prefix, d.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(listing.dirs)+len(listing.objects))
+	for name := range listing.dirs {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	for name := range listing.objects {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Lookup resolves 'name' to either a subdirectory, or the directory of versions of an object.
+func (d *s3VersionsDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, cancel := d.bucket.withTimeout(ctx)
+	defer cancel()
+	listing, err := d.list(ctx)
+	if err != nil {
+		log.Printf("failed to list versions of '%v' in s3 bucket '%v': %v", d.prefix, d.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+
+	out.Mode = 0555
+	switch {
+	case listing.dirs[name]:
+		if ch := d.GetChild(name); ch != nil {
+			if _, ok := ch.Operations().(*s3VersionsDir); ok {
+				return ch, 0
+			}
+		}
+		prefix := d.prefix + name + delimiter
+		return d.NewInode(ctx, newVersionsDir(d.bucket, prefix), d.bucket.inos.stableAttr(fuse.S_IFDIR, inoVersions, prefix)), 0
+	case len(listing.objects[name]) > 0:
+		child := &s3VersionList{dir: d, name: name}
+		return d.NewInode(ctx, child, d.bucket.inos.stableAttr(fuse.S_IFDIR, inoHistory, d.prefix+name)), 0
+	default:
+		return nil, syscall.ENOENT
+	}
+}
+
+// s3VersionList is the directory of versions of the object 'name', named after their version IDs.
+type s3VersionList struct {
+	fs.Inode
+
+	dir  *s3VersionsDir
+	name string
+}
+
+var _ = (fs.NodeGetattrer)((*s3VersionList)(nil))
+var _ = (fs.NodeLookuper)((*s3VersionList)(nil))
+var _ = (fs.NodeReaddirer)((*s3VersionList)(nil))
+
+// versions returns the versions of the object, as of the listing of its directory.
+func (l *s3VersionList) versions(ctx context.Context) ([]*s3.ObjectVersion, syscall.Errno) {
+	b := l.dir.bucket
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	listing, err := l.dir.list(ctx)
+	if err != nil {
+		log.Printf("failed to list versions of '%v%v' in s3 bucket '%v': %v", l.dir.prefix, l.name, b.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	return listing.objects[l.name], 0
+}
+
+func (l *s3VersionList) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555 // dr-xr-xr-x
+	return 0
+}
+
+func (l *s3VersionList) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	versions, errno := l.versions(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	entries := make([]fuse.DirEntry, 0, len(versions))
+	for _, v := range versions {
+		entries = append(entries, fuse.DirEntry{Name: aws.StringValue(v.VersionId), Mode: fuse.S_IFREG})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (l *s3VersionList) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	versions, errno := l.versions(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	for _, v := range versions {
+		if aws.StringValue(v.VersionId) == name {
+			child := &s3Version{bucket: l.dir.bucket, content: v}
+			child.fillAttr(&out.Attr)
+			return l.NewInode(ctx, child, l.dir.bucket.inos.stableAttr(fuse.S_IFREG, inoVersion, name+delimiter+*v.Key)), 0
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+// s3Version is a read-only file exposing a past version of an object.
+type s3Version struct {
+	fs.Inode
+
+	bucket  *s3Bucket
+	content *s3.ObjectVersion
+}
+
+var _ = (fs.NodeGetattrer)((*s3Version)(nil))
+var _ = (fs.NodeOpener)((*s3Version)(nil))
+
+func (v *s3Version) fillAttr(out *fuse.Attr) {
+	out.Mode = 0444 // -r--r--r--
+	out.Nlink = 1
+	out.Mtime = uint64(aws.TimeValue(v.content.LastModified).Unix())
+	out.Size = uint64(aws.Int64Value(v.content.Size))
+}
+
+func (v *s3Version) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	v.fillAttr(&out.Attr)
+	return 0
+}
+
+// Open hands out a handle for reading the version. Versions are immutable, so they cannot be opened for writing.
+func (v *s3Version) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return &s3VersionHandle{bucket: v.bucket, v: version{
+		key:       *v.content.Key,
+		size:      aws.Int64Value(v.content.Size),
+		etag:      aws.StringValue(v.content.ETag),
+		versionID: aws.StringValue(v.content.VersionId),
+	}}, 0, 0
+}
+
+// s3VersionHandle is a version opened for reading.
+type s3VersionHandle struct {
+	bucket *s3Bucket
+	v      version
+}
+
+var _ = (fs.FileReader)((*s3VersionHandle)(nil))
+
+func (h *s3VersionHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	ctx, cancel := h.bucket.withTimeout(ctx)
+	defer cancel()
+	n, err := h.bucket.read(ctx, h.v, dest, off)
+	if err != nil {
+		log.Printf("failed to read version '%v' of object '%v' in s3 bucket '%v': %v", h.v.versionID, h.v.key, h.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.enableVersioning()
+	fake.put("docs/x", "first")
+	fake.put("docs/x", "second")
+	fake.put("y", "only")
+	fake.put("gone", "deleted")
+	fake.delete("gone")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, maxKeys: 2, showVersions: true}))
+	defer clean()
+
+	if got, want := readDirNames(t, mnt), []string{"docs", "y"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := fake.count("ListObjectVersions"); got != 0 {
+		t.Errorf("got %d ListObjectVersions calls before browsing versions, want 0", got)
+	}
+
+	if got, want := readDirNames(t, mnt+"/.versions"), []string{"docs", "gone", "y"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/.versions/docs/x"), []string{"v1", "v2"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mnt+"/.versions/gone"), []string{"v1"}; !equalStrings(got, want) {
+		t.Errorf("delete markers: got %v, want %v", got, want)
+	}
+	for path, want := range map[string]string{
+		"/.versions/docs/x/v1": "first",
+		"/.versions/docs/x/v2": "second",
+		"/.versions/gone/v1":   "deleted",
+	} {
+		if got, err := ioutil.ReadFile(mnt + path); err != nil || string(got) != want {
+			t.Errorf("ReadFile(%v): got %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.OpenFile(mnt+"/.versions/docs/x/v1", os.O_WRONLY, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("OpenFile(O_WRONLY): got %v, want EROFS", err)
+	}
+}
+
+func TestVersionsDisabled(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.enableVersioning()
+	fake.put("x", "hello")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/.versions", &st); err != syscall.ENOENT {
+		t.Errorf("Stat(.versions): got %v, want ENOENT", err)
+	}
+	if got := fake.count("ListObjectVersions"); got != 0 {
+		t.Errorf("got %d ListObjectVersions calls, want 0", got)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// minPartSize is the smallest size s3 accepts for all but the last part of a multipart upload.
+const minPartSize = 5 << 20
+
+// s3Writer is an object opened for writing. S3 can only replace objects as a whole, so writes, at any offset, go to a
+// spool file in 'spoolDir', which is uploaded on Flush: in a multipart upload of 'partSize' chunks, or with a plain
+// PutObject for objects smaller than a single part.
+type s3Writer struct {
+	obj *s3Object
+
+	mu sync.Mutex
+
+	// empty is set when the handle starts out from an empty file rather than from the content of the object, i.e.
+	// when it created the object, or truncated it to zero before anything else.
+	empty bool
+
+	// spool holds the content of the file as written through the handle. It is only created on first use, and
+	// filled with the content of the object unless 'empty' is set.
+	spool *os.File
+
+	// size is the size of the spooled content.
+	size int64
+
+	// dirty is set when the spooled content differs from what was last stored.
+	dirty bool
+
+	// mtime is the modification time to store along with the spooled content, if one was set since it was last
+	// written to.
+	mtime time.Time
+
+	// contentType is the content type to store the content with, if one was set through xattrContentType, rather
+	// than the one detected on upload.
+	contentType string
+}
+
+var _ = (fs.FileReader)((*s3Writer)(nil))
+var _ = (fs.FileWriter)((*s3Writer)(nil))
+var _ = (fs.FileFlusher)((*s3Writer)(nil))
+var _ = (fs.FileReleaser)((*s3Writer)(nil))
+
+func newS3Writer(obj *s3Object, created bool) *s3Writer {
+	// A created file is stored on Flush even if nothing is written to it.
+	w := &s3Writer{obj: obj, empty: created, dirty: created}
+	obj.opened(w)
+	return w
+}
+
+func (w *s3Writer) bucket() *s3Bucket {
+	return w.obj.bucket
+}
+
+func (w *s3Writer) key() string {
+	return w.obj.key()
+}
+
+// load creates the spool file, if not done yet. Unless 'empty' is set, that means downloading the content of the
+// object, which is only supported up to 'maxTruncateSize' to avoid surprise downloads of large objects.
+func (w *s3Writer) load(ctx context.Context) syscall.Errno {
+	if w.spool != nil {
+		return 0
+	}
+	var data []byte
+	if v := w.obj.version(); !w.empty && v.size > 0 {
+		if v.size > w.bucket().opts.maxTruncateSize {
+			return syscall.ENOTSUP
+		}
+		data = make([]byte, v.size)
+		if _, err := w.bucket().download(ctx, v, data, 0); err != nil {
+			log.Printf("failed to read object '%v' in s3 bucket '%v' to modify it: %v", w.key(), w.bucket().name, err)
+			return toErrno(ctx, err)
+		}
+	}
+
+	spool, err := ioutil.TempFile(w.bucket().opts.spoolDir, "s3fs-")
+	if err != nil {
+		log.Printf("failed to create spool file for object '%v': %v", w.key(), err)
+		return syscall.EIO
+	}
+	if _, err := spool.Write(data); err != nil {
+		log.Printf("failed to spool object '%v': %v", w.key(), err)
+		spool.Close()
+		os.Remove(spool.Name())
+		return syscall.EIO
+	}
+	w.spool, w.size = spool, int64(len(data))
+	return 0
+}
+
+// truncate changes the size of the spooled content, which is stored on Flush.
+func (w *s3Writer) truncate(ctx context.Context, size int64) syscall.Errno {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if size == 0 && w.spool == nil {
+		// There is no need to download what is dropped anyway.
+		w.empty = true
+	}
+	if errno := w.load(ctx); errno != 0 {
+		return errno
+	}
+	if err := w.spool.Truncate(size); err != nil {
+		log.Printf("failed to truncate spool file of object '%v': %v", w.key(), err)
+		return syscall.EIO
+	}
+	w.size = size
+	w.dirty = true
+	w.mtime = time.Time{}
+	return 0
+}
+
+// spooledSize returns the size of the file as written through the handle, if anything was.
+func (w *s3Writer) spooledSize() (int64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size, w.spool != nil
+}
+
+// Read returns the spooled content, including what is not stored yet, or the content of the object if nothing was
+// written through the handle.
+func (w *s3Writer) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	ctx, cancel := w.bucket().withTimeout(ctx)
+	defer cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.spool == nil {
+		if w.empty {
+			return fuse.ReadResultData(nil), 0
+		}
+		n, err := w.bucket().read(ctx, w.obj.version(), dest, off)
+		if err != nil {
+			log.Printf("failed to read object '%v' in s3 bucket '%v': %v", w.key(), w.bucket().name, err)
+			return nil, toErrno(ctx, err)
+		}
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+
+	n, err := w.spool.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Printf("failed to read spool file of object '%v': %v", w.key(), err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// Write stores 'data' at 'off' in the spool file.
+func (w *s3Writer) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if w.bucket().opts.readOnly {
+		return 0, syscall.EROFS
+	}
+	ctx, cancel := w.bucket().withTimeout(ctx)
+	defer cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if errno := w.load(ctx); errno != 0 {
+		return 0, errno
+	}
+	n, err := w.spool.WriteAt(data, off)
+	if err != nil {
+		log.Printf("failed to write spool file of object '%v': %v", w.key(), err)
+		return uint32(n), syscall.EIO
+	}
+	if end := off + int64(n); end > w.size {
+		w.size = end
+	}
+	w.dirty = true
+	w.mtime = time.Time{}
+	return uint32(n), 0
+}
+
+// setMtime sets the modification time to store along with the spooled content, if there is any to store, and reports
+// whether it did.
+func (w *s3Writer) setMtime(t time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return false
+	}
+	w.mtime = t
+	return true
+}
+
+// metadata returns the user metadata to store along with the spooled content.
+func (w *s3Writer) metadata() map[string]*string {
+	if w.mtime.IsZero() {
+		return nil
+	}
+	return map[string]*string{metaMtime: aws.String(formatMtime(w.mtime))}
+}
+
+// upload stores the spooled content, either with a single PutObject or, if it is larger than a part, with a multipart
+// upload, which is aborted on failure. A 'partSize' of 0 always stores the content with a single PutObject.
+func (w *s3Writer) upload(ctx context.Context) (etag *string, err error) {
+	b := w.bucket()
+	key := w.key()
+	var src io.ReaderAt = bytes.NewReader(nil)
+	if w.spool != nil {
+		src = w.spool
+	}
+	sse, kmsKeyID := b.encryption()
+	contentType := aws.String(w.detectContentType(src))
+
+	if partSize := b.opts.partSize; partSize == 0 || w.size <= partSize {
+		out, err := b.backend.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:               &b.name,
+			Key:                  &key,
+			Body:                 io.NewSectionReader(src, 0, w.size),
+			ContentType:          contentType,
+			Metadata:             w.metadata(),
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          kmsKeyID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ETag, nil
+	}
+
+	created, err := b.backend.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               &b.name,
+		Key:                  &key,
+		ContentType:          contentType,
+		Metadata:             w.metadata(),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	etag, err = w.uploadParts(ctx, src, created.UploadId)
+	if err != nil {
+		if _, abortErr := b.backend.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &b.name,
+			Key:      &key,
+			UploadId: created.UploadId,
+		}); abortErr != nil {
+			log.Printf("failed to abort upload of object '%v' to s3 bucket '%v': %v", key, b.name, abortErr)
+		}
+		return nil, err
+	}
+	return etag, nil
+}
+
+// uploadParts uploads 'src' in parts of the multipart upload 'uploadID', and completes it.
+func (w *s3Writer) uploadParts(ctx context.Context, src io.ReaderAt, uploadID *string) (etag *string, err error) {
+	b := w.bucket()
+	key := w.key()
+	var parts []*s3.CompletedPart
+	for off := int64(0); off < w.size; off += b.opts.partSize {
+		num := aws.Int64(int64(len(parts) + 1))
+		out, err := b.backend.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     &b.name,
+			Key:        &key,
+			UploadId:   uploadID,
+			PartNumber: num,
+			Body:       io.NewSectionReader(src, off, min64(b.opts.partSize, w.size-off)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: num})
+	}
+
+	out, err := b.backend.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &b.name,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.ETag, nil
+}
+
+// Flush stores the spooled content in s3 if it changed since it was last stored, and reports the outcome, so that
+// e.g. 'cp' fails if the upload does.
+func (w *s3Writer) Flush(ctx context.Context) syscall.Errno {
+	ctx, cancel := w.bucket().withTimeout(ctx)
+	defer cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return 0
+	}
+	etag, err := w.upload(ctx)
+	if err != nil {
+		log.Printf("failed to store object '%v' in s3 bucket '%v': %v", w.key(), w.bucket().name, err)
+		return toErrno(ctx, err)
+	}
+	w.dirty = false
+	w.obj.stored(&s3.Object{
+		Key:          aws.String(w.key()),
+		Size:         aws.Int64(w.size),
+		LastModified: aws.Time(time.Now()),
+		ETag:         etag,
+		StorageClass: aws.String(s3.StorageClassStandard),
+	})
+	dir, name := w.obj.location()
+	dir.probed(name, metaProbe{etag: aws.StringValue(etag), mtime: w.mtime})
+	return 0
+}
+
+// Release deletes the spool file, whether or not its content was stored.
+func (w *s3Writer) Release(ctx context.Context) syscall.Errno {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.obj.released(w)
+	w.dropSpool()
+	return 0
+}
+
+// dropSpool deletes the spool file, if there is one.
+func (w *s3Writer) dropSpool() {
+	if w.spool == nil {
+		return
+	}
+	w.spool.Close()
+	if err := os.Remove(w.spool.Name()); err != nil {
+		log.Printf("failed to remove spool file of object '%v': %v", w.key(), err)
+	}
+	w.spool, w.size = nil, 0
+}
@@ -0,0 +1,263 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testWriteOptions() bucketOptions {
+	return bucketOptions{cacheTTL: time.Hour, partSize: 4}
+}
+
+func TestWriteSmall(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour, partSize: 1024}))
+	defer clean()
+
+	if err := ioutil.WriteFile(mnt+"/dir/new.txt", []byte("x"), 0644); err == nil {
+		t.Errorf("WriteFile in missing dir succeeded")
+	}
+	if err := ioutil.WriteFile(mnt+"/new.txt", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, ok := fake.get("new.txt"); !ok || got != "hello" {
+		t.Errorf("got %q, %v, want %q", got, ok, "hello")
+	}
+	if got := fake.count("PutObject"); got != 1 {
+		t.Errorf("got %d PutObject calls, want 1", got)
+	}
+	if got := fake.count("CreateMultipartUpload"); got != 0 {
+		t.Errorf("got %d CreateMultipartUpload calls, want 0", got)
+	}
+
+	if got, want := readDirNames(t, mnt), []string{"new.txt"}; !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/new.txt"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestWriteMultipart(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, testWriteOptions()))
+	defer clean()
+
+	want := "0123456789"
+	if err := ioutil.WriteFile(mnt+"/big", []byte(want), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, ok := fake.get("big"); !ok || got != want {
+		t.Errorf("got %q, %v, want %q", got, ok, want)
+	}
+	if got := fake.count("UploadPart"); got != 3 {
+		t.Errorf("got %d UploadPart calls, want 3", got)
+	}
+	if got := fake.count("PutObject"); got != 0 {
+		t.Errorf("got %d PutObject calls, want 0", got)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/big", &st); err != nil {
+		t.Errorf("Stat: %v", err)
+	} else if st.Size != int64(len(want)) {
+		t.Errorf("got size %d, want %d", st.Size, len(want))
+	}
+}
+
+func TestWriteOverwrite(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "old content")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, testWriteOptions()))
+	defer clean()
+
+	if err := ioutil.WriteFile(mnt+"/file", []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, _ := fake.get("file"); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+
+	// Modifying parts of an object would require rewriting it.
+	f, err := os.OpenFile(mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("N")); !errors.Is(err, syscall.ENOTSUP) {
+		t.Errorf("Write without truncation: got %v, want ENOTSUP", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := os.OpenFile(mnt+"/file", os.O_WRONLY|os.O_APPEND, 0); !errors.Is(err, syscall.ENOTSUP) {
+		t.Errorf("OpenFile(O_APPEND): got %v, want ENOTSUP", err)
+	}
+	if got, _ := fake.get("file"); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.failAPI("CompleteMultipartUpload")
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, testWriteOptions()))
+	defer clean()
+
+	f, err := os.Create(mnt + "/big")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte("x"), 10)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Close: got %v, want EACCES", err)
+	}
+
+	// Release runs asynchronously with respect to close(2).
+	for i := 0; i < 100 && fake.pendingUploads() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fake.pendingUploads(); got != 0 {
+		t.Errorf("got %d pending uploads, want 0", got)
+	}
+	if got := fake.count("AbortMultipartUpload"); got != 1 {
+		t.Errorf("got %d AbortMultipartUpload calls, want 1", got)
+	}
+	if _, ok := fake.get("big"); ok {
+		t.Errorf("failed upload was stored")
+	}
+}
+
+// spooled returns the names of the files in 'dir', waiting for them to be removed if 'wantEmpty' is set, as Release
+// runs asynchronously with respect to close(2).
+func spooled(t *testing.T, dir string, wantEmpty bool) []string {
+	t.Helper()
+	for i := 0; ; i++ {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		if len(entries) == 0 || !wantEmpty || i == 100 {
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			return names
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteSpooled(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	spoolDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	opts := testWriteOptions()
+	opts.spoolDir = spoolDir
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	f, err := os.OpenFile(mnt+"/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("hello "), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	buf := make([]byte, 11)
+	if n, err := f.ReadAt(buf, 0); err != nil || string(buf[:n]) != "hello world" {
+		t.Errorf("ReadAt: got %q, %v, want %q", buf[:n], err, "hello world")
+	}
+	if _, ok := fake.get("file"); ok {
+		t.Errorf("object was stored before Flush")
+	}
+	if got := spooled(t, spoolDir, false); len(got) != 1 {
+		t.Errorf("got spool files %v, want one", got)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got, _ := fake.get("file"); got != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+	if got := fake.count("UploadPart"); got != 3 {
+		t.Errorf("got %d UploadPart calls, want 3", got)
+	}
+	if got := spooled(t, spoolDir, true); len(got) != 0 {
+		t.Errorf("got spool files %v after Release", got)
+	}
+}
+
+func TestWriteInPlace(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("file", "jello")
+
+	opts := testWriteOptions()
+	opts.maxTruncateSize = 16
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	f, err := os.OpenFile(mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("h")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if got, _ := fake.get("file"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestWriteSpooledFailure(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.failAPI("PutObject")
+	spoolDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	opts := bucketOptions{cacheTTL: time.Hour, partSize: 1024, spoolDir: spoolDir}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+
+	if err := ioutil.WriteFile(mnt+"/file", []byte("data"), 0644); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("WriteFile: got %v, want EACCES", err)
+	}
+	if got := spooled(t, spoolDir, true); len(got) != 0 {
+		t.Errorf("got spool files %v after Release", got)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sys/unix"
+)
+
+// Extended attributes exposing the metadata of objects. User metadata, i.e. the 'x-amz-meta-*' headers, is exposed
+// under xattrMetaPrefix and may be modified; the other attributes are read-only. xattrRestore is only set on archived
+// objects that were restored, or are being restored, and xattrSSE on objects encrypted server-side.
+const (
+	xattrMetaPrefix   = "user.s3.meta."
+	xattrContentType  = "user.s3.content-type"
+	xattrETag         = "user.s3.etag"
+	xattrStorageClass = "user.s3.storage-class"
+	xattrRestore      = "user.s3.restore"
+	xattrSSE          = "user.s3.sse"
+
+	// xattrPresignedURL is a virtual attribute holding a presigned URL to download the object, which is signed anew
+	// every time it is read.
+	xattrPresignedURL = "user.s3.presigned-url"
+)
+
+var _ = (fs.NodeGetxattrer)((*s3Object)(nil))
+var _ = (fs.NodeListxattrer)((*s3Object)(nil))
+var _ = (fs.NodeSetxattrer)((*s3Object)(nil))
+var _ = (fs.NodeRemovexattrer)((*s3Object)(nil))
+
+// Getxattr returns the value of the attribute 'attr'.
+func (o *s3Object) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+
+	var value []byte
+	if attr == xattrPresignedURL && o.bucket.opts.presignExpiry > 0 {
+		url, errno := o.presign()
+		if errno != 0 {
+			return 0, errno
+		}
+		value = []byte(url)
+	} else {
+		attrs, errno := o.extendedAttrs(ctx)
+		if errno != 0 {
+			return 0, errno
+		}
+		var ok bool
+		if value, ok = attrs[attr]; !ok {
+			return 0, syscall.ENODATA
+		}
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// Listxattr returns the names of all attributes.
+func (o *s3Object) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+
+	attrs, errno := o.extendedAttrs(ctx)
+	if errno != 0 {
+		return 0, errno
+	}
+	names := make([]string, 0, len(attrs)+1)
+	for name := range attrs {
+		names = append(names, name)
+	}
+	if o.bucket.opts.presignExpiry > 0 {
+		names = append(names, xattrPresignedURL)
+	}
+	sort.Strings(names)
+
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+// Setxattr sets the user metadata 'attr' by copying the object onto itself with the new metadata. The content type
+// can only be set while the file is being written, and is stored along with the content.
+func (o *s3Object) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+
+	if attr == xattrContentType && o.attachContentType(string(data)) {
+		return 0
+	}
+	return o.updateMeta(ctx, attr, func(meta map[string]*string, name string) syscall.Errno {
+		_, exists := meta[name]
+		if flags&unix.XATTR_CREATE != 0 && exists {
+			return syscall.EEXIST
+		}
+		if flags&unix.XATTR_REPLACE != 0 && !exists {
+			return syscall.ENODATA
+		}
+		meta[name] = aws.String(string(data))
+		return 0
+	})
+}
+
+// Removexattr drops the user metadata 'attr' by copying the object onto itself without it.
+func (o *s3Object) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	ctx, cancel := o.bucket.withTimeout(ctx)
+	defer cancel()
+
+	return o.updateMeta(ctx, attr, func(meta map[string]*string, name string) syscall.Errno {
+		if _, exists := meta[name]; !exists {
+			return syscall.ENODATA
+		}
+		delete(meta, name)
+		return 0
+	})
+}
+
+// updateMeta replaces the user metadata of the object with the outcome of applying 'update' to the metadata
+// 'name' that 'attr' refers to.
+func (o *s3Object) updateMeta(ctx context.Context, attr string, update func(meta map[string]*string, name string) syscall.Errno) syscall.Errno {
+	if o.bucket.opts.readOnly {
+		return syscall.EROFS
+	}
+	switch attr {
+	case xattrContentType, xattrETag, xattrStorageClass, xattrRestore, xattrSSE, xattrPresignedURL:
+		return syscall.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrMetaPrefix) {
+		return syscall.ENOTSUP
+	}
+	name := strings.ToLower(strings.TrimPrefix(attr, xattrMetaPrefix))
+	if name == "" {
+		return syscall.EINVAL
+	}
+	_, errno := o.replaceMeta(ctx, func(meta map[string]*string) syscall.Errno {
+		return update(meta, name)
+	})
+	return errno
+}
+
+// replaceMeta copies the object onto itself with the outcome of applying 'update' to its user metadata, and returns
+// the ETag of the copy.
+func (o *s3Object) replaceMeta(ctx context.Context, update func(meta map[string]*string) syscall.Errno) (string, syscall.Errno) {
+	key := o.key()
+	head, err := o.bucket.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &o.bucket.name, Key: &key})
+	if err != nil {
+		log.Printf("failed to query object '%v' in s3 bucket '%v': %v", key, o.bucket.name, err)
+		return "", toErrno(ctx, err)
+	}
+	meta := make(map[string]*string, len(head.Metadata))
+	for k, v := range head.Metadata {
+		meta[strings.ToLower(k)] = v
+	}
+	if errno := update(meta); errno != 0 {
+		return "", errno
+	}
+	// Copies are only encrypted like their source if requested, so keep its encryption unless another one is.
+	sse, kmsKeyID := o.bucket.encryption()
+	if sse == nil {
+		sse, kmsKeyID = head.ServerSideEncryption, head.SSEKMSKeyId
+	}
+
+	out, err := o.bucket.backend.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            &o.bucket.name,
+		Key:               &key,
+		CopySource:        aws.String(copySource(o.bucket.name, key)),
+		CopySourceIfMatch: head.ETag,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          meta,
+		// Replacing the metadata drops all headers that are not carried over.
+		CacheControl:         head.CacheControl,
+		ContentDisposition:   head.ContentDisposition,
+		ContentEncoding:      head.ContentEncoding,
+		ContentLanguage:      head.ContentLanguage,
+		ContentType:          head.ContentType,
+		StorageClass:         head.StorageClass,
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		log.Printf("failed to update metadata of object '%v' in s3 bucket '%v': %v", key, o.bucket.name, err)
+		return "", toErrno(ctx, err)
+	}
+
+	// The copy is a new version of the object, with the same content.
+	content := *o.snapshot()
+	head.Metadata, head.ServerSideEncryption = meta, sse
+	if out.CopyObjectResult != nil {
+		head.ETag = out.CopyObjectResult.ETag
+		content.ETag, content.LastModified = out.CopyObjectResult.ETag, out.CopyObjectResult.LastModified
+	}
+	o.stored(&content)
+	attrs := xattrsOf(head)
+	o.mu.Lock()
+	o.xattrs = attrs
+	o.mu.Unlock()
+	return aws.StringValue(head.ETag), 0
+}
+
+// presign returns a URL to download the object, valid for 'presignExpiry'.
+func (o *s3Object) presign() (string, syscall.Errno) {
+	key := o.key()
+	req, _ := o.bucket.backend.GetObjectRequest(&s3.GetObjectInput{Bucket: &o.bucket.name, Key: &key})
+	url, err := req.Presign(o.bucket.opts.presignExpiry)
+	if err != nil {
+		log.Printf("failed to presign download of object '%v' in s3 bucket '%v': %v", key, o.bucket.name, err)
+		return "", syscall.EIO
+	}
+	return url, 0
+}
+
+// extendedAttrs returns the attributes of the object, fetching them on first use.
+func (o *s3Object) extendedAttrs(ctx context.Context) (map[string][]byte, syscall.Errno) {
+	o.mu.Lock()
+	attrs := o.xattrs
+	o.mu.Unlock()
+	if attrs != nil {
+		return attrs, 0
+	}
+
+	key := o.key()
+	head, err := o.bucket.backend.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &o.bucket.name, Key: &key})
+	if err != nil {
+		log.Printf("failed to query object '%v' in s3 bucket '%v': %v", key, o.bucket.name, err)
+		return nil, toErrno(ctx, err)
+	}
+	attrs = xattrsOf(head)
+
+	o.mu.Lock()
+	o.xattrs = attrs
+	o.mu.Unlock()
+	return attrs, 0
+}
+
+// xattrsOf maps the headers of an object to extended attributes.
+func xattrsOf(head *s3.HeadObjectOutput) map[string][]byte {
+	attrs := map[string][]byte{
+		// s3 leaves out the storage class of standard objects.
+		xattrStorageClass: []byte(s3.StorageClassStandard),
+	}
+	if head.ContentType != nil {
+		attrs[xattrContentType] = []byte(*head.ContentType)
+	}
+	if head.ETag != nil {
+		attrs[xattrETag] = []byte(*head.ETag)
+	}
+	if head.StorageClass != nil {
+		attrs[xattrStorageClass] = []byte(*head.StorageClass)
+	}
+	if head.Restore != nil {
+		attrs[xattrRestore] = []byte(*head.Restore)
+	}
+	if head.ServerSideEncryption != nil {
+		attrs[xattrSSE] = []byte(*head.ServerSideEncryption)
+	}
+	for k, v := range head.Metadata {
+		attrs[xattrMetaPrefix+strings.ToLower(k)] = []byte(aws.StringValue(v))
+	}
+	return attrs
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getxattr(t *testing.T, path, attr string) (string, error) {
+	t.Helper()
+
+	sz, err := unix.Getxattr(path, attr, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, sz)
+	n, err := unix.Getxattr(path, attr, buf)
+	return string(buf[:n]), err
+}
+
+func TestXattr(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putMeta("a", "hello", map[string]string{"color": "red"})
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+	path := mnt + "/a"
+
+	for attr, want := range map[string]string{
+		"user.s3.meta.color":    "red",
+		"user.s3.etag":          `"5d41402abc4b2a76b9719d911017c592"`,
+		"user.s3.storage-class": "STANDARD",
+		"user.s3.content-type":  "binary/octet-stream",
+	} {
+		if got, err := getxattr(t, path, attr); err != nil || got != want {
+			t.Errorf("Getxattr(%q): got %q, %v, want %q", attr, got, err, want)
+		}
+	}
+	if _, err := unix.Getxattr(path, "user.s3.meta.missing", nil); err != syscall.ENODATA {
+		t.Errorf("Getxattr(missing): got %v, want ENODATA", err)
+	}
+	if _, err := unix.Getxattr(path, "user.s3.etag", make([]byte, 1)); err != syscall.ERANGE {
+		t.Errorf("Getxattr with short buffer: got %v, want ERANGE", err)
+	}
+
+	sz, err := unix.Listxattr(path, nil)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	buf := make([]byte, sz)
+	n, err := unix.Listxattr(path, buf)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	sort.Strings(names)
+	want := []string{"user.s3.content-type", "user.s3.etag", "user.s3.meta.color", "user.s3.storage-class"}
+	if !equalStrings(names, want) {
+		t.Errorf("Listxattr: got %v, want %v", names, want)
+	}
+}
+
+func TestSetxattr(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.putMeta("a", "hello", map[string]string{"color": "red"})
+
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, bucketOptions{cacheTTL: time.Hour}))
+	defer clean()
+	path := mnt + "/a"
+
+	if err := unix.Setxattr(path, "user.s3.meta.shape", []byte("round"), 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if got := fake.meta("a"); got["color"] != "red" || got["shape"] != "round" {
+		t.Errorf("got metadata %v", got)
+	}
+	if got, err := getxattr(t, path, "user.s3.meta.shape"); err != nil || got != "round" {
+		t.Errorf("Getxattr: got %q, %v, want %q", got, err, "round")
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+
+	if err := unix.Setxattr(path, "user.s3.meta.color", []byte("blue"), unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("Setxattr(XATTR_CREATE): got %v, want EEXIST", err)
+	}
+	if err := unix.Setxattr(path, "user.s3.etag", []byte("x"), 0); err != syscall.EPERM {
+		t.Errorf("Setxattr(etag): got %v, want EPERM", err)
+	}
+	if err := unix.Setxattr(path, "user.other", []byte("x"), 0); err != syscall.ENOTSUP {
+		t.Errorf("Setxattr(user.other): got %v, want ENOTSUP", err)
+	}
+
+	if err := unix.Removexattr(path, "user.s3.meta.color"); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+	if got := fake.meta("a"); len(got) != 1 || got["shape"] != "round" {
+		t.Errorf("got metadata %v", got)
+	}
+}
+
+func TestPresignedURL(t *testing.T) {
+	fake, stop := newFakeS3()
+	defer stop()
+	fake.put("a", "hello")
+
+	opts := bucketOptions{cacheTTL: time.Hour, presignExpiry: time.Minute}
+	mnt, clean := testMount(t, newS3Bucket(fake.backend(t), testBucket, opts))
+	defer clean()
+	path := mnt + "/a"
+
+	value, err := getxattr(t, path, xattrPresignedURL)
+	if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", value, err)
+	}
+	if got, want := u.Path, "/"+testBucket+"/a"; got != want {
+		t.Errorf("got path %q, want %q", got, want)
+	}
+	if got := u.Query().Get("X-Amz-Expires"); got != "60" {
+		t.Errorf("got expiry %q, want 60", got)
+	}
+	if u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("URL %q is not signed", value)
+	}
+
+	resp, err := http.Get(value)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if got, err := ioutil.ReadAll(resp.Body); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want %q", got, err, "hello")
+	}
+
+	sz, err := unix.Listxattr(path, nil)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	buf := make([]byte, sz)
+	n, err := unix.Listxattr(path, buf)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	if !strings.Contains(string(buf[:n]), xattrPresignedURL+"\x00") {
+		t.Errorf("Listxattr: got %q, want %v among them", buf[:n], xattrPresignedURL)
+	}
+	if err := unix.Setxattr(path, xattrPresignedURL, []byte("x"), 0); err != syscall.EPERM {
+		t.Errorf("Setxattr: got %v, want EPERM", err)
+	}
+}
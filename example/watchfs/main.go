@@ -0,0 +1,156 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+// This program mounts a loopback file system with long cache
+// timeouts, and keeps the kernel caches up to date by feeding the
+// inotify(7) events of the original directory into an
+// fs.InvalidationHub. Watchers built on a library such as fsnotify
+// map their events the same way.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// watcher watches a directory tree with inotify.
+type watcher struct {
+	fd   int
+	root string
+	// dirs maps watch descriptors to directories relative to
+	// root.
+	dirs map[int32]string
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fd: fd, root: root, dirs: map[int32]string{}}
+	return w, w.addTree("")
+}
+
+// addTree watches the directory rel and its subdirectories.
+func (w *watcher) addTree(rel string) error {
+	return filepath.Walk(filepath.Join(w.root, rel), func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			return err
+		}
+		r, _ := filepath.Rel(w.root, p)
+		w.dirs[int32(wd)] = filepath.ToSlash(r)
+		return nil
+	})
+}
+
+// run reads events, and passes them to hub.
+func (w *watcher) run(hub *fs.InvalidationHub) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			log.Fatalf("inotify: %v", err)
+		}
+
+		// A rename is a MOVED_FROM followed by a MOVED_TO with
+		// the same cookie. An unpaired MOVED_FROM moved the
+		// file out of the tree.
+		movedFrom := map[uint32]string{}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			dir, ok := w.dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+			rel := path.Join(dir, strings.TrimRight(string(nameBytes), "\x00"))
+			switch {
+			case ev.Mask&unix.IN_MOVED_FROM != 0:
+				movedFrom[ev.Cookie] = rel
+			case ev.Mask&unix.IN_MOVED_TO != 0:
+				if old, ok := movedFrom[ev.Cookie]; ok {
+					delete(movedFrom, ev.Cookie)
+					hub.Notify(fs.ChangeEvent{Kind: fs.ChangeRename, Path: old, NewPath: rel})
+				} else {
+					hub.Notify(fs.ChangeEvent{Kind: fs.ChangeCreate, Path: rel})
+				}
+			case ev.Mask&unix.IN_CREATE != 0:
+				hub.Notify(fs.ChangeEvent{Kind: fs.ChangeCreate, Path: rel})
+			case ev.Mask&unix.IN_DELETE != 0:
+				hub.Notify(fs.ChangeEvent{Kind: fs.ChangeDelete, Path: rel})
+			case ev.Mask&(unix.IN_MODIFY|unix.IN_ATTRIB|unix.IN_CLOSE_WRITE) != 0:
+				hub.Notify(fs.ChangeEvent{Kind: fs.ChangeModify, Path: rel})
+			}
+			if ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				if err := w.addTree(rel); err != nil {
+					log.Printf("watch %s: %v", rel, err)
+				}
+			}
+		}
+		for _, old := range movedFrom {
+			hub.Notify(fs.ChangeEvent{Kind: fs.ChangeDelete, Path: old})
+		}
+	}
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "print debugging messages.")
+	ttl := flag.Duration("ttl", time.Hour, "cache timeout for entries and attributes")
+	delay := flag.Duration("delay", 10*time.Millisecond, "time to collect events before invalidating")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Printf("usage: %s MOUNTPOINT ORIGINAL\n", path.Base(os.Args[0]))
+		fmt.Printf("\noptions:\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	orig := flag.Arg(1)
+	root, err := fs.NewLoopbackRoot(orig)
+	if err != nil {
+		log.Fatalf("NewLoopbackRoot(%s): %v", orig, err)
+	}
+	w, err := newWatcher(orig)
+	if err != nil {
+		log.Fatalf("inotify: %v", err)
+	}
+
+	opts := &fs.Options{
+		AttrTimeout:     ttl,
+		EntryTimeout:    ttl,
+		NegativeTimeout: ttl,
+		Logger:          log.New(os.Stderr, "", 0),
+	}
+	opts.Debug = *debug
+	server, err := fs.Mount(flag.Arg(0), root, opts)
+	if err != nil {
+		log.Fatalf("Mount fail: %v", err)
+	}
+
+	go w.run(fs.NewInvalidationHub(root.EmbeddedInode(), *delay))
+	server.Wait()
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDefaultAccessSupplementaryGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to run as other users")
+	}
+	testPath, err := exec.LookPath("test")
+	if err != nil {
+		t.Skip("no test(1) binary")
+	}
+
+	// Only the group may read the file, and the group is not in
+	// the user database for the caller.
+	const fileUid, fileGid, callerId = 4242, 4343, 4444
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			f := &MemRegularFile{
+				Data: []byte("hello"),
+				Attr: fuse.Attr{
+					Mode:  0040,
+					Owner: fuse.Owner{Uid: fileUid, Gid: fileGid},
+				},
+			}
+			root.AddChild("file", root.NewPersistentInode(ctx, f, StableAttr{}), false)
+		},
+	}
+	opts.AllowOther = true
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	for _, tc := range []struct {
+		groups []uint32
+		want   bool
+	}{
+		{nil, false},
+		{[]uint32{fileGid + 1, fileGid}, true},
+	} {
+		cmd := exec.Command(testPath, "-r", mntDir+"/file")
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: callerId, Gid: callerId, Groups: tc.groups},
+		}
+		err := cmd.Run()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatalf("Run: %v", err)
+		}
+		if got := err == nil; got != tc.want {
+			t.Errorf("groups %v: got access %v, want %v", tc.groups, got, tc.want)
+		}
+	}
+}
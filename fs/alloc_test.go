@@ -0,0 +1,194 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// newMemBridge returns a bridge whose root has the files "f0" ..
+func newMemBridge(files int) *rawBridge {
+	root := &Inode{}
+	return NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for i := 0; i < files; i++ {
+				f := &MemRegularFile{Data: []byte("hello")}
+				root.AddChild(fmt.Sprintf("f%d", i), root.NewPersistentInode(ctx, f, StableAttr{}), false)
+			}
+		},
+	}).(*rawBridge)
+}
+
+// readDir lists the directory nodeId through the bridge, using
+// READDIRPLUS if 'plus' is set, and returns the number of entries.
+func readDir(b *rawBridge, nodeId uint64, plus bool, buf []byte) (int, fuse.Status) {
+	var open fuse.OpenOut
+	if st := b.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeId}}, &open); !st.Ok() {
+		return 0, st
+	}
+	defer b.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: nodeId}, Fh: open.Fh})
+
+	_, f := b.inode(nodeId, open.Fh)
+	in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: nodeId}, Fh: open.Fh}
+	for {
+		out := fuse.NewDirEntryList(buf, in.Offset)
+		var st fuse.Status
+		if plus {
+			st = b.ReadDirPlus(nil, in, out)
+		} else {
+			st = b.ReadDir(nil, in, out)
+		}
+		if !st.Ok() {
+			return int(in.Offset), st
+		}
+		if f.dirOffset == in.Offset {
+			return int(in.Offset), fuse.OK
+		}
+		in.Offset = f.dirOffset
+	}
+}
+
+// sizeNode only sets the size in Getattr, so the rest of the
+// attributes comes from what the bridge passes in.
+type sizeNode struct {
+	Inode
+}
+
+var _ = (NodeGetattrer)((*sizeNode)(nil))
+
+func (n *sizeNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = 5
+	return OK
+}
+
+// poisonPools puts out structures full of garbage into the pools.
+func poisonPools() {
+	for i := 0; i < 10; i++ {
+		a := getAttrOut()
+		a.Attr = fuse.Attr{Ino: 42, Size: 42, Blocks: 42, Nlink: 42, Rdev: 42, Blksize: 42, Atime: 42, Mtime: 42, Ctime: 42}
+		a.AttrValid = 42
+		putAttrOut(a)
+
+		e := getEntryOut()
+		e.NodeId = 42
+		e.Generation = 42
+		e.EntryValid = 42
+		e.Attr = a.Attr
+		putEntryOut(e)
+	}
+}
+
+func TestPoolsCleared(t *testing.T) {
+	poisonPools()
+	if a := getAttrOut(); *a != (fuse.AttrOut{}) {
+		t.Errorf("got AttrOut %v from the pool, want zero", a)
+	}
+	if e := getEntryOut(); *e != (fuse.EntryOut{}) {
+		t.Errorf("got EntryOut %v from the pool, want zero", e)
+	}
+
+	root := &Inode{}
+	bridge := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &sizeNode{}, StableAttr{Mode: syscall.S_IFREG}), false)
+		},
+	}).(*rawBridge)
+
+	poisonPools()
+	var entry fuse.EntryOut
+	if st := bridge.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if a := entry.Attr; a.Size != 5 || a.Nlink != 0 || a.Rdev != 0 || a.Atime != 0 || a.Mtime != 0 || a.Ctime != 0 {
+		t.Errorf("Lookup: got attributes %v, want only the size set", &a)
+	}
+	if entry.AttrValid != 0 {
+		t.Errorf("Lookup: got attribute timeout %d, want 0", entry.AttrValid)
+	}
+
+	poisonPools()
+	var sx fuse.StatxOut
+	if st := bridge.Statx(nil, &fuse.StatxIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &sx); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if sx.Size != 5 || sx.Nlink != 0 || sx.RdevMinor != 0 || sx.Atime.Sec != 0 || sx.AttrValid != 0 {
+		t.Errorf("Statx: got %v, want only the size set", &sx)
+	}
+}
+
+func BenchmarkBridgeLookup(b *testing.B) {
+	bridge := newMemBridge(100)
+	var names []string
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("f%d", i))
+	}
+	header := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	// The server passes its request buffer for out.
+	out := &fuse.EntryOut{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		*out = fuse.EntryOut{}
+		bridge.Lookup(nil, header, names[i%len(names)], out)
+	}
+}
+
+func BenchmarkBridgeGetattr(b *testing.B) {
+	bridge := newMemBridge(1)
+	var entry fuse.EntryOut
+	bridge.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "f0", &entry)
+	in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}
+	out := &fuse.AttrOut{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		*out = fuse.AttrOut{}
+		bridge.GetAttr(nil, in, out)
+	}
+}
+
+func BenchmarkBridgeReadDirPlus(b *testing.B) {
+	bridge := newMemBridge(1000)
+	buf := make([]byte, 32*1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, st := readDir(bridge, fuse.FUSE_ROOT_ID, true, buf); !st.Ok() {
+			b.Fatalf("ReadDirPlus: %v", st)
+		}
+	}
+}
+
+func BenchmarkBridgeReadDirLoopback(b *testing.B) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	for i := 0; i < 1000; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+	buf := make([]byte, 32*1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, st := readDir(bridge, fuse.FUSE_ROOT_ID, false, buf); !st.Ok() {
+			b.Fatalf("ReadDir: %v", st)
+		}
+	}
+}
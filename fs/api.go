@@ -103,6 +103,9 @@
 // 3. Directory entries (parent/child relations in the FS tree):
 // controlled with the timeout fields in fuse.EntryOut, and
 // invalidated with Inode.NotifyEntry and Inode.NotifyDelete.
+// Directory listings are cached if OpendirFlags returns
+// fuse.FOPEN_CACHE_DIR, and invalidated with
+// Inode.InvalidateDirCache.
 //
 // Without Directory Entry timeouts, every operation on file "a/b/c"
 // must first do lookups for "a", "a/b" and "a/b/c", which is
@@ -123,11 +126,19 @@
 //      AttrTimeout: &sec,
 //    }
 //
+// These options are defaults. They are filled into the EntryOut or
+// AttrOut before calling Lookup, Getattr, Create, Mkdir, Mknod,
+// Link, Symlink or the DirPlusStream, so a timeout set by the node,
+// including a zero one, takes precedence. For a volatile file, call
+// SetAttrTimeout(0) in Lookup and SetTimeout(0) in Getattr.
+//
 // Locking
 //
 // Locks for networked filesystems are supported through the suite of
 // Getlk, Setlk and Setlkw methods. They alllow locks on regions of
-// regular files.
+// regular files. The kernel only sends lock requests if
+// MountOptions.EnableLocks is set; Mount sets it if the root
+// implements all three Node interfaces.
 //
 // Parallelism
 //
@@ -210,7 +221,8 @@ type NodeStatfser interface {
 // UID and GID for susan here.
 //
 // If not defined, a default implementation will check traditional
-// unix permissions of the Getattr result agains the caller. If so, it
+// unix permissions of the Getattr result agains the caller, including
+// its supplementary groups (see fuse.Caller.Groups). If so, it
 // is necessary to either return permissions from GetAttr/Lookup or
 // set Options.DefaultPermissions in order to allow chdir into the
 // FUSE mount.
@@ -225,11 +237,28 @@ type NodeAccesser interface {
 // mode of 0755 (directory) or 0644 (files). This can be switched off
 // with the Options.NullPermissions setting. If blksize is unset, 4096
 // is assumed, and the 'blocks' field is set accordingly.
+//
+// If the kernel passes a file handle, eg. for fstat(2), and the
+// handle implements FileGetattrer, the handle is asked instead. For
+// stat(2), the kernel passes no handle, and Getattr may be passed
+// any file that is open on the node.
 type NodeGetattrer interface {
 	Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno
 }
 
-// SetAttr sets attributes for an Inode.
+// Statx reads the attributes of an Inode for statx(2), which unlike
+// Getattr may include the birth time. 'flags' are the AT_STATX_*
+// synchronization flags, and 'mask' the attributes asked for; the
+// ones that are set should be reported in out.Mask. The library sets
+// Mode and Ino, and applies the defaults described for Getattr. If
+// not implemented, the attributes returned by Getattr are used.
+type NodeStatxer interface {
+	Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
+}
+
+// SetAttr sets attributes for an Inode. If the kernel passes a file
+// handle, eg. for ftruncate(2), that implements FileSetattrer, the
+// handle's Setattr is called instead.
 type NodeSetattrer interface {
 	Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
 }
@@ -239,6 +268,29 @@ type NodeOnAdder interface {
 	OnAdd(ctx context.Context)
 }
 
+// OnForget is called when the node reaches the end of its life:
+// the kernel has forgotten it and it was dropped from the tree, or
+// the file system was unmounted. This is the place to release
+// resources held by the node.
+//
+// OnForget is called at most once for each Inode. As the kernel has
+// no references left, it is not called concurrently with other
+// methods on the node. The node must not be handed out again, eg. by
+// returning it from Lookup, after this.
+type NodeOnForgetter interface {
+	OnForget()
+}
+
+// OnUnmount is called on the root node when the file system goes
+// away, either by Server.Unmount, or by the kernel, eg. after a
+// lazy unmount or DESTROY. It is called once, after all requests
+// were handled, before the nodes are forgotten, and before
+// Server.Wait returns. This is the place to flush data and close
+// connections to backends.
+type NodeOnUnmounter interface {
+	OnUnmount(ctx context.Context)
+}
+
 // Getxattr should read data for the given attribute into
 // `dest` and return the number of bytes. If `dest` is too
 // small, it should return ERANGE and the size of the attribute.
@@ -268,13 +320,28 @@ type NodeListxattrer interface {
 	Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno)
 }
 
-// Readlink reads the content of a symlink.
+// Readlink reads the content of a symlink. If
+// MountOptions.EnableSymlinkCaching is set, the kernel caches the
+// result; call Inode.NotifySymlink when the target changes.
 type NodeReadlinker interface {
 	Readlink(ctx context.Context) ([]byte, syscall.Errno)
 }
 
 // Open opens an Inode (of regular file type) for reading. It
 // is optional but recommended to return a FileHandle.
+//
+// The returned fuseFlags tell the kernel how to cache the file for
+// this handle only, so each Open of an Inode may choose differently:
+// FOPEN_DIRECT_IO bypasses the page cache, for files whose content
+// changes on every read; FOPEN_KEEP_CACHE keeps the cached pages
+// rather than dropping them on open; FOPEN_NONSEEKABLE makes seeking
+// fail with ESPIPE. FOPEN_CACHE_DIR only applies to directories. See
+// the directIO example.
+//
+// With EnableWritebackCache, the kernel appends by itself, so the
+// flags never have O_APPEND, and O_WRONLY is passed as O_RDWR, as
+// the kernel may read pages it partially overwrites. This also
+// applies to Create and Tmpfile.
 type NodeOpener interface {
 	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
@@ -325,6 +392,18 @@ type NodeAllocater interface {
 	Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno
 }
 
+// Ioctl implements ioctl(2) on an open file. The kernel copies in
+// and out the argument as the cmd number specifies (see _IOC in
+// <asm-generic/ioctl.h>): its input bytes are in 'input', and
+// 'output' has room for the bytes that are copied back. 'arg' is the
+// raw argument, which is useful for commands that don't pass a
+// pointer. The result is returned from ioctl(2). Default is to return
+// ENOTTY. Ioctls on directories are only sent if the root implements
+// NodeIoctler (see Mount) or MountOptions.EnableIoctlDir is set.
+type NodeIoctler interface {
+	Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno)
+}
+
 // CopyFileRange copies data between sections of two files,
 // without the data having to pass through the calling process.
 type NodeCopyFileRanger interface {
@@ -377,9 +456,35 @@ type DirStream interface {
 	Close()
 }
 
+// DirSeeker is an optional extension of DirStream, for streams that
+// can be positioned without listing the entries before. When the
+// kernel reads the directory from another offset than where the
+// previous read ended, Seekdir is called to continue from entry
+// number 'off', counting from 0, rather than listing the directory
+// anew and skipping 'off' entries. Reading from offset 0 always
+// starts a new stream.
+type DirSeeker interface {
+	Seekdir(ctx context.Context, off uint64) syscall.Errno
+}
+
+// DirEntryAppender is an optional extension of DirStream, and of the
+// FileReaddirenter handles from NodeOpendirHandler, for listings that
+// hold the names as bytes. For READDIR, AppendDirEntries is called
+// instead of Next or Readdirent. It should add entries to out with
+// AddBytes until out is full or the directory ends, and return the
+// number of entries added. An entry that did not fit must be the
+// first one added by the next call. READDIRPLUS still uses Next or
+// Readdirent.
+type DirEntryAppender interface {
+	AppendDirEntries(ctx context.Context, out *fuse.DirEntryList) (int, syscall.Errno)
+}
+
 // Lookup should find a direct child of a directory by the child's name.  If
 // the entry does not exist, it should return ENOENT and optionally
-// set a NegativeTimeout in `out`. If it does exist, it should return
+// set an entry timeout in `out`, which overrides
+// Options.NegativeTimeout. The kernel then remembers that the name
+// does not exist for that long, until it is created through the
+// mount or dropped with NotifyEntry. If it does exist, it should return
 // attribute data in `out` and return the Inode for the child. A new
 // inode can be created using `Inode.NewInode`. The new Inode will be
 // added to the FS tree automatically if the return status is OK.
@@ -414,6 +519,16 @@ type NodeOpendirer interface {
 	Opendir(ctx context.Context) syscall.Errno
 }
 
+// OpendirFlags is like Opendir, but can also return flags for the
+// kernel: fuse.FOPEN_CACHE_DIR makes the kernel cache the listing,
+// and fuse.FOPEN_KEEP_CACHE keeps an earlier cached listing, so
+// repeated listings do not call Readdir. Use
+// Inode.InvalidateDirCache to drop the listing when the directory
+// changes. If implemented, it is called instead of Opendir.
+type NodeOpendirFlagser interface {
+	OpendirFlags(ctx context.Context) (fuseFlags uint32, errno syscall.Errno)
+}
+
 // ReadDir opens a stream of directory entries.
 //
 // Readdir essentiallly returns a list of strings, and it is allowed
@@ -429,6 +544,47 @@ type NodeReaddirer interface {
 	Readdir(ctx context.Context) (DirStream, syscall.Errno)
 }
 
+// DirPlusStream is a DirStream whose entries can carry the child
+// Inode and its attributes, for backends that get these along with
+// the listing.
+type DirPlusStream interface {
+	DirStream
+
+	// NextPlus is like Next. If it returns the child too, the
+	// child is added to the tree as if it were returned from
+	// Lookup, and 'out' should be filled in as for Lookup. If the
+	// child is nil, the entry is looked up as usual.
+	NextPlus(ctx context.Context, out *fuse.EntryOut) (fuse.DirEntry, *Inode, syscall.Errno)
+}
+
+// ReaddirPlus is like Readdir, but lets READDIRPLUS reply with the
+// attributes from the stream rather than calling Lookup for each
+// entry. It takes precedence over NodeReaddirer.
+type NodeReaddirPluser interface {
+	ReaddirPlus(ctx context.Context) (DirPlusStream, syscall.Errno)
+}
+
+// OpendirHandle opens a directory, and returns a handle that lives
+// until the kernel releases the directory. A stream from Readdir is
+// opened anew whenever the kernel reads the directory from the start,
+// but the handle serves all reads of one opendir(3), so it can keep a
+// backend cursor, such as a database iterator or a pagination token,
+// between calls. The flags are the open flags; fuseFlags are as for
+// NodeOpendirFlagser.
+//
+// READDIR and READDIRPLUS are served from the handle if it
+// implements FileReaddirenter, FSYNCDIR if it implements
+// FileFsyncdirer, and RELEASEDIR calls FileReleasedirer.Releasedir
+// exactly once per successful OpendirHandle, also if the file system
+// is unmounted while the directory is open. Operations the handle
+// does not implement fall back to the node, as if OpendirHandle
+// returned no handle; node methods such as Getattr are not passed the
+// directory handle. If implemented, OpendirHandle is called instead
+// of OpendirFlags and Opendir.
+type NodeOpendirHandler interface {
+	OpendirHandle(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
 // Mkdir is similar to Lookup, but must create a directory entry and Inode.
 // Default is to return EROFS.
 type NodeMkdirer interface {
@@ -461,6 +617,13 @@ type NodeCreater interface {
 	Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
 
+// Tmpfile is like Create, but the new file has no name, as for
+// open(2) with O_TMPFILE. The node is not added to the tree; it can
+// be given a name later with Link. Default is to return EOPNOTSUPP.
+type NodeTmpfiler interface {
+	Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
 // Unlink should remove a child from this directory.  If the
 // return status is OK, the Inode is removed as child in the
 // FS tree automatically. Default is to return EROFS.
@@ -507,7 +670,8 @@ type FileReleaser interface {
 	Release(ctx context.Context) syscall.Errno
 }
 
-// See NodeGetattrer.
+// See NodeGetattrer. If implemented, it takes precedence over the
+// node's Getattr for calls on an open file.
 type FileGetattrer interface {
 	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 }
@@ -522,6 +686,15 @@ type FileWriter interface {
 	Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno)
 }
 
+// FilePassthroughFder is a FileWriter that is backed by a file
+// descriptor. If fuse.MountOptions.EnableSpliceWrite is set, the data
+// of writes is spliced into the descriptor, and Write is only called
+// for the part that could not be. The descriptor must stay open until
+// the handle is released.
+type FilePassthroughFder interface {
+	Fd() int
+}
+
 // See NodeGetlker.
 type FileGetlker interface {
 	Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno
@@ -542,6 +715,15 @@ type FileLseeker interface {
 	Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// FilePoller reports which poll(2) events (POLLIN, POLLOUT, etc.)
+// are ready on the file. When the readiness changes, call
+// Inode.NotifyPollWakeup so waiters poll again. Files that don't
+// implement FilePoller are always ready. The kernel only sends poll
+// requests if MountOptions.EnablePoll is set.
+type FilePoller interface {
+	Poll(ctx context.Context) (revents uint32, errno syscall.Errno)
+}
+
 // See NodeFlusher.
 type FileFlusher interface {
 	Flush(ctx context.Context) syscall.Errno
@@ -552,39 +734,99 @@ type FileFsyncer interface {
 	Fsync(ctx context.Context, flags uint32) syscall.Errno
 }
 
-// See NodeFsync.
+// See NodeSetattrer. If implemented, it takes precedence over
+// the node's Setattr for calls on an open file.
 type FileSetattrer interface {
 	Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
 }
 
+// FileReaddirenter lists a directory opened with
+// NodeOpendirHandler. Readdirent returns the next entry, or nil at
+// the end of the directory. The entry is copied before the next
+// call, so the handle may reuse it.
+type FileReaddirenter interface {
+	Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno)
+}
+
+// FileSeekdirer positions a directory handle before entry number
+// 'off', counting from 0, like DirSeeker. It is called when the
+// kernel reads from another offset than where the previous read
+// ended, including offset 0 after rewinddir(3). Without it, reading
+// from an earlier offset fails with ESPIPE.
+type FileSeekdirer interface {
+	Seekdir(ctx context.Context, off uint64) syscall.Errno
+}
+
+// FileReleasedirer releases a directory handle. See
+// NodeOpendirHandler.
+type FileReleasedirer interface {
+	Releasedir(ctx context.Context, releaseFlags uint32)
+}
+
+// FileFsyncdirer flushes a directory handle to stable storage. If
+// not implemented, FSYNCDIR calls the node's Fsync.
+type FileFsyncdirer interface {
+	Fsyncdir(ctx context.Context, flags uint32) syscall.Errno
+}
+
 // See NodeAllocater.
 type FileAllocater interface {
 	Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno
 }
 
+// See NodeIoctler.
+type FileIoctler interface {
+	Ioctl(ctx context.Context, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno)
+}
+
+// See NodeCopyFileRanger. The receiver is the file copied from.
+type FileCopyFileRanger interface {
+	CopyFileRange(ctx context.Context, offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+		len uint64, flags uint64) (uint32, syscall.Errno)
+}
+
 // Options sets options for the entire filesystem
 type Options struct {
-	// MountOptions contain the options for mounting the fuse server
+	// MountOptions contain the options for mounting the fuse
+	// server. Its limits, such as MaxWrite, MaxReadAhead and
+	// MaxBackground, are passed on as is; the values that were
+	// agreed with the kernel are in Server.NegotiatedSettings.
 	fuse.MountOptions
 
 	// If set to nonnil, this defines the overall entry timeout
 	// for the file system. See fuse.EntryOut for more information.
+	// Nodes can override it by setting the timeout in Lookup.
 	EntryTimeout *time.Duration
 
 	// If set to nonnil, this defines the overall attribute
 	// timeout for the file system. See fuse.EntryOut for more
-	// information.
+	// information. Nodes can override it by setting the timeout
+	// in Lookup or Getattr.
 	AttrTimeout *time.Duration
 
 	// If set to nonnil, this defines the overall entry timeout
-	// for failed lookups (fuse.ENOENT). See fuse.EntryOut for
-	// more information.
+	// for failed lookups (fuse.ENOENT). A positive timeout is
+	// sent to the kernel as a successful lookup with a zero
+	// NodeId, so the kernel caches the missing name. See
+	// fuse.EntryOut for more information.
 	NegativeTimeout *time.Duration
 
 	// Automatic inode numbers are handed out sequentially
-	// starting from this number. If unset, use 2^63.
+	// starting from this number. If unset, use 2^63. Ranges
+	// added with ReserveInoRange are skipped.
 	FirstAutomaticIno uint64
 
+	// OnStableAttrCollision says what to do if a new node has the
+	// same StableAttr as an existing node of a different type.
+	// Nodes of the same type are taken to be the same file (eg.
+	// a hard link, or the node for a repeated lookup), and are
+	// always unified.
+	OnStableAttrCollision CollisionPolicy
+
+	// reservedInos are the ranges that automatic inode numbers
+	// avoid.
+	reservedInos []inoRange
+
 	// OnAdd is an alternative way to specify the OnAdd
 	// functionality of the root node.
 	OnAdd func(ctx context.Context)
@@ -601,6 +843,77 @@ type Options struct {
 	// If nonzero, replace default (zero) GID with the given GID
 	GID uint32
 
+	// ReadOnly, if set, fails all operations that modify the
+	// file system with EROFS, before they reach the nodes. This
+	// includes opening files for writing. It complements the
+	// "ro" mount option, which the kernel enforces.
+	ReadOnly bool
+
+	// ApplyUmask, if set, removes the umask of the caller from
+	// the mode passed to Create, Mkdir and Mknod. The kernel
+	// does this already, unless MountOptions.DontMask is set, so
+	// this only matters with DontMask. Leave it unset for file
+	// systems that create files through the kernel, like the
+	// loopback, as the backing file system applies the umask of
+	// the server process.
+	ApplyUmask bool
+
+	// InvalidateOnStale, if set, recovers from nodes whose
+	// backing object went away, eg. a file replaced on the
+	// server. When a method of a node or of one of its file
+	// handles returns ESTALE, the bridge replies ESTALE and calls
+	// Inode.Invalidate, so the kernel looks up the name again
+	// rather than using the stale node until the entry times out.
+	// The fresh Lookup must return a node with a different
+	// StableAttr (eg. a new Gen), or it finds the stale node
+	// again. Files that were open stay bound to the stale node,
+	// and their handles should keep failing.
+	InvalidateOnStale bool
+
+	// NoGetattrOnOpenFiles, if set, calls Getattr only once while
+	// a node has open files: later GETATTRs are answered with the
+	// attributes from that call, or from the last Setattr, until
+	// the last file is released. It is meant for
+	// MountOptions.EnableWritebackCache, where the kernel keeps
+	// track of the size and times of open files itself, and the
+	// Getattr calls it sends anyway are wasted. Without the
+	// writeback cache, writes do not update the served size.
+	NoGetattrOnOpenFiles bool
+
+	// UidGidMapper, if set, translates the file owners that the
+	// kernel sees, the IDs in chown(2), and the callers passed
+	// in the context (see fuse.FromContext). The UID and GID
+	// options apply to the mapped IDs.
+	UidGidMapper UidGidMapper
+
+	// RequestTimeout, if nonzero, is the longest time that a
+	// request waits for a node or file handle. The context of the
+	// call is canceled when it expires, and the request fails with
+	// RequestTimeoutErrno. A call that is still running then
+	// carries on, but its result is dropped: nodes it looked up
+	// are forgotten, and files it opened are released again.
+	// Timeouts are logged to Logger with the operation and the
+	// type of the node.
+	//
+	// Forget, Flush, Release, ReleaseDir and blocking locks
+	// (SetLkw) are not timed, as failing them would lose data, or
+	// fail locks that are merely contended.
+	RequestTimeout time.Duration
+
+	// RequestTimeoutErrno is the error for requests that exceed
+	// RequestTimeout. If zero, EIO is returned.
+	RequestTimeoutErrno syscall.Errno
+
+	// OnOrphanHandle, if set, is called for file handles that
+	// never got a Release, so the file system can clean them up,
+	// eg. flush their data. This happens if the mount goes away
+	// before the kernel sent the RELEASE, or if Server.Unmount
+	// detached a direct mount while the files were still open
+	// (see MountOptions.ReleaseTimeout). In the latter case, the
+	// kernel may still send requests for the handles until the
+	// files are closed, but Release is not called anymore.
+	OnOrphanHandle func(fh FileHandle)
+
 	// ServerCallbacks can be provided to stub out notification
 	// functions for testing a filesystem without mounting it.
 	ServerCallbacks ServerCallbacks
@@ -611,3 +924,38 @@ type Options struct {
 	// anyway. If unset, no messages are printed.
 	Logger *log.Logger
 }
+
+// CollisionPolicy is the action for Options.OnStableAttrCollision.
+type CollisionPolicy int
+
+const (
+	// CollisionIgnore uses the existing node, and drops the new
+	// one. This is the default.
+	CollisionIgnore CollisionPolicy = iota
+
+	// CollisionPanic panics, for file systems that guarantee
+	// that their inode numbers are unique.
+	CollisionPanic
+
+	// CollisionWarn logs both node types, and otherwise acts
+	// like CollisionIgnore.
+	CollisionWarn
+
+	// CollisionAutoRenumber gives the new node a fresh automatic
+	// inode number. The mapping is remembered, so later nodes of
+	// the same type and StableAttr get the renumbered node, until
+	// the kernel forgets it.
+	CollisionAutoRenumber
+)
+
+type inoRange struct {
+	first, last uint64
+}
+
+// ReserveInoRange keeps automatic inode numbers, including those of
+// renumbered nodes (see CollisionAutoRenumber), out of the range
+// [first, last]. Use it for inode numbers that the file system picks
+// itself.
+func (o *Options) ReserveInoRange(first, last uint64) {
+	o.reservedInos = append(o.reservedInos, inoRange{first, last})
+}
@@ -7,6 +7,7 @@ package fs
 import (
 	"context"
 	"log"
+	"reflect"
 	"runtime/debug"
 	"sync"
 	"syscall"
@@ -20,9 +21,46 @@ func errnoToStatus(errno syscall.Errno) fuse.Status {
 	return fuse.Status(errno)
 }
 
+// The bridge passes some out structures of its own to the file
+// system, which makes them escape to the heap. They are pooled, and
+// cleared when taken from the pool, so a request never sees the
+// data of an earlier one.
+var (
+	attrOutPool  = sync.Pool{New: func() interface{} { return new(fuse.AttrOut) }}
+	entryOutPool = sync.Pool{New: func() interface{} { return new(fuse.EntryOut) }}
+)
+
+func getAttrOut() *fuse.AttrOut {
+	a := attrOutPool.Get().(*fuse.AttrOut)
+	*a = fuse.AttrOut{}
+	return a
+}
+
+func putAttrOut(a *fuse.AttrOut) {
+	attrOutPool.Put(a)
+}
+
+func getEntryOut() *fuse.EntryOut {
+	e := entryOutPool.Get().(*fuse.EntryOut)
+	*e = fuse.EntryOut{}
+	return e
+}
+
+func putEntryOut(e *fuse.EntryOut) {
+	entryOutPool.Put(e)
+}
+
 type fileEntry struct {
+	// file, dirHandle and orphaned are written with both
+	// bridge.mu and bridge.filesMu held, so requests can read
+	// them after looking up the entry under filesMu only.
 	file FileHandle
 
+	// dirHandle is the handle from NodeOpendirHandler. It is kept
+	// apart from 'file', so node methods such as Getattr are not
+	// passed a directory handle.
+	dirHandle FileHandle
+
 	// index into Inode.openFiles
 	nodeIndex int
 
@@ -33,6 +71,10 @@ type fileEntry struct {
 	dirStream   DirStream
 	hasOverflow bool
 	overflow    fuse.DirEntry
+	// overflowChild and overflowEntry hold what a DirPlusStream
+	// returned along with the overflow entry.
+	overflowChild *Inode
+	overflowEntry fuse.EntryOut
 	// dirOffset is the current location in the directory (see `telldir(3)`).
 	// The value is equivalent to `d_off` (see `getdents(2)`) of the last
 	// directory entry sent to the kernel so far.
@@ -40,6 +82,14 @@ type fileEntry struct {
 	// directory seek has taken place.
 	dirOffset uint64
 
+	// pollKh is the kernel poll handle to wake up, or 0. It is
+	// protected by bridge.mu.
+	pollKh uint64
+
+	// orphaned is set by OrphanHandles, so a late Release does not
+	// release the handle again.
+	orphaned bool
+
 	wg sync.WaitGroup
 }
 
@@ -52,9 +102,15 @@ type ServerCallbacks interface {
 	InodeNotify(node uint64, off int64, length int64) fuse.Status
 	InodeRetrieveCache(node uint64, offset int64, dest []byte) (n int, st fuse.Status)
 	InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status
+	PollNotify(kh uint64) fuse.Status
 }
 
 type rawBridge struct {
+	// pathGen is incremented when an existing link between
+	// nodes changes, invalidating all cached paths. It is
+	// accessed atomically, and comes first for 64-bit alignment.
+	pathGen uint64
+
 	options Options
 	root    *Inode
 	server  ServerCallbacks
@@ -71,6 +127,11 @@ type rawBridge struct {
 	stableAttrs  map[StableAttr]*Inode
 	automaticIno uint64
 
+	// renumbered maps the nodes that had a StableAttr collision
+	// to their new StableAttr, and renumberedBy is its inverse.
+	renumbered   map[renumberKey]StableAttr
+	renumberedBy map[StableAttr]renumberKey
+
 	// The *Node ID* is an arbitrary uint64 identifier chosen by the FUSE library.
 	// It is used the identify *nodes* (files/directories/symlinks/...) in the
 	// communication between the FUSE library and the Linux kernel.
@@ -79,7 +140,8 @@ type rawBridge struct {
 	// go-fuse Inode object.
 	//
 	// A simple incrementing counter is used as the NodeID (see `nextNodeID`).
-	kernelNodeIds map[uint64]*Inode
+	// It is sharded, see nodeIdMap.
+	kernelNodeIds *nodeIdMap
 	// nextNodeID is the next free NodeID. Increment after copying the value.
 	nextNodeId uint64
 	// nodeCountHigh records the highest number of entries we had in the
@@ -89,12 +151,16 @@ type rawBridge struct {
 	// estimate for stableAttrs.
 	nodeCountHigh int
 
+	// filesMu protects the files slice, and the fields of its
+	// entries listed in fileEntry, for readers that do not hold
+	// mu. Writing them requires both locks.
+	filesMu   sync.RWMutex
 	files     []*fileEntry
 	freeFiles []uint32
 }
 
 // newInode creates creates new inode pointing to ops.
-func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
+func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persistent bool, interceptor Interceptor) *Inode {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -114,30 +180,82 @@ func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persisten
 	}
 
 	if id.Ino == 0 {
-		// Find free inode number.
-		for {
-			id.Ino = b.automaticIno
-			b.automaticIno++
-			_, ok := b.stableAttrs[id]
-			if !ok {
-				break
-			}
-		}
+		b.setAutomaticIno(&id)
 	}
 
+	if ops.embed().interceptor == nil {
+		ops.embed().interceptor = interceptor
+	}
 	initInode(ops.embed(), ops, id, b, persistent, b.nextNodeId)
 	b.nextNodeId++
 	return ops.embed()
 }
 
+// setAutomaticIno sets a free automatic inode number in id. Must
+// have b.mu.
+func (b *rawBridge) setAutomaticIno(id *StableAttr) {
+	for {
+		id.Ino = b.automaticIno
+		b.automaticIno++
+		if r := b.reservedIno(id.Ino); r != nil {
+			b.automaticIno = r.last + 1
+			continue
+		}
+		if _, ok := b.stableAttrs[*id]; !ok {
+			break
+		}
+	}
+}
+
+func (b *rawBridge) reservedIno(ino uint64) *inoRange {
+	for i, r := range b.options.reservedInos {
+		if r.first <= ino && ino <= r.last {
+			return &b.options.reservedInos[i]
+		}
+	}
+	return nil
+}
+
+// renumberKey identifies the nodes that CollisionAutoRenumber
+// renumbered.
+type renumberKey struct {
+	attr StableAttr
+	typ  reflect.Type
+}
+
+// stableAttrCollision handles a fresh node that has the same
+// StableAttr as old, according to Options.OnStableAttrCollision. It
+// returns the StableAttr to use for the fresh node, and whether the
+// fresh node should be used rather than old. Must have b.mu.
+func (b *rawBridge) stableAttrCollision(old, fresh *Inode, id StableAttr) (StableAttr, bool) {
+	policy := b.options.OnStableAttrCollision
+	oldType, freshType := reflect.TypeOf(old.ops), reflect.TypeOf(fresh.ops)
+	if policy == CollisionIgnore || oldType == freshType {
+		return id, false
+	}
+	switch policy {
+	case CollisionPanic:
+		log.Panicf("StableAttr %+v used by both %v and %v", id, oldType, freshType)
+	case CollisionWarn:
+		b.logf("warning: StableAttr %+v used by both %v and %v", id, oldType, freshType)
+	case CollisionAutoRenumber:
+		key := renumberKey{id, freshType}
+		b.setAutomaticIno(&id)
+		b.renumbered[key] = id
+		b.renumberedBy[id] = key
+		return id, true
+	}
+	return id, false
+}
+
 func (b *rawBridge) logf(format string, args ...interface{}) {
 	if b.options.Logger != nil {
 		b.options.Logger.Printf(format, args...)
 	}
 }
 
-func (b *rawBridge) newInode(ctx context.Context, ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
-	ch := b.newInodeUnlocked(ops, id, persistent)
+func (b *rawBridge) newInode(ctx context.Context, ops InodeEmbedder, id StableAttr, persistent bool, interceptor Interceptor) *Inode {
+	ch := b.newInodeUnlocked(ops, id, persistent, interceptor)
 	if ch != ops.embed() {
 		return ch
 	}
@@ -173,14 +291,27 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	if id.Mode & ^(uint32(syscall.S_IFMT)) != 0 {
 		log.Panicf("%#v", id)
 	}
+	if b.options.OnStableAttrCollision == CollisionAutoRenumber && fileFlags&syscall.O_EXCL == 0 {
+		b.mu.Lock()
+		if r, ok := b.renumbered[renumberKey{id, reflect.TypeOf(orig.ops)}]; ok {
+			id = r
+		}
+		b.mu.Unlock()
+	}
 	for {
 		lockNodes(parent, child)
 		b.mu.Lock()
+		old := b.stableAttrs[id]
+		if child == orig && old != nil && old != orig {
+			var fresh bool
+			if id, fresh = b.stableAttrCollision(old, orig, id); fresh {
+				break
+			}
+		}
 		if fileFlags&syscall.O_EXCL != 0 {
 			// must create a new node - don't look for existing nodes
 			break
 		}
-		old := b.stableAttrs[id]
 		if old == nil {
 			if child == orig {
 				// no pre-existing node under this inode number
@@ -204,12 +335,16 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 		child = old
 	}
 
+	if child == orig {
+		// The ID changes if the node was renumbered.
+		child.stableAttr = id
+	}
 	child.lookupCount++
 	child.changeCounter++
 
-	b.kernelNodeIds[child.nodeId] = child
-	if len(b.kernelNodeIds) > b.nodeCountHigh {
-		b.nodeCountHigh = len(b.kernelNodeIds)
+	b.kernelNodeIds.set(child.nodeId, child)
+	if l := b.kernelNodeIds.len(); l > b.nodeCountHigh {
+		b.nodeCountHigh = l
 	}
 	// Any node that might be there is overwritten - it is obsolete now
 	b.stableAttrs[id] = child
@@ -217,7 +352,10 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 		fh = b.registerFile(child, file, fileFlags)
 	}
 
-	parent.setEntry(name, child)
+	// Files from Tmpfile have no name.
+	if name != "" {
+		parent.setEntry(name, child)
+	}
 
 	out.NodeId = child.nodeId
 	out.Generation = child.stableAttr.Gen
@@ -229,17 +367,61 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	return child, fh
 }
 
+// setEntryOutTimeout fills in the default timeouts. It is called
+// before calling into the file system, so timeouts set by the file
+// system, including zero ones, take precedence.
 func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
-	b.setAttr(&out.Attr)
-	if b.options.AttrTimeout != nil && out.AttrTimeout() == 0 {
+	if b.options.AttrTimeout != nil {
 		out.SetAttrTimeout(*b.options.AttrTimeout)
 	}
-	if b.options.EntryTimeout != nil && out.EntryTimeout() == 0 {
+	if b.options.EntryTimeout != nil {
 		out.SetEntryTimeout(*b.options.EntryTimeout)
 	}
 }
 
+// setNegativeTimeout replaces the default entry timeout set by
+// setEntryOutTimeout with the negative timeout, for a failed lookup.
+func (b *rawBridge) setNegativeTimeout(out *fuse.EntryOut) {
+	var def, neg time.Duration
+	if b.options.EntryTimeout != nil {
+		def = *b.options.EntryTimeout
+	}
+	if b.options.NegativeTimeout != nil {
+		neg = *b.options.NegativeTimeout
+	}
+	if out.EntryTimeout() == def {
+		out.SetEntryTimeout(neg)
+	}
+}
+
+// newContext returns the context for calling into the file system
+// on behalf of the caller, whose IDs are mapped by
+// Options.UidGidMapper.
+func (b *rawBridge) newContext(cancel <-chan struct{}, caller *fuse.Caller) *fuse.Context {
+	ctx := &fuse.Context{Caller: *caller, Cancel: cancel}
+	if m := b.options.UidGidMapper; m != nil {
+		ctx.Uid, ctx.Gid = m.FromKernel(caller.Uid, caller.Gid)
+	}
+	return ctx
+}
+
+// applyUmask removes umask from mode if Options.ApplyUmask is set.
+func (b *rawBridge) applyUmask(mode, umask uint32) uint32 {
+	if b.options.ApplyUmask {
+		mode &^= umask
+	}
+	return mode
+}
+
+// toKernelOwner maps the owner of a file for the kernel.
+func (b *rawBridge) toKernelOwner(out *fuse.Owner) {
+	if m := b.options.UidGidMapper; m != nil {
+		out.Uid, out.Gid = m.ToKernel(out.Uid, out.Gid)
+	}
+}
+
 func (b *rawBridge) setAttr(out *fuse.Attr) {
+	b.toKernelOwner(&out.Owner)
 	if !b.options.NullPermissions && out.Mode&07777 == 0 {
 		out.Mode |= 0644
 		if out.Mode&syscall.S_IFDIR != 0 {
@@ -255,8 +437,10 @@ func (b *rawBridge) setAttr(out *fuse.Attr) {
 	setBlocks(out)
 }
 
+// setAttrTimeout fills in the default timeout before calling into
+// the file system, like setEntryOutTimeout.
 func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
-	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
+	if b.options.AttrTimeout != nil {
 		out.SetTimeout(*b.options.AttrTimeout)
 	}
 }
@@ -269,6 +453,8 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		server:       opts.ServerCallbacks,
 		nextNodeId:   2, // the root node has nodeid 1
 		stableAttrs:  make(map[StableAttr]*Inode),
+		renumbered:   make(map[renumberKey]StableAttr),
+		renumberedBy: make(map[StableAttr]renumberKey),
 	}
 
 	if bridge.automaticIno == 0 {
@@ -294,9 +480,8 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 	)
 	bridge.root = root.embed()
 	bridge.root.lookupCount = 1
-	bridge.kernelNodeIds = map[uint64]*Inode{
-		1: bridge.root,
-	}
+	bridge.kernelNodeIds = newNodeIdMap()
+	bridge.kernelNodeIds.set(1, bridge.root)
 
 	// Fh 0 means no file handle.
 	bridge.files = []*fileEntry{{}}
@@ -307,6 +492,9 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		oa.OnAdd(context.Background())
 	}
 
+	if bridge.options.RequestTimeout > 0 {
+		return newTimeoutBridge(bridge)
+	}
 	return bridge
 }
 
@@ -314,10 +502,13 @@ func (b *rawBridge) String() string {
 	return "rawBridge"
 }
 
+// inode returns the node and file entry of a request. It does not
+// take b.mu, so operations on different nodes do not contend.
 func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	n, f := b.kernelNodeIds[id], b.files[fh]
+	n := b.kernelNodeIds.get(id)
+	b.filesMu.RLock()
+	f := b.files[fh]
+	b.filesMu.RUnlock()
 	if n == nil {
 		log.Panicf("unknown node %d", id)
 	}
@@ -326,25 +517,41 @@ func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 
 func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
-	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &header.Caller)
+	b.setEntryOutTimeout(out)
 	child, errno := b.lookup(ctx, parent, name, out)
 
 	if errno != 0 {
-		if b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
-			out.SetEntryTimeout(*b.options.NegativeTimeout)
+		b.setNegativeTimeout(out)
+		if errno == syscall.ENOENT && out.EntryTimeout() > 0 {
+			// The kernel discards the entry timeout of an
+			// error reply. A negative entry is cached only
+			// if it comes as a successful reply with a zero
+			// node ID.
+			out.NodeId = 0
+			return fuse.OK
 		}
 		return errnoToStatus(errno)
 	}
 
 	child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setAttr(&out.Attr)
 	return fuse.OK
 }
 
 func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	if lu, ok := parent.ops.(NodeLookuper); ok {
-		return lu.Lookup(ctx, name, out)
+		if !parent.intercepted() {
+			child, errno := lu.Lookup(ctx, name, out)
+			return child, parent.callDone(errno)
+		}
+		var child *Inode
+		errno := parent.intercept(ctx, "Lookup", func() (errno syscall.Errno) {
+			child, errno = lu.Lookup(ctx, name, out)
+			return errno
+		})
+		return child, errno
 	}
 
 	child := parent.GetChild(name)
@@ -353,10 +560,20 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 	}
 
 	if ga, ok := child.ops.(NodeGetattrer); ok {
-		var a fuse.AttrOut
-		errno := ga.Getattr(ctx, nil, &a)
+		a := getAttrOut()
+		defer putAttrOut(a)
+		a.SetTimeout(out.AttrTimeout())
+		var errno syscall.Errno
+		if !child.intercepted() {
+			errno = child.callDone(ga.Getattr(ctx, nil, a))
+		} else {
+			errno = child.intercept(ctx, "Getattr", func() syscall.Errno {
+				return ga.Getattr(ctx, nil, a)
+			})
+		}
 		if errno == 0 {
 			out.Attr = a.Attr
+			out.SetAttrTimeout(a.Timeout())
 		}
 	}
 
@@ -364,10 +581,16 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 }
 
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeRmdirer); ok {
-		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		ctx := b.newContext(cancel, &header.Caller)
+		errno = parent.intercept(ctx, "Rmdir", func() syscall.Errno {
+			return mops.Rmdir(ctx, name)
+		})
 	}
 
 	if errno == 0 {
@@ -377,10 +600,16 @@ func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name st
 }
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeUnlinker); ok {
-		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		ctx := b.newContext(cancel, &header.Caller)
+		errno = parent.intercept(ctx, "Unlink", func() syscall.Errno {
+			return mops.Unlink(ctx, name)
+		})
 	}
 
 	if errno == 0 {
@@ -390,12 +619,20 @@ func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name s
 }
 
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMkdirer); ok {
-		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, out)
+		b.setEntryOutTimeout(out)
+		ctx := b.newContext(cancel, &input.Caller)
+		errno = parent.intercept(ctx, "Mkdir", func() (errno syscall.Errno) {
+			child, errno = mops.Mkdir(ctx, name, b.applyUmask(input.Mode, input.Umask), out)
+			return errno
+		})
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -414,17 +651,25 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setAttr(&out.Attr)
 	return fuse.OK
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMknoder); ok {
-		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, input.Rdev, out)
+		b.setEntryOutTimeout(out)
+		ctx := b.newContext(cancel, &input.Caller)
+		errno = parent.intercept(ctx, "Mknod", func() (errno syscall.Errno) {
+			child, errno = mops.Mknod(ctx, name, b.applyUmask(input.Mode, mknodUmask(input)), input.Rdev, out)
+			return errno
+		})
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -435,12 +680,19 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setAttr(&out.Attr)
+	if got, want := out.Mode&syscall.S_IFMT, input.Mode&syscall.S_IFMT; want != 0 && got != want {
+		// The kernel rejects the entry with EIO.
+		b.logf("Mknod %q: node has file type %o, want %o", name, got, want)
+	}
 	return fuse.OK
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
+	ctx := b.newContext(cancel, &input.Caller)
 	parent, _ := b.inode(input.NodeId, 0)
 
 	var child *Inode
@@ -448,7 +700,11 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	var f FileHandle
 	var flags uint32
 	if mops, ok := parent.ops.(NodeCreater); ok {
-		child, f, flags, errno = mops.Create(ctx, name, input.Flags, input.Mode, &out.EntryOut)
+		b.setEntryOutTimeout(&out.EntryOut)
+		errno = parent.intercept(ctx, "Create", func() (errno syscall.Errno) {
+			child, f, flags, errno = mops.Create(ctx, name, b.openFlags(input.Flags), b.applyUmask(input.Mode, createUmask(input)), &out.EntryOut)
+			return errno
+		})
 	} else {
 		return fuse.EROFS
 	}
@@ -466,7 +722,41 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	out.OpenFlags = flags
 
 	child.setEntryOut(&out.EntryOut)
+	b.setAttr(&out.EntryOut.Attr)
+	return fuse.OK
+}
+
+func (b *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
+	ctx := b.newContext(cancel, &input.Caller)
+	parent, _ := b.inode(input.NodeId, 0)
+
+	mops, ok := parent.ops.(NodeTmpfiler)
+	if !ok {
+		// Not ENOSYS, which disables O_TMPFILE for all directories.
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
 	b.setEntryOutTimeout(&out.EntryOut)
+	var child *Inode
+	var f FileHandle
+	var flags uint32
+	errno := parent.intercept(ctx, "Tmpfile", func() (errno syscall.Errno) {
+		child, f, flags, errno = mops.Tmpfile(ctx, b.openFlags(input.Flags), input.Mode, &out.EntryOut)
+		return errno
+	})
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+
+	child, fh := b.addNewChild(parent, "", child, f, input.Flags|syscall.O_CREAT|syscall.O_EXCL, &out.EntryOut)
+
+	out.Fh = uint64(fh)
+	out.OpenFlags = flags
+
+	child.setEntryOut(&out.EntryOut)
+	b.setAttr(&out.EntryOut.Attr)
 	return fuse.OK
 }
 
@@ -479,6 +769,70 @@ func (b *rawBridge) Forget(nodeid, nlookup uint64) {
 	}
 }
 
+// BatchForget is like Forget for many nodes. It takes the bridge lock
+// once for the batch rather than once per node, so other operations
+// are not held up by lock contention, and removes the forgotten
+// nodes from the tree after releasing it.
+func (b *rawBridge) BatchForget(forgets []fuse.ForgetOne) {
+	counts := make(map[*Inode]uint64, len(forgets))
+	nodes := make([]*Inode, 0, len(forgets))
+	b.mu.Lock()
+	for _, f := range forgets {
+		n := b.kernelNodeIds.get(f.NodeId)
+		if n == nil {
+			b.mu.Unlock()
+			log.Panicf("unknown node %d", f.NodeId)
+		}
+		if _, ok := counts[n]; !ok {
+			nodes = append(nodes, n)
+		}
+		counts[n] += f.Nlookup
+	}
+	b.mu.Unlock()
+
+	var forgotten []*Inode
+	lockNodes(nodes...)
+	b.mu.Lock()
+	for _, n := range nodes {
+		nlookup := counts[n]
+		if nlookup > n.lookupCount {
+			log.Panicf("n%d lookupCount underflow: lookupCount=%d, decrement=%d", n.nodeId, n.lookupCount, nlookup)
+		}
+		n.lookupCount -= nlookup
+		n.changeCounter++
+		if n.lookupCount == 0 {
+			b.dropKernelNode(n)
+			forgotten = append(forgotten, n)
+		}
+	}
+	b.mu.Unlock()
+	unlockNodes(nodes...)
+
+	for _, n := range forgotten {
+		n.mu.Lock()
+		n.detach()
+	}
+	if len(forgotten) > 0 {
+		b.compactMemory()
+	}
+}
+
+// dropKernelNode removes a node that the kernel forgot from the
+// lookup tables. Must have b.mu.
+func (b *rawBridge) dropKernelNode(n *Inode) {
+	// Dropping the node from stableAttrs guarantees that no new references to this node are
+	// handed out to the kernel, hence we can also safely delete it from kernelNodeIds.
+	// A newer node for the same inode number may have replaced it already.
+	if b.stableAttrs[n.stableAttr] == n {
+		delete(b.stableAttrs, n.stableAttr)
+		if key, ok := b.renumberedBy[n.stableAttr]; ok {
+			delete(b.renumbered, key)
+			delete(b.renumberedBy, n.stableAttr)
+		}
+	}
+	b.kernelNodeIds.delete(n.nodeId)
+}
+
 // compactMemory tries to free memory that was previously used by forgotten
 // nodes.
 //
@@ -490,7 +844,7 @@ func (b *rawBridge) Forget(nodeid, nlookup uint64) {
 func (b *rawBridge) compactMemory() {
 	b.mu.Lock()
 
-	if b.nodeCountHigh <= len(b.kernelNodeIds)*100 {
+	if b.nodeCountHigh <= b.kernelNodeIds.len()*100 {
 		b.mu.Unlock()
 		return
 	}
@@ -501,13 +855,8 @@ func (b *rawBridge) compactMemory() {
 	}
 	b.stableAttrs = tmpStableAttrs
 
-	tmpKernelNodeIds := make(map[uint64]*Inode, len(b.kernelNodeIds))
-	for i, v := range b.kernelNodeIds {
-		tmpKernelNodeIds[i] = v
-	}
-	b.kernelNodeIds = tmpKernelNodeIds
-
-	b.nodeCountHigh = len(b.kernelNodeIds)
+	b.kernelNodeIds.compact()
+	b.nodeCountHigh = b.kernelNodeIds.len()
 
 	b.mu.Unlock()
 
@@ -518,37 +867,139 @@ func (b *rawBridge) compactMemory() {
 func (b *rawBridge) SetDebug(debug bool) {}
 
 func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
-	n, fEntry := b.inode(input.NodeId, input.Fh())
-	f := fEntry.file
+	var fh uint64
+	if input.Flags()&fuse.FUSE_GETATTR_FH != 0 {
+		fh = input.Fh()
+	}
+	n, f, kernelFh, done := b.attrFile(input.NodeId, fh)
+	defer done()
+
+	if b.options.NoGetattrOnOpenFiles {
+		b.mu.Lock()
+		attr := n.openAttr
+		b.mu.Unlock()
+		if attr != nil {
+			out.Attr = *attr
+			b.setAttrTimeout(out)
+			return fuse.OK
+		}
+	}
+
+	ctx := b.newContext(cancel, &input.Caller)
+	errno := b.getattr(ctx, n, f, kernelFh, out)
+	if errno == 0 && b.options.NoGetattrOnOpenFiles {
+		b.setOpenAttr(n, &out.Attr)
+	}
+	return errnoToStatus(errno)
+}
+
+// setOpenAttr remembers attr as the attributes of n while it has open
+// files. See Options.NoGetattrOnOpenFiles.
+func (b *rawBridge) setOpenAttr(n *Inode, attr *fuse.Attr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(n.openFiles) > 0 {
+		a := *attr
+		n.openAttr = &a
+	}
+}
+
+// attrFile returns the node 'id', and the file 'fh' or any other file
+// opened on it to read the attributes from. kernelFh is set if the
+// kernel passed the file, eg. for fstat(2). 'done' must be called
+// when the file is no longer used.
+func (b *rawBridge) attrFile(id uint64, fh uint64) (n *Inode, f FileHandle, kernelFh bool, done func()) {
+	n, fEntry := b.inode(id, fh)
+	f = fEntry.file
+	kernelFh = f != nil
+	done = func() {}
 	if f == nil {
 		// The linux kernel doesnt pass along the file
 		// descriptor, so we have to fake it here.
 		// See https://github.com/libfuse/libfuse/issues/62
 		b.mu.Lock()
 		for _, fh := range n.openFiles {
-			f = b.files[fh].file
-			b.files[fh].wg.Add(1)
-			defer b.files[fh].wg.Done()
+			entry := b.files[fh]
+			f = entry.file
+			entry.wg.Add(1)
+			done = entry.wg.Done
 			break
 		}
 		b.mu.Unlock()
 	}
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
-	return errnoToStatus(b.getattr(ctx, n, f, out))
+	return n, f, kernelFh, done
+}
+
+func (b *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	var fh uint64
+	if in.GetattrFlags&fuse.FUSE_GETATTR_FH != 0 {
+		fh = in.Fh
+	}
+	n, f, kernelFh, done := b.attrFile(in.NodeId, fh)
+	defer done()
+	ctx := b.newContext(cancel, &in.Caller)
+
+	sx, ok := n.ops.(NodeStatxer)
+	if !ok {
+		attr := getAttrOut()
+		defer putAttrOut(attr)
+		errno := b.getattr(ctx, n, f, kernelFh, attr)
+		if errno == 0 {
+			out.FromAttr(&attr.Attr)
+			out.SetTimeout(attr.Timeout())
+		}
+		return errnoToStatus(errno)
+	}
+
+	if b.options.AttrTimeout != nil {
+		out.SetTimeout(*b.options.AttrTimeout)
+	}
+	errno := n.intercept(ctx, "Statx", func() syscall.Errno {
+		return sx.Statx(ctx, f, in.SxFlags, in.SxMask, out)
+	})
+	if errno == 0 {
+		out.Ino = n.stableAttr.Ino
+		out.Mode = uint16(uint32(out.Mode)&07777 | n.stableAttr.Mode)
+
+		// Apply the same defaults as for Getattr.
+		attr := fuse.Attr{Mode: uint32(out.Mode), Owner: fuse.Owner{Uid: out.Uid, Gid: out.Gid}}
+		b.setAttr(&attr)
+		out.Mode, out.Uid, out.Gid = uint16(attr.Mode), attr.Uid, attr.Gid
+		setStatxBlocks(&out.Statx)
+	}
+	return errnoToStatus(errno)
 }
 
-func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+// getattr reads the attributes of n. If the kernel passed the file
+// handle f (kernelFh), and it implements FileGetattrer, the handle
+// takes precedence over the node, as it may know better, eg. the
+// size of a file that is being appended to.
+func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, kernelFh bool, out *fuse.AttrOut) syscall.Errno {
 	var errno syscall.Errno
 
 	var fg FileGetattrer
 	if f != nil {
 		fg, _ = f.(FileGetattrer)
 	}
+	fops, nodeOK := n.ops.(NodeGetattrer)
 
-	if fops, ok := n.ops.(NodeGetattrer); ok {
-		errno = fops.Getattr(ctx, f, out)
-	} else if fg != nil {
-		errno = fg.Getattr(ctx, out)
+	b.setAttrTimeout(out)
+	if fg != nil && (kernelFh || !nodeOK) {
+		if !n.intercepted() {
+			errno = n.callDone(fg.Getattr(ctx, out))
+		} else {
+			errno = n.intercept(ctx, "Getattr", func() syscall.Errno {
+				return fg.Getattr(ctx, out)
+			})
+		}
+	} else if nodeOK {
+		if !n.intercepted() {
+			errno = n.callDone(fops.Getattr(ctx, f, out))
+		} else {
+			errno = n.intercept(ctx, "Getattr", func() syscall.Errno {
+				return fops.Getattr(ctx, f, out)
+			})
+		}
 	} else {
 		// We set Mode below, which is the minimum for success
 	}
@@ -560,36 +1011,65 @@ func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fu
 		out.Ino = n.stableAttr.Ino
 		out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
 		b.setAttr(&out.Attr)
-		b.setAttrTimeout(out)
 	}
 	return errno
 }
 
 func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
-	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
+	ctx := b.newContext(cancel, &in.Caller)
 
 	fh, _ := in.GetFh()
 
 	n, fEntry := b.inode(in.NodeId, fh)
 	f := fEntry.file
 
+	if m := b.options.UidGidMapper; m != nil && in.Valid&(fuse.FATTR_UID|fuse.FATTR_GID) != 0 {
+		uid, gid := m.FromKernel(in.Uid, in.Gid)
+		if in.Valid&fuse.FATTR_UID != 0 {
+			in.Uid = uid
+		}
+		if in.Valid&fuse.FATTR_GID != 0 {
+			in.Gid = gid
+		}
+	}
+
+	// If the kernel passes a file handle, eg. for ftruncate(2),
+	// prefer the handle, so the change goes through the same
+	// handle as the writes.
 	var errno = syscall.ENOTSUP
-	if fops, ok := n.ops.(NodeSetattrer); ok {
-		errno = fops.Setattr(ctx, f, in, out)
-	} else if fops, ok := f.(FileSetattrer); ok {
-		errno = fops.Setattr(ctx, in, out)
+	if fops, ok := f.(FileSetattrer); ok {
+		errno = n.intercept(ctx, "Setattr", func() syscall.Errno {
+			return fops.Setattr(ctx, in, out)
+		})
+	} else if fops, ok := n.ops.(NodeSetattrer); ok {
+		errno = n.intercept(ctx, "Setattr", func() syscall.Errno {
+			return fops.Setattr(ctx, f, in, out)
+		})
 	}
 
 	out.Mode = n.stableAttr.Mode | (out.Mode & 07777)
+	b.toKernelOwner(&out.Owner)
+	if errno == 0 && b.options.NoGetattrOnOpenFiles {
+		b.setOpenAttr(n, &out.Attr)
+	}
 	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
 
 	if mops, ok := p1.ops.(NodeRenamer); ok {
-		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
+		ctx := b.newContext(cancel, &input.Caller)
+		errno := p1.intercept(ctx, "Rename", func() syscall.Errno {
+			return mops.Rename(ctx, oldName, p2.ops, newName, input.Flags)
+		})
 		if errno == 0 {
 			if input.Flags&RENAME_EXCHANGE != 0 {
 				p1.ExchangeChild(oldName, p2, newName)
@@ -604,35 +1084,53 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName
 }
 
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 	target, _ := b.inode(input.Oldnodeid, 0)
 
 	if mops, ok := parent.ops.(NodeLinker); ok {
-		child, errno := mops.Link(&fuse.Context{Caller: input.Caller, Cancel: cancel}, target.ops, name, out)
+		b.setEntryOutTimeout(out)
+		ctx := b.newContext(cancel, &input.Caller)
+		var child *Inode
+		errno := parent.intercept(ctx, "Link", func() (errno syscall.Errno) {
+			child, errno = mops.Link(ctx, target.ops, name, out)
+			return errno
+		})
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
 
 		child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 		child.setEntryOut(out)
-		b.setEntryOutTimeout(out)
+		b.setAttr(&out.Attr)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
 
 	if mops, ok := parent.ops.(NodeSymlinker); ok {
-		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, target, name, out)
+		b.setEntryOutTimeout(out)
+		ctx := b.newContext(cancel, &header.Caller)
+		var child *Inode
+		status := parent.intercept(ctx, "Symlink", func() (errno syscall.Errno) {
+			child, errno = mops.Symlink(ctx, target, name, out)
+			return errno
+		})
 		if status != 0 {
 			return errnoToStatus(status)
 		}
 
 		child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 		child.setEntryOut(out)
-		b.setEntryOutTimeout(out)
+		b.setAttr(&out.Attr)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
@@ -642,7 +1140,12 @@ func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out
 	n, _ := b.inode(header.NodeId, 0)
 
 	if linker, ok := n.ops.(NodeReadlinker); ok {
-		result, errno := linker.Readlink(&fuse.Context{Caller: header.Caller, Cancel: cancel})
+		ctx := b.newContext(cancel, &header.Caller)
+		var result []byte
+		errno := n.intercept(ctx, "Readlink", func() (errno syscall.Errno) {
+			result, errno = linker.Readlink(ctx)
+			return errno
+		})
 		if errno != 0 {
 			return nil, errnoToStatus(errno)
 		}
@@ -657,20 +1160,31 @@ func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out
 func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.Caller)
 	if a, ok := n.ops.(NodeAccesser); ok {
-		return errnoToStatus(a.Access(ctx, input.Mask))
+		return errnoToStatus(n.intercept(ctx, "Access", func() syscall.Errno {
+			return a.Access(ctx, input.Mask)
+		}))
 	}
 
 	// default: check attributes.
 	caller := input.Caller
 
 	var out fuse.AttrOut
-	if s := b.getattr(ctx, n, nil, &out); s != 0 {
+	if s := b.getattr(ctx, n, nil, false, &out); s != 0 {
 		return errnoToStatus(s)
 	}
 
-	if !internal.HasAccess(caller.Uid, caller.Gid, out.Uid, out.Gid, out.Mode, input.Mask) {
+	groups := func() []uint32 {
+		gs, err := caller.Groups()
+		if err != nil {
+			// The process is gone, or its groups cannot be
+			// read. Use the groups of its user.
+			return internal.UserGroups(caller.Uid)
+		}
+		return gs
+	}
+	if !internal.HasAccessGroups(caller.Uid, caller.Gid, groups, out.Uid, out.Gid, out.Mode, input.Mask) {
 		return fuse.EACCES
 	}
 	return fuse.OK
@@ -682,7 +1196,12 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 	n, _ := b.inode(header.NodeId, 0)
 
 	if xops, ok := n.ops.(NodeGetxattrer); ok {
-		nb, errno := xops.Getxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr, data)
+		ctx := b.newContext(cancel, &header.Caller)
+		var nb uint32
+		errno := n.intercept(ctx, "Getxattr", func() (errno syscall.Errno) {
+			nb, errno = xops.Getxattr(ctx, attr, data)
+			return errno
+		})
 		return nb, errnoToStatus(errno)
 	}
 
@@ -692,33 +1211,58 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 	if xops, ok := n.ops.(NodeListxattrer); ok {
-		sz, errno := xops.Listxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, dest)
+		ctx := b.newContext(cancel, &header.Caller)
+		errno := n.intercept(ctx, "Listxattr", func() (errno syscall.Errno) {
+			sz, errno = xops.Listxattr(ctx, dest)
+			return errno
+		})
 		return sz, errnoToStatus(errno)
 	}
 	return 0, fuse.OK
 }
 
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(input.NodeId, 0)
 	if xops, ok := n.ops.(NodeSetxattrer); ok {
-		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
+		ctx := b.newContext(cancel, &input.Caller)
+		return errnoToStatus(n.intercept(ctx, "Setxattr", func() syscall.Errno {
+			return xops.Setxattr(ctx, attr, data, input.Flags)
+		}))
 	}
 	return fuse.ENOATTR
 }
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(header.NodeId, 0)
 	if xops, ok := n.ops.(NodeRemovexattrer); ok {
-		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
+		ctx := b.newContext(cancel, &header.Caller)
+		return errnoToStatus(n.intercept(ctx, "Removexattr", func() syscall.Errno {
+			return xops.Removexattr(ctx, attr)
+		}))
 	}
 	return fuse.ENOATTR
 }
 
 func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if b.options.ReadOnly && (input.Flags&syscall.O_ACCMODE != syscall.O_RDONLY || input.Flags&syscall.O_TRUNC != 0) {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(input.NodeId, 0)
 
 	if op, ok := n.ops.(NodeOpener); ok {
-		f, flags, errno := op.Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
+		ctx := b.newContext(cancel, &input.Caller)
+		var f FileHandle
+		var flags uint32
+		errno := n.intercept(ctx, "Open", func() (errno syscall.Errno) {
+			f, flags, errno = op.Open(ctx, b.openFlags(input.Flags))
+			return errno
+		})
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
@@ -735,9 +1279,23 @@ func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.O
 	return fuse.ENOTSUP
 }
 
+// openFlags returns the flags to pass to the nodes for opening a
+// file. With the writeback cache, the kernel does the appending, and
+// reads from files opened for writing.
+func (b *rawBridge) openFlags(flags uint32) uint32 {
+	if b.options.EnableWritebackCache {
+		if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+			flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+		}
+		flags &^= syscall.O_APPEND
+	}
+	return flags
+}
+
 // registerFile hands out a file handle. Must have bridge.mu
 func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	var fh uint32
+	b.filesMu.Lock()
 	if len(b.freeFiles) > 0 {
 		last := len(b.freeFiles) - 1
 		fh = b.freeFiles[last]
@@ -746,10 +1304,14 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 		fh = uint32(len(b.files))
 		b.files = append(b.files, &fileEntry{})
 	}
-
 	fileEntry := b.files[fh]
-	fileEntry.nodeIndex = len(n.openFiles)
 	fileEntry.file = f
+	fileEntry.dirHandle = nil
+	fileEntry.orphaned = false
+	b.filesMu.Unlock()
+
+	fileEntry.nodeIndex = len(n.openFiles)
+	fileEntry.pollKh = 0
 
 	n.openFiles = append(n.openFiles, fh)
 	return fh
@@ -757,13 +1319,21 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 
+	var res fuse.ReadResult
 	if fops, ok := n.ops.(NodeReader); ok {
-		res, errno := fops.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, buf, int64(input.Offset))
+		errno := n.intercept(ctx, "Read", func() (errno syscall.Errno) {
+			res, errno = fops.Read(ctx, f.file, buf, int64(input.Offset))
+			return errno
+		})
 		return res, errnoToStatus(errno)
 	}
 	if fr, ok := f.file.(FileReader); ok {
-		res, errno := fr.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, buf, int64(input.Offset))
+		errno := n.intercept(ctx, "Read", func() (errno syscall.Errno) {
+			res, errno = fr.Read(ctx, buf, int64(input.Offset))
+			return errno
+		})
 		return res, errnoToStatus(errno)
 	}
 
@@ -772,49 +1342,75 @@ func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte)
 
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 
 	if lops, ok := n.ops.(NodeGetlker); ok {
-		return errnoToStatus(lops.Getlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
+		return errnoToStatus(n.intercept(ctx, "Getlk", func() syscall.Errno {
+			return lops.Getlk(ctx, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+		}))
 	}
 	if gl, ok := f.file.(FileGetlker); ok {
-		return errnoToStatus(gl.Getlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
+		return errnoToStatus(n.intercept(ctx, "Getlk", func() syscall.Errno {
+			return gl.Getlk(ctx, input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+		}))
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 	if lops, ok := n.ops.(NodeSetlker); ok {
-		return errnoToStatus(lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
+		return errnoToStatus(n.intercept(ctx, "Setlk", func() syscall.Errno {
+			return lops.Setlk(ctx, f.file, input.Owner, &input.Lk, input.LkFlags)
+		}))
 	}
-	if sl, ok := n.ops.(FileSetlker); ok {
-		return errnoToStatus(sl.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
+	if sl, ok := f.file.(FileSetlker); ok {
+		return errnoToStatus(n.intercept(ctx, "Setlk", func() syscall.Errno {
+			return sl.Setlk(ctx, input.Owner, &input.Lk, input.LkFlags)
+		}))
 	}
 	return fuse.ENOTSUP
 }
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 	if lops, ok := n.ops.(NodeSetlkwer); ok {
-		return errnoToStatus(lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
+		return errnoToStatus(n.intercept(ctx, "Setlkw", func() syscall.Errno {
+			return lops.Setlkw(ctx, f.file, input.Owner, &input.Lk, input.LkFlags)
+		}))
 	}
-	if sl, ok := n.ops.(FileSetlkwer); ok {
-		return errnoToStatus(sl.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
+	if sl, ok := f.file.(FileSetlkwer); ok {
+		return errnoToStatus(n.intercept(ctx, "Setlkw", func() syscall.Errno {
+			return sl.Setlkw(ctx, input.Owner, &input.Lk, input.LkFlags)
+		}))
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
-	n, f := b.releaseFileEntry(input.NodeId, input.Fh)
+	n, f, orphaned := b.releaseFileEntry(input.NodeId, input.Fh)
 	if f == nil {
 		return
 	}
 
 	f.wg.Wait()
 
-	if r, ok := n.ops.(NodeReleaser); ok {
-		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file)
-	} else if r, ok := f.file.(FileReleaser); ok {
-		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel})
+	// Orphaned handles went to Options.OnOrphanHandle already.
+	ctx := b.newContext(cancel, &input.Caller)
+	if input.ReleaseFlags&fuse.RELEASE_FLOCK_UNLOCK != 0 && !orphaned {
+		// The kernel does not send an unlock for flock(2) locks
+		// that are still held when the file is closed.
+		b.flockUnlock(ctx, n, f, input.LockOwner)
+	}
+	if r, ok := n.ops.(NodeReleaser); ok && !orphaned {
+		n.intercept(ctx, "Release", func() syscall.Errno {
+			return r.Release(ctx, f.file)
+		})
+	} else if r, ok := f.file.(FileReleaser); ok && !orphaned {
+		n.intercept(ctx, "Release", func() syscall.Errno {
+			return r.Release(ctx)
+		})
 	}
 
 	b.mu.Lock()
@@ -822,8 +1418,21 @@ func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
 }
 
+func (b *rawBridge) flockUnlock(ctx *fuse.Context, n *Inode, f *fileEntry, owner uint64) {
+	lk := fuse.FileLock{End: (1 << 63) - 1, Typ: syscall.F_UNLCK}
+	if lops, ok := n.ops.(NodeSetlker); ok {
+		n.intercept(ctx, "Setlk", func() syscall.Errno {
+			return lops.Setlk(ctx, f.file, owner, &lk, fuse.FUSE_LK_FLOCK)
+		})
+	} else if sl, ok := f.file.(FileSetlker); ok {
+		n.intercept(ctx, "Setlk", func() syscall.Errno {
+			return sl.Setlk(ctx, owner, &lk, fuse.FUSE_LK_FLOCK)
+		})
+	}
+}
+
 func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
-	_, f := b.releaseFileEntry(input.NodeId, input.Fh)
+	n, f, _ := b.releaseFileEntry(input.NodeId, input.Fh)
 	f.wg.Wait()
 
 	f.mu.Lock()
@@ -831,6 +1440,7 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 		f.dirStream.Close()
 		f.dirStream = nil
 	}
+	b.releaseDirHandle(b.newContext(nil, &input.Caller), n, f, input.ReleaseFlags)
 	f.mu.Unlock()
 
 	b.mu.Lock()
@@ -838,12 +1448,31 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
 }
 
-func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry) {
+// releaseDirHandle calls Releasedir on the handle from
+// OpendirHandle, if there is one, and drops the handle, so it is
+// released only once. Caller must hold f.mu.
+func (b *rawBridge) releaseDirHandle(ctx context.Context, n *Inode, f *fileEntry, releaseFlags uint32) {
+	if r, ok := f.dirHandle.(FileReleasedirer); ok {
+		n.intercept(ctx, "Releasedir", func() syscall.Errno {
+			r.Releasedir(ctx, releaseFlags)
+			return OK
+		})
+	}
+	b.mu.Lock()
+	b.filesMu.Lock()
+	f.dirHandle = nil
+	b.filesMu.Unlock()
+	b.mu.Unlock()
+}
+
+// releaseFileEntry removes the handle 'fh' from the open files of
+// the node. It also returns whether the handle was orphaned, which
+// cannot change once the handle is no longer open.
+func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (n *Inode, entry *fileEntry, orphaned bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	n := b.kernelNodeIds[nid]
-	var entry *fileEntry
+	n = b.kernelNodeIds.get(nid)
 	if fh > 0 {
 		last := len(n.openFiles) - 1
 		entry = b.files[fh]
@@ -853,63 +1482,160 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 			b.files[n.openFiles[entry.nodeIndex]].nodeIndex = entry.nodeIndex
 		}
 		n.openFiles = n.openFiles[:last]
+		if last == 0 {
+			n.openAttr = nil
+		}
+		entry.pollKh = 0
+		orphaned = entry.orphaned
 	}
-	return n, entry
+	return n, entry, orphaned
 }
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
+	if b.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 
 	if wr, ok := n.ops.(NodeWriter); ok {
-		w, errno := wr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+		errno := n.intercept(ctx, "Write", func() (errno syscall.Errno) {
+			written, errno = wr.Write(ctx, f.file, data, int64(input.Offset))
+			return errno
+		})
+		return written, errnoToStatus(errno)
 	}
 	if fr, ok := f.file.(FileWriter); ok {
-		w, errno := fr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+		errno := n.intercept(ctx, "Write", func() (errno syscall.Errno) {
+			written, errno = fr.Write(ctx, data, int64(input.Offset))
+			return errno
+		})
+		return written, errnoToStatus(errno)
 	}
 
 	return 0, fuse.ENOTSUP
 }
 
+// WriteFd implements fuse.WriteFder. Nodes that write themselves, or
+// are intercepted, get their data through Write.
+func (b *rawBridge) WriteFd(cancel <-chan struct{}, input *fuse.WriteIn) (int, bool) {
+	if b.options.ReadOnly {
+		return -1, false
+	}
+	n, f := b.inode(input.NodeId, input.Fh)
+	if _, ok := n.ops.(NodeWriter); ok || n.intercepted() {
+		return -1, false
+	}
+	if _, ok := f.file.(FileWriter); !ok {
+		return -1, false
+	}
+	fder, ok := f.file.(FilePassthroughFder)
+	if !ok {
+		return -1, false
+	}
+	fd := fder.Fd()
+	return fd, fd >= 0
+}
+
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 	if fl, ok := n.ops.(NodeFlusher); ok {
-		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file))
+		return errnoToStatus(n.intercept(ctx, "Flush", func() syscall.Errno {
+			return fl.Flush(ctx, f.file)
+		}))
 	}
 	if fl, ok := f.file.(FileFlusher); ok {
-		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}))
+		return errnoToStatus(n.intercept(ctx, "Flush", func() syscall.Errno {
+			return fl.Flush(ctx)
+		}))
 	}
 	return 0
 }
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 	if fs, ok := n.ops.(NodeFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
+		return errnoToStatus(n.intercept(ctx, "Fsync", func() syscall.Errno {
+			return fs.Fsync(ctx, f.file, input.FsyncFlags)
+		}))
 	}
 	if fs, ok := f.file.(FileFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.FsyncFlags))
+		return errnoToStatus(n.intercept(ctx, "Fsync", func() syscall.Errno {
+			return fs.Fsync(ctx, input.FsyncFlags)
+		}))
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
 	if a, ok := n.ops.(NodeAllocater); ok {
-		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Offset, input.Length, input.Mode))
+		return errnoToStatus(n.intercept(ctx, "Allocate", func() syscall.Errno {
+			return a.Allocate(ctx, f.file, input.Offset, input.Length, input.Mode)
+		}))
 	}
 	if a, ok := f.file.(FileAllocater); ok {
-		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Offset, input.Length, input.Mode))
+		return errnoToStatus(n.intercept(ctx, "Allocate", func() syscall.Errno {
+			return a.Allocate(ctx, input.Offset, input.Length, input.Mode)
+		}))
 	}
 	return fuse.ENOTSUP
 }
 
+func (b *rawBridge) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, bufOut []byte) fuse.Status {
+	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
+	var errno syscall.Errno
+	if io, ok := n.ops.(NodeIoctler); ok {
+		errno = n.intercept(ctx, "Ioctl", func() (errno syscall.Errno) {
+			output.Result, errno = io.Ioctl(ctx, f.file, input.Cmd, input.Arg, inbuf, bufOut)
+			return errno
+		})
+	} else if io, ok := f.file.(FileIoctler); ok {
+		errno = n.intercept(ctx, "Ioctl", func() (errno syscall.Errno) {
+			output.Result, errno = io.Ioctl(ctx, input.Cmd, input.Arg, inbuf, bufOut)
+			return errno
+		})
+	} else {
+		errno = syscall.ENOTTY
+	}
+	return errnoToStatus(errno)
+}
+
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 
-	if od, ok := n.ops.(NodeOpendirer); ok {
-		errno := od.Opendir(&fuse.Context{Caller: input.Caller, Cancel: cancel})
+	var flags uint32
+	var fh FileHandle
+	if od, ok := n.ops.(NodeOpendirHandler); ok {
+		ctx := b.newContext(cancel, &input.Caller)
+		errno := n.intercept(ctx, "Opendir", func() (errno syscall.Errno) {
+			fh, flags, errno = od.OpendirHandle(ctx, input.Flags)
+			return errno
+		})
+		if errno != 0 {
+			return errnoToStatus(errno)
+		}
+	} else if od, ok := n.ops.(NodeOpendirFlagser); ok {
+		ctx := b.newContext(cancel, &input.Caller)
+		errno := n.intercept(ctx, "Opendir", func() (errno syscall.Errno) {
+			flags, errno = od.OpendirFlags(ctx)
+			return errno
+		})
+		if errno != 0 {
+			return errnoToStatus(errno)
+		}
+	} else if od, ok := n.ops.(NodeOpendirer); ok {
+		ctx := b.newContext(cancel, &input.Caller)
+		errno := n.intercept(ctx, "Opendir", func() syscall.Errno {
+			return od.Opendir(ctx)
+		})
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
@@ -917,10 +1643,146 @@ func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fus
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	out.Fh = uint64(b.registerFile(n, nil, 0))
+	dirFh := b.registerFile(n, nil, 0)
+	b.filesMu.Lock()
+	b.files[dirFh].dirHandle = fh
+	b.filesMu.Unlock()
+	out.Fh = uint64(dirFh)
+	out.OpenFlags = flags
 	return fuse.OK
 }
 
+// handleDirStream reads a directory handle from OpendirHandle as a
+// DirStream. It reads one entry ahead to answer HasNext.
+type handleDirStream struct {
+	// ctx is the context of the current READDIR call.
+	ctx   context.Context
+	inode *Inode
+	rd    FileReaddirenter
+
+	fetched bool
+	next    *fuse.DirEntry
+	errno   syscall.Errno
+}
+
+func (s *handleDirStream) fetch() {
+	if s.fetched {
+		return
+	}
+	s.fetched = true
+	if !s.inode.intercepted() {
+		var errno syscall.Errno
+		s.next, errno = s.rd.Readdirent(s.ctx)
+		s.errno = s.inode.callDone(errno)
+		return
+	}
+	s.errno = s.inode.intercept(s.ctx, "Readdirent", func() (errno syscall.Errno) {
+		s.next, errno = s.rd.Readdirent(s.ctx)
+		return errno
+	})
+}
+
+func (s *handleDirStream) HasNext() bool {
+	s.fetch()
+	return s.next != nil || s.errno != 0
+}
+
+func (s *handleDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.fetch()
+	var e fuse.DirEntry
+	if s.next != nil {
+		e = *s.next
+	}
+	errno := s.errno
+	s.reset()
+	return e, errno
+}
+
+// AppendDirEntries adds the entry read ahead, if any, and then
+// calls the handle, which must be a DirEntryAppender.
+func (s *handleDirStream) AppendDirEntries(ctx context.Context, out *fuse.DirEntryList) (int, syscall.Errno) {
+	n := 0
+	if s.fetched {
+		if s.next == nil || s.errno != 0 {
+			errno := s.errno
+			s.reset()
+			return 0, errno
+		}
+		if !out.AddDirEntry(*s.next) {
+			return 0, OK
+		}
+		s.reset()
+		n++
+	}
+
+	app := s.rd.(DirEntryAppender)
+	var added int
+	errno := s.inode.intercept(ctx, "AppendDirEntries", func() (errno syscall.Errno) {
+		added, errno = app.AppendDirEntries(ctx, out)
+		return errno
+	})
+	return n + added, errno
+}
+
+// dirEntryAppender returns the DirEntryAppender to list f with, or
+// nil.
+func dirEntryAppender(f *fileEntry) DirEntryAppender {
+	if hs, ok := f.dirStream.(*handleDirStream); ok {
+		if _, ok := hs.rd.(DirEntryAppender); !ok {
+			return nil
+		}
+		return hs
+	}
+	app, _ := f.dirStream.(DirEntryAppender)
+	return app
+}
+
+// reset drops the entry read ahead.
+func (s *handleDirStream) reset() {
+	s.fetched = false
+	s.next = nil
+	s.errno = 0
+}
+
+// The handle is released by RELEASEDIR, not when the stream ends.
+func (s *handleDirStream) Close() {}
+
+// setHandleStream is the part of setStream for directory handles
+// that implement FileReaddirenter. The stream is created once and
+// kept until RELEASEDIR; moving to another offset uses
+// FileSeekdirer.
+func (b *rawBridge) setHandleStream(ctx context.Context, input *fuse.ReadIn, inode *Inode, f *fileEntry, rd FileReaddirenter) syscall.Errno {
+	hs, _ := f.dirStream.(*handleDirStream)
+	if hs == nil {
+		hs = &handleDirStream{inode: inode, rd: rd}
+		f.dirStream = hs
+		f.dirOffset = 0
+		f.hasOverflow = false
+	}
+	hs.ctx = ctx
+	if input.Offset == f.dirOffset {
+		return OK
+	}
+	sk, ok := f.dirHandle.(FileSeekdirer)
+	if !ok {
+		if input.Offset < f.dirOffset {
+			return syscall.ESPIPE
+		}
+		// Skip forward in setStream.
+		return OK
+	}
+	if errno := inode.intercept(ctx, "Seekdir", func() syscall.Errno {
+		return sk.Seekdir(ctx, input.Offset)
+	}); errno != 0 {
+		return errno
+	}
+	hs.reset()
+	f.dirOffset = input.Offset
+	f.hasOverflow = false
+	f.overflowChild = nil
+	return OK
+}
+
 // setStream makes sure `f.dirStream` and associated state variables are set and
 // seeks to offset requested in `input`. Caller must hold `f.mu`.
 // The `eof` return value shows if `f.dirStream` ended before the requested
@@ -930,13 +1792,20 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 	// 1) f.dirStream == nil ............ First READDIR[PLUS] on this file handle.
 	// 2) input.Offset == 0 ............. Start reading the directory again from
 	//                                    the beginning (user called rewinddir(3) or lseek(2)).
-	// 3) input.Offset < f.nextOffset ... Seek back (user called seekdir(3) or lseek(2)).
-	if f.dirStream == nil || input.Offset == 0 || input.Offset < f.dirOffset {
+	// 3) input.Offset < f.nextOffset ... Seek back (user called seekdir(3) or lseek(2)),
+	//                                    unless the stream is a DirSeeker.
+	// A directory handle from OpendirHandle keeps its stream instead.
+	_, seeker := f.dirStream.(DirSeeker)
+	if rd, ok := f.dirHandle.(FileReaddirenter); ok {
+		if errno := b.setHandleStream(b.newContext(cancel, &input.Caller), input, inode, f, rd); errno != 0 {
+			return errno, false
+		}
+	} else if f.dirStream == nil || input.Offset == 0 || (input.Offset < f.dirOffset && !seeker) {
 		if f.dirStream != nil {
 			f.dirStream.Close()
 			f.dirStream = nil
 		}
-		str, errno := b.getStream(&fuse.Context{Caller: input.Caller, Cancel: cancel}, inode)
+		str, errno := b.getStream(b.newContext(cancel, &input.Caller), inode)
 		if errno != 0 {
 			return errno, false
 		}
@@ -944,6 +1813,12 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 		f.dirOffset = 0
 		f.hasOverflow = false
 		f.dirStream = str
+	} else if ds, ok := f.dirStream.(DirSeeker); ok && input.Offset != f.dirOffset {
+		if errno := ds.Seekdir(b.newContext(cancel, &input.Caller), input.Offset); errno != 0 {
+			return errno, false
+		}
+		f.dirOffset = input.Offset
+		f.hasOverflow = false
 	}
 
 	// Seek forward?
@@ -965,16 +1840,33 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 }
 
 func (b *rawBridge) getStream(ctx context.Context, inode *Inode) (DirStream, syscall.Errno) {
+	if rd, ok := inode.ops.(NodeReaddirPluser); ok {
+		var str DirPlusStream
+		errno := inode.intercept(ctx, "ReaddirPlus", func() (errno syscall.Errno) {
+			str, errno = rd.ReaddirPlus(ctx)
+			return errno
+		})
+		if errno != 0 {
+			return nil, errno
+		}
+		return str, 0
+	}
 	if rd, ok := inode.ops.(NodeReaddirer); ok {
-		return rd.Readdir(ctx)
+		var str DirStream
+		errno := inode.intercept(ctx, "Readdir", func() (errno syscall.Errno) {
+			str, errno = rd.Readdir(ctx)
+			return errno
+		})
+		return str, errno
 	}
 
-	r := []fuse.DirEntry{}
-	for k, ch := range inode.Children() {
+	r := make([]fuse.DirEntry, 0, inode.ChildrenCount())
+	inode.ForEachChild(func(k string, ch *Inode) bool {
 		r = append(r, fuse.DirEntry{Mode: ch.Mode(),
 			Name: k,
 			Ino:  ch.StableAttr().Ino})
-	}
+		return true
+	})
 	return NewListDirStream(r), 0
 }
 
@@ -998,6 +1890,12 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 		f.dirOffset++
 	}
 
+	if app := dirEntryAppender(f); app != nil {
+		n, errno := app.AppendDirEntries(b.newContext(cancel, &input.Caller), out)
+		f.dirOffset += uint64(n)
+		return errnoToStatus(errno)
+	}
+
 	for f.dirStream.HasNext() {
 		e, errno := f.dirStream.Next()
 
@@ -1028,14 +1926,23 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 		return fuse.OK
 	}
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.Caller)
+	plus, _ := f.dirStream.(DirPlusStream)
+	entry := getEntryOut()
+	defer putEntryOut(entry)
 	for f.dirStream.HasNext() || f.hasOverflow {
 		var e fuse.DirEntry
+		var child *Inode
 		var errno syscall.Errno
 
+		*entry = fuse.EntryOut{}
 		if f.hasOverflow {
-			e = f.overflow
+			e, child, *entry = f.overflow, f.overflowChild, f.overflowEntry
 			f.hasOverflow = false
+			f.overflowChild = nil
+		} else if plus != nil {
+			b.setEntryOutTimeout(entry)
+			e, child, errno = plus.NextPlus(ctx, entry)
 		} else {
 			e, errno = f.dirStream.Next()
 		}
@@ -1047,6 +1954,7 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 		entryOut := out.AddDirLookupEntry(e)
 		if entryOut == nil {
 			f.overflow = e
+			f.overflowChild, f.overflowEntry = child, *entry
 			f.hasOverflow = true
 			return fuse.OK
 		}
@@ -1061,15 +1969,19 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			continue
 		}
 
-		child, errno := b.lookup(ctx, n, e.Name, entryOut)
+		if child != nil {
+			// The stream supplied the attributes, so skip Lookup.
+			*entryOut = *entry
+		} else {
+			b.setEntryOutTimeout(entryOut)
+			child, errno = b.lookup(ctx, n, e.Name, entryOut)
+		}
 		if errno != 0 {
-			if b.options.NegativeTimeout != nil {
-				entryOut.SetEntryTimeout(*b.options.NegativeTimeout)
-			}
+			b.setNegativeTimeout(entryOut)
 		} else {
 			child, _ = b.addNewChild(n, e.Name, child, nil, 0, entryOut)
 			child.setEntryOut(entryOut)
-			b.setEntryOutTimeout(entryOut)
+			b.setAttr(&entryOut.Attr)
 			if e.Mode&syscall.S_IFMT != child.stableAttr.Mode&syscall.S_IFMT {
 				// The file type has changed behind our back. Use the new value.
 				out.FixMode(child.stableAttr.Mode)
@@ -1082,9 +1994,19 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 }
 
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
-	n, _ := b.inode(input.NodeId, input.Fh)
+	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := b.newContext(cancel, &input.Caller)
+	if fs, ok := f.dirHandle.(FileFsyncdirer); ok {
+		f.wg.Add(1)
+		defer f.wg.Done()
+		return errnoToStatus(n.intercept(ctx, "Fsyncdir", func() syscall.Errno {
+			return fs.Fsyncdir(ctx, input.FsyncFlags)
+		}))
+	}
 	if fs, ok := n.ops.(NodeFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, nil, input.FsyncFlags))
+		return errnoToStatus(n.intercept(ctx, "Fsync", func() syscall.Errno {
+			return fs.Fsync(ctx, nil, input.FsyncFlags)
+		}))
 	}
 
 	return fuse.ENOTSUP
@@ -1093,7 +2015,10 @@ func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.S
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 	if sf, ok := n.ops.(NodeStatfser); ok {
-		return errnoToStatus(sf.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
+		ctx := b.newContext(cancel, &input.Caller)
+		return errnoToStatus(n.intercept(ctx, "Statfs", func() syscall.Errno {
+			return sf.Statfs(ctx, out)
+		}))
 	}
 
 	// leave zeroed out
@@ -1104,33 +2029,120 @@ func (b *rawBridge) Init(s *fuse.Server) {
 	b.server = s
 }
 
-func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (size uint32, status fuse.Status) {
-	n1, f1 := b.inode(in.NodeId, in.FhIn)
-	cfr, ok := n1.ops.(NodeCopyFileRanger)
-	if !ok {
-		return 0, fuse.ENOTSUP
+// OnUnmount calls the NodeOnUnmounter of the root, and ends the life
+// of all remaining nodes: those in the tree, and those that were
+// dropped from it but are still known to the kernel.
+func (b *rawBridge) OnUnmount() {
+	if u, ok := b.root.ops.(NodeOnUnmounter); ok {
+		u.OnUnmount(context.Background())
 	}
+	b.OrphanHandles()
 
-	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	todo := []*Inode{b.root}
+	b.mu.Lock()
+	b.kernelNodeIds.forEach(func(n *Inode) {
+		todo = append(todo, n)
+	})
+	b.mu.Unlock()
+
+	seen := map[*Inode]bool{}
+	for len(todo) > 0 {
+		n := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		for _, ch := range n.Children() {
+			todo = append(todo, ch)
+		}
+		n.onForget()
+	}
+}
+
+// OrphanHandles gives up on the handles that the kernel did not
+// release, eg. because the mount was detached while files were open,
+// or the connection was aborted. Directory handles are released, and
+// file handles are passed to Options.OnOrphanHandle. A Release that
+// still comes for them is ignored.
+func (b *rawBridge) OrphanHandles() {
+	type openFile struct {
+		n *Inode
+		f *fileEntry
+		// file is copied, as the entry may be reused once the
+		// kernel released it after all.
+		file FileHandle
+	}
+	var open []openFile
+	b.mu.Lock()
+	b.kernelNodeIds.forEach(func(n *Inode) {
+		for _, fh := range n.openFiles {
+			f := b.files[fh]
+			if f.orphaned {
+				continue
+			}
+			b.filesMu.Lock()
+			f.orphaned = true
+			b.filesMu.Unlock()
+			open = append(open, openFile{n, f, f.file})
+		}
+	})
+	b.mu.Unlock()
 
-	sz, errno := cfr.CopyFileRange(&fuse.Context{Caller: in.Caller, Cancel: cancel},
-		f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
-	return sz, errnoToStatus(errno)
+	ctx := context.Background()
+	for _, o := range open {
+		if o.n.IsDir() {
+			o.f.mu.Lock()
+			b.releaseDirHandle(ctx, o.n, o.f, 0)
+			o.f.mu.Unlock()
+		} else if o.file != nil && b.options.OnOrphanHandle != nil {
+			b.options.OnOrphanHandle(o.file)
+		}
+	}
+}
+
+func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (size uint32, status fuse.Status) {
+	if b.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
+	n1, f1 := b.inode(in.NodeId, in.FhIn)
+	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	ctx := b.newContext(cancel, &in.Caller)
+
+	if cfr, ok := n1.ops.(NodeCopyFileRanger); ok {
+		errno := n1.intercept(ctx, "CopyFileRange", func() (errno syscall.Errno) {
+			size, errno = cfr.CopyFileRange(ctx, f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
+			return errno
+		})
+		return size, errnoToStatus(errno)
+	}
+	if cfr, ok := f1.file.(FileCopyFileRanger); ok {
+		errno := n1.intercept(ctx, "CopyFileRange", func() (errno syscall.Errno) {
+			size, errno = cfr.CopyFileRange(ctx, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
+			return errno
+		})
+		return size, errnoToStatus(errno)
+	}
+	return 0, fuse.ENOTSUP
 }
 
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
+	ctx := b.newContext(cancel, &in.Caller)
 
 	ls, ok := n.ops.(NodeLseeker)
 	if ok {
-		off, errno := ls.Lseek(&fuse.Context{Caller: in.Caller, Cancel: cancel},
-			f.file, in.Offset, in.Whence)
-		out.Offset = off
+		errno := n.intercept(ctx, "Lseek", func() (errno syscall.Errno) {
+			out.Offset, errno = ls.Lseek(ctx, f.file, in.Offset, in.Whence)
+			return errno
+		})
 		return errnoToStatus(errno)
 	}
 	if fs, ok := f.file.(FileLseeker); ok {
-		off, errno := fs.Lseek(&fuse.Context{Caller: in.Caller, Cancel: cancel}, in.Offset, in.Whence)
-		out.Offset = off
+		errno := n.intercept(ctx, "Lseek", func() (errno syscall.Errno) {
+			out.Offset, errno = fs.Lseek(ctx, in.Offset, in.Whence)
+			return errno
+		})
 		return errnoToStatus(errno)
 	}
 
@@ -1141,3 +2153,28 @@ func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.Ls
 
 	return fuse.ENOTSUP
 }
+
+func (b *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	n, f := b.inode(in.NodeId, in.Fh)
+	fp, ok := f.file.(FilePoller)
+	if !ok {
+		// ENOSYS would switch off polling for all files, so
+		// report what the kernel assumes for files without poll.
+		out.Revents = _DEFAULT_POLLMASK
+		return fuse.OK
+	}
+
+	if in.Flags&fuse.FUSE_POLL_SCHEDULE_NOTIFY != 0 {
+		// Register before polling, so a wakeup racing with
+		// the Poll call is not lost.
+		b.mu.Lock()
+		f.pollKh = in.Kh
+		b.mu.Unlock()
+	}
+	ctx := b.newContext(cancel, &in.Caller)
+	errno := n.intercept(ctx, "Poll", func() (errno syscall.Errno) {
+		out.Revents, errno = fp.Poll(ctx)
+		return errno
+	})
+	return errnoToStatus(errno)
+}
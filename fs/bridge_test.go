@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -238,3 +239,138 @@ func (fn *testIno1) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	child := fn.NewInode(ctx, &testIno1{}, stable)
 	return child, 0
 }
+
+// TestNegativeTimeout checks that the kernel caches non-existent
+// entries for the timeout set by Lookup or Options.NegativeTimeout,
+// and that NotifyEntry drops a cached negative entry.
+func TestNegativeTimeout(t *testing.T) {
+	hour := time.Hour
+	for _, tc := range []struct {
+		name    string
+		timeout *time.Duration
+		opts    *Options
+		want    int32
+	}{
+		{name: "none", opts: &Options{}, want: 3},
+		{name: "lookup", timeout: &hour, opts: &Options{}, want: 1},
+		{name: "options", opts: &Options{NegativeTimeout: &hour}, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootNode := testNegativeIno{timeout: tc.timeout}
+			mnt, _, clean := testMount(t, &rootNode, tc.opts)
+			defer clean()
+
+			var st syscall.Stat_t
+			for i := 0; i < 3; i++ {
+				if err := syscall.Stat(mnt+"/missing", &st); err != syscall.ENOENT {
+					t.Fatalf("Stat: got %v, want ENOENT", err)
+				}
+			}
+			if got := atomic.LoadInt32(&rootNode.lookups); got != tc.want {
+				t.Errorf("got %d lookups, want %d", got, tc.want)
+			}
+
+			if errno := rootNode.NotifyEntry("missing"); errno != 0 {
+				t.Fatalf("NotifyEntry: %v", errno)
+			}
+			if err := syscall.Stat(mnt+"/missing", &st); err != syscall.ENOENT {
+				t.Fatalf("Stat: got %v, want ENOENT", err)
+			}
+			if got := atomic.LoadInt32(&rootNode.lookups); got != tc.want+1 {
+				t.Errorf("got %d lookups after NotifyEntry, want %d", got, tc.want+1)
+			}
+		})
+	}
+}
+
+type testNegativeIno struct {
+	Inode
+
+	timeout *time.Duration
+	lookups int32
+}
+
+func (n *testNegativeIno) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	atomic.AddInt32(&n.lookups, 1)
+	if n.timeout != nil {
+		out.SetEntryTimeout(*n.timeout)
+	}
+	return nil, syscall.ENOENT
+}
+
+// setattrNode records whether Setattr reached the node or the file
+// handle.
+type setattrNode struct {
+	Inode
+	calls chan string
+}
+
+var _ = (NodeOpener)((*setattrNode)(nil))
+var _ = (NodeSetattrer)((*setattrNode)(nil))
+
+func (n *setattrNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &setattrFile{calls: n.calls}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *setattrNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	n.calls <- "node"
+	out.Size, _ = in.GetSize()
+	return OK
+}
+
+type setattrFile struct {
+	calls chan string
+}
+
+var _ = (FileSetattrer)((*setattrFile)(nil))
+
+func (f *setattrFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.calls <- "file"
+	out.Size, _ = in.GetSize()
+	return OK
+}
+
+func TestSetattrFileHandle(t *testing.T) {
+	root := &Inode{}
+	node := &setattrNode{calls: make(chan string, 10)}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{Mode: syscall.S_IFREG}), false)
+		},
+	})
+	defer clean()
+
+	want := func(who string) {
+		t.Helper()
+		select {
+		case got := <-node.calls:
+			if got != who {
+				t.Errorf("got Setattr on %s, want %s", got, who)
+			}
+		default:
+			t.Errorf("no Setattr call, want one on %s", who)
+		}
+	}
+
+	fn := mntDir + "/file"
+	if err := syscall.Truncate(fn, 10); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	want("node")
+
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(20); err != nil {
+		t.Fatalf("Ftruncate: %v", err)
+	}
+	want("file")
+
+	// truncate(2) does not pass the handle, even if the file is open.
+	if err := syscall.Truncate(fn, 30); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	want("node")
+}
@@ -9,9 +9,12 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -134,3 +137,378 @@ func TestKeepCache(t *testing.T) {
 		t.Errorf("nokeep read 2 got %q want read 1 %q", c2, c1)
 	}
 }
+
+// openFlagsFile is opened with the flags set in 'next'.
+type openFlagsFile struct {
+	Inode
+
+	mu      sync.Mutex
+	next    uint32
+	content []byte
+}
+
+var _ = (NodeReader)((*openFlagsFile)(nil))
+var _ = (NodeOpener)((*openFlagsFile)(nil))
+var _ = (NodeGetattrer)((*openFlagsFile)(nil))
+
+func (f *openFlagsFile) set(next uint32, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next, f.content = next, []byte(content)
+}
+
+func (f *openFlagsFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return nil, f.next, OK
+}
+
+func (f *openFlagsFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Size = uint64(len(f.content))
+	return OK
+}
+
+func (f *openFlagsFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := off + int64(len(dest))
+	if end > int64(len(f.content)) {
+		end = int64(len(f.content))
+	}
+	return fuse.ReadResultData(append([]byte{}, f.content[off:end]...)), OK
+}
+
+// TestOpenFlagsPerHandle opens the same file with different flags,
+// which the kernel honors for each handle.
+func TestOpenFlagsPerHandle(t *testing.T) {
+	root := &Inode{}
+	file := &openFlagsFile{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	open := func(flags uint32) int {
+		t.Helper()
+		file.set(flags, "v1")
+		fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return fd
+	}
+	read := func(fd int, want string) {
+		t.Helper()
+		buf := make([]byte, 10)
+		n, err := syscall.Pread(fd, buf, 0)
+		if err != nil {
+			t.Fatalf("Pread: %v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// Opening without KEEP_CACHE drops the cache, so open the
+	// cached handle last.
+	direct := open(fuse.FOPEN_DIRECT_IO)
+	defer syscall.Close(direct)
+	cached := open(fuse.FOPEN_KEEP_CACHE)
+	defer syscall.Close(cached)
+	read(cached, "v1")
+	read(direct, "v1")
+
+	// Keep the size, so the kernel doesn't invalidate the cache.
+	file.set(0, "v2")
+	read(direct, "v2")
+	read(cached, "v1")
+
+	nonseekable := open(fuse.FOPEN_NONSEEKABLE)
+	defer syscall.Close(nonseekable)
+	if _, err := syscall.Seek(nonseekable, 1, 0); err != syscall.ESPIPE {
+		t.Errorf("Seek: got %v, want ESPIPE", err)
+	}
+}
+
+// countGetattrFile counts Getattr calls, and disables attribute
+// caching if 'volatile' is set.
+type countGetattrFile struct {
+	Inode
+	volatile bool
+	count    int32
+}
+
+var _ = (NodeGetattrer)((*countGetattrFile)(nil))
+
+func (f *countGetattrFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	atomic.AddInt32(&f.count, 1)
+	out.Mode = 0644
+	if f.volatile {
+		out.SetTimeout(0)
+	}
+	return OK
+}
+
+func TestGetattrZeroTimeout(t *testing.T) {
+	root := &Inode{}
+	cached := &countGetattrFile{}
+	volatile := &countGetattrFile{volatile: true}
+	hour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &hour,
+		AttrTimeout:  &hour,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("cached", root.NewPersistentInode(ctx, cached, StableAttr{}), false)
+			root.AddChild("volatile", root.NewPersistentInode(ctx, volatile, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	const stats = 5
+	for i := 0; i < stats; i++ {
+		for _, nm := range []string{"cached", "volatile"} {
+			var st syscall.Stat_t
+			if err := syscall.Stat(mntDir+"/"+nm, &st); err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+		}
+	}
+
+	// The lookup returns the attributes too.
+	if got := atomic.LoadInt32(&cached.count); got != 1 {
+		t.Errorf("cached: got %d Getattr calls, want 1", got)
+	}
+	if got := atomic.LoadInt32(&volatile.count); got < stats {
+		t.Errorf("volatile: got %d Getattr calls, want at least %d", got, stats)
+	}
+}
+
+func TestNotifyStoreRetrieve(t *testing.T) {
+	root := &keepCacheRoot{}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	// Make the kernel know the inode.
+	if _, err := ioutil.ReadFile(mntDir + "/keep"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	root.keep.mu.Lock()
+	count := root.keep.count
+	root.keep.mu.Unlock()
+
+	// Keep the size, so the kernel doesn't drop the cache.
+	want := []byte("stored!!!!")
+	if errno := root.keep.NotifyStore(0, want); errno != OK {
+		t.Fatalf("NotifyStore: %v", errno)
+	}
+
+	got, err := ioutil.ReadFile(mntDir + "/keep")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read got %q, want %q", got, want)
+	}
+	root.keep.mu.Lock()
+	if root.keep.count != count {
+		t.Errorf("read reached the node")
+	}
+	root.keep.mu.Unlock()
+
+	got, errno := root.keep.NotifyRetrieve(0, 100)
+	if errno != OK {
+		t.Fatalf("NotifyRetrieve: %v", errno)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("retrieve got %q, want %q", got, want)
+	}
+}
+
+// countingSymlink counts Readlink calls.
+type countingSymlink struct {
+	Inode
+
+	mu     sync.Mutex
+	target string
+	count  int
+}
+
+var _ = (NodeReadlinker)((*countingSymlink)(nil))
+
+func (l *countingSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	return []byte(l.target), OK
+}
+
+func (l *countingSymlink) setTarget(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.target = target
+}
+
+func (l *countingSymlink) readlinks() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func TestSymlinkCaching(t *testing.T) {
+	for _, caching := range []bool{false, true} {
+		t.Run(fmt.Sprintf("caching=%v", caching), func(t *testing.T) {
+			root := &Inode{}
+			link := &countingSymlink{target: "target1"}
+			sec := time.Second
+			opts := &Options{
+				EntryTimeout: &sec,
+				AttrTimeout:  &sec,
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("link",
+						root.NewPersistentInode(ctx, link, StableAttr{Mode: syscall.S_IFLNK}), false)
+				},
+			}
+			opts.EnableSymlinkCaching = caching
+			mntDir, server, clean := testMount(t, root, opts)
+			defer clean()
+
+			enabled := server.KernelSettings().Flags&fuse.CAP_CACHE_SYMLINKS != 0
+			if caching && !enabled {
+				t.Skip("kernel does not support CAP_CACHE_SYMLINKS")
+			}
+			if !caching && enabled {
+				t.Fatal("CAP_CACHE_SYMLINKS enabled without EnableSymlinkCaching")
+			}
+
+			buf := make([]byte, 100)
+			readlink := func(want string) {
+				n, err := syscall.Readlink(mntDir+"/link", buf)
+				if err != nil {
+					t.Fatalf("Readlink: %v", err)
+				}
+				if got := string(buf[:n]); got != want {
+					t.Errorf("Readlink: got %q, want %q", got, want)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				readlink("target1")
+			}
+
+			want := 3
+			if caching {
+				want = 1
+			}
+			if got := link.readlinks(); got != want {
+				t.Errorf("got %d Readlink calls, want %d", got, want)
+			}
+
+			link.setTarget("target2")
+			if errno := link.NotifySymlink(); errno != 0 {
+				t.Fatalf("NotifySymlink: %v", errno)
+			}
+			readlink("target2")
+		})
+	}
+}
+
+// cachedDir counts Readdir calls, and asks the kernel to cache the
+// listing if 'flags' has FOPEN_CACHE_DIR.
+type cachedDir struct {
+	Inode
+	flags uint32
+
+	mu       sync.Mutex
+	names    []string
+	readdirs int
+}
+
+var _ = (NodeOpendirFlagser)((*cachedDir)(nil))
+var _ = (NodeReaddirer)((*cachedDir)(nil))
+
+func (d *cachedDir) OpendirFlags(ctx context.Context) (uint32, syscall.Errno) {
+	return d.flags, OK
+}
+
+func (d *cachedDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readdirs++
+	var r []fuse.DirEntry
+	for _, nm := range d.names {
+		r = append(r, fuse.DirEntry{Name: nm, Mode: syscall.S_IFREG})
+	}
+	return NewListDirStream(r), OK
+}
+
+func (d *cachedDir) setNames(names ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names = names
+}
+
+func (d *cachedDir) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readdirs
+}
+
+func TestDirCache(t *testing.T) {
+	for _, caching := range []bool{false, true} {
+		t.Run(fmt.Sprintf("caching=%v", caching), func(t *testing.T) {
+			root := &cachedDir{names: []string{"a", "b"}}
+			if caching {
+				root.flags = fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE
+			}
+			sec := time.Second
+			mntDir, _, clean := testMount(t, root, &Options{
+				EntryTimeout: &sec,
+				AttrTimeout:  &sec,
+			})
+			defer clean()
+
+			list := func(want int) {
+				f, err := os.Open(mntDir)
+				if err != nil {
+					t.Fatalf("Open: %v", err)
+				}
+				defer f.Close()
+				names, err := f.Readdirnames(-1)
+				if err != nil {
+					t.Fatalf("Readdirnames: %v", err)
+				}
+				if len(names) != want {
+					t.Errorf("got %v, want %d names", names, want)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				list(2)
+			}
+			want := 3
+			if caching {
+				want = 1
+			}
+			if got := root.count(); got != want {
+				t.Errorf("got %d Readdir calls, want %d", got, want)
+			}
+
+			root.setNames("a", "b", "c")
+			if errno := root.InvalidateDirCache(); errno != 0 {
+				t.Fatalf("InvalidateDirCache: %v", errno)
+			}
+			list(3)
+			list(3)
+			want += 2
+			if caching {
+				want = 2
+			}
+			if got := root.count(); got != want {
+				t.Errorf("after invalidation: got %d Readdir calls, want %d", got, want)
+			}
+		})
+	}
+}
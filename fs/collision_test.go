@@ -0,0 +1,120 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type collisionA struct {
+	Inode
+}
+
+type collisionB struct {
+	Inode
+}
+
+// collisionDir returns nodes of different types with the same
+// StableAttr for "a" and "b".
+type collisionDir struct {
+	Inode
+}
+
+var _ = (NodeLookuper)((*collisionDir)(nil))
+
+func (d *collisionDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	var ops InodeEmbedder
+	switch name {
+	case "a":
+		ops = &collisionA{}
+	case "b":
+		ops = &collisionB{}
+	default:
+		return nil, syscall.ENOENT
+	}
+	return d.NewInode(ctx, ops, StableAttr{Mode: syscall.S_IFREG, Ino: 42}), OK
+}
+
+func TestStableAttrCollision(t *testing.T) {
+	const first = uint64(1) << 63
+	for _, tc := range []struct {
+		name   string
+		policy CollisionPolicy
+		// same is set if "a" and "b" should be unified.
+		same bool
+		log  string
+	}{
+		{"ignore", CollisionIgnore, true, ""},
+		{"warn", CollisionWarn, true, "used by both *fs.collisionA and *fs.collisionB"},
+		{"renumber", CollisionAutoRenumber, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			opts := &Options{
+				OnStableAttrCollision: tc.policy,
+				Logger:                log.New(&logs, "", 0),
+			}
+			opts.ReserveInoRange(first, first+10)
+			bridge := NewNodeFS(&collisionDir{}, opts).(*rawBridge)
+			header := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+			lookup := func(name string) *fuse.EntryOut {
+				var out fuse.EntryOut
+				if st := bridge.Lookup(nil, header, name, &out); !st.Ok() {
+					t.Fatalf("Lookup(%q): %v", name, st)
+				}
+				return &out
+			}
+
+			a, b := lookup("a"), lookup("b")
+			if a.Ino != 42 {
+				t.Errorf("a: got ino %d, want 42", a.Ino)
+			}
+			if tc.same {
+				if a.NodeId != b.NodeId || b.Ino != 42 {
+					t.Errorf("got a=n%d/i%d, b=n%d/i%d, want the same", a.NodeId, a.Ino, b.NodeId, b.Ino)
+				}
+			} else {
+				if a.NodeId == b.NodeId {
+					t.Errorf("a and b were unified")
+				}
+				if want := first + 11; b.Ino != want {
+					t.Errorf("b: got ino %d, want %d", b.Ino, want)
+				}
+				b2 := lookup("b")
+				if b2.NodeId != b.NodeId || b2.Ino != b.Ino {
+					t.Errorf("second lookup: got n%d/i%d, want n%d/i%d", b2.NodeId, b2.Ino, b.NodeId, b.Ino)
+				}
+			}
+			if got := logs.String(); tc.log == "" && got != "" {
+				t.Errorf("unexpected log %q", got)
+			} else if !strings.Contains(got, tc.log) {
+				t.Errorf("got log %q, want %q", got, tc.log)
+			}
+		})
+	}
+}
+
+func TestStableAttrCollisionPanic(t *testing.T) {
+	bridge := NewNodeFS(&collisionDir{}, &Options{
+		OnStableAttrCollision: CollisionPanic,
+	}).(*rawBridge)
+	header := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var out fuse.EntryOut
+	bridge.Lookup(nil, header, "a", &out)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("no panic for colliding StableAttr")
+		}
+	}()
+	bridge.Lookup(nil, header, "b", &out)
+}
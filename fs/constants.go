@@ -19,11 +19,26 @@ func ToErrno(err error) syscall.Errno {
 	return syscall.Errno(s)
 }
 
-// RENAME_EXCHANGE is a flag argument for renameat2()
-const RENAME_EXCHANGE = 0x2
+// Flag arguments for renameat2()
+const (
+	RENAME_NOREPLACE = 0x1
+	RENAME_EXCHANGE  = 0x2
+	RENAME_WHITEOUT  = 0x4
+)
 
 // seek to the next data
 const _SEEK_DATA = 3
 
 // seek to the next hole
 const _SEEK_HOLE = 4
+
+// Modes of fallocate(2).
+const (
+	_FALLOC_FL_KEEP_SIZE  = 0x1
+	_FALLOC_FL_PUNCH_HOLE = 0x2
+	_FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// The events that the kernel reports for files that don't support
+// poll: POLLIN | POLLOUT | POLLRDNORM | POLLWRNORM, as in Linux.
+const _DEFAULT_POLLMASK = 0x1 | 0x4 | 0x40 | 0x100
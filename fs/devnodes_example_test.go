@@ -0,0 +1,56 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// This demonstrates a static /dev-like tree, with device nodes, a
+// FIFO and a symlink. Mounting with "dev" and as root allows
+// opening the devices.
+func ExampleMemDevNode() {
+	mntDir, _ := ioutil.TempDir("", "")
+
+	root := &fs.Inode{}
+	devices := map[string]*fs.MemDevNode{
+		"null":  {Mode: syscall.S_IFCHR | 0666, Dev: uint32(unix.Mkdev(1, 3))},
+		"zero":  {Mode: syscall.S_IFCHR | 0666, Dev: uint32(unix.Mkdev(1, 5))},
+		"loop0": {Mode: syscall.S_IFBLK | 0660, Dev: uint32(unix.Mkdev(7, 0))},
+	}
+	server, err := fs.Mount(mntDir, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			Options: []string{"dev"},
+		},
+		OnAdd: func(ctx context.Context) {
+			for name, d := range devices {
+				root.AddChild(name, root.NewPersistentInode(ctx, d,
+					fs.StableAttr{Mode: d.Mode & syscall.S_IFMT}), false)
+			}
+			root.AddChild("initctl", root.NewPersistentInode(ctx,
+				&fs.MemFIFO{Attr: fuse.Attr{Mode: 0600}},
+				fs.StableAttr{Mode: syscall.S_IFIFO}), false)
+			root.AddChild("stdin", root.NewPersistentInode(ctx,
+				&fs.MemSymlink{Data: []byte("/proc/self/fd/0")},
+				fs.StableAttr{Mode: syscall.S_IFLNK}), false)
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("Mounted on %s", mntDir)
+	log.Printf("Unmount by calling 'fusermount -u %s'", mntDir)
+
+	// Wait until unmount before exiting
+	server.Wait()
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cursorDir lists its entries from a cursor that lives in the
+// directory handle, and counts the handles opened and released.
+type cursorDir struct {
+	Inode
+	names []string
+
+	opens    int32
+	releases int32
+	rewinds  int32
+}
+
+var _ = (NodeOpendirHandler)((*cursorDir)(nil))
+
+func (d *cursorDir) OpendirHandle(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	atomic.AddInt32(&d.opens, 1)
+	return &cursorHandle{dir: d}, 0, OK
+}
+
+type cursorHandle struct {
+	dir      *cursorDir
+	cursor   int
+	released bool
+}
+
+var _ = (FileReaddirenter)((*cursorHandle)(nil))
+var _ = (FileSeekdirer)((*cursorHandle)(nil))
+var _ = (FileReleasedirer)((*cursorHandle)(nil))
+
+func (h *cursorHandle) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	if h.released {
+		return nil, syscall.EBADF
+	}
+	if h.cursor >= len(h.dir.names) {
+		return nil, OK
+	}
+	e := &fuse.DirEntry{Name: h.dir.names[h.cursor], Mode: syscall.S_IFREG}
+	h.cursor++
+	return e, OK
+}
+
+func (h *cursorHandle) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	if off == 0 {
+		atomic.AddInt32(&h.dir.rewinds, 1)
+	}
+	h.cursor = int(off)
+	return OK
+}
+
+func (h *cursorHandle) Releasedir(ctx context.Context, releaseFlags uint32) {
+	h.released = true
+	atomic.AddInt32(&h.dir.releases, 1)
+}
+
+func newCursorDir(n int) *cursorDir {
+	d := &cursorDir{}
+	for i := 0; i < n; i++ {
+		d.names = append(d.names, fmt.Sprintf("file%04d", i))
+	}
+	return d
+}
+
+func TestOpendirHandle(t *testing.T) {
+	// Enough entries to need several READDIR calls.
+	root := newCursorDir(1000)
+	mntDir, _, clean := testMount(t, root, nil)
+	unmounted := false
+	defer func() {
+		if !unmounted {
+			clean()
+		}
+	}()
+
+	f, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Readdirnames: %v", err)
+	}
+	if len(names) != len(root.names) {
+		t.Fatalf("got %d entries, want %d", len(names), len(root.names))
+	}
+	for i, nm := range names {
+		if nm != root.names[i] {
+			t.Fatalf("entry %d: got %q, want %q", i, nm, root.names[i])
+		}
+	}
+	if got := atomic.LoadInt32(&root.opens); got != 1 {
+		t.Errorf("got %d opens, want 1", got)
+	}
+	if got := atomic.LoadInt32(&root.rewinds); got != 0 {
+		t.Errorf("got %d rewinds, want 0", got)
+	}
+
+	// RELEASEDIR is sent asynchronously, but before the unmount
+	// completes.
+	clean()
+	unmounted = true
+	if got := atomic.LoadInt32(&root.releases); got != 1 {
+		t.Errorf("got %d releases, want 1", got)
+	}
+}
+
+func TestOpendirHandleReleasedOnUnmount(t *testing.T) {
+	root := newCursorDir(3)
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	var out fuse.OpenOut
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}
+	if st := bridge.OpenDir(nil, in, &out); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+
+	// The kernel went away without RELEASEDIR.
+	bridge.OnUnmount()
+	if got := atomic.LoadInt32(&root.releases); got != 1 {
+		t.Errorf("got %d releases, want 1", got)
+	}
+}
@@ -5,30 +5,54 @@
 package fs
 
 import (
+	"context"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type dirArray struct {
+	idx     int
 	entries []fuse.DirEntry
 }
 
+var _ = (DirSeeker)((*dirArray)(nil))
+var _ = (DirEntryAppender)((*dirArray)(nil))
+
 func (a *dirArray) HasNext() bool {
-	return len(a.entries) > 0
+	return a.idx < len(a.entries)
 }
 
 func (a *dirArray) Next() (fuse.DirEntry, syscall.Errno) {
-	e := a.entries[0]
-	a.entries = a.entries[1:]
+	e := a.entries[a.idx]
+	a.idx++
 	return e, 0
 }
 
+func (a *dirArray) AppendDirEntries(ctx context.Context, out *fuse.DirEntryList) (int, syscall.Errno) {
+	n := 0
+	for ; a.idx < len(a.entries); a.idx++ {
+		if !out.AddDirEntry(a.entries[a.idx]) {
+			break
+		}
+		n++
+	}
+	return n, 0
+}
+
+func (a *dirArray) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	a.idx = len(a.entries)
+	if off < uint64(len(a.entries)) {
+		a.idx = int(off)
+	}
+	return 0
+}
+
 func (a *dirArray) Close() {
 
 }
 
 // NewListDirStream wraps a slice of DirEntry as a DirStream.
 func NewListDirStream(list []fuse.DirEntry) DirStream {
-	return &dirArray{list}
+	return &dirArray{entries: list}
 }
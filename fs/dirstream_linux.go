@@ -5,11 +5,13 @@
 package fs
 
 import (
+	"context"
 	"sync"
 	"syscall"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 type loopbackDirStream struct {
@@ -19,8 +21,16 @@ type loopbackDirStream struct {
 	// Protects fd so we can guard against double close
 	mu sync.Mutex
 	fd int
+
+	// pos is the number of the next entry, and offs holds the
+	// offset following each entry read so far, to seek to it.
+	pos  uint64
+	offs []int64
 }
 
+var _ = (DirSeeker)((*loopbackDirStream)(nil))
+var _ = (DirEntryAppender)((*loopbackDirStream)(nil))
+
 // NewLoopbackDirStream open a directory for reading as a DirStream
 func NewLoopbackDirStream(name string) (DirStream, syscall.Errno) {
 	fd, err := syscall.Open(name, syscall.O_DIRECTORY, 0755)
@@ -67,7 +77,21 @@ type dirent struct {
 func (ds *loopbackDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
+	return ds.next()
+}
 
+func (ds *loopbackDirStream) next() (fuse.DirEntry, syscall.Errno) {
+	de, nameBytes := ds.peek()
+	result := fuse.DirEntry{
+		Ino:  de.Ino,
+		Mode: (uint32(de.Type) << 12),
+		Name: string(nameBytes),
+	}
+	return result, ds.advance(de)
+}
+
+// peek returns the next entry and its name, which points into ds.buf.
+func (ds *loopbackDirStream) peek() (*dirent, []byte) {
 	// We can't use syscall.Dirent here, because it declares a
 	// [256]byte name, which may run beyond the end of ds.todo.
 	// when that happens in the race detector, it causes a panic
@@ -75,7 +99,6 @@ func (ds *loopbackDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 	de := (*dirent)(unsafe.Pointer(&ds.todo[0]))
 
 	nameBytes := ds.todo[unsafe.Offsetof(dirent{}.Name):de.Reclen]
-	ds.todo = ds.todo[de.Reclen:]
 
 	// After the loop, l contains the index of the first '\0'.
 	l := 0
@@ -84,13 +107,38 @@ func (ds *loopbackDirStream) Next() (fuse.DirEntry, syscall.Errno) {
 			break
 		}
 	}
-	nameBytes = nameBytes[:l]
-	result := fuse.DirEntry{
-		Ino:  de.Ino,
-		Mode: (uint32(de.Type) << 12),
-		Name: string(nameBytes),
+	return de, nameBytes[:l]
+}
+
+// advance moves past de, the entry returned by peek.
+func (ds *loopbackDirStream) advance(de *dirent) syscall.Errno {
+	ds.todo = ds.todo[de.Reclen:]
+	if ds.pos < uint64(len(ds.offs)) {
+		ds.offs[ds.pos] = de.Off
+	} else {
+		ds.offs = append(ds.offs, de.Off)
 	}
-	return result, ds.load()
+	ds.pos++
+	return ds.load()
+}
+
+// AppendDirEntries adds the entries straight from the getdents(2)
+// buffer.
+func (ds *loopbackDirStream) AppendDirEntries(ctx context.Context, out *fuse.DirEntryList) (int, syscall.Errno) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	n := 0
+	for len(ds.todo) > 0 {
+		de, name := ds.peek()
+		if !out.AddBytes(name, de.Ino, uint32(de.Type)<<12) {
+			break
+		}
+		n++
+		if errno := ds.advance(de); errno != 0 {
+			return n, errno
+		}
+	}
+	return n, OK
 }
 
 func (ds *loopbackDirStream) load() syscall.Errno {
@@ -105,3 +153,39 @@ func (ds *loopbackDirStream) load() syscall.Errno {
 	ds.todo = ds.buf[:n]
 	return OK
 }
+
+// Seekdir continues at the entry 'off'. Entries that were read before
+// are seeked to directly, like seekdir(3) does.
+func (ds *loopbackDirStream) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	known := uint64(len(ds.offs))
+	if off <= known {
+		return ds.seek(off)
+	}
+	if errno := ds.seek(known); errno != 0 {
+		return errno
+	}
+	for ds.pos < off && len(ds.todo) > 0 {
+		if _, errno := ds.next(); errno != 0 {
+			return errno
+		}
+	}
+	return OK
+}
+
+// seek positions the stream before the entry 'off', which must
+// directly follow one that was read before.
+func (ds *loopbackDirStream) seek(off uint64) syscall.Errno {
+	var cookie int64
+	if off > 0 {
+		cookie = ds.offs[off-1]
+	}
+	if _, err := unix.Seek(ds.fd, cookie, 0); err != nil {
+		return ToErrno(err)
+	}
+	ds.todo = nil
+	ds.pos = off
+	return ds.load()
+}
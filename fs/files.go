@@ -34,6 +34,7 @@ var _ = (FileReleaser)((*loopbackFile)(nil))
 var _ = (FileGetattrer)((*loopbackFile)(nil))
 var _ = (FileReader)((*loopbackFile)(nil))
 var _ = (FileWriter)((*loopbackFile)(nil))
+var _ = (FilePassthroughFder)((*loopbackFile)(nil))
 var _ = (FileGetlker)((*loopbackFile)(nil))
 var _ = (FileSetlker)((*loopbackFile)(nil))
 var _ = (FileSetlkwer)((*loopbackFile)(nil))
@@ -57,6 +58,12 @@ func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (uint3
 	return uint32(n), ToErrno(err)
 }
 
+func (f *loopbackFile) Fd() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fd
+}
+
 func (f *loopbackFile) Release(ctx context.Context) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -116,9 +123,47 @@ func (f *loopbackFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLo
 }
 
 func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) (errno syscall.Errno) {
+	isFlock := (flags & fuse.FUSE_LK_FLOCK) != 0
+	if isFlock && lk.Typ != syscall.F_RDLCK && lk.Typ != syscall.F_WRLCK && lk.Typ != syscall.F_UNLCK {
+		return syscall.EINVAL
+	}
 	f.mu.Lock()
-	defer f.mu.Unlock()
-	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
+	fd := f.fd
+	if !blocking {
+		defer f.mu.Unlock()
+		return lockFd(fd, isFlock, lk, false)
+	}
+	f.mu.Unlock()
+
+	// A blocking lock can wait indefinitely, so don't hold f.mu,
+	// and give up if the kernel interrupts the request.
+	done := make(chan syscall.Errno, 1)
+	go func() {
+		done <- lockFd(fd, isFlock, lk, true)
+	}()
+	select {
+	case errno = <-done:
+		return errno
+	case <-ctx.Done():
+		go func() {
+			// The caller was told that the lock failed, so
+			// release it if we obtained it after all.
+			if <-done == OK {
+				unlk := *lk
+				unlk.Typ = syscall.F_UNLCK
+				f.mu.Lock()
+				lockFd(f.fd, isFlock, &unlk, false)
+				f.mu.Unlock()
+			}
+		}()
+		return syscall.EINTR
+	}
+}
+
+// lockFd sets a flock(2) lock on fd if isFlock is set, or an open
+// file description lock otherwise.
+func lockFd(fd int, isFlock bool, lk *fuse.FileLock, blocking bool) syscall.Errno {
+	if isFlock {
 		var op int
 		switch lk.Typ {
 		case syscall.F_RDLCK:
@@ -127,24 +172,22 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 			op = syscall.LOCK_EX
 		case syscall.F_UNLCK:
 			op = syscall.LOCK_UN
-		default:
-			return syscall.EINVAL
 		}
 		if !blocking {
 			op |= syscall.LOCK_NB
 		}
-		return ToErrno(syscall.Flock(f.fd, op))
+		return ToErrno(syscall.Flock(fd, op))
+	}
+
+	flk := syscall.Flock_t{}
+	lk.ToFlockT(&flk)
+	var op int
+	if blocking {
+		op = _OFD_SETLKW
 	} else {
-		flk := syscall.Flock_t{}
-		lk.ToFlockT(&flk)
-		var op int
-		if blocking {
-			op = _OFD_SETLKW
-		} else {
-			op = _OFD_SETLK
-		}
-		return ToErrno(syscall.FcntlFlock(uintptr(f.fd), op, &flk))
+		op = _OFD_SETLK
 	}
+	return ToErrno(syscall.FcntlFlock(uintptr(fd), op, &flk))
 }
 
 func (f *loopbackFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
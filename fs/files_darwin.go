@@ -8,3 +8,6 @@ import "github.com/hanwen/go-fuse/v2/fuse"
 
 func setBlocks(out *fuse.Attr) {
 }
+
+func setStatxBlocks(out *fuse.Statx) {
+}
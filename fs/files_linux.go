@@ -6,22 +6,61 @@ package fs
 
 import (
 	"context"
+	"math"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	err := syscall.Fallocate(f.fd, mode, int64(off), int64(sz))
+	// The mode bits, such as FALLOC_FL_PUNCH_HOLE, are passed on
+	// as is, so the backing file system rejects the ones it does
+	// not support.
+	err := unix.Fallocate(f.fd, mode, int64(off), int64(sz))
 	if err != nil {
 		return ToErrno(err)
 	}
 	return OK
 }
 
+var _ = (FileCopyFileRanger)((*loopbackFile)(nil))
+
+// CopyFileRange copies between the backing files in the kernel. If
+// they cannot be copied between, for example because they are on
+// different file systems, ENOTSUP makes the kernel fall back to
+// reading and writing.
+func (f *loopbackFile) CopyFileRange(ctx context.Context, offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	lfOut, ok := fhOut.(*loopbackFile)
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+	// Only one lock is held at a time, so copies in opposite
+	// directions cannot deadlock.
+	lfOut.mu.Lock()
+	fdOut := lfOut.fd
+	lfOut.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The reply only fits 32 bits.
+	if len > math.MaxInt32 {
+		len = math.MaxInt32
+	}
+	signedOffIn := int64(offIn)
+	signedOffOut := int64(offOut)
+	count, err := unix.CopyFileRange(f.fd, &signedOffIn, fdOut, &signedOffOut, int(len), int(flags))
+	if err == syscall.EXDEV {
+		err = syscall.ENOTSUP
+	}
+	return uint32(count), ToErrno(err)
+}
+
 // Utimens - file handle based version of loopbackFileSystem.Utimens()
 func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	var ts [2]syscall.Timespec
@@ -40,3 +79,13 @@ func setBlocks(out *fuse.Attr) {
 	pages := (out.Size + 4095) / 4096
 	out.Blocks = pages * 8
 }
+
+func setStatxBlocks(out *fuse.Statx) {
+	if out.Blksize > 0 {
+		return
+	}
+
+	out.Blksize = 4096
+	pages := (out.Size + 4095) / 4096
+	out.Blocks = pages * 8
+}
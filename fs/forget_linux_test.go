@@ -0,0 +1,63 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestOnUnmountLazy(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("lazy unmount needs root")
+	}
+	root := &unmountRoot{}
+	slow := &slowGetattrNode{
+		root:    root,
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	server, err := Mount(dir, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("slow", root.NewPersistentInode(ctx, slow, StableAttr{}), false)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statDone := make(chan error, 1)
+	go func() {
+		var st syscall.Stat_t
+		statDone <- syscall.Stat(dir+"/slow", &st)
+	}()
+	<-slow.started
+
+	// The stat keeps the mount alive until it returns.
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		close(slow.release)
+		server.Unmount()
+		t.Fatalf("lazy unmount: %v", err)
+	}
+	close(slow.release)
+	if err := <-statDone; err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	server.Wait()
+	if got := atomic.LoadInt32(&root.unmounts); got != 1 {
+		t.Errorf("got %d OnUnmount calls, want 1", got)
+	}
+	if !root.slowDone {
+		t.Error("OnUnmount was called before the request in flight returned")
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -112,9 +115,236 @@ func TestForget(t *testing.T) {
 
 	bridge := rawFS.(*rawBridge)
 	bridge.mu.Lock()
-	l := len(bridge.kernelNodeIds)
+	l := bridge.kernelNodeIds.len()
 	bridge.mu.Unlock()
 	if l != 1 {
 		t.Fatalf("got %d live nodes, want 1", l)
 	}
 }
+
+// lifeNode counts OnForget calls.
+type lifeNode struct {
+	Inode
+	forgets chan struct{}
+}
+
+var _ = (NodeOnForgetter)((*lifeNode)(nil))
+
+func (n *lifeNode) OnForget() {
+	n.forgets <- struct{}{}
+}
+
+// lifeDir has a "file" until it is unlinked.
+type lifeDir struct {
+	lifeNode
+
+	fileMu   sync.Mutex
+	file     *lifeNode
+	unlinked bool
+}
+
+var _ = (NodeLookuper)((*lifeDir)(nil))
+var _ = (NodeUnlinker)((*lifeDir)(nil))
+
+func (d *lifeDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if ch := d.GetChild(name); ch != nil {
+		return ch, OK
+	}
+	d.fileMu.Lock()
+	defer d.fileMu.Unlock()
+	if name != "file" || d.unlinked {
+		return nil, syscall.ENOENT
+	}
+	d.file = &lifeNode{forgets: make(chan struct{}, 10)}
+	out.Nlink = 1
+	return d.NewInode(ctx, d.file, StableAttr{Mode: syscall.S_IFREG}), OK
+}
+
+func (d *lifeDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	d.fileMu.Lock()
+	defer d.fileMu.Unlock()
+	d.unlinked = true
+	return OK
+}
+
+func TestOnForget(t *testing.T) {
+	root := &lifeDir{lifeNode: lifeNode{forgets: make(chan struct{}, 10)}}
+	persistent := &lifeNode{forgets: make(chan struct{}, 10)}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("persistent", root.NewPersistentInode(ctx, persistent, StableAttr{}), false)
+		},
+	})
+	unmounted := false
+	defer func() {
+		if !unmounted {
+			clean()
+		}
+	}()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	root.fileMu.Lock()
+	file := root.file
+	root.fileMu.Unlock()
+
+	// Unlinking drops the last link, so the kernel forgets the inode.
+	if err := syscall.Unlink(mntDir + "/file"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	select {
+	case <-file.forgets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnForget was not called after FORGET")
+	}
+
+	if err := syscall.Stat(mntDir+"/persistent", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// Unmounting ends the life of the remaining nodes.
+	clean()
+	unmounted = true
+	for nm, n := range map[string]*lifeNode{"root": &root.lifeNode, "persistent": persistent, "file": file} {
+		want := 1
+		if nm == "file" {
+			want = 0
+		}
+		if got := len(n.forgets); got != want {
+			t.Errorf("%s: got %d OnForget calls, want %d", nm, got, want)
+		}
+	}
+}
+
+// anyFileDir has a file for every name.
+type anyFileDir struct {
+	Inode
+}
+
+var _ = (NodeLookuper)((*anyFileDir)(nil))
+
+func (d *anyFileDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}), OK
+}
+
+// TestBatchForgetStress forgets many nodes in kernel-sized batches,
+// as after "echo 2 > /proc/sys/vm/drop_caches", and checks that
+// concurrent lookups are not held up. It drives the bridge directly,
+// so it does not need root.
+func TestBatchForgetStress(t *testing.T) {
+	count := 200000
+	if testing.Short() {
+		count = 20000
+	}
+	root := &anyFileDir{}
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+	header := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+
+	forgets := make([]fuse.ForgetOne, 0, count)
+	for i := 0; i < count; i++ {
+		var out fuse.EntryOut
+		if st := bridge.Lookup(nil, header, strconv.Itoa(i), &out); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+		forgets = append(forgets, fuse.ForgetOne{NodeId: out.NodeId, Nlookup: 1})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var maxLatency time.Duration
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var out fuse.EntryOut
+			start := time.Now()
+			bridge.Lookup(nil, header, fmt.Sprintf("concurrent%d", i%100), &out)
+			if dt := time.Since(start); dt > maxLatency {
+				maxLatency = dt
+			}
+		}
+	}()
+
+	// The kernel sends batches of at most a few thousand entries.
+	const batchSize = 4096
+	for todo := forgets; len(todo) > 0; {
+		n := batchSize
+		if n > len(todo) {
+			n = len(todo)
+		}
+		bridge.BatchForget(todo[:n])
+		todo = todo[n:]
+	}
+	close(stop)
+	wg.Wait()
+
+	if maxLatency > 500*time.Millisecond {
+		t.Errorf("concurrent Lookup took %v", maxLatency)
+	}
+	for nm := range root.Children() {
+		if _, err := strconv.Atoi(nm); err == nil {
+			t.Fatalf("forgotten child %q still in the tree", nm)
+		}
+	}
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	for _, f := range forgets {
+		if bridge.kernelNodeIds.get(f.NodeId) != nil {
+			t.Fatalf("n%d is still known", f.NodeId)
+		}
+	}
+}
+
+// unmountRoot counts OnUnmount calls. Getattr on its "slow" child
+// blocks until 'release' is closed.
+type unmountRoot struct {
+	Inode
+
+	unmounts int32
+	// slowDone is set if the slow Getattr had returned when
+	// OnUnmount was called.
+	slowDone bool
+	done     int32
+}
+
+var _ = (NodeOnUnmounter)((*unmountRoot)(nil))
+
+func (r *unmountRoot) OnUnmount(ctx context.Context) {
+	atomic.AddInt32(&r.unmounts, 1)
+	r.slowDone = atomic.LoadInt32(&r.done) != 0
+}
+
+type slowGetattrNode struct {
+	Inode
+	root    *unmountRoot
+	started chan struct{}
+	release chan struct{}
+}
+
+var _ = (NodeGetattrer)((*slowGetattrNode)(nil))
+
+func (n *slowGetattrNode) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	select {
+	case n.started <- struct{}{}:
+	default:
+	}
+	<-n.release
+	atomic.StoreInt32(&n.root.done, 1)
+	return OK
+}
+
+func TestOnUnmount(t *testing.T) {
+	root := &unmountRoot{}
+	_, _, clean := testMount(t, root, nil)
+	clean()
+	if got := atomic.LoadInt32(&root.unmounts); got != 1 {
+		t.Errorf("got %d OnUnmount calls, want 1", got)
+	}
+}
@@ -0,0 +1,727 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fstest drives a tree of fs.InodeEmbedder nodes from tests,
+// without mounting it.
+//
+// A Harness plays the part of the kernel: it sends the raw FUSE
+// operations of fs.NewNodeFS, caches entries and attributes as long
+// as the timeouts say, counts lookups and forgets the nodes again.
+// The file system code under test therefore runs through the same
+// paths as when it is mounted, but tests need neither root, nor
+// /dev/fuse, nor a fusermount binary.
+//
+// While it works, the harness checks for common mistakes in the file
+// system, and reports them through testing.TB.Errorf:
+//
+//   - a node that has no file type in its StableAttr.Mode, which
+//     makes it a regular file, while Readdir lists it as something
+//     else, or while it has children or a Lookup method;
+//
+//   - directory streams whose offsets do not resume or seek to the
+//     same entries as a listing in one go.
+package fstest
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// entry is a cached directory entry. A zero nodeId is a negative
+// entry.
+type entry struct {
+	nodeId      uint64
+	out         fuse.EntryOut
+	entryExpiry time.Duration
+	attrExpiry  time.Duration
+}
+
+// Harness sends file system operations for paths to the root of a
+// tree. Paths are relative to the root, with '/' as separator. Errors
+// returned by the harness are of type syscall.Errno.
+//
+// Time does not pass for the caches of the harness, except through
+// Advance.
+type Harness struct {
+	// Caller is the owner and process for the operations.
+	Caller fuse.Caller
+
+	// SkipChecks disables the checks for contract violations. Each
+	// Readdir then lists the directory only once, which makes it
+	// easier to count calls to the backing store.
+	SkipChecks bool
+
+	tb   testing.TB
+	root fs.InodeEmbedder
+	raw  fuse.RawFileSystem
+
+	mu  sync.Mutex
+	now time.Duration
+	// entries holds the cached entries by path.
+	entries map[string]*entry
+	// lookups holds the lookups by node ID, which must be
+	// forgotten.
+	lookups map[uint64]uint64
+	// rootExpiry is the attribute expiry of the root.
+	rootAttr   fuse.Attr
+	rootExpiry time.Duration
+	// checked holds the nodes that were checked already.
+	checked map[*fs.Inode]bool
+}
+
+// New returns a harness for root. If opts is nil, the timeouts of
+// fs.Mount apply. Unless opts sets ServerCallbacks, notifications
+// from the file system drop entries and attributes from the caches
+// of the harness.
+func New(tb testing.TB, root fs.InodeEmbedder, opts *fs.Options) *Harness {
+	h := &Harness{
+		tb:      tb,
+		root:    root,
+		entries: map[string]*entry{},
+		lookups: map[uint64]uint64{},
+		checked: map[*fs.Inode]bool{},
+		Caller: fuse.Caller{
+			Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+			Pid:   uint32(os.Getpid()),
+		},
+	}
+
+	var o fs.Options
+	if opts != nil {
+		o = *opts
+	} else {
+		oneSec := time.Second
+		o.EntryTimeout = &oneSec
+		o.AttrTimeout = &oneSec
+	}
+	if o.ServerCallbacks == nil {
+		o.ServerCallbacks = (*notifier)(h)
+	}
+	h.raw = fs.NewNodeFS(root, &o)
+	return h
+}
+
+// Advance moves the clock of the caches forward by d.
+func (h *Harness) Advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now += d
+}
+
+func (h *Harness) header(nodeId uint64) fuse.InHeader {
+	return fuse.InHeader{NodeId: nodeId, Caller: h.Caller}
+}
+
+func toErr(st fuse.Status) error {
+	if st.Ok() {
+		return nil
+	}
+	return syscall.Errno(st)
+}
+
+func timeout(sec uint64, nsec uint32) time.Duration {
+	return time.Duration(sec)*time.Second + time.Duration(nsec)
+}
+
+func isDir(mode uint32) bool {
+	return mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// clean returns p as a path relative to the root, where "" is the
+// root itself.
+func clean(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func join(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Lookup resolves p like the kernel does, using the cached entries
+// that have not expired. It returns the entry of the last component.
+func (h *Harness) Lookup(p string) (fuse.EntryOut, error) {
+	p = clean(p)
+	if p == "" {
+		attr, err := h.Getattr("")
+		return fuse.EntryOut{NodeId: fuse.FUSE_ROOT_ID, Attr: attr}, err
+	}
+
+	var nodeId uint64 = fuse.FUSE_ROOT_ID
+	mode := uint32(syscall.S_IFDIR)
+	var dir string
+	var out fuse.EntryOut
+	for _, name := range strings.Split(p, "/") {
+		if !isDir(mode) {
+			return fuse.EntryOut{}, syscall.ENOTDIR
+		}
+		child := join(dir, name)
+		var err error
+		out, err = h.lookup(nodeId, child, name)
+		if err != nil {
+			return fuse.EntryOut{}, err
+		}
+		nodeId, mode, dir = out.NodeId, out.Mode, child
+	}
+	return out, nil
+}
+
+// lookup returns the entry for name in the directory parent, which
+// has path p.
+func (h *Harness) lookup(parent uint64, p, name string) (fuse.EntryOut, error) {
+	h.mu.Lock()
+	if e := h.entries[p]; e != nil && h.now < e.entryExpiry {
+		h.mu.Unlock()
+		if e.nodeId == 0 {
+			return fuse.EntryOut{}, syscall.ENOENT
+		}
+		return e.out, nil
+	}
+	h.mu.Unlock()
+
+	var out fuse.EntryOut
+	hdr := h.header(parent)
+	st := h.raw.Lookup(nil, &hdr, name, &out)
+	if !st.Ok() {
+		h.setEntry(p, nil)
+		return fuse.EntryOut{}, toErr(st)
+	}
+	h.setEntry(p, &out)
+	if out.NodeId == 0 {
+		return fuse.EntryOut{}, syscall.ENOENT
+	}
+	h.checkNode(p, out.Mode)
+	return out, nil
+}
+
+// setEntry caches out for p, or drops the entry if out is nil. A
+// positive entry counts as a lookup.
+func (h *Harness) setEntry(p string, out *fuse.EntryOut) {
+	h.mu.Lock()
+	var forget []uint64
+	if old := h.entries[p]; old != nil && old.nodeId != 0 && (out == nil || old.nodeId != out.NodeId) {
+		// The kernel replaces the dentry, and forgets the old
+		// inode once nothing refers to it anymore.
+		forget = h.dropLocked(p)
+	}
+	if out == nil {
+		delete(h.entries, p)
+	} else {
+		e := &entry{
+			nodeId:      out.NodeId,
+			out:         *out,
+			entryExpiry: h.now + timeout(out.EntryValid, out.EntryValidNsec),
+			attrExpiry:  h.now + timeout(out.AttrValid, out.AttrValidNsec),
+		}
+		h.entries[p] = e
+		if e.nodeId != 0 {
+			h.lookups[e.nodeId]++
+		}
+	}
+	h.mu.Unlock()
+	h.forget(forget)
+}
+
+// dropLocked removes the entries for p and below, and returns the
+// nodes that are no longer referenced.
+func (h *Harness) dropLocked(p string) []uint64 {
+	var dropped []uint64
+	for k, e := range h.entries {
+		if k == p || strings.HasPrefix(k, p+"/") || p == "" {
+			delete(h.entries, k)
+			if e.nodeId != 0 {
+				dropped = append(dropped, e.nodeId)
+			}
+		}
+	}
+	var forget []uint64
+	for _, id := range dropped {
+		if h.referencedLocked(id) {
+			continue
+		}
+		forget = append(forget, id)
+	}
+	return forget
+}
+
+func (h *Harness) referencedLocked(nodeId uint64) bool {
+	for _, e := range h.entries {
+		if e.nodeId == nodeId {
+			return true
+		}
+	}
+	return false
+}
+
+// forget sends FORGET for the lookups of the given nodes.
+func (h *Harness) forget(nodeIds []uint64) {
+	for _, id := range nodeIds {
+		h.mu.Lock()
+		n := h.lookups[id]
+		delete(h.lookups, id)
+		h.mu.Unlock()
+		if n > 0 {
+			h.raw.Forget(id, n)
+		}
+	}
+}
+
+// Forget drops the cached entries for p and everything below it, and
+// forgets the nodes that are no longer referenced.
+func (h *Harness) Forget(p string) {
+	p = clean(p)
+	h.mu.Lock()
+	forget := h.dropLocked(p)
+	h.mu.Unlock()
+	sort.Slice(forget, func(i, j int) bool { return forget[i] > forget[j] })
+	h.forget(forget)
+}
+
+// Close forgets all nodes, as the kernel does on unmount.
+func (h *Harness) Close() {
+	h.Forget("")
+}
+
+// Getattr returns the attributes of p, from the cache if they have
+// not expired.
+func (h *Harness) Getattr(p string) (fuse.Attr, error) {
+	p = clean(p)
+	nodeId := uint64(fuse.FUSE_ROOT_ID)
+	if p != "" {
+		out, err := h.Lookup(p)
+		if err != nil {
+			return fuse.Attr{}, err
+		}
+		nodeId = out.NodeId
+	}
+
+	h.mu.Lock()
+	if p == "" && h.now < h.rootExpiry {
+		attr := h.rootAttr
+		h.mu.Unlock()
+		return attr, nil
+	} else if e := h.entries[p]; p != "" && e != nil && h.now < e.attrExpiry {
+		h.mu.Unlock()
+		return e.out.Attr, nil
+	}
+	h.mu.Unlock()
+
+	in := fuse.GetAttrIn{InHeader: h.header(nodeId)}
+	var out fuse.AttrOut
+	if st := h.raw.GetAttr(nil, &in, &out); !st.Ok() {
+		return fuse.Attr{}, toErr(st)
+	}
+	h.setAttr(p, &out)
+	return out.Attr, nil
+}
+
+// Setattr changes the attributes of p, as chmod(2), truncate(2) and
+// friends do. The node ID of in is set by the harness.
+func (h *Harness) Setattr(p string, in fuse.SetAttrIn) (fuse.Attr, error) {
+	out, err := h.Lookup(p)
+	if err != nil {
+		return fuse.Attr{}, err
+	}
+	in.InHeader = h.header(out.NodeId)
+	var attrOut fuse.AttrOut
+	if st := h.raw.SetAttr(nil, &in, &attrOut); !st.Ok() {
+		return fuse.Attr{}, toErr(st)
+	}
+	h.setAttr(clean(p), &attrOut)
+	return attrOut.Attr, nil
+}
+
+func (h *Harness) setAttr(p string, out *fuse.AttrOut) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expiry := h.now + timeout(out.AttrValid, out.AttrValidNsec)
+	if p == "" {
+		h.rootAttr, h.rootExpiry = out.Attr, expiry
+	} else if e := h.entries[p]; e != nil {
+		e.out.Attr, e.attrExpiry = out.Attr, expiry
+	}
+}
+
+// Read opens p for reading, reads up to n bytes at off, and releases
+// the file again.
+func (h *Harness) Read(p string, off int64, n int) ([]byte, error) {
+	out, err := h.Lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if isDir(out.Mode) {
+		return nil, syscall.EISDIR
+	}
+
+	hdr := h.header(out.NodeId)
+	var open fuse.OpenOut
+	if st := h.raw.Open(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_RDONLY}, &open); !st.Ok() {
+		return nil, toErr(st)
+	}
+	defer func() {
+		h.raw.Flush(nil, &fuse.FlushIn{InHeader: hdr, Fh: open.Fh})
+		h.raw.Release(nil, &fuse.ReleaseIn{InHeader: hdr, Fh: open.Fh, Flags: syscall.O_RDONLY})
+	}()
+
+	buf := make([]byte, n)
+	res, st := h.raw.Read(nil, &fuse.ReadIn{InHeader: hdr, Fh: open.Fh, Offset: uint64(off), Size: uint32(n)}, buf)
+	if !st.Ok() {
+		return nil, toErr(st)
+	}
+	defer res.Done()
+	data, st := res.Bytes(buf)
+	if !st.Ok() {
+		return nil, toErr(st)
+	}
+	return append([]byte{}, data...), nil
+}
+
+// Readdir lists the directory p with READDIRPLUS, as the kernel does
+// for readdir(3). The lookups of the entries are counted, and the
+// entries are cached. It returns the entries in their order, without
+// "." and "..". The Mode of the entries is the type of the node.
+//
+// Unless SkipChecks is set, the directory is also listed in small
+// steps, and by seeking back, to check the offsets.
+func (h *Harness) Readdir(p string) ([]fuse.DirEntry, error) {
+	p = clean(p)
+	nodeId := uint64(fuse.FUSE_ROOT_ID)
+	if p != "" {
+		out, err := h.Lookup(p)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir(out.Mode) {
+			return nil, syscall.ENOTDIR
+		}
+		nodeId = out.NodeId
+	}
+
+	plus, err := h.list(nodeId, true, 4096, 0, func(e *dirent) {
+		if e.name == "." || e.name == ".." || e.entry.NodeId == 0 {
+			return
+		}
+		child := join(p, e.name)
+		h.setEntry(child, &e.entry)
+		h.checkNode(child, e.entry.Mode)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []fuse.DirEntry
+	for _, e := range plus {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		mode := e.typ
+		if e.entry.NodeId != 0 {
+			mode = e.entry.Mode &^ 07777
+		}
+		result = append(result, fuse.DirEntry{Name: e.name, Mode: mode, Ino: e.ino})
+	}
+	if !h.SkipChecks {
+		h.checkReaddir(p, nodeId, plus)
+	}
+	return result, nil
+}
+
+// dirent is an entry of a READDIR or READDIRPLUS reply.
+type dirent struct {
+	name string
+	ino  uint64
+	off  uint64
+	typ  uint32
+	// entry is set for READDIRPLUS.
+	entry fuse.EntryOut
+}
+
+type rawDirent struct {
+	Ino     uint64
+	Off     uint64
+	NameLen uint32
+	Typ     uint32
+}
+
+// parseDirents parses a READDIR or READDIRPLUS reply. The unused part
+// of buf must be zero.
+func parseDirents(buf []byte, plus bool) []dirent {
+	const entryOutSize = int(unsafe.Sizeof(fuse.EntryOut{}))
+	const direntSize = int(unsafe.Sizeof(rawDirent{}))
+	var result []dirent
+	for off := 0; ; {
+		var d dirent
+		if plus {
+			if off+entryOutSize > len(buf) {
+				break
+			}
+			d.entry = *(*fuse.EntryOut)(unsafe.Pointer(&buf[off]))
+			off += entryOutSize
+		}
+		if off+direntSize > len(buf) {
+			break
+		}
+		raw := (*rawDirent)(unsafe.Pointer(&buf[off]))
+		if raw.NameLen == 0 {
+			break
+		}
+		off += direntSize
+		d.name = string(buf[off : off+int(raw.NameLen)])
+		d.ino, d.off, d.typ = raw.Ino, raw.Off, raw.Typ<<12
+		off += (int(raw.NameLen) + 7) &^ 7
+		result = append(result, d)
+	}
+	return result
+}
+
+// list reads the directory nodeId from offset 'start' to the end with
+// buffers of 'size' bytes, on a new handle. Each entry is passed to
+// 'each' as it is read.
+func (h *Harness) list(nodeId uint64, plus bool, size int, start uint64, each func(e *dirent)) ([]dirent, error) {
+	hdr := h.header(nodeId)
+	var open fuse.OpenOut
+	if st := h.raw.OpenDir(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_RDONLY}, &open); !st.Ok() {
+		return nil, toErr(st)
+	}
+	defer h.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: hdr, Fh: open.Fh})
+	return h.readHandle(hdr, open.Fh, plus, size, start, each)
+}
+
+func (h *Harness) readHandle(hdr fuse.InHeader, fh uint64, plus bool, size int, off uint64, each func(e *dirent)) ([]dirent, error) {
+	var result []dirent
+	buf := make([]byte, size)
+	for {
+		for i := range buf {
+			buf[i] = 0
+		}
+		in := fuse.ReadIn{InHeader: hdr, Fh: fh, Offset: off, Size: uint32(size)}
+		out := fuse.NewDirEntryList(buf, off)
+		var st fuse.Status
+		if plus {
+			st = h.raw.ReadDirPlus(nil, &in, out)
+		} else {
+			st = h.raw.ReadDir(nil, &in, out)
+		}
+		if !st.Ok() {
+			return result, toErr(st)
+		}
+		ents := parseDirents(buf, plus)
+		if len(ents) == 0 {
+			return result, nil
+		}
+		for i := range ents {
+			if each != nil {
+				each(&ents[i])
+			}
+		}
+		result = append(result, ents...)
+		off = ents[len(ents)-1].off
+	}
+}
+
+// minDirentBuf fits any single entry, like the page that the kernel
+// passes at least.
+const minDirentBuf = 24 + 256
+
+// checkReaddir compares the READDIRPLUS listing of the directory p
+// with a READDIR listing in small steps, and checks that seeking back
+// on a handle returns the same entries again.
+func (h *Harness) checkReaddir(p string, nodeId uint64, plus []dirent) {
+	h.tb.Helper()
+	describe := p
+	if describe == "" {
+		describe = "the root"
+	}
+
+	nodeTypes := map[string]uint32{}
+	for _, e := range plus {
+		if _, ok := nodeTypes[e.name]; ok {
+			h.tb.Errorf("fstest: Readdir of %s returns %q twice", describe, e.name)
+		}
+		nodeTypes[e.name] = 0
+		if e.entry.NodeId != 0 {
+			nodeTypes[e.name] = e.entry.Mode & syscall.S_IFMT
+		}
+	}
+
+	// Separate handles may list in a different order.
+	small, err := h.list(nodeId, false, minDirentBuf, 0, nil)
+	if err != nil {
+		h.tb.Errorf("fstest: Readdir of %s in small steps: %v", describe, err)
+		return
+	}
+	if got, want := sortedNames(small), sortedNames(plus); !equalNames(got, want) {
+		h.tb.Errorf("fstest: Readdir of %s in small steps returns %v, in one go %v; are the offsets of the stream right?", describe, got, want)
+		return
+	}
+	for _, e := range small {
+		if nodeType := nodeTypes[e.name]; e.typ != 0 && nodeType != 0 && e.typ != nodeType {
+			h.tb.Errorf("fstest: Readdir of %s lists %q with type %o, but its node has type %o; is StableAttr.Mode set?", describe, e.name, e.typ, nodeType)
+		}
+	}
+
+	if len(small) < 2 {
+		return
+	}
+	hdr := h.header(nodeId)
+	var open fuse.OpenOut
+	if st := h.raw.OpenDir(nil, &fuse.OpenIn{InHeader: hdr, Flags: syscall.O_RDONLY}, &open); !st.Ok() {
+		h.tb.Errorf("fstest: OpenDir of %s: %v", describe, st)
+		return
+	}
+	defer h.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: hdr, Fh: open.Fh})
+	all, err := h.readHandle(hdr, open.Fh, false, 4096, 0, nil)
+	if err != nil || len(all) < 2 {
+		h.tb.Errorf("fstest: Readdir of %s: got %d entries, %v", describe, len(all), err)
+		return
+	}
+	// Like seekdir(3) to a telldir(3) in the middle.
+	mid := len(all) / 2
+	off := all[mid-1].off
+	tail, err := h.readHandle(hdr, open.Fh, false, 4096, off, nil)
+	if err != nil {
+		h.tb.Errorf("fstest: Readdir of %s from offset %d: %v", describe, off, err)
+	} else if got, want := direntNames(tail), direntNames(all[mid:]); !equalNames(got, want) {
+		h.tb.Errorf("fstest: Readdir of %s from offset %d returns %v, want %v; does seeking work?", describe, off, got, want)
+	}
+}
+
+func direntNames(ents []dirent) []string {
+	names := make([]string, 0, len(ents))
+	for _, e := range ents {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+func sortedNames(ents []dirent) []string {
+	names := direntNames(ents)
+	sort.Strings(names)
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkNode checks the node for p the first time it is seen. Mode is
+// the mode the bridge returned for it.
+func (h *Harness) checkNode(p string, mode uint32) {
+	if h.SkipChecks {
+		return
+	}
+	h.tb.Helper()
+	n := h.root.EmbeddedInode()
+	for _, c := range strings.Split(p, "/") {
+		if n = n.GetChild(c); n == nil {
+			return
+		}
+	}
+
+	h.mu.Lock()
+	done := h.checked[n]
+	h.checked[n] = true
+	h.mu.Unlock()
+	if done || mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+
+	ops := n.Operations()
+	_, lookuper := ops.(fs.NodeLookuper)
+	_, readdirer := ops.(fs.NodeReaddirer)
+	_, opener := ops.(fs.NodeOpener)
+	_, reader := ops.(fs.NodeReader)
+	if n.ChildrenCount() > 0 {
+		h.tb.Errorf("fstest: %q is a regular file with children; is StableAttr.Mode set?", p)
+	} else if (lookuper || readdirer) && !opener && !reader {
+		h.tb.Errorf("fstest: %q is a regular file, but %T has directory methods only; is StableAttr.Mode set?", p, ops)
+	}
+}
+
+// notifier applies the notifications of the file system to the
+// caches of the harness.
+type notifier Harness
+
+func (n *notifier) dropChild(parent uint64, name string) fuse.Status {
+	h := (*Harness)(n)
+	h.mu.Lock()
+	var dirs []string
+	if parent == fuse.FUSE_ROOT_ID {
+		dirs = append(dirs, "")
+	}
+	for k, e := range h.entries {
+		if e.nodeId == parent {
+			dirs = append(dirs, k)
+		}
+	}
+	var forget []uint64
+	for _, d := range dirs {
+		forget = append(forget, h.dropLocked(join(d, name))...)
+	}
+	h.mu.Unlock()
+	h.forget(forget)
+	if len(dirs) == 0 {
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
+func (n *notifier) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return n.dropChild(parent, name)
+}
+
+func (n *notifier) EntryNotify(parent uint64, name string) fuse.Status {
+	return n.dropChild(parent, name)
+}
+
+func (n *notifier) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	h := (*Harness)(n)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	found := false
+	if node == fuse.FUSE_ROOT_ID {
+		h.rootExpiry, found = 0, true
+	}
+	for _, e := range h.entries {
+		if e.nodeId == node {
+			e.attrExpiry, found = 0, true
+		}
+	}
+	if !found {
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
+func (n *notifier) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.OK
+}
+
+func (n *notifier) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.OK
+}
+
+func (n *notifier) PollNotify(kh uint64) fuse.Status {
+	return fuse.OK
+}
@@ -0,0 +1,316 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fstest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// recorder collects the errors reported by the harness.
+type recorder struct {
+	*testing.T
+	errs []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func names(ents []fuse.DirEntry) []string {
+	var r []string
+	for _, e := range ents {
+		r = append(r, e.Name)
+	}
+	return r
+}
+
+// sizeFile is a file whose size can change behind the back of the
+// harness.
+type sizeFile struct {
+	fs.Inode
+
+	mu   sync.Mutex
+	size uint64
+}
+
+var _ = (fs.NodeGetattrer)((*sizeFile)(nil))
+
+func (f *sizeFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Size = f.size
+	return 0
+}
+
+func TestHarnessMem(t *testing.T) {
+	root := &fs.Inode{}
+	sized := &sizeFile{size: 5}
+	sec := time.Second
+	h := New(t, root, &fs.Options{
+		EntryTimeout: &sec,
+		AttrTimeout:  &sec,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &fs.MemRegularFile{Data: []byte("hello")}, fs.StableAttr{}), false)
+			root.AddChild("sized", root.NewPersistentInode(ctx, sized, fs.StableAttr{}), false)
+			dir := root.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			dir.AddChild("sub", dir.NewPersistentInode(ctx, &fs.MemRegularFile{}, fs.StableAttr{}), false)
+		},
+	})
+	defer h.Close()
+
+	if out, err := h.Lookup("dir/sub"); err != nil || out.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("Lookup dir/sub: got mode %o, %v", out.Mode, err)
+	}
+	if _, err := h.Lookup("file/sub"); err != syscall.ENOTDIR {
+		t.Errorf("Lookup file/sub: got %v, want ENOTDIR", err)
+	}
+	if _, err := h.Lookup("missing"); err != syscall.ENOENT {
+		t.Errorf("Lookup missing: got %v, want ENOENT", err)
+	}
+
+	if data, err := h.Read("file", 1, 3); err != nil || string(data) != "ell" {
+		t.Errorf("Read: got %q, %v", data, err)
+	}
+	if _, err := h.Read("dir", 0, 3); err != syscall.EISDIR {
+		t.Errorf("Read dir: got %v, want EISDIR", err)
+	}
+
+	ents, err := h.Readdir("")
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	// The children of an Inode are listed in no particular order.
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name < ents[j].Name })
+	if got, want := names(ents), []string{"dir", "file", "sized"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir: got %v, want %v", got, want)
+	} else if ents[0].Mode != syscall.S_IFDIR || ents[1].Mode != syscall.S_IFREG {
+		t.Errorf("Readdir: got %v", ents)
+	}
+
+	// The attributes are cached for a second.
+	if attr, err := h.Getattr("sized"); err != nil || attr.Size != 5 {
+		t.Fatalf("Getattr: got %v, %v", &attr, err)
+	}
+	sized.mu.Lock()
+	sized.size = 11
+	sized.mu.Unlock()
+	if attr, _ := h.Getattr("sized"); attr.Size != 5 {
+		t.Errorf("Getattr: got size %d, want the cached 5", attr.Size)
+	}
+	h.Advance(2 * time.Second)
+	if attr, _ := h.Getattr("sized"); attr.Size != 11 {
+		t.Errorf("Getattr after the timeout: got size %d, want 11", attr.Size)
+	}
+
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 2
+	if attr, err := h.Setattr("file", in); err != nil || attr.Size != 2 {
+		t.Errorf("Setattr: got %v, %v", &attr, err)
+	}
+	if data, err := h.Read("file", 0, 10); err != nil || string(data) != "he" {
+		t.Errorf("Read after truncate: got %q, %v", data, err)
+	}
+}
+
+// countDir looks up children on demand, and records the calls.
+type countDir struct {
+	fs.Inode
+
+	mu      sync.Mutex
+	lookups int
+	forgets int
+	// exists says whether the child "file" exists.
+	exists bool
+}
+
+var _ = (fs.NodeLookuper)((*countDir)(nil))
+
+func (d *countDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lookups++
+	if name != "file" || !d.exists {
+		return nil, syscall.ENOENT
+	}
+	// The same Ino makes the bridge reuse the node.
+	return d.NewInode(ctx, &forgetFile{dir: d}, fs.StableAttr{Mode: syscall.S_IFREG, Ino: 42}), 0
+}
+
+type forgetFile struct {
+	fs.Inode
+	dir *countDir
+}
+
+var _ = (fs.NodeOnForgetter)((*forgetFile)(nil))
+
+func (f *forgetFile) OnForget() {
+	f.dir.mu.Lock()
+	defer f.dir.mu.Unlock()
+	f.dir.forgets++
+}
+
+func (d *countDir) counts() (lookups, forgets int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookups, d.forgets
+}
+
+func TestHarnessCaching(t *testing.T) {
+	root := &countDir{}
+	hour := time.Hour
+	h := New(t, root, &fs.Options{
+		EntryTimeout:    &hour,
+		AttrTimeout:     &hour,
+		NegativeTimeout: &hour,
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.Lookup("file"); err != syscall.ENOENT {
+			t.Fatalf("Lookup: got %v, want ENOENT", err)
+		}
+	}
+	if l, _ := root.counts(); l != 1 {
+		t.Errorf("got %d lookups, want 1 for the cached negative entry", l)
+	}
+
+	root.mu.Lock()
+	root.exists = true
+	root.mu.Unlock()
+	if errno := root.NotifyEntry("file"); errno != 0 {
+		t.Fatalf("NotifyEntry: %v", errno)
+	}
+	first, err := h.Lookup("file")
+	if err != nil {
+		t.Fatalf("Lookup after NotifyEntry: %v", err)
+	}
+	h.Advance(2 * time.Hour)
+	if second, err := h.Lookup("file"); err != nil || second.NodeId != first.NodeId {
+		t.Fatalf("Lookup after the timeout: got node %d, %v, want %d", second.NodeId, err, first.NodeId)
+	}
+	if l, f := root.counts(); l != 3 || f != 0 {
+		t.Errorf("got %d lookups, %d forgets, want 3, 0", l, f)
+	}
+
+	// Both lookups must be forgotten before the node goes.
+	h.Close()
+	if _, f := root.counts(); f != 1 {
+		t.Errorf("got %d forgets after Close, want 1", f)
+	}
+}
+
+// badDir lists a subdirectory, but creates its node without a file
+// type.
+type badDir struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeLookuper)((*badDir)(nil))
+var _ = (fs.NodeReaddirer)((*badDir)(nil))
+
+func (d *badDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return fs.NewListDirStream([]fuse.DirEntry{{Name: "sub", Mode: syscall.S_IFDIR}}), 0
+}
+
+func (d *badDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name != "sub" {
+		return nil, syscall.ENOENT
+	}
+	return d.NewInode(ctx, &badDir{}, fs.StableAttr{}), 0
+}
+
+func TestHarnessMissingMode(t *testing.T) {
+	rec := &recorder{T: t}
+	h := New(rec, &badDir{}, nil)
+	defer h.Close()
+
+	if _, err := h.Readdir(""); err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	if len(rec.errs) != 2 {
+		t.Fatalf("got errors %q, want 2", rec.errs)
+	}
+	for _, e := range rec.errs {
+		if !strings.Contains(e, "StableAttr.Mode") {
+			t.Errorf("got %q, want a hint at StableAttr.Mode", e)
+		}
+	}
+}
+
+// seekDir is a directory whose handle ignores the offset in Seekdir.
+type seekDir struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeOpendirHandler)((*seekDir)(nil))
+
+func (d *seekDir) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return &badSeeker{}, 0, 0
+}
+
+type badSeeker struct {
+	next int
+}
+
+var _ = (fs.FileReaddirenter)((*badSeeker)(nil))
+var _ = (fs.FileSeekdirer)((*badSeeker)(nil))
+
+func (s *badSeeker) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	if s.next >= 4 {
+		return nil, 0
+	}
+	s.next++
+	return &fuse.DirEntry{Name: fmt.Sprintf("f%d", s.next), Mode: syscall.S_IFREG}, 0
+}
+
+func (s *badSeeker) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	s.next = 0
+	return 0
+}
+
+func TestHarnessSeek(t *testing.T) {
+	rec := &recorder{T: t}
+	h := New(rec, &seekDir{}, nil)
+	defer h.Close()
+
+	if _, err := h.Readdir(""); err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	if len(rec.errs) != 1 || !strings.Contains(rec.errs[0], "seeking") {
+		t.Errorf("got errors %q, want one about seeking", rec.errs)
+	}
+}
+
+func TestHarnessSeekMem(t *testing.T) {
+	root := &fs.Inode{}
+	h := New(t, root, &fs.Options{
+		OnAdd: func(ctx context.Context) {
+			for i := 0; i < 20; i++ {
+				root.AddChild(fmt.Sprintf("f%02d", i), root.NewPersistentInode(ctx, &fs.MemRegularFile{}, fs.StableAttr{}), false)
+			}
+		},
+	})
+	defer h.Close()
+
+	// The checks fail the test if seeking back lists other
+	// entries.
+	if ents, err := h.Readdir(""); err != nil || len(ents) != 20 {
+		t.Errorf("Readdir: got %d entries, %v", len(ents), err)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// attrNode reports a size of 10, and its file handles a size of 20.
+// It records which of them the Getattr calls reach.
+type attrNode struct {
+	Inode
+
+	mu    sync.Mutex
+	calls []string
+}
+
+var _ = (NodeOpener)((*attrNode)(nil))
+var _ = (NodeGetattrer)((*attrNode)(nil))
+
+func (n *attrNode) record(who string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls = append(n.calls, who)
+}
+
+// takeCalls returns the calls recorded so far, and clears them.
+func (n *attrNode) takeCalls() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	calls := n.calls
+	n.calls = nil
+	return calls
+}
+
+func (n *attrNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &attrFile{node: n}, 0, OK
+}
+
+func (n *attrNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.record("node")
+	out.Mode = 0644
+	out.Size = 10
+	return OK
+}
+
+type attrFile struct {
+	node *attrNode
+}
+
+var _ = (FileGetattrer)((*attrFile)(nil))
+
+func (f *attrFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.node.record("file")
+	out.Mode = 0644
+	out.Size = 20
+	return OK
+}
+
+func mountAttrNode(t *testing.T, opts *Options) (string, *attrNode, func()) {
+	root := &Inode{}
+	node := &attrNode{}
+	opts.AttrTimeout = new(time.Duration)
+	opts.OnAdd = func(ctx context.Context) {
+		root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{Mode: syscall.S_IFREG}), false)
+	}
+	mntDir, _, clean := testMount(t, root, opts)
+	return mntDir + "/file", node, clean
+}
+
+func TestGetattrFileHandle(t *testing.T) {
+	fn, node, clean := mountAttrNode(t, &Options{})
+	defer clean()
+
+	wantCalls := func(op, who string) {
+		t.Helper()
+		calls := node.takeCalls()
+		if len(calls) == 0 {
+			t.Errorf("%s: no Getattr call, want one on %s", op, who)
+		}
+		for _, c := range calls {
+			if c != who {
+				t.Errorf("%s: got Getattr on %s, want %s", op, c, who)
+			}
+		}
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(fn, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	wantCalls("stat", "node")
+	if st.Size != 10 {
+		t.Errorf("stat: got size %d, want 10", st.Size)
+	}
+
+	fd, err := syscall.Open(fn, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+	node.takeCalls()
+
+	// The kernel reads the attributes through the handle to find
+	// the end of the file.
+	end, err := unix.Seek(fd, 0, unix.SEEK_END)
+	if err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	wantCalls("lseek", "file")
+	if end != 20 {
+		t.Errorf("lseek: got offset %d, want 20", end)
+	}
+
+	// Linux passes no handle for fstat(2), nor for stat(2) while
+	// the file is open.
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+	wantCalls("fstat", "node")
+	if err := syscall.Stat(fn, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	wantCalls("stat", "node")
+}
+
+func TestNoGetattrOnOpenFiles(t *testing.T) {
+	fn, node, clean := mountAttrNode(t, &Options{NoGetattrOnOpenFiles: true})
+	defer clean()
+
+	fd, err := syscall.Open(fn, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	node.takeCalls()
+
+	var st syscall.Stat_t
+	for i := 0; i < 5; i++ {
+		if err := syscall.Fstat(fd, &st); err != nil {
+			t.Fatalf("Fstat: %v", err)
+		}
+		if st.Size != 10 {
+			t.Errorf("got size %d, want 10", st.Size)
+		}
+	}
+	if calls := node.takeCalls(); len(calls) != 1 {
+		t.Errorf("got Getattr calls %v while open, want 1", calls)
+	}
+
+	// RELEASE is asynchronous, so wait for Getattr to be called
+	// again.
+	syscall.Close(fd)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(node.takeCalls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no Getattr calls after the file was closed")
+		}
+		if err := syscall.Stat(fn, &st); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handleNode opens handles that report a size of 20, and read
+// "hello".
+type handleNode struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*handleNode)(nil))
+
+func (n *handleNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &handleFile{}, 0, OK
+}
+
+type handleFile struct{}
+
+var _ = (FileGetattrer)((*handleFile)(nil))
+var _ = (FileReader)((*handleFile)(nil))
+
+func (f *handleFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	out.Size = 20
+	return OK
+}
+
+func (f *handleFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return fuse.ReadResultData([]byte("hello")), OK
+}
+
+// TestFileHandlesConcurrent opens and releases handles, some of them
+// orphaned, while requests run on other handles. Run it with -race.
+func TestFileHandlesConcurrent(t *testing.T) {
+	root := &Inode{}
+	bridge := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &handleNode{}, StableAttr{Mode: syscall.S_IFREG}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := bridge.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	header := fuse.InHeader{NodeId: entry.NodeId}
+	open := func() uint64 {
+		var out fuse.OpenOut
+		if st := bridge.Open(nil, &fuse.OpenIn{InHeader: header}, &out); !st.Ok() {
+			t.Errorf("Open: %v", st)
+		}
+		return out.Fh
+	}
+	use := func(fh uint64) {
+		var out fuse.AttrOut
+		in := fuse.GetAttrIn{InHeader: header, Flags_: fuse.FUSE_GETATTR_FH, Fh_: fh}
+		if st := bridge.GetAttr(nil, &in, &out); !st.Ok() || out.Size != 20 {
+			t.Errorf("GetAttr(fh %d): got size %d, %v, want 20", fh, out.Size, st)
+		}
+		buf := make([]byte, 5)
+		res, st := bridge.Read(nil, &fuse.ReadIn{InHeader: header, Fh: fh, Size: 5}, buf)
+		if !st.Ok() {
+			t.Errorf("Read(fh %d): %v", fh, st)
+			return
+		}
+		if got, _ := res.Bytes(buf); string(got) != "hello" {
+			t.Errorf("Read(fh %d): got %q, want \"hello\"", fh, got)
+		}
+	}
+
+	stop := make(chan struct{})
+	var users sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		fh := open()
+		users.Add(1)
+		go func() {
+			defer users.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					use(fh)
+				}
+			}
+		}()
+	}
+
+	// Hand each new handle from the goroutine opening it to one
+	// using it through a pipe, like the kernel does. The raw system
+	// calls do not order the goroutines for the race detector, so
+	// the bridge must. The kernel only releases a handle once the
+	// requests on it are answered, so that step is a channel.
+	opened, openedW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+	defer openedW.Close()
+	used := make(chan uint64, 16)
+	send := func(w *os.File, fh uint64) {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], fh)
+		if _, _, errno := unix.Syscall(unix.SYS_WRITE, w.Fd(), uintptr(unsafe.Pointer(&buf[0])), 8); errno != 0 {
+			t.Errorf("write: %v", errno)
+		}
+	}
+	receive := func(r *os.File) uint64 {
+		var buf [8]byte
+		if n, _, errno := unix.Syscall(unix.SYS_READ, r.Fd(), uintptr(unsafe.Pointer(&buf[0])), 8); errno != 0 || n != 8 {
+			t.Errorf("read: %d, %v", n, errno)
+		}
+		return binary.LittleEndian.Uint64(buf[:])
+	}
+
+	const n = 500
+	var churn sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		churn.Add(3)
+		go func() {
+			defer churn.Done()
+			for j := 0; j < n; j++ {
+				send(openedW, open())
+			}
+		}()
+		go func() {
+			defer churn.Done()
+			for j := 0; j < n; j++ {
+				fh := receive(opened)
+				use(fh)
+				used <- fh
+			}
+		}()
+		go func(i int) {
+			defer churn.Done()
+			// Keep every other handle until the end, so both
+			// new and reused entries are handed out.
+			var kept []uint64
+			for j := 0; j < n; j++ {
+				if i == 0 && j%100 == 0 {
+					bridge.OrphanHandles()
+				}
+				fh := <-used
+				if j%2 == 1 {
+					kept = append(kept, fh)
+					continue
+				}
+				bridge.Release(nil, &fuse.ReleaseIn{InHeader: header, Fh: fh})
+			}
+			for _, fh := range kept {
+				bridge.Release(nil, &fuse.ReleaseIn{InHeader: header, Fh: fh})
+			}
+		}(i)
+	}
+	churn.Wait()
+	close(stop)
+	users.Wait()
+}
@@ -6,12 +6,13 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -58,6 +59,14 @@ type Inode struct {
 	ops    InodeEmbedder
 	bridge *rawBridge
 
+	// interceptor wraps the calls into ops. It is set by
+	// WrapNode, or inherited from the parent on creation.
+	interceptor Interceptor
+
+	// stale is set atomically on the nodes that InvalidateSubtree
+	// removed, so that later calls into them fail with ESTALE.
+	stale uint32
+
 	// The *Node ID* is an arbitrary uint64 identifier chosen by the FUSE library.
 	// It is used the identify *nodes* (files/directories/symlinks/...) in the
 	// communication between the FUSE library and the Linux kernel.
@@ -69,6 +78,10 @@ type Inode struct {
 	// protected by bridge.mu
 	openFiles []uint32
 
+	// openAttr holds the attributes served while files are open,
+	// see Options.NoGetattrOnOpenFiles. Protected by bridge.mu.
+	openAttr *fuse.Attr
+
 	// mu protects the following mutable fields. When locking
 	// multiple Inodes, locks must be acquired using
 	// lockNodes/unlockNodes
@@ -101,6 +114,12 @@ type Inode struct {
 	// Parents of this Inode. Can be more than one due to hard links.
 	// When you change this, you MUST increment changeCounter.
 	parents inodeParents
+
+	// path caches the result of the last Path call.
+	path pathCache
+
+	// forgotten is set once OnForget was called.
+	forgotten bool
 }
 
 func (n *Inode) IsDir() bool {
@@ -185,10 +204,15 @@ func (n *Inode) String() string {
 //
 // See lockNodes where this property is used to avoid deadlock when taking
 // locks on inode group.
+//
+// The groups are small, and an insertion sort does not allocate,
+// unlike sort.Slice.
 func sortNodes(ns []*Inode) {
-	sort.Slice(ns, func(i, j int) bool {
-		return nodeLess(ns[i], ns[j])
-	})
+	for i := 1; i < len(ns); i++ {
+		for j := i; j > 0 && nodeLess(ns[j], ns[j-1]); j-- {
+			ns[j], ns[j-1] = ns[j-1], ns[j]
+		}
+	}
 }
 
 func nodeLess(a, b *Inode) bool {
@@ -268,35 +292,93 @@ func (n *Inode) Operations() InodeEmbedder {
 	return n.ops
 }
 
+// ErrDisconnected is returned by PathOrErr for nodes that cannot be
+// reached from the root, because they or one of their ancestors
+// were removed from the tree.
+var ErrDisconnected = errors.New("fs: inode is disconnected from the root")
+
+// pathCache holds a path computed relative to root. It is valid
+// while gen equals the bridge's pathGen.
+type pathCache struct {
+	root *Inode
+	gen  uint64
+	path string
+}
+
 // Path returns a path string to the inode relative to `root`.
 // Pass nil to walk the hierarchy as far up as possible.
 //
 // If you set `root`, Path() warns if it finds an orphaned Inode, i.e.
-// if it does not end up at `root` after walking the hierarchy.
+// if it does not end up at `root` after walking the hierarchy. Use
+// PathOrErr to detect this case instead.
 func (n *Inode) Path(root *Inode) string {
+	path, connected := n.computePath(root)
+	if root != nil && !connected {
+		deletedPlaceholder := fmt.Sprintf(".go-fuse.%d/deleted", rand.Uint64())
+		n.bridge.logf("warning: Inode.Path: n%d is orphaned, replacing segment with %q",
+			n.nodeId, deletedPlaceholder)
+		// NOSUBMIT - should replace rather than append?
+		if path == "" {
+			return deletedPlaceholder
+		}
+		return deletedPlaceholder + "/" + path
+	}
+	return path
+}
+
+// PathOrErr is like Path, but returns ErrDisconnected along with the
+// partial path if the node is not connected to `root` (or to the
+// root of the file system, if `root` is nil).
+func (n *Inode) PathOrErr(root *Inode) (string, error) {
+	path, connected := n.computePath(root)
+	if !connected {
+		return path, ErrDisconnected
+	}
+	return path, nil
+}
+
+// computePath walks up to root, and reports whether it got
+// there. Paths of connected nodes are cached until a link between
+// nodes changes, and the walk stops at the first ancestor with a
+// valid cached path.
+func (n *Inode) computePath(root *Inode) (path string, connected bool) {
+	if root == nil && n.bridge != nil {
+		root = n.bridge.root
+	}
+	var gen uint64
+	if n.bridge != nil {
+		gen = atomic.LoadUint64(&n.bridge.pathGen)
+	}
+
 	var segments []string
+	prefix := ""
 	p := n
-	for p != nil && p != root {
+	for {
+		if p == root {
+			connected = true
+			break
+		}
 		// We don't try to take all locks at the same time, because
 		// the caller won't use the "path" string under lock anyway.
 		p.mu.Lock()
+		if c := p.path; root != nil && c.root == root && c.gen == gen {
+			p.mu.Unlock()
+			prefix = c.path
+			connected = true
+			break
+		}
 		// Get last known parent
 		pd := p.parents.get()
 		p.mu.Unlock()
 		if pd == nil {
-			p = nil
+			connected = root == nil
 			break
 		}
 		segments = append(segments, pd.name)
 		p = pd.parent
 	}
-
-	if root != nil && root != p {
-		deletedPlaceholder := fmt.Sprintf(".go-fuse.%d/deleted", rand.Uint64())
-		n.bridge.logf("warning: Inode.Path: n%d is orphaned, replacing segment with %q",
-			n.nodeId, deletedPlaceholder)
-		// NOSUBMIT - should replace rather than append?
-		segments = append(segments, deletedPlaceholder)
+	if p == n {
+		return prefix, connected
 	}
 
 	i := 0
@@ -308,8 +390,24 @@ func (n *Inode) Path(root *Inode) string {
 		j--
 	}
 
-	path := strings.Join(segments, "/")
-	return path
+	path = strings.Join(segments, "/")
+	if prefix != "" {
+		path = prefix + "/" + path
+	}
+	if connected && root != nil {
+		n.mu.Lock()
+		n.path = pathCache{root: root, gen: gen, path: path}
+		n.mu.Unlock()
+	}
+	return path, connected
+}
+
+// invalidatePaths drops all cached paths. It must be called after
+// changing or removing an existing link between nodes.
+func (n *Inode) invalidatePaths() {
+	if n.bridge != nil {
+		atomic.AddUint64(&n.bridge.pathGen, 1)
+	}
 }
 
 // setEntry does `iparent[name] = ichild` linking.
@@ -320,6 +418,7 @@ func (n *Inode) Path(root *Inode) string {
 // created and only one goroutine keeps referencing it.
 func (iparent *Inode) setEntry(name string, ichild *Inode) {
 	newParent := parentData{name, iparent}
+	hadParent := ichild.parents.count() > 0
 	if ichild.stableAttr.Mode == syscall.S_IFDIR {
 		// Directories cannot have more than one parent. Clear the map.
 		// This special-case is neccessary because ichild may still have a
@@ -330,6 +429,9 @@ func (iparent *Inode) setEntry(name string, ichild *Inode) {
 	iparent.children[name] = ichild
 	ichild.changeCounter++
 	iparent.changeCounter++
+	if hadParent {
+		ichild.invalidatePaths()
+	}
 }
 
 // NewPersistentInode returns an Inode whose lifetime is not in
@@ -364,16 +466,13 @@ func (n *Inode) NewInode(ctx context.Context, node InodeEmbedder, id StableAttr)
 }
 
 func (n *Inode) newInode(ctx context.Context, ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
-	return n.bridge.newInode(ctx, ops, id, persistent)
+	return n.bridge.newInode(ctx, ops, id, persistent, n.interceptor)
 }
 
 // removeRef decreases references. Returns if this operation caused
 // the node to be forgotten (for kernel references), and whether it is
 // live (ie. was not dropped from the tree)
 func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (forgotten bool, live bool) {
-	var lockme []*Inode
-	var parents []parentData
-
 	n.mu.Lock()
 	if nlookup > 0 && dropPersistence {
 		log.Panic("only one allowed")
@@ -387,15 +486,23 @@ func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (forgotten bool,
 		n.changeCounter++
 	}
 
-	n.bridge.mu.Lock()
 	if n.lookupCount == 0 {
 		forgotten = true
-		// Dropping the node from stableAttrs guarantees that no new references to this node are
-		// handed out to the kernel, hence we can also safely delete it from kernelNodeIds.
-		delete(n.bridge.stableAttrs, n.stableAttr)
-		delete(n.bridge.kernelNodeIds, n.nodeId)
+		n.bridge.mu.Lock()
+		n.bridge.dropKernelNode(n)
+		n.bridge.mu.Unlock()
 	}
-	n.bridge.mu.Unlock()
+
+	return forgotten, n.detach()
+}
+
+// detach removes n from the tree, if it is no longer referenced by
+// the kernel, by children, or by being persistent. It must be called
+// with n.mu held, and releases it. It returns whether n is still
+// live.
+func (n *Inode) detach() (live bool) {
+	var lockme []*Inode
+	var parents []parentData
 
 retry:
 	for {
@@ -410,7 +517,7 @@ retry:
 		n.mu.Unlock()
 
 		if live {
-			return forgotten, live
+			return live
 		}
 
 		lockNodes(lockme...)
@@ -431,6 +538,7 @@ retry:
 		}
 		n.parents.clear()
 		n.changeCounter++
+		n.invalidatePaths()
 
 		if n.lookupCount != 0 {
 			log.Panicf("n%d %p lookupCount changed: %d", n.nodeId, n, n.lookupCount)
@@ -440,12 +548,25 @@ retry:
 		break
 	}
 
+	n.onForget()
 	for _, p := range lockme {
 		if p != n {
 			p.removeRef(0, false)
 		}
 	}
-	return forgotten, false
+	return false
+}
+
+// onForget calls OnForget, unless it was called before.
+func (n *Inode) onForget() {
+	n.mu.Lock()
+	done := n.forgotten
+	n.forgotten = true
+	n.mu.Unlock()
+
+	if of, ok := n.ops.(NodeOnForgetter); ok && !done {
+		of.OnForget()
+	}
 }
 
 // GetChild returns a child node with the given name, or nil if the
@@ -469,10 +590,14 @@ retry:
 		prev, ok := n.children[name]
 		parentCounter := n.changeCounter
 		if !ok {
+			hadParent := ch.parents.count() > 0
 			n.children[name] = ch
 			ch.parents.add(parentData{name, n})
 			n.changeCounter++
 			ch.changeCounter++
+			if hadParent {
+				ch.invalidatePaths()
+			}
 			unlockNode2(n, ch)
 			return true
 		}
@@ -494,6 +619,7 @@ retry:
 		n.changeCounter++
 		ch.changeCounter++
 		prev.changeCounter++
+		n.invalidatePaths()
 		unlockNodes(lockme[:]...)
 
 		return true
@@ -511,6 +637,29 @@ func (n *Inode) Children() map[string]*Inode {
 	return r
 }
 
+// ForEachChild calls f for each child of this directory Inode, in no
+// particular order, until f returns false. Unlike Children, it does
+// not copy the children. The Inode stays locked during the
+// iteration, so f must not change the tree, nor call methods of this
+// Inode that lock it, eg. GetChild, Children or AddChild.
+func (n *Inode) ForEachChild(f func(name string, child *Inode) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, v := range n.children {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// ChildrenCount returns the number of children of this directory
+// Inode.
+func (n *Inode) ChildrenCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.children)
+}
+
 // Parents returns a parent of this Inode, or nil if this Inode is
 // deleted or is the root
 func (n *Inode) Parent() (string, *Inode) {
@@ -539,6 +688,46 @@ func (n *Inode) RmAllChildren() {
 	n.removeRef(0, true)
 }
 
+// InvalidateSubtree removes all children of n from the tree,
+// depth first, for when the backing store lost a whole directory
+// tree. For each removed name, the kernel is told with NotifyDelete,
+// so processes see the deletion right away. The removed nodes are
+// marked stale: later operations on them, including those through
+// files that are still open, fail with ESTALE. Flush and Release
+// still reach the open files, so they can be cleaned up. n itself
+// stays in the tree.
+//
+// InvalidateSubtree must not be called from within a file system
+// operation, as the kernel may hold locks that the notifications
+// wait for. It stops with EINTR if ctx is canceled. Otherwise it
+// returns the first error of a notification, other than ENOENT,
+// which means that the kernel did not cache the entry.
+func (n *Inode) InvalidateSubtree(ctx context.Context) syscall.Errno {
+	var errno syscall.Errno
+	for {
+		chs := n.Children()
+		if len(chs) == 0 {
+			return errno
+		}
+		for name, ch := range chs {
+			if ctx.Err() != nil {
+				return syscall.EINTR
+			}
+			if e := ch.InvalidateSubtree(ctx); e == syscall.EINTR {
+				return e
+			} else if e != 0 && errno == 0 {
+				errno = e
+			}
+			atomic.StoreUint32(&ch.stale, 1)
+			if e := n.NotifyDelete(name, ch); e != 0 && e != syscall.ENOENT && errno == 0 {
+				errno = e
+			}
+			n.RmChild(name)
+			ch.removeRef(0, true)
+		}
+	}
+}
+
 // RmChild removes multiple children.  Returns whether the removal
 // succeeded and whether the node is still live afterward. The removal
 // is transactional: it only succeeds if all names are children, and
@@ -577,6 +766,7 @@ retry:
 			ch.changeCounter++
 		}
 		n.changeCounter++
+		n.invalidatePaths()
 
 		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent
 		unlockNodes(lockme...)
@@ -644,6 +834,7 @@ retry:
 			oldChild.parents.add(parentData{newName, newParent})
 			oldChild.changeCounter++
 		}
+		n.invalidatePaths()
 
 		unlockNodes(n, newParent, oldChild, destChild)
 
@@ -709,6 +900,7 @@ retry:
 			destChild.parents.add(parentData{oldName, oldParent})
 			destChild.changeCounter++
 		}
+		oldParent.invalidatePaths()
 		unlockNodes(oldParent, newParent, oldChild, destChild)
 		return
 	}
@@ -722,9 +914,27 @@ func (n *Inode) NotifyEntry(name string) syscall.Errno {
 	return syscall.Errno(status)
 }
 
+// Invalidate notifies the kernel that n is stale under all of its
+// names, as with NotifyEntry on each parent, so that subsequent
+// operations by name look it up again. Files that are already open
+// keep using n. See also Options.InvalidateOnStale.
+func (n *Inode) Invalidate() syscall.Errno {
+	n.mu.Lock()
+	parents := n.parents.all()
+	n.mu.Unlock()
+	for _, p := range parents {
+		if errno := p.parent.NotifyEntry(p.name); errno != 0 {
+			return errno
+		}
+	}
+	return OK
+}
+
 // NotifyDelete notifies the kernel that the given inode was removed
-// from this directory as entry under the given name. It is equivalent
-// to NotifyEntry, but also sends an event to inotify watchers.
+// from this directory as entry under the given name. Unlike
+// NotifyEntry, it leaves the entry alone, returning ENOENT, if the
+// name meanwhile refers to another inode, and it sends an event to
+// inotify watchers. See fuse.Server.DeleteNotify.
 func (n *Inode) NotifyDelete(name string, child *Inode) syscall.Errno {
 	// XXX arg ordering?
 	return syscall.Errno(n.bridge.server.DeleteNotify(n.nodeId, child.nodeId, name))
@@ -738,6 +948,45 @@ func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
 	return syscall.Errno(n.bridge.server.InodeNotify(n.nodeId, off, sz))
 }
 
+// NotifySymlink notifies the kernel that the target of this symlink
+// changed. It is only needed if MountOptions.EnableSymlinkCaching is
+// set; the kernel then caches the target until it is invalidated. If
+// the change also replaced the node, use NotifyEntry on the parent
+// instead.
+func (n *Inode) NotifySymlink() syscall.Errno {
+	return n.NotifyContent(0, 0)
+}
+
+// InvalidateDirCache drops the listing of directory n that the
+// kernel cached for fuse.FOPEN_CACHE_DIR (see NodeOpendirFlagser),
+// so the next listing calls Readdir again. Looked up entries
+// stay cached; invalidate those with NotifyEntry.
+func (n *Inode) InvalidateDirCache() syscall.Errno {
+	return n.NotifyContent(0, 0)
+}
+
+// NotifyPollWakeup wakes up poll(2), select(2) and epoll(7) callers
+// waiting on an open file of this inode, so they poll again. Call
+// it when the readiness reported by FilePoller changes.
+func (n *Inode) NotifyPollWakeup() syscall.Errno {
+	b := n.bridge
+	var khs []uint64
+	b.mu.Lock()
+	for _, fh := range n.openFiles {
+		if kh := b.files[fh].pollKh; kh != 0 {
+			khs = append(khs, kh)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, kh := range khs {
+		if st := b.server.PollNotify(kh); !st.Ok() {
+			return syscall.Errno(st)
+		}
+	}
+	return OK
+}
+
 // WriteCache stores data in the kernel cache.
 func (n *Inode) WriteCache(offset int64, data []byte) syscall.Errno {
 	return syscall.Errno(n.bridge.server.InodeNotifyStoreCache(n.nodeId, offset, data))
@@ -748,3 +997,25 @@ func (n *Inode) ReadCache(offset int64, dest []byte) (count int, errno syscall.E
 	c, s := n.bridge.server.InodeRetrieveCache(n.nodeId, offset, dest)
 	return c, syscall.Errno(s)
 }
+
+// NotifyStore pushes data into the kernel page cache for this inode,
+// so reads of the range are served without calling into the file
+// system. The file is extended if the data ends beyond its size.
+//
+// The kernel only keeps the data if the file is opened with
+// fuse.FOPEN_KEEP_CACHE, as opening it otherwise drops the cache.
+func (n *Inode) NotifyStore(offset int64, data []byte) syscall.Errno {
+	return n.WriteCache(offset, data)
+}
+
+// NotifyRetrieve returns up to 'size' bytes at 'offset' from the
+// kernel page cache for this inode, stopping at the first page that
+// is not cached. It blocks until the kernel replies.
+func (n *Inode) NotifyRetrieve(offset int64, size uint32) ([]byte, syscall.Errno) {
+	dest := make([]byte, size)
+	c, errno := n.ReadCache(offset, dest)
+	if errno != 0 {
+		return nil, errno
+	}
+	return dest[:c], OK
+}
@@ -20,12 +20,17 @@ type inodeParents struct {
 
 // add adds a parent to the store.
 func (p *inodeParents) add(n parentData) {
+	// already known as `newest`. This is checked first, and n
+	// only copied to the heap below, so that looking up a known
+	// entry does not allocate.
+	if p.newest != nil && *p.newest == n {
+		return
+	}
+	newest := new(parentData)
+	*newest = n
 	// one and only parent
 	if p.newest == nil {
-		p.newest = &n
-	}
-	// already known as `newest`
-	if *p.newest == n {
+		p.newest = newest
 		return
 	}
 	// old `newest` gets displaced into `other`
@@ -35,7 +40,7 @@ func (p *inodeParents) add(n parentData) {
 	p.other[*p.newest] = struct{}{}
 	// new parent becomes `newest` (possibly moving up from `other`)
 	delete(p.other, n)
-	p.newest = &n
+	p.newest = newest
 }
 
 // get returns the most recent parent
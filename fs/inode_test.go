@@ -1,6 +1,10 @@
 package fs
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 )
@@ -26,3 +30,182 @@ func TestInodeIsDir(t *testing.T) {
 		}
 	}
 }
+
+// newPathTree returns the root of an unmounted tree, and the
+// directories d0/d1/.../d<depth-1> below it.
+func newPathTree(depth int) (*Inode, []*Inode) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	var dirs []*Inode
+	p := root
+	for i := 0; i < depth; i++ {
+		ch := p.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+		p.AddChild(fmt.Sprintf("d%d", i), ch, false)
+		dirs = append(dirs, ch)
+		p = ch
+	}
+	return root, dirs
+}
+
+func TestInodePathCache(t *testing.T) {
+	root, dirs := newPathTree(4)
+	leaf := dirs[3]
+	if got, want := leaf.Path(nil), "d0/d1/d2/d3"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := leaf.Path(dirs[1]), "d2/d3"; got != want {
+		t.Errorf("relative: got %q, want %q", got, want)
+	}
+
+	// Renaming an ancestor invalidates the cached path.
+	if !dirs[0].MvChild("d1", root, "moved", false) {
+		t.Fatal("MvChild failed")
+	}
+	if got, err := leaf.PathOrErr(nil); err != nil || got != "moved/d2/d3" {
+		t.Errorf("after rename: got %q, %v, want %q", got, err, "moved/d2/d3")
+	}
+
+	// Removing an ancestor disconnects the node.
+	root.RmChild("moved")
+	if got, err := leaf.PathOrErr(nil); err != ErrDisconnected {
+		t.Errorf("after unlink: got %q, %v, want ErrDisconnected", got, err)
+	} else if got != "d2/d3" {
+		t.Errorf("after unlink: got partial path %q, want %q", got, "d2/d3")
+	}
+	if got := leaf.Path(root); !strings.HasSuffix(got, "/deleted/d2/d3") {
+		t.Errorf("after unlink: got %q, want placeholder", got)
+	}
+}
+
+func TestInodePathConcurrentRename(t *testing.T) {
+	root, dirs := newPathTree(10)
+	leaf := dirs[9]
+	names := []string{"d5", "other"}
+	valid := map[string]bool{}
+	for _, nm := range names {
+		valid["d0/d1/d2/d3/d4/"+nm+"/d6/d7/d8/d9"] = true
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan string, 1)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if p, err := leaf.PathOrErr(root); err != nil || !valid[p] {
+					select {
+					case errs <- fmt.Sprintf("got %q, %v", p, err):
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10000; i++ {
+		if !dirs[4].MvChild(names[i%2], dirs[4], names[(i+1)%2], false) {
+			t.Fatal("MvChild failed")
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case e := <-errs:
+		t.Fatal(e)
+	default:
+	}
+	if got, want := leaf.Path(nil), "d0/d1/d2/d3/d4/d5/d6/d7/d8/d9"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func BenchmarkInodePath(b *testing.B) {
+	_, dirs := newPathTree(50)
+	leaf := dirs[len(dirs)-1]
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			leaf.Path(nil)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			leaf.invalidatePaths()
+			leaf.Path(nil)
+		}
+	})
+}
+
+func TestInodeForEachChild(t *testing.T) {
+	root, _ := newPathTree(1)
+	ctx := context.Background()
+	for i := 1; i < 10; i++ {
+		root.AddChild(fmt.Sprintf("d%d", i), root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR}), false)
+	}
+	if got := root.ChildrenCount(); got != 10 {
+		t.Errorf("ChildrenCount: got %d, want 10", got)
+	}
+
+	seen := map[string]*Inode{}
+	root.ForEachChild(func(name string, ch *Inode) bool {
+		seen[name] = ch
+		return true
+	})
+	want := root.Children()
+	if len(seen) != len(want) {
+		t.Fatalf("got %d children, want %d", len(seen), len(want))
+	}
+	for k, v := range want {
+		if seen[k] != v {
+			t.Errorf("%s: got %p, want %p", k, seen[k], v)
+		}
+	}
+
+	calls := 0
+	root.ForEachChild(func(name string, ch *Inode) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Errorf("got %d calls after stopping, want 3", calls)
+	}
+}
+
+func BenchmarkInodeChildren(b *testing.B) {
+	root := &Inode{}
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+	ctx := context.Background()
+	for i := 0; i < 100000; i++ {
+		root.AddChild(fmt.Sprintf("f%d", i), root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+	}
+	b.ResetTimer()
+	b.Run("Children", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for range root.Children() {
+			}
+		}
+	})
+	b.Run("ForEachChild", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			root.ForEachChild(func(string, *Inode) bool { return true })
+		}
+	})
+	// The default listing, for nodes without Readdir.
+	b.Run("Readdir", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bridge.getStream(ctx, root)
+		}
+	})
+}
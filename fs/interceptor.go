@@ -0,0 +1,180 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Interceptor is called around each operation that the bridge
+// dispatches to a node or to one of its file handles. The op is the
+// name of the method called, eg. "Lookup" or "Read", and next makes
+// the actual call. An interceptor may time or log the call, or
+// short-circuit it by returning an error without calling next. It
+// must not return success without calling next, as the results
+// would be missing; this is reported as EIO.
+type Interceptor func(ctx context.Context, op string, next func() syscall.Errno) syscall.Errno
+
+// WrapNode installs the interceptor on node, and returns the node.
+// As the node itself is returned, it implements exactly the same
+// interfaces as before. Nodes created with NewInode or
+// NewPersistentInode on a wrapped node inherit its interceptor, so
+// wrapping the root node intercepts the whole file system. Wrapping
+// a node more than once chains the interceptors, with the last one
+// outermost.
+//
+// WrapNode must be called before the node is added to the tree.
+func WrapNode(node InodeEmbedder, interceptor Interceptor) InodeEmbedder {
+	n := node.embed()
+	if inner := n.interceptor; inner != nil {
+		n.interceptor = func(ctx context.Context, op string, next func() syscall.Errno) syscall.Errno {
+			return interceptor(ctx, op, func() syscall.Errno {
+				return inner(ctx, op, next)
+			})
+		}
+	} else {
+		n.interceptor = interceptor
+	}
+	return node
+}
+
+// intercept runs call through the interceptor of n, if there is one.
+// Calls into nodes removed by InvalidateSubtree fail with ESTALE,
+// except those that clean up open files.
+func (n *Inode) intercept(ctx context.Context, op string, call func() syscall.Errno) syscall.Errno {
+	if atomic.LoadUint32(&n.stale) != 0 && op != "Flush" && op != "Release" && op != "Releasedir" {
+		return syscall.ESTALE
+	}
+	var errno syscall.Errno
+	if n.interceptor == nil {
+		errno = call()
+	} else {
+		called := false
+		errno = n.interceptor(ctx, op, func() syscall.Errno {
+			called = true
+			return call()
+		})
+		if errno == 0 && !called {
+			errno = syscall.EIO
+		}
+	}
+	return n.callDone(errno)
+}
+
+// intercepted reports whether calls into n must go through
+// intercept. If not, the hottest operations call the node directly,
+// followed by callDone, as the closure for intercept has to be
+// allocated.
+func (n *Inode) intercepted() bool {
+	return n.interceptor != nil || atomic.LoadUint32(&n.stale) != 0
+}
+
+// callDone handles the result of a call into n.
+func (n *Inode) callDone(errno syscall.Errno) syscall.Errno {
+	if errno == syscall.ESTALE && n.bridge != nil && n.bridge.options.InvalidateOnStale {
+		// The kernel may hold the lock of the parent directory
+		// until we reply, so notify asynchronously.
+		go n.Invalidate()
+	}
+	return errno
+}
+
+// NewLoggingInterceptor returns an interceptor that logs each call
+// with its caller, result and duration. If logger is nil, the
+// standard logger is used.
+func NewLoggingInterceptor(logger *log.Logger) Interceptor {
+	logf := log.Printf
+	if logger != nil {
+		logf = logger.Printf
+	}
+	return func(ctx context.Context, op string, next func() syscall.Errno) syscall.Errno {
+		start := time.Now()
+		errno := next()
+		var caller fuse.Caller
+		if c, ok := fuse.FromContext(ctx); ok {
+			caller = *c
+		}
+		logf("%s uid=%d pid=%d: %v (%v)", op, caller.Uid, caller.Pid, errnoToStatus(errno), time.Since(start))
+		return errno
+	}
+}
+
+// LatencyBuckets are the upper bounds of the histogram buckets
+// used by LatencyRecorder.
+var LatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyRecorder records a latency histogram for each operation.
+// Use its Intercept method as an Interceptor.
+type LatencyRecorder struct {
+	mu    sync.Mutex
+	hists map[string][]int
+}
+
+// NewLatencyRecorder returns an empty LatencyRecorder.
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{hists: map[string][]int{}}
+}
+
+// Intercept times the call, and adds it to the histogram of op.
+func (r *LatencyRecorder) Intercept(ctx context.Context, op string, next func() syscall.Errno) syscall.Errno {
+	start := time.Now()
+	errno := next()
+	dt := time.Since(start)
+
+	i := 0
+	for i < len(LatencyBuckets) && dt >= LatencyBuckets[i] {
+		i++
+	}
+	r.mu.Lock()
+	h := r.hists[op]
+	if h == nil {
+		h = make([]int, len(LatencyBuckets)+1)
+		r.hists[op] = h
+	}
+	h[i]++
+	r.mu.Unlock()
+	return errno
+}
+
+// Histogram returns the call counts for op. Entry i counts the
+// calls that took less than LatencyBuckets[i] (and at least the
+// previous bound); the last entry counts the remaining, slower
+// calls. It returns nil if op was not called.
+func (r *LatencyRecorder) Histogram(op string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.hists[op]
+	if h == nil {
+		return nil
+	}
+	return append([]int(nil), h...)
+}
+
+// Ops returns the sorted names of the operations recorded so far.
+func (r *LatencyRecorder) Ops() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ops []string
+	for op := range r.hists {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// syncBuffer is a bytes.Buffer that can be written concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWrapNode(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := NewLatencyRecorder()
+	var logs syncBuffer
+	root = WrapNode(root, rec.Intercept)
+	root = WrapNode(root, NewLoggingInterceptor(log.New(&logs, "", 0)))
+	root = WrapNode(root, func(ctx context.Context, op string, next func() syscall.Errno) syscall.Errno {
+		if op == "Unlink" {
+			return syscall.EPERM
+		}
+		return next()
+	})
+	if _, ok := root.(NodeOpener); !ok {
+		t.Fatal("wrapped node lost NodeOpener")
+	}
+
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	if err := ioutil.WriteFile(mntDir+"/new", []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if content, err := ioutil.ReadFile(mntDir + "/file"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	if err := syscall.Unlink(mntDir + "/file"); err != syscall.EPERM {
+		t.Errorf("Unlink: got %v, want EPERM", err)
+	}
+	if _, err := os.Stat(origDir + "/file"); err != nil {
+		t.Errorf("short-circuited Unlink removed the file: %v", err)
+	}
+
+	// Create is called on the root, the other calls on its
+	// children, which inherit the interceptors.
+	for _, op := range []string{"Lookup", "Create", "Write", "Open", "Read"} {
+		total := 0
+		for _, c := range rec.Histogram(op) {
+			total += c
+		}
+		if total == 0 {
+			t.Errorf("no latencies recorded for %s, got ops %v", op, rec.Ops())
+		}
+	}
+	if h := rec.Histogram("Unlink"); h != nil {
+		t.Errorf("Unlink reached the recorder: %v", h)
+	}
+	if !strings.Contains(logs.String(), "Read uid=") {
+		t.Errorf("Read was not logged: %q", logs.String())
+	}
+}
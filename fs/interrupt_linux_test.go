@@ -0,0 +1,83 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type blockingRoot struct {
+	Inode
+	child blockingOps
+}
+
+var _ = (NodeOnAdder)((*blockingRoot)(nil))
+
+func (r *blockingRoot) OnAdd(ctx context.Context) {
+	r.AddChild("file", r.NewPersistentInode(ctx, &r.child, StableAttr{}), false)
+}
+
+// blockingOps blocks opening until the request is canceled.
+type blockingOps struct {
+	Inode
+	opening chan struct{}
+}
+
+var _ = (NodeOpener)((*blockingOps)(nil))
+
+func (o *blockingOps) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	close(o.opening)
+	select {
+	case <-ctx.Done():
+		// Fail as a call cut short by the cancellation would.
+		return nil, 0, syscall.EIO
+	case <-time.After(5 * time.Second):
+		return nil, 0, syscall.ETIMEDOUT
+	}
+}
+
+func TestInterruptEINTR(t *testing.T) {
+	root := &blockingRoot{child: blockingOps{opening: make(chan struct{})}}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	tids := make(chan int, 1)
+	errs := make(chan error, 1)
+	go func() {
+		// Signals are sent to the thread blocked in open.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		tids <- unix.Gettid()
+
+		fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+		if err == nil {
+			syscall.Close(fd)
+		}
+		errs <- err
+	}()
+	tid := <-tids
+	<-root.child.opening
+
+	// Any signal, even one the process handles, makes the kernel
+	// interrupt the request. The Go runtime ignores SIGURG.
+	if err := unix.Tgkill(os.Getpid(), tid, unix.SIGURG); err != nil {
+		t.Fatalf("Tgkill: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != syscall.EINTR {
+			t.Errorf("got %v, want EINTR", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("open was not interrupted")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ChangeKind is the kind of a ChangeEvent.
+type ChangeKind int
+
+const (
+	// ChangeCreate is a new file or directory.
+	ChangeCreate ChangeKind = iota
+
+	// ChangeModify is a change of the contents or attributes of
+	// a file or directory.
+	ChangeModify
+
+	// ChangeDelete is the removal of a file or directory.
+	ChangeDelete
+
+	// ChangeRename is a move from Path to NewPath.
+	ChangeRename
+)
+
+// ChangeEvent describes a change in the backing store of a file
+// system. Paths are relative to the root of the hub, with '/' as
+// separator.
+type ChangeEvent struct {
+	Kind    ChangeKind
+	Path    string
+	NewPath string
+}
+
+// InvalidationHub translates the changes of a backing store, eg. as
+// reported by inotify(7), into kernel cache invalidations. It
+// resolves the paths in the tree of Inodes, and calls NotifyEntry,
+// NotifyDelete and NotifyContent as needed. Paths that the kernel
+// has not looked up need no invalidation, and are ignored.
+//
+// Renames and deletes are also applied to the tree, so that nodes
+// whose operations depend on their path, like LoopbackNode, follow
+// the backing store.
+//
+// Events are collected for a delay before they are applied, so a
+// burst of events for the same file causes a single invalidation.
+type InvalidationHub struct {
+	root  *Inode
+	delay time.Duration
+
+	// applyMu serializes the application of batches, so events
+	// are applied in order.
+	applyMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []ChangeEvent
+	// seen holds the pending events since the last rename, to
+	// drop repeated ones. Renames change the tree, so they are
+	// never dropped.
+	seen  map[ChangeEvent]bool
+	timer *time.Timer
+}
+
+// NewInvalidationHub returns a hub for the tree under root, which
+// must be part of a mounted file system. Events are applied 'delay'
+// after the first event of a batch. With a zero delay, Notify
+// applies each event directly; it must then not be called from
+// within a file system operation, as the kernel may hold locks that
+// the notifications wait for.
+func NewInvalidationHub(root *Inode, delay time.Duration) *InvalidationHub {
+	return &InvalidationHub{
+		root:  root,
+		delay: delay,
+		seen:  map[ChangeEvent]bool{},
+	}
+}
+
+// Notify queues an event.
+func (h *InvalidationHub) Notify(ev ChangeEvent) {
+	h.mu.Lock()
+	if ev.Kind == ChangeRename {
+		h.seen = map[ChangeEvent]bool{}
+		h.pending = append(h.pending, ev)
+	} else if !h.seen[ev] {
+		h.seen[ev] = true
+		h.pending = append(h.pending, ev)
+	}
+	if h.delay > 0 && h.timer == nil {
+		h.timer = time.AfterFunc(h.delay, h.Flush)
+	}
+	h.mu.Unlock()
+
+	if h.delay == 0 {
+		h.Flush()
+	}
+}
+
+// Flush applies the queued events now.
+func (h *InvalidationHub) Flush() {
+	h.applyMu.Lock()
+	defer h.applyMu.Unlock()
+
+	h.mu.Lock()
+	evs := h.pending
+	h.pending = nil
+	h.seen = map[ChangeEvent]bool{}
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.mu.Unlock()
+
+	for _, ev := range evs {
+		h.apply(ev)
+	}
+}
+
+func (h *InvalidationHub) apply(ev ChangeEvent) {
+	switch ev.Kind {
+	case ChangeCreate:
+		h.invalidateEntry(ev.Path, false)
+	case ChangeModify:
+		if n, rest := h.resolve(splitPath(ev.Path)); len(rest) == 0 {
+			h.check("NotifyContent", ev.Path, n.NotifyContent(0, 0))
+		}
+	case ChangeDelete:
+		h.invalidateEntry(ev.Path, true)
+	case ChangeRename:
+		h.rename(ev.Path, ev.NewPath)
+	}
+}
+
+// resolve returns the deepest known node on the path, and the
+// components below it that were not found.
+func (h *InvalidationHub) resolve(components []string) (*Inode, []string) {
+	n := h.root
+	for i, c := range components {
+		ch := n.GetChild(c)
+		if ch == nil {
+			return n, components[i:]
+		}
+		n = ch
+	}
+	return n, nil
+}
+
+// invalidateEntry invalidates the entry for p, and the attributes of
+// its directory. If deleted is set, the entry is also removed from
+// the tree.
+func (h *InvalidationHub) invalidateEntry(p string, deleted bool) {
+	components := splitPath(p)
+	if len(components) == 0 {
+		return
+	}
+	parent, rest := h.resolve(components[:len(components)-1])
+	if len(rest) > 0 {
+		// Nothing below the missing directory is known, but
+		// the kernel may have cached that it does not exist.
+		h.check("NotifyEntry", p, parent.NotifyEntry(rest[0]))
+		return
+	}
+
+	name := components[len(components)-1]
+	child := parent.GetChild(name)
+	if deleted && child != nil {
+		h.check("NotifyDelete", p, parent.NotifyDelete(name, child))
+		parent.RmChild(name)
+	} else {
+		h.check("NotifyEntry", p, parent.NotifyEntry(name))
+	}
+	h.check("NotifyContent", p, parent.NotifyContent(0, 0))
+}
+
+func (h *InvalidationHub) rename(oldPath, newPath string) {
+	oldComponents := splitPath(oldPath)
+	newComponents := splitPath(newPath)
+	if len(oldComponents) == 0 || len(newComponents) == 0 {
+		return
+	}
+	oldParent, oldRest := h.resolve(oldComponents[:len(oldComponents)-1])
+	newParent, newRest := h.resolve(newComponents[:len(newComponents)-1])
+	oldName := oldComponents[len(oldComponents)-1]
+	newName := newComponents[len(newComponents)-1]
+	if len(oldRest) > 0 || len(newRest) > 0 || oldParent.GetChild(oldName) == nil {
+		h.invalidateEntry(oldPath, true)
+		h.invalidateEntry(newPath, false)
+		return
+	}
+
+	oldParent.MvChild(oldName, newParent, newName, true)
+	h.check("NotifyEntry", oldPath, oldParent.NotifyEntry(oldName))
+	h.check("NotifyEntry", newPath, newParent.NotifyEntry(newName))
+	h.check("NotifyContent", oldPath, oldParent.NotifyContent(0, 0))
+	if newParent != oldParent {
+		h.check("NotifyContent", newPath, newParent.NotifyContent(0, 0))
+	}
+}
+
+// check logs failed notifications. ENOENT means that the kernel did
+// not have the node or entry cached, which is fine.
+func (h *InvalidationHub) check(op, p string, errno syscall.Errno) {
+	if errno != 0 && errno != syscall.ENOENT {
+		h.root.bridge.logf("InvalidationHub: %s %q: %v", op, p, errno)
+	}
+}
+
+// splitPath splits p into its components.
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
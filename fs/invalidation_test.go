@@ -0,0 +1,279 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// mountCachedLoopback mounts a loopback file system that caches
+// entries, negative entries and attributes for an hour, so changes to
+// the backing directory are only seen after an invalidation.
+func mountCachedLoopback(t *testing.T) (orig, mnt string, root *Inode, clean func()) {
+	dir := testutil.TempDir()
+	orig = dir + "/orig"
+	if err := os.Mkdir(orig, 0755); err != nil {
+		t.Fatal(err)
+	}
+	loopback, err := NewLoopbackRoot(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Hour
+	mnt, _, cleanMount := testMount(t, loopback, &Options{
+		EntryTimeout:    &hour,
+		AttrTimeout:     &hour,
+		NegativeTimeout: &hour,
+	})
+	return orig, mnt, loopback.EmbeddedInode(), func() {
+		cleanMount()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInvalidationHubModify(t *testing.T) {
+	orig, mnt, root, clean := mountCachedLoopback(t)
+	defer clean()
+	hub := NewInvalidationHub(root, 0)
+
+	if err := ioutil.WriteFile(orig+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Reading would invalidate the attributes on the short read,
+	// so only stat the file.
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if err := ioutil.WriteFile(orig+"/file", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(mnt+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Size != 5 {
+		t.Fatalf("got size %d before the event, want the cached 5", st.Size)
+	}
+
+	hub.Notify(ChangeEvent{Kind: ChangeModify, Path: "file"})
+	if content, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(content) != "hello world" {
+		t.Errorf("ReadFile after the event: got %q, %v, want %q", content, err, "hello world")
+	}
+}
+
+func TestInvalidationHubCreate(t *testing.T) {
+	orig, mnt, root, clean := mountCachedLoopback(t)
+	defer clean()
+	hub := NewInvalidationHub(root, 0)
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/a/b/file", &st); err != syscall.ENOENT {
+		t.Fatalf("Stat: got %v, want ENOENT", err)
+	}
+	if err := os.MkdirAll(orig+"/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(orig+"/a/b/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(mnt+"/a/b/file", &st); err != syscall.ENOENT {
+		t.Fatalf("Stat before the event: got %v, want the cached ENOENT", err)
+	}
+
+	// "a" and "b" are unknown to the tree.
+	hub.Notify(ChangeEvent{Kind: ChangeCreate, Path: "a/b/file"})
+	if err := syscall.Stat(mnt+"/a/b/file", &st); err != nil {
+		t.Errorf("Stat after the event: %v", err)
+	}
+}
+
+func TestInvalidationHubRenameDelete(t *testing.T) {
+	orig, mnt, root, clean := mountCachedLoopback(t)
+	defer clean()
+	hub := NewInvalidationHub(root, 0)
+
+	if err := ioutil.WriteFile(orig+"/old", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var before syscall.Stat_t
+	if err := syscall.Stat(mnt+"/old", &before); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.Rename(orig+"/old", orig+"/new"); err != nil {
+		t.Fatal(err)
+	}
+	hub.Notify(ChangeEvent{Kind: ChangeRename, Path: "old", NewPath: "new"})
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/old", &st); err != syscall.ENOENT {
+		t.Errorf("Stat old: got %v, want ENOENT", err)
+	}
+	if err := syscall.Stat(mnt+"/new", &st); err != nil {
+		t.Fatalf("Stat new: %v", err)
+	} else if st.Ino != before.Ino {
+		t.Errorf("got inode %d for new, want %d", st.Ino, before.Ino)
+	}
+	if got := root.GetChild("new"); got == nil || got.Path(root) != "new" {
+		t.Errorf("node not moved in the tree: %v", got)
+	}
+
+	if err := os.Remove(orig + "/new"); err != nil {
+		t.Fatal(err)
+	}
+	hub.Notify(ChangeEvent{Kind: ChangeDelete, Path: "new"})
+	if err := syscall.Stat(mnt+"/new", &st); err != syscall.ENOENT {
+		t.Errorf("Stat after delete: got %v, want ENOENT", err)
+	}
+}
+
+// hubRecorder records the notifications of a bridge that is not
+// mounted.
+type hubRecorder struct {
+	ServerCallbacks
+
+	mu    sync.Mutex
+	calls []string
+	done  chan struct{}
+}
+
+func (r *hubRecorder) record(format string, args ...interface{}) fuse.Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprintf(format, args...))
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	return fuse.OK
+}
+
+func (r *hubRecorder) takeCalls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func (r *hubRecorder) EntryNotify(parent uint64, name string) fuse.Status {
+	return r.record("entry %d %s", parent, name)
+}
+
+func (r *hubRecorder) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return r.record("delete %d %s", parent, name)
+}
+
+func (r *hubRecorder) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	return r.record("inode %d", node)
+}
+
+func TestInvalidationHubBatching(t *testing.T) {
+	root := &Inode{}
+	rec := &hubRecorder{}
+	var file *Inode
+	NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		OnAdd: func(ctx context.Context) {
+			file = root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+			root.AddChild("file", file, false)
+		},
+	})
+
+	hub := NewInvalidationHub(root, time.Hour)
+	for i := 0; i < 100; i++ {
+		hub.Notify(ChangeEvent{Kind: ChangeModify, Path: "file"})
+		hub.Notify(ChangeEvent{Kind: ChangeCreate, Path: "/dir/../other"})
+	}
+	if calls := rec.takeCalls(); len(calls) != 0 {
+		t.Fatalf("got notifications %v before the delay", calls)
+	}
+	hub.Flush()
+	want := []string{
+		fmt.Sprintf("inode %d", file.nodeId),
+		"entry 1 other",
+		"inode 1",
+	}
+	if calls := rec.takeCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+
+	// The timer applies the batch too.
+	done := make(chan struct{})
+	rec.mu.Lock()
+	rec.done = done
+	rec.mu.Unlock()
+	hub = NewInvalidationHub(root, time.Millisecond)
+	hub.Notify(ChangeEvent{Kind: ChangeModify, Path: "file"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification after the delay")
+	}
+}
+
+// TestNotifyDeleteRecreated checks that a late NotifyDelete for a
+// replaced file leaves the entry of the new file alone.
+func TestNotifyDeleteRecreated(t *testing.T) {
+	orig, mnt, root, clean := mountCachedLoopback(t)
+	defer clean()
+
+	if err := ioutil.WriteFile(orig+"/file", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the old inode alive in the kernel.
+	f, err := os.Open(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	oldCh := root.GetChild("file")
+	if oldCh == nil {
+		t.Fatal("no inode for file")
+	}
+
+	// The name is recreated, and the kernel learns about the
+	// new file before the deletion of the old one is notified.
+	if err := ioutil.WriteFile(orig+"/file.new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(orig+"/file.new", orig+"/file"); err != nil {
+		t.Fatal(err)
+	}
+	if errno := root.NotifyEntry("file"); errno != 0 {
+		t.Fatalf("NotifyEntry: %v", errno)
+	}
+	var before syscall.Stat_t
+	if err := syscall.Stat(mnt+"/file", &before); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if root.GetChild("file") == oldCh {
+		t.Fatal("file was not looked up again")
+	}
+
+	// A new lookup would fail now.
+	if err := os.Remove(orig + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if errno := root.NotifyDelete("file", oldCh); errno != 0 && errno != syscall.ENOENT {
+		t.Fatalf("NotifyDelete: %v", errno)
+	}
+	var after syscall.Stat_t
+	if err := syscall.Stat(mnt+"/file", &after); err != nil {
+		t.Fatalf("Stat after NotifyDelete: %v", err)
+	} else if after.Ino != before.Ino {
+		t.Errorf("got ino %d, want %d", after.Ino, before.Ino)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Ioctl numbers as in <asm-generic/ioctl.h>.
+const (
+	// _IOWR('g', 1, [8]byte): reverses the 8 bytes.
+	ioctlReverse = 3<<30 | 8<<16 | 'g'<<8 | 1
+	// _IO('g', 2): returns the argument plus one.
+	ioctlIncrement = 'g'<<8 | 2
+)
+
+// ioctlFile is a file that answers ioctls from its file handles.
+type ioctlFile struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*ioctlFile)(nil))
+
+func (f *ioctlFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &ioctlHandle{}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+type ioctlHandle struct{}
+
+var _ = (FileIoctler)((*ioctlHandle)(nil))
+
+func (h *ioctlHandle) Ioctl(ctx context.Context, cmd uint32, arg uint64, input []byte, output []byte) (int32, syscall.Errno) {
+	switch cmd {
+	case ioctlReverse:
+		if len(input) != 8 || len(output) != 8 {
+			return 0, syscall.EINVAL
+		}
+		for i, b := range input {
+			output[len(output)-1-i] = b
+		}
+		return 0, OK
+	case ioctlIncrement:
+		return int32(arg) + 1, OK
+	}
+	return 0, syscall.ENOTTY
+}
+
+// ioctlDir handles ioctls on the directory itself.
+type ioctlDir struct {
+	Inode
+}
+
+var _ = (NodeIoctler)((*ioctlDir)(nil))
+
+func (d *ioctlDir) Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, output []byte) (int32, syscall.Errno) {
+	if cmd == ioctlIncrement {
+		return int32(arg) + 2, OK
+	}
+	return 0, syscall.ENOTTY
+}
+
+func ioctl(fd int, cmd uintptr, arg uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, arg)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func TestIoctl(t *testing.T) {
+	root := &ioctlDir{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &ioctlFile{}, StableAttr{}), false)
+			root.AddChild("plain", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	buf := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if _, err := ioctl(fd, ioctlReverse, uintptr(unsafe.Pointer(&buf))); err != nil {
+		t.Fatalf("ioctl(reverse): %v", err)
+	}
+	if want := [8]byte{8, 7, 6, 5, 4, 3, 2, 1}; buf != want {
+		t.Errorf("ioctl(reverse): got %v, want %v", buf, want)
+	}
+	if r, err := ioctl(fd, ioctlIncrement, 41); err != nil || r != 42 {
+		t.Errorf("ioctl(increment): got %d, %v, want 42", r, err)
+	}
+
+	plain, err := syscall.Open(mntDir+"/plain", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(plain)
+	if _, err := ioctl(plain, ioctlIncrement, 41); err != syscall.ENOTTY {
+		t.Errorf("ioctl on plain file: got %v, want ENOTTY", err)
+	}
+
+	dir, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(dir)
+	if r, err := ioctl(dir, ioctlIncrement, 40); err != nil || r != 42 {
+		t.Errorf("ioctl on directory: got %d, %v, want 42", r, err)
+	}
+}
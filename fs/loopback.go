@@ -8,6 +8,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -32,7 +33,10 @@ type LoopbackRoot struct {
 
 func (r *LoopbackRoot) newNode(parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
 	if r.NewNode != nil {
-		return r.NewNode(r, parent, name, st)
+		// Pass a copy, so st need not escape to the heap when
+		// NewNode is not set.
+		stCopy := *st
+		return r.NewNode(r, parent, name, &stCopy)
 	}
 	return &LoopbackNode{
 		RootData: r,
@@ -69,7 +73,6 @@ type LoopbackNode struct {
 	RootData *LoopbackRoot
 }
 
-var _ = (NodeStatfser)((*LoopbackNode)(nil))
 var _ = (NodeStatfser)((*LoopbackNode)(nil))
 var _ = (NodeGetattrer)((*LoopbackNode)(nil))
 var _ = (NodeGetxattrer)((*LoopbackNode)(nil))
@@ -81,6 +84,7 @@ var _ = (NodeOpener)((*LoopbackNode)(nil))
 var _ = (NodeCopyFileRanger)((*LoopbackNode)(nil))
 var _ = (NodeLookuper)((*LoopbackNode)(nil))
 var _ = (NodeOpendirer)((*LoopbackNode)(nil))
+var _ = (NodeOpendirHandler)((*LoopbackNode)(nil))
 var _ = (NodeReaddirer)((*LoopbackNode)(nil))
 var _ = (NodeMkdirer)((*LoopbackNode)(nil))
 var _ = (NodeMknoder)((*LoopbackNode)(nil))
@@ -90,6 +94,8 @@ var _ = (NodeUnlinker)((*LoopbackNode)(nil))
 var _ = (NodeRmdirer)((*LoopbackNode)(nil))
 var _ = (NodeRenamer)((*LoopbackNode)(nil))
 
+// Statfs reports the numbers of the underlying file system, so df(1)
+// and free space checks see the real capacity.
 func (n *LoopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 	s := syscall.Statfs_t{}
 	err := syscall.Statfs(n.path(), &s)
@@ -190,8 +196,8 @@ func (n *LoopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
 }
 
 func (n *LoopbackNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	if flags&RENAME_EXCHANGE != 0 {
-		return n.renameExchange(name, newParent, newName)
+	if flags != 0 {
+		return n.renameat2(name, newParent, newName, flags)
 	}
 
 	p1 := filepath.Join(n.path(), name)
@@ -247,7 +253,14 @@ func (n *LoopbackNode) Symlink(ctx context.Context, target, name string, out *fu
 func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 
 	p := filepath.Join(n.path(), name)
-	err := syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	var err error
+	if tf, ok := target.(*loopbackTmpfile); ok && tf.orphan() {
+		tf.mu.Lock()
+		err = tf.link(p)
+		tf.mu.Unlock()
+	} else {
+		err = syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	}
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -263,6 +276,64 @@ func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name stri
 	return ch, 0
 }
 
+// loopbackTmpfile is a file from Tmpfile. Until it is linked into
+// the tree, it has no path, so it is reached through its own file
+// descriptor, which is closed when the node is forgotten.
+type loopbackTmpfile struct {
+	LoopbackNode
+
+	mu sync.Mutex
+	fd int
+}
+
+var _ = (NodeGetattrer)((*loopbackTmpfile)(nil))
+var _ = (NodeSetattrer)((*loopbackTmpfile)(nil))
+var _ = (NodeOpener)((*loopbackTmpfile)(nil))
+var _ = (NodeOnForgetter)((*loopbackTmpfile)(nil))
+
+func (n *loopbackTmpfile) orphan() bool {
+	_, parent := n.Parent()
+	return parent == nil
+}
+
+func (n *loopbackTmpfile) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f != nil || !n.orphan() {
+		return n.LoopbackNode.Getattr(ctx, f, out)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return (&loopbackFile{fd: n.fd}).Getattr(ctx, out)
+}
+
+func (n *loopbackTmpfile) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if f != nil || !n.orphan() {
+		return n.LoopbackNode.Setattr(ctx, f, in, out)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return (&loopbackFile{fd: n.fd}).Setattr(ctx, in, out)
+}
+
+func (n *loopbackTmpfile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if !n.orphan() {
+		return n.LoopbackNode.Open(ctx, flags)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fd, err := n.reopen(int(flags &^ syscall.O_APPEND))
+	if err != nil {
+		return nil, 0, ToErrno(err)
+	}
+	return NewLoopbackFile(fd), 0, 0
+}
+
+func (n *loopbackTmpfile) OnForget() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	syscall.Close(n.fd)
+	n.fd = -1
+}
+
 func (n *LoopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 	p := n.path()
 
@@ -290,6 +361,33 @@ func (n *LoopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, f
 	return lf, 0, 0
 }
 
+var _ = (NodeGetlker)((*LoopbackNode)(nil))
+var _ = (NodeSetlker)((*LoopbackNode)(nil))
+var _ = (NodeSetlkwer)((*LoopbackNode)(nil))
+
+// Getlk, Setlk and Setlkw forward to the file handle. Implementing
+// them on the node makes Mount ask the kernel for lock requests.
+func (n *LoopbackNode) Getlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if gl, ok := f.(FileGetlker); ok {
+		return gl.Getlk(ctx, owner, lk, flags, out)
+	}
+	return syscall.EBADF
+}
+
+func (n *LoopbackNode) Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if sl, ok := f.(FileSetlker); ok {
+		return sl.Setlk(ctx, owner, lk, flags)
+	}
+	return syscall.EBADF
+}
+
+func (n *LoopbackNode) Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if sl, ok := f.(FileSetlkwer); ok {
+		return sl.Setlkw(ctx, owner, lk, flags)
+	}
+	return syscall.EBADF
+}
+
 func (n *LoopbackNode) Opendir(ctx context.Context) syscall.Errno {
 	fd, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0755)
 	if err != nil {
@@ -303,6 +401,104 @@ func (n *LoopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
 	return NewLoopbackDirStream(n.path())
 }
 
+// OpendirHandle keeps the directory stream open until the directory
+// is released, rather than opening it for every listing.
+func (n *LoopbackNode) OpendirHandle(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if errno := n.Opendir(ctx); errno != 0 {
+		return nil, 0, errno
+	}
+	return &loopbackDirHandle{node: n}, 0, OK
+}
+
+// loopbackDirHandle is the directory handle of a LoopbackNode.
+type loopbackDirHandle struct {
+	node *LoopbackNode
+
+	mu sync.Mutex
+	// ds is opened on the first read, so entries created after
+	// opendir(3) are listed.
+	ds DirStream
+	// entry is returned by Readdirent.
+	entry fuse.DirEntry
+}
+
+var _ = (FileReaddirenter)((*loopbackDirHandle)(nil))
+var _ = (DirEntryAppender)((*loopbackDirHandle)(nil))
+var _ = (FileSeekdirer)((*loopbackDirHandle)(nil))
+var _ = (FileReleasedirer)((*loopbackDirHandle)(nil))
+
+// stream opens the directory stream if needed. Must have h.mu.
+func (h *loopbackDirHandle) stream() syscall.Errno {
+	if h.ds == nil {
+		ds, errno := NewLoopbackDirStream(h.node.path())
+		if errno != 0 {
+			return errno
+		}
+		h.ds = ds
+	}
+	return OK
+}
+
+func (h *loopbackDirHandle) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if errno := h.stream(); errno != 0 {
+		return nil, errno
+	}
+	if !h.ds.HasNext() {
+		return nil, OK
+	}
+	var errno syscall.Errno
+	h.entry, errno = h.ds.Next()
+	return &h.entry, errno
+}
+
+// AppendDirEntries lists the entries without converting their names
+// to strings, as the streams of NewLoopbackDirStream are
+// DirEntryAppenders.
+func (h *loopbackDirHandle) AppendDirEntries(ctx context.Context, out *fuse.DirEntryList) (int, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if errno := h.stream(); errno != 0 {
+		return 0, errno
+	}
+	return h.ds.(DirEntryAppender).AppendDirEntries(ctx, out)
+}
+
+// Seekdir reopens the directory for offset 0, so a rewound listing
+// shows the current contents.
+func (h *loopbackDirHandle) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off == 0 || h.ds == nil {
+		if h.ds != nil {
+			h.ds.Close()
+			h.ds = nil
+		}
+		if off == 0 {
+			return OK
+		}
+		ds, errno := NewLoopbackDirStream(h.node.path())
+		if errno != 0 {
+			return errno
+		}
+		h.ds = ds
+	}
+	if sk, ok := h.ds.(DirSeeker); ok {
+		return sk.Seekdir(ctx, off)
+	}
+	return syscall.ESPIPE
+}
+
+func (h *loopbackDirHandle) Releasedir(ctx context.Context, releaseFlags uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ds != nil {
+		h.ds.Close()
+		h.ds = nil
+	}
+}
+
 func (n *LoopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
 	if f != nil {
 		return f.(FileGetattrer).Getattr(ctx, out)
@@ -14,25 +14,35 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/utimens"
+	"golang.org/x/sys/unix"
 )
 
+// The L variants pass XATTR_NOFOLLOW, so symlinks have their own
+// attributes, as on Linux. Reads and writes at an offset into
+// com.apple.ResourceFork are served by the fuse package on top of
+// these calls.
+
 func (n *LoopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	return 0, syscall.ENOSYS
+	sz, err := unix.Lgetxattr(n.path(), attr, dest)
+	return uint32(sz), ToErrno(err)
 }
 
 func (n *LoopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
-	return syscall.ENOSYS
+	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
+	return ToErrno(err)
 }
 
 func (n *LoopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
-	return syscall.ENOSYS
+	err := unix.Lremovexattr(n.path(), attr)
+	return ToErrno(err)
 }
 
 func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	return 0, syscall.ENOSYS
+	sz, err := unix.Llistxattr(n.path(), dest)
+	return uint32(sz), ToErrno(err)
 }
 
-func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
+func (n *LoopbackNode) renameat2(name string, newparent InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	return syscall.ENOSYS
 }
 
@@ -116,3 +126,11 @@ func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
 	return 0, syscall.ENOSYS
 }
+
+func (n *loopbackTmpfile) link(p string) error {
+	return syscall.ENOTSUP
+}
+
+func (n *loopbackTmpfile) reopen(flags int) (int, error) {
+	return -1, syscall.ENOTSUP
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXAttrDarwin(t *testing.T) {
+	if _, err := exec.LookPath("xattr"); err != nil {
+		t.Skip("xattr(1) not found")
+	}
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "", 0644)
+	mntFile := filepath.Join(tc.mntDir, "file")
+	origFile := filepath.Join(tc.origDir, "file")
+
+	xattr := func(args ...string) string {
+		out, err := exec.Command("xattr", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("xattr %v: %v, %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	attr := "com.example.xattrtest"
+	xattr("-w", attr, "value", mntFile)
+	if got := xattr("-p", attr, origFile); got != "value" {
+		t.Errorf("backing file: got %q, want %q", got, "value")
+	}
+	if got := xattr("-p", attr, mntFile); got != "value" {
+		t.Errorf("mount: got %q, want %q", got, "value")
+	}
+	if got := xattr(mntFile); !strings.Contains(got, attr) {
+		t.Errorf("list: got %q, want %q", got, attr)
+	}
+	xattr("-d", attr, mntFile)
+	if got := xattr(origFile); strings.Contains(got, attr) {
+		t.Errorf("after delete: got %q", got)
+	}
+}
+
+// The resource fork is larger than a single request, so it is read
+// and written at offsets.
+func TestXAttrResourceFork(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "", 0644)
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	rsrc := "file/..namedfork/rsrc"
+	if err := ioutil.WriteFile(filepath.Join(tc.mntDir, rsrc), want, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.origDir, rsrc))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("backing file: got %d bytes, want %d", len(got), len(want))
+	}
+	got, err = ioutil.ReadFile(filepath.Join(tc.mntDir, rsrc))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("mount: got %d bytes, want %d", len(got), len(want))
+	}
+}
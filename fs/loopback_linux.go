@@ -8,9 +8,11 @@ package fs
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,7 +36,32 @@ func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, sysc
 	return uint32(sz), ToErrno(err)
 }
 
-func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
+var _ = (NodeStatxer)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	dirfd, p := unix.AT_FDCWD, n.path()
+	atFlags := int(flags)
+	if lf, ok := f.(*loopbackFile); ok {
+		lf.mu.Lock()
+		defer lf.mu.Unlock()
+		dirfd, p = lf.fd, ""
+		atFlags |= unix.AT_EMPTY_PATH
+	} else if &n.Inode != n.Root() {
+		atFlags |= unix.AT_SYMLINK_NOFOLLOW
+	}
+
+	var st unix.Statx_t
+	if err := unix.Statx(dirfd, p, atFlags, int(mask), &st); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatx(&st)
+	return OK
+}
+
+// renameat2 renames with RENAME_* flags. For RENAME_EXCHANGE, it
+// verifies that both parents are still the directories we know
+// about, so the bridge swaps the right children afterwards.
+func (n *LoopbackNode) renameat2(name string, newparent InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	fd1, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0)
 	if err != nil {
 		return ToErrno(err)
@@ -42,10 +69,14 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 	defer syscall.Close(fd1)
 	p2 := filepath.Join(n.RootData.Path, newparent.EmbeddedInode().Path(nil))
 	fd2, err := syscall.Open(p2, syscall.O_DIRECTORY, 0)
-	defer syscall.Close(fd2)
 	if err != nil {
 		return ToErrno(err)
 	}
+	defer syscall.Close(fd2)
+
+	if flags&RENAME_EXCHANGE == 0 {
+		return ToErrno(unix.Renameat2(fd1, name, fd2, newName, uint(flags)))
+	}
 
 	var st syscall.Stat_t
 	if err := syscall.Fstat(fd1, &st); err != nil {
@@ -66,23 +97,72 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 		return syscall.EBUSY
 	}
 
-	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
+	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, uint(flags)))
 }
 
 func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
-	lfIn, ok := fhIn.(*loopbackFile)
+	cfr, ok := fhIn.(FileCopyFileRanger)
 	if !ok {
 		return 0, syscall.ENOTSUP
 	}
-	lfOut, ok := fhOut.(*loopbackFile)
-	if !ok {
-		return 0, syscall.ENOTSUP
+	return cfr.CopyFileRange(ctx, offIn, out, fhOut, offOut, len, flags)
+}
+
+var _ = (NodeTmpfiler)((*LoopbackNode)(nil))
+
+// Tmpfile opens the backing directory with O_TMPFILE. If the backing
+// file system does not support it, this returns EOPNOTSUPP.
+func (n *LoopbackNode) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	flags = flags &^ syscall.O_APPEND
+	fd, err := syscall.Open(n.path(), int(flags)|unix.O_TMPFILE, mode)
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && syscall.Getuid() == 0 {
+		syscall.Fchown(fd, int(caller.Uid), int(caller.Gid))
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+	nodeFd, err := syscall.Dup(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
 	}
 
-	signedOffIn := int64(offIn)
-	signedOffOut := int64(offOut)
-	count, err := unix.CopyFileRange(lfIn.fd, &signedOffIn, lfOut.fd, &signedOffOut, int(len), int(flags))
-	return uint32(count), ToErrno(err)
+	node := &loopbackTmpfile{LoopbackNode: LoopbackNode{RootData: n.RootData}, fd: nodeFd}
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	out.FromStat(&st)
+	return ch, NewLoopbackFile(fd), 0, 0
+}
+
+// Getxattr reads from the file descriptor while the node has no
+// path. The kernel asks for security.capability on writes.
+func (n *loopbackTmpfile) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if !n.orphan() {
+		return n.LoopbackNode.Getxattr(ctx, attr, dest)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sz, err := unix.Fgetxattr(n.fd, attr, dest)
+	return uint32(sz), ToErrno(err)
+}
+
+// link gives the file the name p. Linking through /proc follows the
+// file descriptor without needing CAP_DAC_READ_SEARCH, which
+// AT_EMPTY_PATH requires.
+func (n *loopbackTmpfile) link(p string) error {
+	return unix.Linkat(unix.AT_FDCWD, n.procPath(), unix.AT_FDCWD, p, unix.AT_SYMLINK_FOLLOW)
+}
+
+func (n *loopbackTmpfile) reopen(flags int) (int, error) {
+	return syscall.Open(n.procPath(), flags, 0)
+}
+
+func (n *loopbackTmpfile) procPath() string {
+	return fmt.Sprintf("/proc/self/fd/%d", n.fd)
 }
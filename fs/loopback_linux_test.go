@@ -6,10 +6,16 @@ package fs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"os/exec"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -179,6 +185,62 @@ func TestXAttr(t *testing.T) {
 	}
 }
 
+func TestStatx(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	var want unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.origDir+"/file", 0, unix.STATX_ALL, &want); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if want.Mask&unix.STATX_BTIME == 0 {
+		t.Skip("$TMP does not support btime. Rerun this test with a $TMPDIR override")
+	}
+
+	var got unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.mntDir+"/file", 0, unix.STATX_ALL, &got); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if got.Mask&unix.STATX_BTIME == 0 {
+		t.Fatalf("btime missing from mask 0x%x", got.Mask)
+	}
+	if got.Btime != want.Btime {
+		t.Errorf("got btime %v, want %v", got.Btime, want.Btime)
+	}
+	if got.Size != 5 || got.Mode != syscall.S_IFREG|0644 {
+		t.Errorf("got size %d mode 0%o, want 5, 0%o", got.Size, got.Mode, syscall.S_IFREG|0644)
+	}
+}
+
+// TestStatxGetattr checks that statx is answered from Getattr for
+// nodes that don't implement NodeStatxer.
+func TestStatxGetattr(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			ch := n.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{})
+			n.AddChild("file", ch, false)
+		},
+		UID: 42,
+	})
+	defer clean()
+
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, mntDir+"/file", 0, unix.STATX_ALL, &st); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if st.Mask&unix.STATX_BTIME != 0 {
+		t.Errorf("got btime in mask 0x%x", st.Mask)
+	}
+	if st.Size != 5 || st.Uid != 42 || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("got size %d uid %d mode 0%o, want 5, 42, a regular file", st.Size, st.Uid, st.Mode)
+	}
+}
+
 // TestXAttrSymlink verifies that we did not forget to use Lgetxattr instead
 // of Getxattr. This test is Linux-specific because it depends on the behavoir
 // of the `security` namespace.
@@ -264,6 +326,91 @@ func TestCopyFileRange(t *testing.T) {
 
 }
 
+// copyCountingFile counts the copies made from a loopback file.
+type copyCountingFile struct {
+	*loopbackFile
+	copies *int32
+}
+
+func (f *copyCountingFile) CopyFileRange(ctx context.Context, offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	atomic.AddInt32(f.copies, 1)
+	if c, ok := fhOut.(*copyCountingFile); ok {
+		fhOut = c.loopbackFile
+	}
+	return f.loopbackFile.CopyFileRange(ctx, offIn, out, fhOut, offOut, len, flags)
+}
+
+type copyCountingNode struct {
+	LoopbackNode
+	copies *int32
+}
+
+func (n *copyCountingNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	fh, fuseFlags, errno := n.LoopbackNode.Open(ctx, flags)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return &copyCountingFile{fh.(*loopbackFile), n.copies}, fuseFlags, 0
+}
+
+func TestCopyFileRangeLarge(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+
+	var copies int32
+	rootData := &LoopbackRoot{
+		Path: origDir,
+		NewNode: func(rootData *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
+			return &copyCountingNode{LoopbackNode{RootData: rootData}, &copies}
+		},
+	}
+	mntDir, server, clean := testMount(t, rootData.NewNode(rootData, nil, "", nil), nil)
+	defer clean()
+	if !server.KernelSettings().SupportsVersion(7, 28) {
+		t.Skip("need v7.28 for CopyFileRange")
+	}
+
+	want := make([]byte, 5<<20+123)
+	rand.Read(want)
+	if err := ioutil.WriteFile(origDir+"/src", want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(mntDir + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(mntDir + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	for n := 0; n < len(want); {
+		sz, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, len(want)-n, 0)
+		if err != nil {
+			t.Fatalf("CopyFileRange: %v", err)
+		}
+		if sz == 0 {
+			t.Fatalf("CopyFileRange: premature EOF at %d", n)
+		}
+		n += sz
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got, err := ioutil.ReadFile(origDir + "/dst"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("copy differs from the source")
+	}
+	if atomic.LoadInt32(&copies) == 0 {
+		t.Errorf("data was not copied with copy_file_range")
+	}
+}
+
 // Wait for a change in /proc/self/mounts. Efficient through the use of
 // unix.Poll().
 func waitProcMountsChange() error {
@@ -401,3 +548,630 @@ func TestRoMount(t *testing.T) {
 	tc := newTestCase(t, &testOptions{ro: true})
 	defer tc.Clean()
 }
+
+func TestLoopbackDirStreamSeekdir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoopbackDirStreamSeekdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough entries to need several getdents calls.
+	for i := 0; i < 1000; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/file%d", dir, i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds, errno := NewLoopbackDirStream(dir)
+	if errno != 0 {
+		t.Fatalf("NewLoopbackDirStream: %v", errno)
+	}
+	defer ds.Close()
+	var names []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		names = append(names, e.Name)
+	}
+
+	seeker := ds.(DirSeeker)
+	for _, k := range []int{700, 0, 999, 1, 500} {
+		if errno := seeker.Seekdir(context.Background(), uint64(k)); errno != 0 {
+			t.Fatalf("Seekdir(%d): %v", k, errno)
+		}
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		if e.Name != names[k] {
+			t.Errorf("Seekdir(%d): got %q, want %q", k, e.Name, names[k])
+		}
+	}
+
+	// Seeking past the entries read so far reads up to the offset.
+	fresh, errno := NewLoopbackDirStream(dir)
+	if errno != 0 {
+		t.Fatalf("NewLoopbackDirStream: %v", errno)
+	}
+	defer fresh.Close()
+	if errno := fresh.(DirSeeker).Seekdir(context.Background(), 500); errno != 0 {
+		t.Fatalf("Seekdir: %v", errno)
+	}
+	if e, _ := fresh.Next(); e.Name != names[500] {
+		t.Errorf("got %q, want %q", e.Name, names[500])
+	}
+	if errno := fresh.(DirSeeker).Seekdir(context.Background(), uint64(len(names)+10)); errno != 0 {
+		t.Fatalf("Seekdir: %v", errno)
+	}
+	if fresh.HasNext() {
+		t.Errorf("HasNext after seeking past the end")
+	}
+}
+
+func TestTmpfile(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+
+	fd, err := unix.Open(tc.mntDir, unix.O_TMPFILE|unix.O_RDWR, 0644)
+	if err == syscall.EOPNOTSUPP {
+		t.Skipf("backing file system does not support O_TMPFILE")
+	} else if err != nil {
+		t.Fatalf("Open(O_TMPFILE): %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if _, err := syscall.Write(fd, []byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := syscall.Fchmod(fd, 0600); err != nil {
+		t.Fatalf("Fchmod: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+	if st.Size != 5 || st.Mode&07777 != 0600 {
+		t.Errorf("got size %d mode %o, want 5, 0600", st.Size, st.Mode&07777)
+	}
+	if err := syscall.Stat(tc.origDir, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Mode&07777 == 0600 {
+		t.Errorf("Fchmod changed the directory")
+	}
+
+	// The file is unnamed until it is linked.
+	if names, err := ioutil.ReadDir(tc.origDir); err != nil || len(names) != 0 {
+		t.Errorf("ReadDir: got %v, %v, want empty", names, err)
+	}
+	if err := unix.Linkat(fd, "", unix.AT_FDCWD, tc.mntDir+"/file", unix.AT_EMPTY_PATH); err != nil {
+		t.Fatalf("Linkat: %v", err)
+	}
+	if got, err := ioutil.ReadFile(tc.origDir + "/file"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestTmpfileUnsupported(t *testing.T) {
+	mntDir, _, clean := testMount(t, &Inode{}, nil)
+	defer clean()
+
+	if _, err := unix.Open(mntDir, unix.O_TMPFILE|unix.O_RDWR, 0644); err != syscall.EOPNOTSUPP {
+		t.Errorf("Open(O_TMPFILE): got %v, want EOPNOTSUPP", err)
+	}
+}
+
+func TestLoopbackLocks(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	fd1, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd1)
+	fd2, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd2)
+	origFd, err := syscall.Open(origDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(origFd)
+
+	// A record lock through the mount is visible on the backing file.
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(uintptr(fd1), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("F_SETLK: %v", err)
+	}
+	lk = syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(uintptr(origFd), _OFD_GETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_GETLK: %v", err)
+	} else if lk.Type != syscall.F_WRLCK {
+		t.Errorf("got lock type %d on backing file, want F_WRLCK", lk.Type)
+	}
+	lk = syscall.Flock_t{Type: syscall.F_UNLCK}
+	if err := syscall.FcntlFlock(uintptr(fd1), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("F_SETLK(F_UNLCK): %v", err)
+	}
+	lk = syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(uintptr(origFd), _OFD_GETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_GETLK: %v", err)
+	} else if lk.Type != syscall.F_UNLCK {
+		t.Errorf("got lock type %d on backing file after unlock, want F_UNLCK", lk.Type)
+	}
+
+	// BSD locks conflict between open files.
+	if err := syscall.Flock(fd1, syscall.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+	if err := syscall.Flock(fd2, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Flock on second file: got %v, want EWOULDBLOCK", err)
+	}
+	if err := syscall.Flock(origFd, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Flock on backing file: got %v, want EWOULDBLOCK", err)
+	}
+	if err := syscall.Flock(fd1, syscall.LOCK_UN); err != nil {
+		t.Fatalf("Flock(LOCK_UN): %v", err)
+	}
+	if err := syscall.Flock(fd2, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("Flock after unlock: %v", err)
+	}
+}
+
+type flockNode struct {
+	LoopbackNode
+
+	mu      sync.Mutex
+	flocks  int
+	unlocks int
+}
+
+func (n *flockNode) Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		n.mu.Lock()
+		n.flocks++
+		if lk.Typ == syscall.F_UNLCK {
+			n.unlocks++
+		}
+		n.mu.Unlock()
+	}
+	return n.LoopbackNode.Setlk(ctx, f, owner, lk, flags)
+}
+
+func (n *flockNode) counts() (flocks, unlocks int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.flocks, n.unlocks
+}
+
+func TestLoopbackFlockProcesses(t *testing.T) {
+	flock, err := exec.LookPath("flock")
+	if err != nil {
+		t.Skip("flock command not found.")
+	}
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var node *flockNode
+	rootData := &LoopbackRoot{
+		Path: origDir,
+		NewNode: func(rootData *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
+			n := &flockNode{LoopbackNode: LoopbackNode{RootData: rootData}}
+			if name == "file" {
+				node = n
+			}
+			return n
+		},
+	}
+	mntDir, server, clean := testMount(t, rootData.NewNode(rootData, nil, "", nil), nil)
+	defer clean()
+	if server.KernelSettings().Flags&fuse.CAP_FLOCK_LOCKS == 0 {
+		t.Skip("kernel does not support FLOCK_LOCKS")
+	}
+
+	fn := mntDir + "/file"
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+	if flocks, _ := node.counts(); flocks == 0 {
+		t.Errorf("Setlk was not called with FUSE_LK_FLOCK")
+	}
+
+	// Another process cannot take the lock while we hold it.
+	cmd := exec.Command(flock, "--exclusive", "--nonblock", fn, "true")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("flock succeeded while the file was locked: %s", out)
+	}
+
+	// Closing the file releases the lock, through a Release
+	// with RELEASE_FLOCK_UNLOCK set.
+	f.Close()
+	for i := 0; i < 100; i++ {
+		if _, unlocks := node.counts(); unlocks > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, unlocks := node.counts(); unlocks == 0 {
+		t.Errorf("flock was not unlocked on release")
+	}
+	cmd = exec.Command(flock, "--exclusive", "--nonblock", fn, "true")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("flock after close: %v: %s", err, out)
+	}
+}
+
+func TestLoopbackSetlkwInterrupt(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	fn := dir + "/file"
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []FileHandle
+	for i := 0; i < 3; i++ {
+		fd, err := syscall.Open(fn, syscall.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		f := NewLoopbackFile(fd)
+		defer f.(FileReleaser).Release(context.Background())
+		files = append(files, f)
+	}
+
+	ctx := context.Background()
+	lk := fuse.FileLock{End: (1 << 63) - 1, Typ: syscall.F_WRLCK}
+	if errno := files[0].(FileSetlker).Setlk(ctx, 0, &lk, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+
+	cancel := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancel) })
+	if errno := files[1].(FileSetlkwer).Setlkw(&fuse.Context{Cancel: cancel}, 0, &lk, 0); errno != syscall.EINTR {
+		t.Fatalf("Setlkw: got %v, want EINTR", errno)
+	}
+
+	// The interrupted request must not keep the lock once it is
+	// obtained.
+	unlk := lk
+	unlk.Typ = syscall.F_UNLCK
+	if errno := files[0].(FileSetlker).Setlk(ctx, 0, &unlk, 0); errno != 0 {
+		t.Fatalf("Setlk(F_UNLCK): %v", errno)
+	}
+	var errno syscall.Errno
+	for i := 0; i < 100; i++ {
+		if errno = files[2].(FileSetlker).Setlk(ctx, 0, &lk, 0); errno == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if errno != 0 {
+		t.Errorf("Setlk after interrupted Setlkw: %v", errno)
+	}
+}
+
+// BenchmarkLoopbackWrite writes large blocks sequentially. The
+// kernel splits each write(2) into MaxWrite sized requests.
+func TestLoopbackWritebackCache(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	opts.EnableWritebackCache = true
+	mntDir, server, clean := testMount(t, root, opts)
+	defer clean()
+	if server.KernelSettings().Flags&fuse.CAP_WRITEBACK_CACHE == 0 {
+		t.Skip("kernel does not support CAP_WRITEBACK_CACHE")
+	}
+
+	checkOrig := func(name, want string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(origDir + "/" + name)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	t.Run("append", func(t *testing.T) {
+		if err := ioutil.WriteFile(mntDir+"/append", []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(mntDir+"/append", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{" world", "!"} {
+			if _, err := f.WriteString(s); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkOrig("append", "hello world!")
+	})
+
+	t.Run("writeonly", func(t *testing.T) {
+		// A partial page write into a file opened write-only
+		// makes the kernel read the rest of the page.
+		if err := ioutil.WriteFile(origDir+"/writeonly", []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(mntDir+"/writeonly", os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte("abc"), 2); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkOrig("writeonly", "01abc56789")
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		if err := ioutil.WriteFile(mntDir+"/mmap", make([]byte, 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(mntDir+"/mmap", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := syscall.Mmap(int(f.Fd()), 0, 4096, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			t.Fatalf("Mmap: %v", err)
+		}
+		// Fault the page in with a syscall, so the server can
+		// run while the kernel reads it, even at GOMAXPROCS=1;
+		// see the mmap test in fuse/test/cachecontrol_test.go.
+		if err := unix.Mlock(data); err != nil {
+			t.Fatalf("Mlock: %v", err)
+		}
+		copy(data, "mapped")
+		if err := unix.Msync(data, unix.MS_SYNC); err != nil {
+			t.Fatalf("Msync: %v", err)
+		}
+		if err := syscall.Munmap(data); err != nil {
+			t.Fatalf("Munmap: %v", err)
+		}
+		checkOrig("mmap", "mapped"+string(make([]byte, 4096-6)))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		f, err := os.Create(mntDir + "/truncate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		// The pages are still dirty when the file is truncated
+		// through another path.
+		if _, err := f.Write(bytes.Repeat([]byte("x"), 8192)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := os.Truncate(mntDir+"/truncate", 100); err != nil {
+			t.Fatalf("Truncate: %v", err)
+		}
+		if fi, err := os.Stat(mntDir + "/truncate"); err != nil {
+			t.Fatalf("Stat: %v", err)
+		} else if fi.Size() != 100 {
+			t.Errorf("got size %d, want 100", fi.Size())
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkOrig("truncate", strings.Repeat("x", 100))
+	})
+
+	t.Run("retrieve", func(t *testing.T) {
+		f, err := os.Create(mntDir + "/retrieve")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		want := make([]byte, 4*4096)
+		for i := range want {
+			want[i] = byte(i % 253)
+		}
+		// The data is dirty in the page cache until the
+		// file is flushed, but can be retrieved already.
+		if _, err := f.Write(want); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		ch := root.EmbeddedInode().GetChild("retrieve")
+		if ch == nil {
+			t.Fatal("no inode for retrieve")
+		}
+
+		// Concurrent retrieves each get their own range.
+		var wg sync.WaitGroup
+		for off := 0; off < len(want); off += 4096 {
+			wg.Add(1)
+			go func(off int) {
+				defer wg.Done()
+				got := make([]byte, 4096)
+				n, errno := ch.ReadCache(int64(off), got)
+				if errno != 0 {
+					t.Errorf("ReadCache %d: %v", off, errno)
+				} else if !bytes.Equal(got[:n], want[off:off+4096]) {
+					t.Errorf("ReadCache %d: got %d bytes of wrong data", off, n)
+				}
+			}(off)
+		}
+		wg.Wait()
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkOrig("retrieve", string(want))
+	})
+}
+
+// TestLoopbackIOUring copies files through a mount that talks to the
+// kernel through io_uring. Large writes keep their read buffers in
+// flight, and reads of the loopback are spliced.
+func TestLoopbackIOUring(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	opts.EnableIOUring = true
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := bytes.Repeat([]byte{byte('a' + i)}, 1<<20+i)
+			name := fmt.Sprintf("%s/file%d", mntDir, i)
+			if err := ioutil.WriteFile(name, want, 0644); err != nil {
+				errs <- err
+				return
+			}
+			if got, err := ioutil.ReadFile(name); err != nil {
+				errs <- err
+			} else if !bytes.Equal(got, want) {
+				errs <- fmt.Errorf("%s: got %d bytes of content, want %d", name, len(got), len(want))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if entries, err := ioutil.ReadDir(mntDir); err != nil || len(entries) != cap(errs) {
+		t.Errorf("ReadDir: got %d entries, %v", len(entries), err)
+	}
+}
+
+func TestLoopbackSpliceWrite(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	opts.EnableSpliceWrite = true
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	want := make([]byte, 1<<20+123)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	f, err := os.Create(mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(want[:1<<20])
+	if err == nil {
+		// Overwrite the middle, and write past the end.
+		_, err = f.WriteAt(want[4096-1:], 4096-1)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got, err := ioutil.ReadFile(origDir + "/file"); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes of content, %v, want %d", len(got), err, len(want))
+	}
+
+	// O_APPEND files cannot be spliced into at an offset.
+	f, err = os.OpenFile(mntDir+"/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("tail"))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Write O_APPEND: %v", err)
+	}
+	if got, err := ioutil.ReadFile(mntDir + "/file"); err != nil || string(got[len(want):]) != "tail" {
+		t.Errorf("got %d bytes of content, %v, want %q appended", len(got), err, "tail")
+	}
+}
+
+func BenchmarkLoopbackWrite(b *testing.B) {
+	for _, maxWrite := range []int{64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("MaxWrite%dk", maxWrite/1024), func(b *testing.B) {
+			benchmarkLoopbackWrite(b, maxWrite, false)
+		})
+	}
+	// A MaxWrite of 1M does not fit in a pipe of the default
+	// maximum size.
+	for _, maxWrite := range []int{64 * 1024, 512 * 1024} {
+		b.Run(fmt.Sprintf("MaxWrite%dkSplice", maxWrite/1024), func(b *testing.B) {
+			benchmarkLoopbackWrite(b, maxWrite, true)
+		})
+	}
+}
+
+func benchmarkLoopbackWrite(b *testing.B, maxWrite int, spliceWrite bool) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := &Options{}
+	opts.MaxWrite = maxWrite
+	opts.EnableSpliceWrite = spliceWrite
+	mntDir, server, clean := testMount(b, root, opts)
+	defer clean()
+	if got := server.NegotiatedSettings().MaxWrite; int(got) != maxWrite {
+		b.Logf("kernel limits MaxWrite to %d", got)
+	}
+
+	f, err := os.Create(mntDir + "/file")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
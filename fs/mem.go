@@ -8,18 +8,32 @@ import (
 	"context"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// MemRegularFile is a filesystem node that holds a read-only data
-// slice in memory.
+// memChunkSize is the size of the chunks holding the content of a
+// MemRegularFile.
+const memChunkSize = 64 << 10
+
+// MemRegularFile is a filesystem node that holds a data slice in
+// memory. The content is kept in chunks, so holes take no memory,
+// and writes at large offsets don't copy the whole file.
 type MemRegularFile struct {
 	Inode
 
-	mu   sync.Mutex
+	mu sync.Mutex
+
+	// Data is the initial content of the file. It is moved to
+	// the chunks on first use, after which it is nil.
 	Data []byte
 	Attr fuse.Attr
+
+	// chunks holds the content by chunk index. Missing chunks,
+	// and bytes beyond the length of a chunk, read as zeros.
+	chunks map[int64][]byte
+	size   int64
 }
 
 var _ = (NodeOpener)((*MemRegularFile)(nil))
@@ -28,6 +42,63 @@ var _ = (NodeWriter)((*MemRegularFile)(nil))
 var _ = (NodeSetattrer)((*MemRegularFile)(nil))
 var _ = (NodeFlusher)((*MemRegularFile)(nil))
 
+// load moves Data into the chunks. It does not copy: the chunks
+// refer to the Data slice.
+func (f *MemRegularFile) load() {
+	if f.chunks != nil {
+		return
+	}
+	f.chunks = map[int64][]byte{}
+	f.size = int64(len(f.Data))
+	for off := 0; off < len(f.Data); off += memChunkSize {
+		end := off + memChunkSize
+		if end > len(f.Data) {
+			end = len(f.Data)
+		}
+		f.chunks[int64(off/memChunkSize)] = f.Data[off:end:end]
+	}
+	f.Data = nil
+}
+
+// truncate sets the size of the file, dropping the content beyond.
+func (f *MemRegularFile) truncate(sz int64) {
+	if sz < f.size {
+		for i, c := range f.chunks {
+			if i*memChunkSize >= sz {
+				delete(f.chunks, i)
+			} else if end := sz - i*memChunkSize; end < int64(len(c)) {
+				f.chunks[i] = c[:end]
+			}
+		}
+	}
+	f.size = sz
+}
+
+// zero clears the range [off, end), dropping the chunks it covers.
+// It only visits the chunks that exist, as the range may span most
+// of the int64 space.
+func (f *MemRegularFile) zero(off, end int64) {
+	for i, c := range f.chunks {
+		lo, hi := off-i*memChunkSize, end-i*memChunkSize
+		if hi <= 0 || lo >= int64(len(c)) {
+			continue
+		}
+		if lo <= 0 && hi >= memChunkSize {
+			delete(f.chunks, i)
+			continue
+		}
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(c)) {
+			hi = int64(len(c))
+		}
+		for j := lo; j < hi; j++ {
+			c[j] = 0
+		}
+	}
+}
+
 func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	return nil, fuse.FOPEN_KEEP_CACHE, OK
 }
@@ -35,15 +106,37 @@ func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle,
 func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	end := int64(len(data)) + off
-	if int64(len(f.Data)) < end {
-		n := make([]byte, end)
-		copy(n, f.Data)
-		f.Data = n
-	}
+	f.load()
 
-	copy(f.Data[off:off+int64(len(data))], data)
+	for done := 0; done < len(data); {
+		pos := off + int64(done)
+		i, lo := pos/memChunkSize, int(pos%memChunkSize)
+		hi := lo + len(data) - done
+		if hi > memChunkSize {
+			hi = memChunkSize
+		}
 
+		c := f.chunks[i]
+		if len(c) < hi {
+			if cap(c) < hi {
+				n := make([]byte, len(c), memChunkSize)
+				copy(n, c)
+				c = n
+			}
+			// The bytes past the old length may be stale
+			// from a truncation.
+			old := len(c)
+			c = c[:hi]
+			for j := old; j < lo; j++ {
+				c[j] = 0
+			}
+			f.chunks[i] = c
+		}
+		done += copy(c[lo:hi], data[done:])
+	}
+	if end := off + int64(len(data)); end > f.size {
+		f.size = end
+	}
 	return uint32(len(data)), 0
 }
 
@@ -52,22 +145,103 @@ var _ = (NodeGetattrer)((*MemRegularFile)(nil))
 func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.load()
 	out.Attr = f.Attr
-	out.Attr.Size = uint64(len(f.Data))
+	out.Attr.Size = uint64(f.size)
 	return OK
 }
 
 func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.load()
 	if sz, ok := in.GetSize(); ok {
-		f.Data = f.Data[:sz]
+		f.truncate(int64(sz))
 	}
 	out.Attr = f.Attr
-	out.Size = uint64(len(f.Data))
+	out.Size = uint64(f.size)
 	return OK
 }
 
+var _ = (NodeAllocater)((*MemRegularFile)(nil))
+
+// Allocate extends the file with zeros, unless FALLOC_FL_KEEP_SIZE is
+// set, and zeroes the range for FALLOC_FL_PUNCH_HOLE and
+// FALLOC_FL_ZERO_RANGE. Other modes are not supported.
+func (f *MemRegularFile) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	switch mode &^ _FALLOC_FL_KEEP_SIZE {
+	case 0, _FALLOC_FL_ZERO_RANGE:
+	case _FALLOC_FL_PUNCH_HOLE:
+		// Punching holes never changes the size.
+		if mode&_FALLOC_FL_KEEP_SIZE == 0 {
+			return syscall.EOPNOTSUPP
+		}
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.load()
+	end := int64(off + size)
+	if end > f.size && mode&_FALLOC_FL_KEEP_SIZE == 0 {
+		f.size = end
+	}
+	if end > f.size {
+		// With KEEP_SIZE, there is nothing to clear past the end.
+		end = f.size
+	}
+	if mode&(_FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_ZERO_RANGE) != 0 {
+		f.zero(int64(off), end)
+	}
+	return OK
+}
+
+var _ = (NodeLseeker)((*MemRegularFile)(nil))
+
+// Lseek finds data or holes. The chunks that were never written are
+// holes.
+func (f *MemRegularFile) Lseek(ctx context.Context, fh FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.load()
+	if int64(off) >= f.size {
+		return 0, syscall.ENXIO
+	}
+	i := int64(off) / memChunkSize
+	switch whence {
+	case _SEEK_DATA:
+		if _, ok := f.chunks[i]; ok {
+			return off, OK
+		}
+		next := int64(-1)
+		for j := range f.chunks {
+			if j > i && (next < 0 || j < next) {
+				next = j
+			}
+		}
+		if next < 0 || next*memChunkSize >= f.size {
+			return 0, syscall.ENXIO
+		}
+		return uint64(next * memChunkSize), OK
+	case _SEEK_HOLE:
+		if _, ok := f.chunks[i]; !ok {
+			return off, OK
+		}
+		for {
+			i++
+			if _, ok := f.chunks[i]; !ok {
+				break
+			}
+		}
+		if i*memChunkSize >= f.size {
+			return uint64(f.size), OK
+		}
+		return uint64(i * memChunkSize), OK
+	}
+	return 0, syscall.EINVAL
+}
+
 func (f *MemRegularFile) Flush(ctx context.Context, fh FileHandle) syscall.Errno {
 	return 0
 }
@@ -75,16 +249,68 @@ func (f *MemRegularFile) Flush(ctx context.Context, fh FileHandle) syscall.Errno
 func (f *MemRegularFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	end := int(off) + len(dest)
-	if end > len(f.Data) {
-		end = len(f.Data)
+	f.load()
+	if off >= f.size {
+		return fuse.ReadResultData(nil), OK
+	}
+	if rest := f.size - off; int64(len(dest)) > rest {
+		dest = dest[:rest]
+	}
+
+	for done := 0; done < len(dest); {
+		pos := off + int64(done)
+		i, lo := pos/memChunkSize, int(pos%memChunkSize)
+		hi := lo + len(dest) - done
+		if hi > memChunkSize {
+			hi = memChunkSize
+		}
+
+		n := 0
+		if c := f.chunks[i]; lo < len(c) {
+			end := hi
+			if end > len(c) {
+				end = len(c)
+			}
+			n = copy(dest[done:], c[lo:end])
+		}
+		for j := done + n; j < done+hi-lo; j++ {
+			dest[j] = 0
+		}
+		done += hi - lo
+	}
+	return fuse.ReadResultData(dest), OK
+}
+
+// memSetattr applies the mode, owner and time changes of in to
+// attr. Like the kernel, it sets the change time, unless in does.
+func memSetattr(attr *fuse.Attr, in *fuse.SetAttrIn) {
+	if m, ok := in.GetMode(); ok {
+		attr.Mode = attr.Mode&^07777 | m
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.Gid = gid
+	}
+	if a, ok := in.GetATime(); ok {
+		attr.SetTimes(&a, nil, nil)
+	}
+	if m, ok := in.GetMTime(); ok {
+		attr.SetTimes(nil, &m, nil)
 	}
-	return fuse.ReadResultData(f.Data[off:end]), OK
+	c, ok := in.GetCTime()
+	if !ok {
+		c = time.Now()
+	}
+	attr.SetTimes(nil, nil, &c)
 }
 
 // MemSymlink is an inode holding a symlink in memory.
 type MemSymlink struct {
 	Inode
+
+	mu   sync.Mutex
 	Attr fuse.Attr
 	Data []byte
 }
@@ -98,6 +324,207 @@ func (l *MemSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 var _ = (NodeGetattrer)((*MemSymlink)(nil))
 
 func (l *MemSymlink) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out.Attr = l.Attr
+	return OK
+}
+
+var _ = (NodeSetattrer)((*MemSymlink)(nil))
+
+// Setattr changes the owner and times, eg. for lchown(2) and
+// utimensat(2) with AT_SYMLINK_NOFOLLOW.
+func (l *MemSymlink) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	memSetattr(&l.Attr, in)
 	out.Attr = l.Attr
 	return OK
 }
+
+// MemDevNode is an inode for a character or block device. Its
+// StableAttr should have the file type of Mode. Opening the device
+// needs a mount without the "nodev" option, and is handled by the
+// kernel.
+type MemDevNode struct {
+	Inode
+
+	mu sync.Mutex
+
+	// Dev is the device number, eg. uint32(unix.Mkdev(1, 3)).
+	Dev uint32
+
+	// Mode is the file type, syscall.S_IFCHR or
+	// syscall.S_IFBLK, and the permissions.
+	Mode uint32
+
+	// Attr holds the other attributes, eg. the owner and
+	// times. Its Mode and Rdev are overwritten.
+	Attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*MemDevNode)(nil))
+var _ = (NodeSetattrer)((*MemDevNode)(nil))
+
+func (d *MemDevNode) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Attr.Mode, d.Attr.Rdev = d.Mode, d.Dev
+	out.Attr = d.Attr
+	return OK
+}
+
+func (d *MemDevNode) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Attr.Mode, d.Attr.Rdev = d.Mode, d.Dev
+	memSetattr(&d.Attr, in)
+	d.Mode = d.Attr.Mode
+	out.Attr = d.Attr
+	return OK
+}
+
+// MemFIFO is an inode for a named pipe. Its StableAttr should have
+// mode syscall.S_IFIFO. The kernel implements the pipe itself, so
+// the data never reaches the file system.
+type MemFIFO struct {
+	Inode
+
+	mu   sync.Mutex
+	Attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*MemFIFO)(nil))
+var _ = (NodeSetattrer)((*MemFIFO)(nil))
+
+func (p *MemFIFO) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out.Attr = p.Attr
+	return OK
+}
+
+func (p *MemFIFO) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	memSetattr(&p.Attr, in)
+	out.Attr = p.Attr
+	return OK
+}
+
+// MemSocket is an inode for a Unix domain socket. Its StableAttr
+// should have mode syscall.S_IFSOCK. As for FIFOs, the kernel
+// connects the processes, and the file system only stores the entry.
+type MemSocket struct {
+	Inode
+
+	mu   sync.Mutex
+	Attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*MemSocket)(nil))
+var _ = (NodeSetattrer)((*MemSocket)(nil))
+
+func (s *MemSocket) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out.Attr = s.Attr
+	return OK
+}
+
+func (s *MemSocket) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	memSetattr(&s.Attr, in)
+	out.Attr = s.Attr
+	return OK
+}
+
+// MemDir is a directory in memory, in which entries can be created
+// through the mount. Mknod makes regular files, FIFOs, sockets and
+// device nodes, using the Mem* types above, and Mkdir makes MemDirs.
+// The new nodes are persistent, as they only exist in memory, and
+// removing entries needs no support from the node.
+//
+// Binding a Unix domain socket, eg. with net.Listen("unix", path),
+// creates the socket with Mknod.
+type MemDir struct {
+	Inode
+
+	mu   sync.Mutex
+	Attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*MemDir)(nil))
+var _ = (NodeSetattrer)((*MemDir)(nil))
+var _ = (NodeMknoder)((*MemDir)(nil))
+var _ = (NodeMkdirer)((*MemDir)(nil))
+
+func (d *MemDir) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out.Attr = d.Attr
+	return OK
+}
+
+func (d *MemDir) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	memSetattr(&d.Attr, in)
+	out.Attr = d.Attr
+	return OK
+}
+
+// memNewAttr returns the attributes of a new node: the mode, the
+// caller as owner, and the current time.
+func memNewAttr(ctx context.Context, mode uint32) fuse.Attr {
+	var attr fuse.Attr
+	attr.Mode = mode
+	if caller, ok := fuse.FromContext(ctx); ok {
+		attr.Owner = caller.Owner
+	}
+	now := time.Now()
+	attr.SetTimes(&now, &now, &now)
+	return attr
+}
+
+// Mknod creates a node for the file type in mode. Regular files
+// only arrive here if the parent does not implement NodeCreater. Other
+// types fail with EINVAL.
+func (d *MemDir) Mknod(ctx context.Context, name string, mode, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	if mode&syscall.S_IFMT == 0 {
+		mode |= syscall.S_IFREG
+	}
+	attr := memNewAttr(ctx, mode)
+
+	var node InodeEmbedder
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		node = &MemRegularFile{Attr: attr}
+	case syscall.S_IFIFO:
+		node = &MemFIFO{Attr: attr}
+	case syscall.S_IFSOCK:
+		node = &MemSocket{Attr: attr}
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		node = &MemDevNode{Mode: mode, Dev: dev, Attr: attr}
+	default:
+		return nil, syscall.EINVAL
+	}
+
+	var attrOut fuse.AttrOut
+	node.(NodeGetattrer).Getattr(ctx, nil, &attrOut)
+	out.Attr = attrOut.Attr
+	return d.NewPersistentInode(ctx, node, StableAttr{Mode: mode & syscall.S_IFMT}), OK
+}
+
+func (d *MemDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if d.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+	dir := &MemDir{Attr: memNewAttr(ctx, syscall.S_IFDIR|mode)}
+	out.Attr = dir.Attr
+	return d.NewPersistentInode(ctx, dir, StableAttr{Mode: syscall.S_IFDIR}), OK
+}
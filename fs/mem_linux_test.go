@@ -0,0 +1,208 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+func TestDataFileFallocate(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("0123456789"), Attr: fuse.Attr{Mode: 0644}}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			n.AddChild("file", n.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	check := func(want string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(mntDir + "/file")
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !bytes.Equal(got, []byte(want)) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// Punching a hole in the middle reads back as zeros.
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 3, 4); err != nil {
+		t.Fatalf("Fallocate(PUNCH_HOLE): %v", err)
+	}
+	check("012\x00\x00\x00\x00789")
+
+	// KEEP_SIZE does not extend the file, and punching stops at its end.
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 8, 100); err != nil {
+		t.Fatalf("Fallocate(PUNCH_HOLE): %v", err)
+	}
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_KEEP_SIZE, 0, 100); err != nil {
+		t.Fatalf("Fallocate(KEEP_SIZE): %v", err)
+	}
+	check("012\x00\x00\x00\x007\x00\x00")
+
+	// Plain allocation extends with zeros.
+	if err := unix.Fallocate(fd, 0, 5, 7); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	check("012\x00\x00\x00\x007\x00\x00\x00\x00")
+
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_COLLAPSE_RANGE, 0, 4); err != syscall.EOPNOTSUPP {
+		t.Errorf("Fallocate(COLLAPSE_RANGE): got %v, want EOPNOTSUPP", err)
+	}
+	if errno := file.Allocate(context.Background(), nil, 0, 4, unix.FALLOC_FL_INSERT_RANGE); errno != syscall.EOPNOTSUPP {
+		t.Errorf("Allocate(INSERT_RANGE): got %v, want EOPNOTSUPP", errno)
+	}
+}
+
+// TestDataFileFallocateHuge checks that clearing a range up to the
+// largest file size only visits the content of the file.
+func TestDataFileFallocateHuge(t *testing.T) {
+	file := &MemRegularFile{Data: []byte("0123456789")}
+	ctx := context.Background()
+	if _, errno := file.Write(ctx, nil, []byte("abc"), 1<<40); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+
+	const off = 2
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, mode := range []uint32{
+			unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE,
+			unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE,
+			unix.FALLOC_FL_ZERO_RANGE,
+		} {
+			if errno := file.Allocate(ctx, nil, off, math.MaxInt64-off, mode); errno != 0 {
+				t.Errorf("Allocate(%#x): %v", mode, errno)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Allocate did not return")
+	}
+
+	dest := make([]byte, 10)
+	res, errno := file.Read(ctx, nil, dest, 0)
+	if errno != 0 {
+		t.Fatalf("Read: %v", errno)
+	}
+	got, _ := res.Bytes(dest)
+	if want := "01\x00\x00\x00\x00\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var out fuse.AttrOut
+	file.Getattr(ctx, nil, &out)
+	if out.Size != math.MaxInt64 {
+		t.Errorf("got size %d, want %d", out.Size, int64(math.MaxInt64))
+	}
+}
+
+func TestMemSpecialFiles(t *testing.T) {
+	root := &Inode{}
+	chr := &MemDevNode{Mode: syscall.S_IFCHR | 0644, Dev: uint32(unix.Mkdev(1, 3))}
+	blk := &MemDevNode{Mode: syscall.S_IFBLK | 0600, Dev: uint32(unix.Mkdev(7, 300))}
+	fifo := &MemFIFO{Attr: fuse.Attr{Mode: 0640}}
+	link := &MemSymlink{Data: []byte("target")}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for nm, ch := range map[string]struct {
+				ops  InodeEmbedder
+				mode uint32
+			}{
+				"chr":  {chr, syscall.S_IFCHR},
+				"blk":  {blk, syscall.S_IFBLK},
+				"fifo": {fifo, syscall.S_IFIFO},
+				"link": {link, syscall.S_IFLNK},
+			} {
+				root.AddChild(nm, root.NewPersistentInode(ctx, ch.ops, StableAttr{Mode: ch.mode}), false)
+			}
+		},
+	})
+	defer clean()
+
+	for _, tc := range []struct {
+		name string
+		mode uint32
+		dev  uint64
+	}{
+		{"chr", syscall.S_IFCHR | 0644, unix.Mkdev(1, 3)},
+		{"blk", syscall.S_IFBLK | 0600, unix.Mkdev(7, 300)},
+		{"fifo", syscall.S_IFIFO | 0640, 0},
+	} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(mntDir+"/"+tc.name, &st); err != nil {
+			t.Fatalf("Lstat(%s): %v", tc.name, err)
+		}
+		if uint32(st.Mode) != tc.mode {
+			t.Errorf("%s: got mode %#o, want %#o", tc.name, st.Mode, tc.mode)
+		}
+		if uint64(st.Rdev) != tc.dev {
+			t.Errorf("%s: got rdev %#x, want %#x", tc.name, st.Rdev, tc.dev)
+		}
+	}
+
+	if err := syscall.Chmod(mntDir+"/chr", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mntDir+"/chr", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if want := uint32(syscall.S_IFCHR | 0600); uint32(st.Mode) != want {
+		t.Errorf("after chmod: got mode %#o, want %#o", st.Mode, want)
+	}
+
+	// utimensat(2) on the link itself.
+	mtime := unix.NsecToTimespec(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, mntDir+"/link", []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatalf("UtimesNanoAt: %v", err)
+	}
+	if err := syscall.Lstat(mntDir+"/link", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if st.Mtim.Sec != mtime.Sec {
+		t.Errorf("got mtime %v, want %v", st.Mtim, mtime)
+	}
+}
+
+func TestMemDirMknodDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to create device nodes")
+	}
+	root := &MemDir{Attr: fuse.Attr{Mode: 0755}}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	dev := unix.Mkdev(1, 3)
+	if err := syscall.Mknod(mntDir+"/null", syscall.S_IFCHR|0666, int(dev)); err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mntDir+"/null", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if st.Mode != syscall.S_IFCHR|0666 || uint64(st.Rdev) != dev {
+		t.Errorf("got mode %o rdev %#x, want %o %#x", st.Mode, st.Rdev, syscall.S_IFCHR|0666, dev)
+	}
+}
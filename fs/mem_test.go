@@ -7,8 +7,10 @@ package fs
 import (
 	"bytes"
 	"context"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"syscall"
 	"testing"
@@ -17,7 +19,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 )
 
-func testMount(t *testing.T, root InodeEmbedder, opts *Options) (string, *fuse.Server, func()) {
+func testMount(t testing.TB, root InodeEmbedder, opts *Options) (string, *fuse.Server, func()) {
 	t.Helper()
 
 	mntDir := testutil.TempDir()
@@ -136,6 +138,36 @@ func TestDataFile(t *testing.T) {
 	}
 }
 
+func TestDataFileSeekHole(t *testing.T) {
+	want := "hello"
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			ch := n.NewPersistentInode(ctx, &MemRegularFile{Data: []byte(want)}, StableAttr{})
+			n.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if off, err := syscall.Seek(fd, 1, _SEEK_DATA); err != nil || off != 1 {
+		t.Errorf("Seek(SEEK_DATA): got %d, %v, want 1", off, err)
+	}
+	if off, err := syscall.Seek(fd, 1, _SEEK_HOLE); err != nil || off != int64(len(want)) {
+		t.Errorf("Seek(SEEK_HOLE): got %d, %v, want %d", off, err, len(want))
+	}
+	if _, err := syscall.Seek(fd, int64(len(want)), _SEEK_DATA); err != syscall.ENXIO {
+		t.Errorf("Seek(SEEK_DATA) at EOF: got %v, want ENXIO", err)
+	}
+}
+
 func TestDataFileLargeRead(t *testing.T) {
 	root := &Inode{}
 
@@ -168,6 +200,84 @@ func TestDataFileLargeRead(t *testing.T) {
 	}
 }
 
+func TestDataFileSparse(t *testing.T) {
+	ctx := context.Background()
+	f := &MemRegularFile{Data: []byte("hello")}
+	read := func(off int64, sz int) string {
+		t.Helper()
+		res, errno := f.Read(ctx, nil, make([]byte, sz), off)
+		if errno != 0 {
+			t.Fatalf("Read: %v", errno)
+		}
+		data, _ := res.Bytes(nil)
+		return string(data)
+	}
+
+	// Truncating up and writing far out stores only two chunks.
+	const big = 10 << 30
+	in := &fuse.SetAttrIn{}
+	in.Valid, in.Size = fuse.FATTR_SIZE, big
+	var out fuse.AttrOut
+	if errno := f.Setattr(ctx, nil, in, &out); errno != 0 || out.Size != big {
+		t.Fatalf("Setattr: %v, size %d", errno, out.Size)
+	}
+	if _, errno := f.Write(ctx, nil, []byte("world"), big/2); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if len(f.chunks) != 2 {
+		t.Errorf("got %d chunks, want 2", len(f.chunks))
+	}
+	if got, want := read(big/2-2, 7), "\x00\x00world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := read(big-2, 10); got != "\x00\x00" {
+		t.Errorf("read at EOF: got %q", got)
+	}
+	if off, errno := f.Lseek(ctx, nil, 10, _SEEK_HOLE); errno != 0 || off != memChunkSize {
+		t.Errorf("SEEK_HOLE: got %d, %v, want %d", off, errno, memChunkSize)
+	}
+	if off, errno := f.Lseek(ctx, nil, memChunkSize, _SEEK_DATA); errno != 0 || off != big/2 {
+		t.Errorf("SEEK_DATA: got %d, %v, want %d", off, errno, big/2)
+	}
+
+	// Writes can span chunks.
+	span := bytes.Repeat([]byte("x"), memChunkSize+10)
+	if _, errno := f.Write(ctx, nil, span, memChunkSize-5); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if got := read(memChunkSize-6, len(span)+2); got != "\x00"+string(span)+"\x00" {
+		t.Errorf("spanning read mismatch")
+	}
+
+	// Shrinking drops the content, so extending again reads zeros.
+	in.Size = 3
+	if errno := f.Setattr(ctx, nil, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	in.Size = 6
+	if errno := f.Setattr(ctx, nil, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	if got := read(0, 100); got != "hel\x00\x00\x00" {
+		t.Errorf("got %q after truncation", got)
+	}
+	if len(f.chunks) != 1 {
+		t.Errorf("got %d chunks after truncation, want 1", len(f.chunks))
+	}
+}
+
+// BenchmarkDataFileAppend appends in small writes, which takes
+// linear time.
+func BenchmarkDataFileAppend(b *testing.B) {
+	ctx := context.Background()
+	f := &MemRegularFile{}
+	data := make([]byte, 4096)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		f.Write(ctx, nil, data, int64(i*len(data)))
+	}
+}
+
 type SymlinkerRoot struct {
 	Inode
 }
@@ -197,3 +307,113 @@ func TestDataSymlink(t *testing.T) {
 		t.Errorf("Readlink: got %q want %q", got, want)
 	}
 }
+
+func TestMemDirMknodEntry(t *testing.T) {
+	root := &MemDir{Attr: fuse.Attr{Mode: 0755}}
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	for _, tc := range []struct {
+		name string
+		mode uint32
+		rdev uint32
+	}{
+		{"sock", syscall.S_IFSOCK | 0755, 0},
+		{"fifo", syscall.S_IFIFO | 0640, 0},
+		{"chr", syscall.S_IFCHR | 0666, 0x0103},
+		{"blk", syscall.S_IFBLK | 0600, 0x0700},
+		{"file", syscall.S_IFREG | 0644, 0},
+	} {
+		in := &fuse.MknodIn{
+			InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID},
+			Mode:     tc.mode,
+			Rdev:     tc.rdev,
+		}
+		var out fuse.EntryOut
+		if st := bridge.Mknod(nil, in, tc.name, &out); !st.Ok() {
+			t.Fatalf("Mknod(%s): %v", tc.name, st)
+		}
+		if out.Mode != tc.mode || out.Rdev != tc.rdev {
+			t.Errorf("%s: got mode %o rdev %#x, want %o %#x", tc.name, out.Mode, out.Rdev, tc.mode, tc.rdev)
+		}
+		if out.NodeId == 0 || out.Ino == 0 {
+			t.Errorf("%s: got node %d ino %d", tc.name, out.NodeId, out.Ino)
+		}
+
+		var attr fuse.AttrOut
+		if st := bridge.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}, &attr); !st.Ok() {
+			t.Fatalf("GetAttr(%s): %v", tc.name, st)
+		} else if attr.Mode != tc.mode || attr.Rdev != tc.rdev {
+			t.Errorf("%s: GetAttr got mode %o rdev %#x, want %o %#x", tc.name, attr.Mode, attr.Rdev, tc.mode, tc.rdev)
+		}
+
+		if st := bridge.Mknod(nil, in, tc.name, &out); st != fuse.Status(syscall.EEXIST) {
+			t.Errorf("Mknod(%s) again: got %v, want EEXIST", tc.name, st)
+		}
+	}
+}
+
+func TestMemDirSocket(t *testing.T) {
+	root := &MemDir{Attr: fuse.Attr{Mode: 0755}}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	if err := os.Mkdir(mntDir+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	sock := mntDir + "/dir/sock"
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(sock, &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if st.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		t.Errorf("got mode %o, want a socket", st.Mode)
+	}
+	if st.Uid != uint32(os.Getuid()) || st.Gid != uint32(os.Getgid()) {
+		t.Errorf("got owner %d:%d, want %d:%d", st.Uid, st.Gid, os.Getuid(), os.Getgid())
+	}
+
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	want := []byte("hello")
+	if _, err := c.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := syscall.Mkfifo(mntDir+"/dir/fifo", 0600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+	if err := syscall.Lstat(mntDir+"/dir/fifo", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if st.Mode != syscall.S_IFIFO|0600 {
+		t.Errorf("got mode %o, want %o", st.Mode, syscall.S_IFIFO|0600)
+	}
+
+	if err := os.Remove(sock); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := syscall.Lstat(sock, &st); err != syscall.ENOENT {
+		t.Errorf("Lstat after Remove: got %v, want ENOENT", err)
+	}
+}
@@ -13,7 +13,10 @@ import (
 // Mount mounts the given NodeFS on the directory, and starts serving
 // requests. This is a convenience wrapper around NewNodeFS and
 // fuse.NewServer.  If nil is given as options, default settings are
-// applied, which are 1 second entry and attribute timeout.
+// applied, which are 1 second entry and attribute timeout. If the root
+// implements NodeGetlker, NodeSetlker and NodeSetlkwer, file locks
+// are enabled. If it implements NodeIoctler, so are ioctls on
+// directories.
 func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, error) {
 	if options == nil {
 		oneSec := time.Second
@@ -23,8 +26,16 @@ func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, erro
 		}
 	}
 
+	mountOpts := options.MountOptions
+	if supportsLocks(root) {
+		mountOpts.EnableLocks = true
+	}
+	if _, ok := root.(NodeIoctler); ok {
+		mountOpts.EnableIoctlDir = true
+	}
+
 	rawFS := NewNodeFS(root, options)
-	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	server, err := fuse.NewServer(rawFS, dir, &mountOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -38,3 +49,10 @@ func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, erro
 
 	return server, nil
 }
+
+func supportsLocks(root InodeEmbedder) bool {
+	_, getlk := root.(NodeGetlker)
+	_, setlk := root.(NodeSetlker)
+	_, setlkw := root.(NodeSetlkwer)
+	return getlk && setlk && setlkw
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "sync"
+
+// nodeIdShards is the number of shards in a nodeIdMap. Node IDs are
+// handed out sequentially, so consecutive IDs land in different
+// shards.
+const nodeIdShards = 16
+
+// nodeIdMap translates kernel node IDs to Inodes. Every operation
+// looks up its node, so the map is sharded, and lookups only take the
+// read lock of one shard rather than rawBridge.mu.
+//
+// Changes must be made with rawBridge.mu held, which keeps the map
+// consistent with stableAttrs and the lookup counts. With
+// rawBridge.mu held, the map can also be read and iterated without
+// taking the shard locks.
+type nodeIdMap struct {
+	shards [nodeIdShards]nodeIdShard
+}
+
+type nodeIdShard struct {
+	mu    sync.RWMutex
+	nodes map[uint64]*Inode
+}
+
+func newNodeIdMap() *nodeIdMap {
+	m := &nodeIdMap{}
+	for i := range m.shards {
+		m.shards[i].nodes = map[uint64]*Inode{}
+	}
+	return m
+}
+
+func (m *nodeIdMap) shard(id uint64) *nodeIdShard {
+	return &m.shards[id%nodeIdShards]
+}
+
+// get returns the node for id, or nil. It may be called without
+// rawBridge.mu.
+func (m *nodeIdMap) get(id uint64) *Inode {
+	s := m.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nodes[id]
+}
+
+// set adds n under id. Must have rawBridge.mu.
+func (m *nodeIdMap) set(id uint64, n *Inode) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[id] = n
+}
+
+// delete removes id. Must have rawBridge.mu.
+func (m *nodeIdMap) delete(id uint64) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.nodes, id)
+}
+
+// len returns the number of nodes. Must have rawBridge.mu.
+func (m *nodeIdMap) len() int {
+	l := 0
+	for i := range m.shards {
+		l += len(m.shards[i].nodes)
+	}
+	return l
+}
+
+// forEach calls f for each node. Must have rawBridge.mu.
+func (m *nodeIdMap) forEach(f func(n *Inode)) {
+	for i := range m.shards {
+		for _, n := range m.shards[i].nodes {
+			f(n)
+		}
+	}
+}
+
+// compact recreates the shard maps, to free the memory of deleted
+// entries. Must have rawBridge.mu.
+func (m *nodeIdMap) compact() {
+	for i := range m.shards {
+		s := &m.shards[i]
+		tmp := make(map[uint64]*Inode, len(s.nodes))
+		for id, n := range s.nodes {
+			tmp[id] = n
+		}
+		s.mu.Lock()
+		s.nodes = tmp
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// newSubtreeBridge returns a bridge whose root has 'dirs' directories
+// "d0", "d1", ..., that have a file for every name.
+func newSubtreeBridge(dirs int) (*rawBridge, []*anyFileDir) {
+	root := &Inode{}
+	var subtrees []*anyFileDir
+	bridge := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for i := 0; i < dirs; i++ {
+				d := &anyFileDir{}
+				subtrees = append(subtrees, d)
+				root.AddChild(fmt.Sprintf("d%d", i), root.NewPersistentInode(ctx, d, StableAttr{Mode: fuse.S_IFDIR}), false)
+			}
+		},
+	}).(*rawBridge)
+	return bridge, subtrees
+}
+
+// TestConcurrentSubtrees runs lookups, getattrs, renames and
+// forgets on independent subtrees in parallel. Run it with -race.
+func TestConcurrentSubtrees(t *testing.T) {
+	const workers = 8
+	iters := 2000
+	if testing.Short() {
+		iters = 200
+	}
+	bridge, subtrees := newSubtreeBridge(workers)
+
+	var wg sync.WaitGroup
+	var failures int32
+	fail := func(format string, args ...interface{}) {
+		if atomic.AddInt32(&failures, 1) == 1 {
+			t.Errorf(format, args...)
+		}
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var dirEntry fuse.EntryOut
+			root := &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+			if st := bridge.Lookup(nil, root, fmt.Sprintf("d%d", w), &dirEntry); !st.Ok() {
+				fail("Lookup d%d: %v", w, st)
+				return
+			}
+			dir := &fuse.InHeader{NodeId: dirEntry.NodeId}
+
+			var forgets []fuse.ForgetOne
+			for i := 0; i < iters; i++ {
+				name := fmt.Sprintf("f%d", i%50)
+				var out fuse.EntryOut
+				if st := bridge.Lookup(nil, dir, name, &out); !st.Ok() {
+					fail("Lookup %s: %v", name, st)
+					return
+				}
+				forgets = append(forgets, fuse.ForgetOne{NodeId: out.NodeId, Nlookup: 1})
+
+				var attr fuse.AttrOut
+				if st := bridge.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}, &attr); !st.Ok() {
+					fail("GetAttr %s: %v", name, st)
+					return
+				}
+
+				subtrees[w].MvChild(name, subtrees[w].EmbeddedInode(), fmt.Sprintf("g%d", i%50), true)
+
+				if len(forgets) == 10 {
+					bridge.BatchForget(forgets)
+					forgets = forgets[:0]
+				}
+			}
+			bridge.BatchForget(forgets)
+			bridge.Forget(dirEntry.NodeId, 1)
+		}(w)
+	}
+	wg.Wait()
+
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	if l := bridge.kernelNodeIds.len(); l != 1 {
+		t.Errorf("got %d nodes known to the kernel, want only the root", l)
+	}
+}
+
+// BenchmarkParallelGetattr measures GETATTR on distinct nodes from 8
+// goroutines, which contend on the bridge's node table.
+func BenchmarkParallelGetattr(b *testing.B) {
+	bridge, _ := newSubtreeBridge(1)
+	var dirEntry fuse.EntryOut
+	bridge.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "d0", &dirEntry)
+	var ids []uint64
+	for i := 0; i < 1024; i++ {
+		var out fuse.EntryOut
+		bridge.Lookup(nil, &fuse.InHeader{NodeId: dirEntry.NodeId}, fmt.Sprintf("f%d", i), &out)
+		ids = append(ids, out.NodeId)
+	}
+
+	var next uint32
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&next, 1)
+		var attr fuse.AttrOut
+		in := &fuse.GetAttrIn{}
+		for pb.Next() {
+			in.NodeId = ids[i%uint32(len(ids))]
+			bridge.GetAttr(nil, in, &attr)
+			i += 8
+		}
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// releaseCounter is a file whose handles count their Release calls.
+type releaseCounter struct {
+	Inode
+
+	mu       sync.Mutex
+	released int
+}
+
+var _ = (NodeOpener)((*releaseCounter)(nil))
+
+func (n *releaseCounter) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &countedHandle{n}, 0, 0
+}
+
+func (n *releaseCounter) releases() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.released
+}
+
+type countedHandle struct {
+	node *releaseCounter
+}
+
+var _ = (FileReleaser)((*countedHandle)(nil))
+
+func (h *countedHandle) Release(ctx context.Context) syscall.Errno {
+	h.node.mu.Lock()
+	defer h.node.mu.Unlock()
+	h.node.released++
+	return 0
+}
+
+func TestUnmountWaitsForRelease(t *testing.T) {
+	root := &Inode{}
+	file := &releaseCounter{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	}
+	opts.ReleaseTimeout = time.Second
+	mnt, server, clean := testMount(t, root, opts)
+
+	f, err := os.Open(mnt + "/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := server.OpenHandles(); got != 1 {
+		t.Errorf("got %d open handles, want 1", got)
+	}
+	f.Close()
+
+	// The kernel sends RELEASE after close(2) returns, so
+	// unmounting right away used to lose it.
+	clean()
+	if got := file.releases(); got != 1 {
+		t.Errorf("got %d releases, want 1", got)
+	}
+	if got := server.OpenHandles(); got != 0 {
+		t.Errorf("got %d open handles after unmount, want 0", got)
+	}
+}
+
+func TestUnmountOrphansOpenFiles(t *testing.T) {
+	root := &Inode{}
+	file := &releaseCounter{}
+	var mu sync.Mutex
+	var orphans []FileHandle
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+		OnOrphanHandle: func(fh FileHandle) {
+			mu.Lock()
+			defer mu.Unlock()
+			orphans = append(orphans, fh)
+		},
+	}
+	opts.ReleaseTimeout = 10 * time.Millisecond
+	opts.DirectMount = true
+	mnt, server, clean := testMount(t, root, opts)
+	defer clean()
+
+	f, err := os.Open(mnt + "/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// The open file keeps the mount busy, so it is detached.
+	if err := server.Unmount(); err != nil {
+		f.Close()
+		t.Fatalf("Unmount: %v", err)
+	}
+	mu.Lock()
+	got := orphans
+	mu.Unlock()
+	if len(got) != 1 {
+		t.Errorf("got orphans %v, want 1", got)
+	} else if h, ok := got[0].(*countedHandle); !ok || h.node != file {
+		t.Errorf("got orphan %#v, want the handle of file", got[0])
+	}
+
+	// Closing the file ends the mount, but the orphan is not
+	// released again.
+	f.Close()
+	server.Wait()
+	if got := file.releases(); got != 0 {
+		t.Errorf("got %d releases of the orphan, want 0", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(orphans) != 1 {
+		t.Errorf("got orphans %v after the mount ended, want 1", orphans)
+	}
+}
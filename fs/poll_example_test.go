@@ -0,0 +1,99 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// tickFile is a pseudo file that alternates between having data to
+// read and having none, like a device that receives events.
+type tickFile struct {
+	fs.Inode
+
+	mu    sync.Mutex
+	ready bool
+}
+
+// tickFile implements Open
+var _ = (fs.NodeOpener)((*tickFile)(nil))
+
+func (f *tickFile) Open(ctx context.Context, openFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return &tickHandle{file: f}, fuse.FOPEN_DIRECT_IO | fuse.FOPEN_NONSEEKABLE, 0
+}
+
+// toggle flips the readiness every interval, and wakes up pollers.
+func (f *tickFile) toggle(interval time.Duration) {
+	for range time.Tick(interval) {
+		f.mu.Lock()
+		f.ready = !f.ready
+		f.mu.Unlock()
+
+		f.NotifyPollWakeup()
+	}
+}
+
+type tickHandle struct {
+	file *tickFile
+}
+
+// tickHandle supports reads and poll(2).
+var _ = (fs.FileReader)((*tickHandle)(nil))
+var _ = (fs.FilePoller)((*tickHandle)(nil))
+
+func (h *tickHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	if !h.file.ready {
+		return nil, syscall.EAGAIN
+	}
+	return fuse.ReadResultData([]byte("tick\n")), 0
+}
+
+func (h *tickHandle) Poll(ctx context.Context) (uint32, syscall.Errno) {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+	if h.file.ready {
+		return unix.POLLIN, 0
+	}
+	return 0, 0
+}
+
+// ExamplePoll shows a file whose readability changes over time, so
+// select(2) and poll(2) on it block until it is ready.
+func Example_poll() {
+	mntDir := "/tmp/x"
+	root := &fs.Inode{}
+	tick := &tickFile{}
+
+	server, err := fs.Mount(mntDir, root, &fs.Options{
+		// Without this, the kernel considers all files ready.
+		MountOptions: fuse.MountOptions{EnablePoll: true},
+
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, tick, fs.StableAttr{Mode: syscall.S_IFREG})
+			root.AddChild("tick", ch, true)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go tick.toggle(time.Second)
+
+	fmt.Printf("poll %s/tick to see it become readable every other second\n", mntDir)
+	fmt.Printf("Unmount by calling 'fusermount -u %s'\n", mntDir)
+
+	// Serve the file system, until unmounted by calling fusermount -u
+	server.Wait()
+}
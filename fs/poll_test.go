@@ -0,0 +1,126 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// pollNode is readable once 'ready' is set.
+type pollNode struct {
+	Inode
+
+	mu    sync.Mutex
+	ready bool
+	polls int
+}
+
+var _ = (NodeOpener)((*pollNode)(nil))
+
+func (n *pollNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &pollHandle{node: n}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *pollNode) setReady() {
+	n.mu.Lock()
+	n.ready = true
+	n.mu.Unlock()
+	n.NotifyPollWakeup()
+}
+
+type pollHandle struct {
+	node *pollNode
+}
+
+var _ = (FilePoller)((*pollHandle)(nil))
+
+func (h *pollHandle) Poll(ctx context.Context) (uint32, syscall.Errno) {
+	h.node.mu.Lock()
+	defer h.node.mu.Unlock()
+	h.node.polls++
+	if h.node.ready {
+		return unix.POLLIN, OK
+	}
+	return 0, OK
+}
+
+func TestPoll(t *testing.T) {
+	root := &Inode{}
+	node := &pollNode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnablePoll: true},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+			root.AddChild("plain", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	plain, err := syscall.Open(mntDir+"/plain", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(plain)
+	fds := []unix.PollFd{{Fd: int32(plain), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 0); err != nil || n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+		t.Errorf("Poll on plain file: got %d, %v, revents 0x%x, want POLLIN", n, err, fds[0].Revents)
+	}
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+	fds = []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 0); err != nil || n != 0 {
+		t.Fatalf("Poll before ready: got %d, %v, revents 0x%x, want 0", n, err, fds[0].Revents)
+	}
+
+	time.AfterFunc(50*time.Millisecond, node.setReady)
+	start := time.Now()
+	if n, err := unix.Poll(fds, 5000); err != nil || n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+		t.Errorf("Poll: got %d, %v, revents 0x%x, want POLLIN", n, err, fds[0].Revents)
+	}
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("Poll was not woken up: took %v", d)
+	}
+}
+
+// TestPollDisabled checks that without EnablePoll, files are always
+// ready, and the file system is not asked.
+func TestPollDisabled(t *testing.T) {
+	root := &Inode{}
+	node := &pollNode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+	for i := 0; i < 2; i++ {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if n, err := unix.Poll(fds, 0); err != nil || n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+			t.Errorf("Poll: got %d, %v, revents 0x%x, want POLLIN", n, err, fds[0].Revents)
+		}
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.polls != 0 {
+		t.Errorf("got %d calls to Poll, want 0", node.polls)
+	}
+}
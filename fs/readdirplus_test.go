@@ -0,0 +1,113 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// plusDir lists its children with attributes if 'plus' is set, and
+// counts the lookups.
+type plusDir struct {
+	Inode
+	plus    bool
+	names   []string
+	lookups int32
+}
+
+var _ = (NodeLookuper)((*plusDir)(nil))
+var _ = (NodeReaddirPluser)((*plusDir)(nil))
+
+func (d *plusDir) child(ctx context.Context, out *fuse.EntryOut) *Inode {
+	out.Mode = syscall.S_IFREG | 0644
+	out.Size = 42
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG})
+}
+
+func (d *plusDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	atomic.AddInt32(&d.lookups, 1)
+	for _, n := range d.names {
+		if n == name {
+			return d.child(ctx, out), OK
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *plusDir) ReaddirPlus(ctx context.Context) (DirPlusStream, syscall.Errno) {
+	return &plusDirStream{dir: d}, OK
+}
+
+type plusDirStream struct {
+	dir *plusDir
+	idx int
+}
+
+func (s *plusDirStream) HasNext() bool {
+	return s.idx < len(s.dir.names)
+}
+
+func (s *plusDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	e := fuse.DirEntry{Name: s.dir.names[s.idx], Mode: syscall.S_IFREG}
+	s.idx++
+	return e, OK
+}
+
+func (s *plusDirStream) NextPlus(ctx context.Context, out *fuse.EntryOut) (fuse.DirEntry, *Inode, syscall.Errno) {
+	e, errno := s.Next()
+	if !s.dir.plus {
+		return e, nil, errno
+	}
+	return e, s.dir.child(ctx, out), errno
+}
+
+func (s *plusDirStream) Close() {}
+
+func TestReaddirPlusAttributes(t *testing.T) {
+	for _, plus := range []bool{false, true} {
+		t.Run(fmt.Sprintf("plus=%v", plus), func(t *testing.T) {
+			root := &plusDir{plus: plus}
+			for i := 0; i < 100; i++ {
+				root.names = append(root.names, fmt.Sprintf("file%d", i))
+			}
+			sec := time.Second
+			mntDir, _, clean := testMount(t, root, &Options{
+				EntryTimeout: &sec,
+				AttrTimeout:  &sec,
+			})
+			defer clean()
+
+			// Like "ls -l", this stats each entry.
+			infos, err := ioutil.ReadDir(mntDir)
+			if err != nil {
+				t.Fatalf("ReadDir: %v", err)
+			}
+			if len(infos) != len(root.names) {
+				t.Fatalf("got %d entries, want %d", len(infos), len(root.names))
+			}
+			for _, fi := range infos {
+				if fi.Size() != 42 {
+					t.Errorf("%s: got size %d, want 42", fi.Name(), fi.Size())
+				}
+			}
+
+			want := int32(len(root.names))
+			if plus {
+				want = 0
+			}
+			if got := atomic.LoadInt32(&root.lookups); got != want {
+				t.Errorf("got %d lookups, want %d", got, want)
+			}
+		})
+	}
+}
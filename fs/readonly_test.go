@@ -6,11 +6,15 @@ package fs
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"syscall"
 	"testing"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"golang.org/x/sys/unix"
 )
 
 func TestReadonlyCreate(t *testing.T) {
@@ -51,3 +55,81 @@ func TestDefaultPermissions(t *testing.T) {
 		}
 	}
 }
+
+func TestReadOnlyOption(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(origDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mntDir, _, clean := testMount(t, root, &Options{ReadOnly: true})
+	defer clean()
+
+	content, err := ioutil.ReadFile(mntDir + "/file")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	file := mntDir + "/file"
+	dir := mntDir + "/dir"
+	for nm, f := range map[string]func() error{
+		"open O_WRONLY": func() error {
+			fd, err := syscall.Open(file, syscall.O_WRONLY, 0)
+			if err == nil {
+				syscall.Close(fd)
+			}
+			return err
+		},
+		"open O_TRUNC": func() error {
+			fd, err := syscall.Open(file, syscall.O_RDONLY|syscall.O_TRUNC, 0)
+			if err == nil {
+				syscall.Close(fd)
+			}
+			return err
+		},
+		"create": func() error {
+			fd, err := syscall.Creat(mntDir+"/new", 0644)
+			if err == nil {
+				syscall.Close(fd)
+			}
+			return err
+		},
+		"chmod":    func() error { return syscall.Chmod(file, 0600) },
+		"truncate": func() error { return syscall.Truncate(file, 0) },
+		"mkdir":    func() error { return syscall.Mkdir(mntDir+"/newdir", 0755) },
+		"mknod":    func() error { return syscall.Mkfifo(mntDir+"/fifo", 0644) },
+		"unlink":   func() error { return syscall.Unlink(file) },
+		"rmdir":    func() error { return syscall.Rmdir(dir) },
+		"rename":   func() error { return syscall.Rename(file, mntDir+"/renamed") },
+		"link":     func() error { return syscall.Link(file, mntDir+"/link") },
+		"symlink":  func() error { return syscall.Symlink("file", mntDir+"/symlink") },
+		"setxattr": func() error { return unix.Setxattr(file, "user.attr", []byte("val"), 0) },
+		"removexattr": func() error {
+			return unix.Removexattr(file, "user.attr")
+		},
+	} {
+		if err := f(); err != syscall.EROFS {
+			t.Errorf("%s: got %v, want EROFS", nm, err)
+		}
+	}
+
+	if content, err := ioutil.ReadFile(origDir + "/file"); err != nil || string(content) != "hello" {
+		t.Errorf("backing file changed: %q, %v", content, err)
+	}
+	entries, err := ioutil.ReadDir(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(entries))
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -61,6 +62,7 @@ type testOptions struct {
 	suppressDebug bool
 	testDir       string
 	ro            bool
+	allowOther    bool
 }
 
 // newTestCase creates the directories `orig` and `mnt` inside a temporary
@@ -114,6 +116,7 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 	if opts.ro {
 		mOpts.Options = append(mOpts.Options, "ro")
 	}
+	mOpts.AllowOther = opts.allowOther
 	tc.server, err = fuse.NewServer(tc.rawFS, tc.mntDir, mOpts)
 	if err != nil {
 		t.Fatal(err)
@@ -277,6 +280,52 @@ func TestStatFs(t *testing.T) {
 	}
 }
 
+// dfKiB returns the size, used and available space in KiB, as df(1)
+// reports them for dir.
+func dfKiB(t *testing.T, dir string) [3]uint64 {
+	out, err := exec.Command("df", "-P", "-k", dir).Output()
+	if err != nil {
+		t.Fatalf("df %s: %v", dir, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	// Filesystem 1024-blocks Used Available Capacity Mounted-on
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		t.Fatalf("df %s: unexpected output %q", dir, out)
+	}
+	var result [3]uint64
+	for i := range result {
+		if result[i], err = strconv.ParseUint(fields[1+i], 10, 64); err != nil {
+			t.Fatalf("df %s: %v", dir, err)
+		}
+	}
+	return result
+}
+
+func TestStatFsDf(t *testing.T) {
+	if _, err := exec.LookPath("df"); err != nil {
+		t.Skip("df not found")
+	}
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+
+	orig := dfKiB(t, tc.origDir)
+	mnt := dfKiB(t, tc.mntDir)
+
+	// Other processes may consume space between the calls, and
+	// on darwin, the block counts are rounded to the I/O size.
+	slack := orig[0] / 1000
+	for i, name := range []string{"size", "used", "available"} {
+		diff := orig[i] - mnt[i]
+		if mnt[i] > orig[i] {
+			diff = mnt[i] - orig[i]
+		}
+		if diff > slack {
+			t.Errorf("%s: got %d KiB, want %d KiB", name, mnt[i], orig[i])
+		}
+	}
+}
+
 func TestGetAttrParallel(t *testing.T) {
 	// We grab a file-handle to provide to the API so rename+fstat
 	// can be handled correctly. Here, test that closing and
@@ -385,7 +434,9 @@ func TestPosix(t *testing.T) {
 		t.Run(nm, func(t *testing.T) {
 			tc := newTestCase(t, &testOptions{
 				suppressDebug: noisy[nm],
-				attrCache:     true, entryCache: true})
+				// Only root may mount with allow_other.
+				allowOther: os.Geteuid() == 0,
+				attrCache:  true, entryCache: true})
 			defer tc.Clean()
 
 			fn(t, tc.mntDir)
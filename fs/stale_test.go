@@ -0,0 +1,146 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// staleDir has a "file" whose backing object is replaced when gen
+// is bumped. The nodes of earlier generations return ESTALE.
+type staleDir struct {
+	Inode
+	gen     uint64
+	lookups int32
+}
+
+var _ = (NodeLookuper)((*staleDir)(nil))
+
+func (d *staleDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name != "file" {
+		return nil, syscall.ENOENT
+	}
+	atomic.AddInt32(&d.lookups, 1)
+	gen := atomic.LoadUint64(&d.gen)
+	f := &staleFile{dir: d, gen: gen}
+	f.attr(&out.Attr)
+	return d.NewInode(ctx, f, StableAttr{Mode: syscall.S_IFREG, Ino: 2, Gen: gen}), OK
+}
+
+type staleFile struct {
+	Inode
+	dir *staleDir
+	gen uint64
+}
+
+var _ = (NodeGetattrer)((*staleFile)(nil))
+var _ = (NodeOpener)((*staleFile)(nil))
+
+func (f *staleFile) attr(out *fuse.Attr) {
+	out.Mode = syscall.S_IFREG | 0644
+	out.Size = f.gen
+}
+
+func (f *staleFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f.gen != atomic.LoadUint64(&f.dir.gen) {
+		return syscall.ESTALE
+	}
+	f.attr(&out.Attr)
+	return OK
+}
+
+func (f *staleFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, OK
+}
+
+func TestInvalidateOnStale(t *testing.T) {
+	root := &staleDir{}
+	hour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout:      &hour,
+		AttrTimeout:       new(time.Duration),
+		InvalidateOnStale: true,
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	// The backend replaces the file.
+	atomic.AddUint64(&root.gen, 1)
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Size != 1 {
+		t.Errorf("got size %d, want 1 from the new file", st.Size)
+	}
+	if got := atomic.LoadInt32(&root.lookups); got < 2 {
+		t.Errorf("got %d lookups, want at least 2", got)
+	}
+
+	// The open file is bound to the stale node.
+	if err := syscall.Fstat(fd, &st); err != syscall.ESTALE {
+		t.Errorf("Fstat on stale file: got %v, want ESTALE", err)
+	}
+}
+
+// notifyRecorder records the entry notifications of a bridge that
+// is not mounted.
+type notifyRecorder struct {
+	ServerCallbacks
+	entries chan string
+}
+
+func (r *notifyRecorder) EntryNotify(parent uint64, name string) fuse.Status {
+	r.entries <- name
+	return fuse.OK
+}
+
+func TestInvalidateOnStaleNotify(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		root := &staleDir{}
+		rec := &notifyRecorder{entries: make(chan string, 10)}
+		bridge := NewNodeFS(root, &Options{
+			InvalidateOnStale: on,
+			ServerCallbacks:   rec,
+		}).(*rawBridge)
+
+		var entry fuse.EntryOut
+		if st := bridge.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+		atomic.AddUint64(&root.gen, 1)
+
+		var out fuse.AttrOut
+		in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}
+		if st := bridge.GetAttr(nil, in, &out); st != fuse.Status(syscall.ESTALE) {
+			t.Fatalf("GetAttr: got %v, want ESTALE", st)
+		}
+
+		select {
+		case name := <-rec.entries:
+			if !on {
+				t.Errorf("got notification for %q with InvalidateOnStale unset", name)
+			} else if name != "file" {
+				t.Errorf("got notification for %q, want %q", name, "file")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if on {
+				t.Errorf("no notification with InvalidateOnStale set")
+			}
+		}
+	}
+}
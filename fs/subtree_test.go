@@ -0,0 +1,131 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInvalidateSubtreeOrder(t *testing.T) {
+	root := &Inode{}
+	rec := &hubRecorder{}
+	b := NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		OnAdd: func(ctx context.Context) {
+			a := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("a", a, false)
+			b := a.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			a.AddChild("b", b, false)
+			b.AddChild("c", b.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	// Look the nodes up, so they have IDs.
+	var ids []uint64
+	parent := uint64(fuse.FUSE_ROOT_ID)
+	for _, name := range []string{"a", "b", "c"} {
+		var out fuse.EntryOut
+		if st := b.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup %s: %v", name, st)
+		}
+		ids = append(ids, out.NodeId)
+		parent = out.NodeId
+	}
+	a := root.GetChild("a")
+
+	if errno := root.InvalidateSubtree(context.Background()); errno != 0 {
+		t.Fatalf("InvalidateSubtree: %v", errno)
+	}
+	want := []string{
+		fmt.Sprintf("delete %d c", ids[1]),
+		fmt.Sprintf("delete %d b", ids[0]),
+		"delete 1 a",
+	}
+	if got := rec.takeCalls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %q, want %q", got, want)
+	}
+	if len(root.Children()) != 0 || len(a.Children()) != 0 {
+		t.Errorf("children left in the tree: %v, %v", root.Children(), a.Children())
+	}
+
+	// The kernel still knows c, but calls into it fail.
+	var attr fuse.AttrOut
+	if st := b.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: ids[2]}}, &attr); st != fuse.Status(syscall.ESTALE) {
+		t.Errorf("GetAttr on a removed node: got %v, want ESTALE", st)
+	}
+}
+
+func TestInvalidateSubtreeCanceled(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("a", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR}), false)
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if errno := root.InvalidateSubtree(ctx); errno != syscall.EINTR {
+		t.Errorf("got %v, want EINTR", errno)
+	}
+	if root.GetChild("a") == nil {
+		t.Errorf("child removed after cancellation")
+	}
+}
+
+func TestInvalidateSubtreeOpenFile(t *testing.T) {
+	root := &Inode{}
+	var dir *Inode
+	mnt, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			dir = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			sub := dir.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			dir.AddChild("sub", sub, false)
+			sub.AddChild("file", sub.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	f, err := os.OpenFile(mnt+"/dir/sub/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if errno := dir.InvalidateSubtree(context.Background()); errno != 0 {
+		t.Fatalf("InvalidateSubtree: %v", errno)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/dir/sub", &st); err != syscall.ENOENT {
+		t.Errorf("Stat sub: got %v, want ENOENT", err)
+	}
+	if err := syscall.Stat(mnt+"/dir", &st); err != nil {
+		t.Errorf("Stat dir: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := f.Read(buf); !isErrno(err, syscall.ESTALE) {
+		t.Errorf("Read: got %v, want ESTALE", err)
+	}
+	if _, err := f.Write([]byte("world")); !isErrno(err, syscall.ESTALE) {
+		t.Errorf("Write: got %v, want ESTALE", err)
+	}
+	// The file can still be closed.
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func isErrno(err error, want syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == want
+}
@@ -0,0 +1,587 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// timeoutBridge is the RawFileSystem of NewNodeFS if
+// Options.RequestTimeout is set. Each call runs in a goroutine of its
+// own, on copies of the request and reply structures, so a call that
+// is still running after the deadline can be left behind: the kernel
+// gets the timeout error, and the late result goes to the copies.
+//
+// Forget, Flush, Release, ReleaseDir and SetLkw are not timed, as
+// abandoning them loses data or breaks blocking locks.
+type timeoutBridge struct {
+	*rawBridge
+	timeout time.Duration
+	errno   fuse.Status
+}
+
+func newTimeoutBridge(b *rawBridge) *timeoutBridge {
+	errno := b.options.RequestTimeoutErrno
+	if errno == 0 {
+		errno = syscall.EIO
+	}
+	return &timeoutBridge{rawBridge: b, timeout: b.options.RequestTimeout, errno: fuse.Status(errno)}
+}
+
+// timedCall is the state shared between a call and the request
+// waiting for it.
+type timedCall struct {
+	mu        sync.Mutex
+	status    fuse.Status
+	finished  bool
+	abandoned bool
+	done      chan struct{}
+}
+
+// call runs 'run' on node nodeId. The cancel channel passed to run is
+// closed when the request is interrupted, or when the deadline
+// passes. It returns the status of run, and true if run returned in
+// time. Otherwise, it returns the timeout error and false; if run
+// succeeds later after all, discard is called to undo what the kernel
+// never learns about. Exactly one of the two happens, so a call that
+// finishes as the deadline passes is not answered twice.
+func (t *timeoutBridge) call(op string, nodeId uint64, cancel <-chan struct{}, run func(cancel <-chan struct{}) fuse.Status, discard func()) (fuse.Status, bool) {
+	start := time.Now()
+	expired := make(chan struct{})
+	c := &timedCall{done: make(chan struct{})}
+	go func() {
+		st := run(expired)
+		c.mu.Lock()
+		c.status = st
+		c.finished = true
+		late := c.abandoned
+		c.mu.Unlock()
+		close(c.done)
+		if late {
+			t.logf("%s on %s returned %v after %v, past its deadline; dropping the result",
+				op, t.nodeType(nodeId), st, time.Since(start))
+			if st.Ok() && discard != nil {
+				discard()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	interrupted := false
+	for {
+		select {
+		case <-c.done:
+			return c.status, true
+		case <-cancel:
+			close(expired)
+			interrupted = true
+			cancel = nil
+		case <-timer.C:
+			c.mu.Lock()
+			if c.finished {
+				c.mu.Unlock()
+				return c.status, true
+			}
+			c.abandoned = true
+			c.mu.Unlock()
+			if !interrupted {
+				close(expired)
+			}
+			t.logf("%s on %s timed out after %v", op, t.nodeType(nodeId), time.Since(start))
+			return t.errno, false
+		}
+	}
+}
+
+// nodeType describes the node nodeId for log messages.
+func (t *timeoutBridge) nodeType(nodeId uint64) string {
+	if n := t.kernelNodeIds.get(nodeId); n != nil {
+		return fmt.Sprintf("%T (node %d)", n.ops, nodeId)
+	}
+	return fmt.Sprintf("node %d", nodeId)
+}
+
+// forgetEntry undoes the lookup of a late reply.
+func (t *timeoutBridge) forgetEntry(out *fuse.EntryOut) {
+	if out.NodeId != 0 {
+		t.rawBridge.Forget(out.NodeId, 1)
+	}
+}
+
+// releaseFile undoes the open of a late reply.
+func (t *timeoutBridge) releaseFile(nodeId uint64, out *fuse.OpenOut, flags uint32) {
+	if out.Fh != 0 {
+		t.rawBridge.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: nodeId}, Fh: out.Fh, Flags: flags})
+	}
+}
+
+func (t *timeoutBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	h := *header
+	var o fuse.EntryOut
+	st, ok := t.call("Lookup", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Lookup(c, &h, name, &o)
+	}, func() { t.forgetEntry(&o) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	in := *input
+	var o fuse.AttrOut
+	st, ok := t.call("GetAttr", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.GetAttr(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	in := *input
+	var o fuse.AttrOut
+	st, ok := t.call("SetAttr", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.SetAttr(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Statx(cancel <-chan struct{}, input *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	in := *input
+	var o fuse.StatxOut
+	st, ok := t.call("Statx", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Statx(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	in := *input
+	var o fuse.EntryOut
+	st, ok := t.call("Mknod", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Mknod(c, &in, name, &o)
+	}, func() { t.forgetEntry(&o) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	in := *input
+	var o fuse.EntryOut
+	st, ok := t.call("Mkdir", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Mkdir(c, &in, name, &o)
+	}, func() { t.forgetEntry(&o) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	h := *header
+	st, _ := t.call("Unlink", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Unlink(c, &h, name)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	h := *header
+	st, _ := t.call("Rmdir", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Rmdir(c, &h, name)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	in := *input
+	st, _ := t.call("Rename", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Rename(c, &in, oldName, newName)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	in := *input
+	var o fuse.EntryOut
+	st, ok := t.call("Link", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Link(c, &in, filename, &o)
+	}, func() { t.forgetEntry(&o) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	h := *header
+	var o fuse.EntryOut
+	st, ok := t.call("Symlink", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Symlink(c, &h, target, name, &o)
+	}, func() { t.forgetEntry(&o) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	h := *header
+	var target []byte
+	st, ok := t.call("Readlink", h.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		target, st = t.rawBridge.Readlink(c, &h)
+		return st
+	}, nil)
+	if !ok {
+		return nil, st
+	}
+	return target, st
+}
+
+func (t *timeoutBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	in := *input
+	st, _ := t.call("Access", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Access(c, &in)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	h := *header
+	buf := make([]byte, len(dest))
+	var sz uint32
+	st, ok := t.call("GetXAttr", h.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		sz, st = t.rawBridge.GetXAttr(c, &h, attr, buf)
+		return st
+	}, nil)
+	if !ok {
+		return 0, st
+	}
+	copy(dest, buf)
+	return sz, st
+}
+
+func (t *timeoutBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	h := *header
+	buf := make([]byte, len(dest))
+	var sz uint32
+	st, ok := t.call("ListXAttr", h.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		sz, st = t.rawBridge.ListXAttr(c, &h, buf)
+		return st
+	}, nil)
+	if !ok {
+		return 0, st
+	}
+	copy(dest, buf)
+	return sz, st
+}
+
+func (t *timeoutBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	in := *input
+	data = append([]byte{}, data...)
+	st, _ := t.call("SetXAttr", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.SetXAttr(c, &in, attr, data)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	h := *header
+	st, _ := t.call("RemoveXAttr", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.RemoveXAttr(c, &h, attr)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	in := *input
+	var o fuse.CreateOut
+	st, ok := t.call("Create", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Create(c, &in, name, &o)
+	}, func() {
+		t.releaseFile(o.NodeId, &o.OpenOut, in.Flags)
+		t.forgetEntry(&o.EntryOut)
+	})
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	in := *input
+	var o fuse.CreateOut
+	st, ok := t.call("Tmpfile", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Tmpfile(c, &in, &o)
+	}, func() {
+		t.releaseFile(o.NodeId, &o.OpenOut, in.Flags)
+		t.forgetEntry(&o.EntryOut)
+	})
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	in := *input
+	var o fuse.OpenOut
+	st, ok := t.call("Open", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Open(c, &in, &o)
+	}, func() { t.releaseFile(in.NodeId, &o, in.Flags) })
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	in := *input
+	// The result may point into the buffer, so the buffer is
+	// not handed back.
+	private := make([]byte, len(buf))
+	var res fuse.ReadResult
+	st, ok := t.call("Read", in.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		res, st = t.rawBridge.Read(c, &in, private)
+		return st
+	}, func() {
+		if res != nil {
+			res.Done()
+		}
+	})
+	if !ok {
+		return nil, st
+	}
+	return res, st
+}
+
+func (t *timeoutBridge) Lseek(cancel <-chan struct{}, input *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	in := *input
+	var o fuse.LseekOut
+	st, ok := t.call("Lseek", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Lseek(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) Poll(cancel <-chan struct{}, input *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	in := *input
+	var o fuse.PollOut
+	st, ok := t.call("Poll", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Poll(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	in := *input
+	var o fuse.LkOut
+	st, ok := t.call("GetLk", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.GetLk(c, &in, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	in := *input
+	st, _ := t.call("SetLk", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.SetLk(c, &in)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	in := *input
+	data = append([]byte{}, data...)
+	var written uint32
+	st, ok := t.call("Write", in.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		written, st = t.rawBridge.Write(c, &in, data)
+		return st
+	}, nil)
+	if !ok {
+		return 0, st
+	}
+	return written, st
+}
+
+func (t *timeoutBridge) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	in := *input
+	var written uint32
+	st, ok := t.call("CopyFileRange", in.NodeId, cancel, func(c <-chan struct{}) (st fuse.Status) {
+		written, st = t.rawBridge.CopyFileRange(c, &in)
+		return st
+	}, nil)
+	if !ok {
+		return 0, st
+	}
+	return written, st
+}
+
+func (t *timeoutBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	in := *input
+	st, _ := t.call("Fsync", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Fsync(c, &in)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	in := *input
+	st, _ := t.call("Fallocate", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Fallocate(c, &in)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, bufOut []byte) fuse.Status {
+	in := *input
+	inbuf = append([]byte{}, inbuf...)
+	out := make([]byte, len(bufOut))
+	var o fuse.IoctlOut
+	st, ok := t.call("Ioctl", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.Ioctl(c, &in, inbuf, &o, out)
+	}, nil)
+	if ok {
+		*output = o
+		copy(bufOut, out)
+	}
+	return st
+}
+
+func (t *timeoutBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	in := *input
+	var o fuse.OpenOut
+	st, ok := t.call("OpenDir", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.OpenDir(c, &in, &o)
+	}, func() {
+		if o.Fh != 0 {
+			t.rawBridge.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: in.NodeId}, Fh: o.Fh})
+		}
+	})
+	if ok {
+		*out = o
+	}
+	return st
+}
+
+func (t *timeoutBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	return t.readDir("ReadDir", cancel, input, out, false)
+}
+
+func (t *timeoutBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	return t.readDir("ReadDirPlus", cancel, input, out, true)
+}
+
+// readDir lists into a buffer of its own, and copies the entries to
+// out if the listing finishes in time.
+func (t *timeoutBridge) readDir(op string, cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) fuse.Status {
+	in := *input
+	buf := make([]byte, in.Size)
+	list := fuse.NewDirEntryList(buf, in.Offset)
+	st, ok := t.call(op, in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		if plus {
+			return t.rawBridge.ReadDirPlus(c, &in, list)
+		}
+		return t.rawBridge.ReadDir(c, &in, list)
+	}, func() {
+		if plus {
+			forEachDirent(buf, true, func(e fuse.DirEntry, entry *fuse.EntryOut) {
+				t.forgetEntry(entry)
+			})
+		}
+	})
+	if ok {
+		forEachDirent(buf, plus, func(e fuse.DirEntry, entry *fuse.EntryOut) {
+			if !plus {
+				out.AddDirEntry(e)
+			} else if dst := out.AddDirLookupEntry(e); dst != nil {
+				*dst = *entry
+			}
+		})
+	}
+	return st
+}
+
+// replyDirent is the header of an entry in a READDIR reply.
+type replyDirent struct {
+	Ino     uint64
+	Off     uint64
+	NameLen uint32
+	Typ     uint32
+}
+
+// forEachDirent calls f for the entries of a READDIR or READDIRPLUS
+// reply in buf, whose unused part is zero.
+func forEachDirent(buf []byte, plus bool, f func(e fuse.DirEntry, entry *fuse.EntryOut)) {
+	const entryOutSize = int(unsafe.Sizeof(fuse.EntryOut{}))
+	const direntSize = int(unsafe.Sizeof(replyDirent{}))
+	for off := 0; ; {
+		var entry *fuse.EntryOut
+		if plus {
+			if off+entryOutSize > len(buf) {
+				return
+			}
+			entry = (*fuse.EntryOut)(unsafe.Pointer(&buf[off]))
+			off += entryOutSize
+		}
+		if off+direntSize > len(buf) {
+			return
+		}
+		d := (*replyDirent)(unsafe.Pointer(&buf[off]))
+		if d.NameLen == 0 {
+			return
+		}
+		off += direntSize
+		name := string(buf[off : off+int(d.NameLen)])
+		off += (int(d.NameLen) + 7) &^ 7
+		f(fuse.DirEntry{Name: name, Ino: d.Ino, Mode: d.Typ << 12}, entry)
+	}
+}
+
+func (t *timeoutBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	in := *input
+	st, _ := t.call("FsyncDir", in.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.FsyncDir(c, &in)
+	}, nil)
+	return st
+}
+
+func (t *timeoutBridge) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	h := *header
+	var o fuse.StatfsOut
+	st, ok := t.call("StatFs", h.NodeId, cancel, func(c <-chan struct{}) fuse.Status {
+		return t.rawBridge.StatFs(c, &h, &o)
+	}, nil)
+	if ok {
+		*out = o
+	}
+	return st
+}
@@ -0,0 +1,253 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// hangNode blocks in the method named 'op' until 'release' is
+// closed.
+type hangNode struct {
+	Inode
+
+	op      string
+	release chan struct{}
+	// canceled is closed when the context of a call is done.
+	canceled chan struct{}
+	forgot   chan struct{}
+	released chan struct{}
+}
+
+var _ = (NodeGetattrer)((*hangNode)(nil))
+var _ = (NodeLookuper)((*hangNode)(nil))
+var _ = (NodeOpener)((*hangNode)(nil))
+var _ = (NodeOnForgetter)((*hangNode)(nil))
+
+func newHangNode(op string) *hangNode {
+	return &hangNode{
+		op:       op,
+		release:  make(chan struct{}),
+		canceled: make(chan struct{}),
+		forgot:   make(chan struct{}),
+		released: make(chan struct{}),
+	}
+}
+
+func (n *hangNode) hang(ctx context.Context, op string) {
+	if op != n.op {
+		return
+	}
+	<-ctx.Done()
+	close(n.canceled)
+	<-n.release
+}
+
+func (n *hangNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.hang(ctx, "Getattr")
+	out.Size = 42
+	return 0
+}
+
+func (n *hangNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.hang(ctx, "Lookup")
+	return n.NewInode(ctx, &forgetNode{forgot: n.forgot}, StableAttr{Mode: syscall.S_IFREG}), 0
+}
+
+func (n *hangNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	n.hang(ctx, "Open")
+	return &releaseHandle{released: n.released}, 0, 0
+}
+
+type forgetNode struct {
+	Inode
+	forgot chan struct{}
+}
+
+var _ = (NodeOnForgetter)((*forgetNode)(nil))
+
+func (n *forgetNode) OnForget() {
+	close(n.forgot)
+}
+
+func (n *hangNode) OnForget() {}
+
+type releaseHandle struct {
+	released chan struct{}
+}
+
+var _ = (FileReleaser)((*releaseHandle)(nil))
+
+func (h *releaseHandle) Release(ctx context.Context) syscall.Errno {
+	close(h.released)
+	return 0
+}
+
+func waitClosed(t *testing.T, ch chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestRequestTimeoutGetattr(t *testing.T) {
+	root := newHangNode("Getattr")
+	logs := &syncBuffer{}
+	b := NewNodeFS(root, &Options{
+		RequestTimeout: 10 * time.Millisecond,
+		Logger:         log.New(logs, "", 0),
+	})
+
+	out := fuse.AttrOut{}
+	start := time.Now()
+	if st := b.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}, &out); st != fuse.EIO {
+		t.Errorf("GetAttr: got %v, want EIO", st)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("GetAttr took %v", d)
+	}
+	waitClosed(t, root.canceled, "the context to be canceled")
+
+	close(root.release)
+	// The late reply must not go to the abandoned request.
+	time.Sleep(10 * time.Millisecond)
+	if out.Size != 0 {
+		t.Errorf("got late size %d in the abandoned reply", out.Size)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), "past its deadline"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the late reply was not logged: %q", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := logs.String(); !strings.Contains(got, "GetAttr on *fs.hangNode (node 1) timed out") {
+		t.Errorf("got log %q, want the operation and node type", got)
+	}
+}
+
+func TestRequestTimeoutErrno(t *testing.T) {
+	root := newHangNode("Getattr")
+	b := NewNodeFS(root, &Options{
+		RequestTimeout:      10 * time.Millisecond,
+		RequestTimeoutErrno: syscall.ETIMEDOUT,
+	})
+	defer close(root.release)
+
+	var out fuse.AttrOut
+	if st := b.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}, &out); st != fuse.Status(syscall.ETIMEDOUT) {
+		t.Errorf("GetAttr: got %v, want ETIMEDOUT", st)
+	}
+}
+
+func TestRequestTimeoutLateLookup(t *testing.T) {
+	root := newHangNode("Lookup")
+	b := NewNodeFS(root, &Options{RequestTimeout: 10 * time.Millisecond})
+
+	var out fuse.EntryOut
+	if st := b.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &out); st != fuse.EIO {
+		t.Fatalf("Lookup: got %v, want EIO", st)
+	}
+	close(root.release)
+	// The kernel never learns about the node, so it is forgotten
+	// for it.
+	waitClosed(t, root.forgot, "the node to be forgotten")
+	if out.NodeId != 0 {
+		t.Errorf("got node %d in the abandoned reply", out.NodeId)
+	}
+}
+
+func TestRequestTimeoutLateOpen(t *testing.T) {
+	root := &Inode{}
+	file := newHangNode("Open")
+	b := NewNodeFS(root, &Options{
+		RequestTimeout: 10 * time.Millisecond,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	var entry fuse.EntryOut
+	if st := b.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+
+	var open fuse.OpenOut
+	if st := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &open); st != fuse.EIO {
+		t.Fatalf("Open: got %v, want EIO", st)
+	}
+	close(file.release)
+	waitClosed(t, file.released, "the file to be released")
+}
+
+// slowFlushHandle takes longer to flush than the request timeout.
+type slowFlushHandle struct{}
+
+var _ = (FileFlusher)((*slowFlushHandle)(nil))
+
+func (h *slowFlushHandle) Flush(ctx context.Context) syscall.Errno {
+	time.Sleep(50 * time.Millisecond)
+	return syscall.ENOSPC
+}
+
+type slowFlushNode struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*slowFlushNode)(nil))
+
+func (n *slowFlushNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &slowFlushHandle{}, 0, 0
+}
+
+func TestRequestTimeoutFlushExempt(t *testing.T) {
+	root := &slowFlushNode{}
+	b := NewNodeFS(root, &Options{RequestTimeout: time.Millisecond})
+
+	var open fuse.OpenOut
+	if st := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}, &open); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	if st := b.Flush(nil, &fuse.FlushIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Fh: open.Fh}); st != fuse.Status(syscall.ENOSPC) {
+		t.Errorf("Flush: got %v, want the ENOSPC of the handle", st)
+	}
+}
+
+func TestRequestTimeoutMount(t *testing.T) {
+	root := &Inode{}
+	opts := &Options{
+		RequestTimeout: time.Minute,
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			dir.AddChild("file", dir.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{}), false)
+		},
+	}
+	mnt, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	// The replies are copied from the private buffers.
+	entries, err := ioutil.ReadDir(mnt + "/dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "file" || entries[0].Size() != 5 {
+		t.Fatalf("ReadDir: got %v, %v", entries, err)
+	}
+	if content, err := ioutil.ReadFile(mnt + "/dir/file"); err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile: got %q, %v", content, err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir/file", []byte("world"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if content, err := ioutil.ReadFile(mnt + "/dir/file"); err != nil || string(content) != "world" {
+		t.Errorf("ReadFile after write: got %q, %v", content, err)
+	}
+}
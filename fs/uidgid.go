@@ -0,0 +1,35 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+// UidGidMapper translates user and group IDs between the file system
+// and the kernel, for example when the file system runs as a
+// different user than the one that mounts it.
+type UidGidMapper interface {
+	// ToKernel maps IDs of the file system to those shown to
+	// the kernel.
+	ToKernel(uid, gid uint32) (uint32, uint32)
+
+	// FromKernel maps IDs from the kernel to those of the file
+	// system. It should be the inverse of ToKernel.
+	FromKernel(uid, gid uint32) (uint32, uint32)
+}
+
+// UidGidOffset is a UidGidMapper that adds a fixed offset to the IDs
+// of the file system, like a user namespace does.
+type UidGidOffset struct {
+	Uid int32
+	Gid int32
+}
+
+var _ = (UidGidMapper)(UidGidOffset{})
+
+func (o UidGidOffset) ToKernel(uid, gid uint32) (uint32, uint32) {
+	return uid + uint32(o.Uid), gid + uint32(o.Gid)
+}
+
+func (o UidGidOffset) FromKernel(uid, gid uint32) (uint32, uint32) {
+	return uid - uint32(o.Uid), gid - uint32(o.Gid)
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestUidGidMapper(t *testing.T) {
+	origDir := testutil.TempDir()
+	defer os.RemoveAll(origDir)
+	if err := ioutil.WriteFile(origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := UidGidOffset{Uid: 100000, Gid: 100000}
+	mntDir, _, clean := testMount(t, root, &Options{UidGidMapper: mapper})
+	defer clean()
+
+	for _, nm := range []string{"", "/file"} {
+		var orig, st syscall.Stat_t
+		if err := syscall.Stat(origDir+nm, &orig); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if err := syscall.Stat(mntDir+nm, &st); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if st.Uid != orig.Uid+100000 || st.Gid != orig.Gid+100000 {
+			t.Errorf("%q: got owner %d:%d, want %d:%d", nm, st.Uid, st.Gid, orig.Uid+100000, orig.Gid+100000)
+		}
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("need root to chown files")
+	}
+
+	var st syscall.Stat_t
+	if err := os.Chown(mntDir+"/file", 101234, 105678); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+	if err := syscall.Stat(origDir+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Uid != 1234 || st.Gid != 5678 {
+		t.Errorf("got backing owner %d:%d, want 1234:5678", st.Uid, st.Gid)
+	}
+	if err := syscall.Stat(mntDir+"/file", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Uid != 101234 || st.Gid != 105678 {
+		t.Errorf("got owner %d:%d, want 101234:105678", st.Uid, st.Gid)
+	}
+
+	// The loopback file system gives new files to the caller, as
+	// seen by the file system.
+	if err := os.Mkdir(mntDir+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	wantUid, wantGid := mapper.FromKernel(uint32(os.Getuid()), uint32(os.Getgid()))
+	if err := syscall.Stat(origDir+"/dir", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Uid != wantUid || st.Gid != wantGid {
+		t.Errorf("got backing owner %d:%d, want %d:%d", st.Uid, st.Gid, wantUid, wantGid)
+	}
+	if err := syscall.Stat(mntDir+"/dir", &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	} else if st.Uid != uint32(os.Getuid()) || st.Gid != uint32(os.Getgid()) {
+		t.Errorf("got owner %d:%d, want %d:%d", st.Uid, st.Gid, os.Getuid(), os.Getgid())
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+// OSXFUSE does not pass the umask for CREATE and MKNOD.
+
+func createUmask(in *fuse.CreateIn) uint32 {
+	return 0
+}
+
+func mknodUmask(in *fuse.MknodIn) uint32 {
+	return 0
+}
@@ -0,0 +1,15 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+func createUmask(in *fuse.CreateIn) uint32 {
+	return in.Umask
+}
+
+func mknodUmask(in *fuse.MknodIn) uint32 {
+	return in.Umask
+}
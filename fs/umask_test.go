@@ -0,0 +1,129 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// modeDir records the modes passed for new entries.
+type modeDir struct {
+	Inode
+
+	mu    sync.Mutex
+	modes map[string]uint32
+}
+
+var _ = (NodeCreater)((*modeDir)(nil))
+var _ = (NodeMkdirer)((*modeDir)(nil))
+var _ = (NodeMknoder)((*modeDir)(nil))
+
+func (d *modeDir) record(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) *Inode {
+	d.mu.Lock()
+	d.modes[name] = mode
+	d.mu.Unlock()
+	out.Mode = mode
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: mode & syscall.S_IFMT})
+}
+
+func (d *modeDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	return d.record(ctx, name, mode|syscall.S_IFREG, out), nil, 0, OK
+}
+
+func (d *modeDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return d.record(ctx, name, mode|syscall.S_IFDIR, out), OK
+}
+
+func (d *modeDir) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return d.record(ctx, name, mode, out), OK
+}
+
+func TestUmask(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	for _, tc := range []struct {
+		dontMask, applyUmask bool
+		want                 uint32
+	}{
+		// The kernel applies the umask.
+		{false, false, 0755},
+		{false, true, 0755},
+		// The node gets the raw mode, unless the bridge
+		// applies the umask.
+		{true, false, 0777},
+		{true, true, 0755},
+	} {
+		t.Run(fmt.Sprintf("dontMask=%v,applyUmask=%v", tc.dontMask, tc.applyUmask), func(t *testing.T) {
+			root := &modeDir{modes: map[string]uint32{}}
+			opts := &Options{ApplyUmask: tc.applyUmask}
+			opts.DontMask = tc.dontMask
+			mntDir, _, clean := testMount(t, root, opts)
+			defer clean()
+
+			f, err := os.OpenFile(filepath.Join(mntDir, "file"), os.O_CREATE|os.O_WRONLY, 0777)
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			f.Close()
+			if err := syscall.Mkdir(filepath.Join(mntDir, "dir"), 0777); err != nil {
+				t.Fatalf("Mkdir: %v", err)
+			}
+			if err := syscall.Mknod(filepath.Join(mntDir, "fifo"), syscall.S_IFIFO|0777, 0); err != nil {
+				t.Fatalf("Mknod: %v", err)
+			}
+
+			root.mu.Lock()
+			defer root.mu.Unlock()
+			for nm, mode := range root.modes {
+				if got := mode & 07777; got != tc.want {
+					t.Errorf("%s: got mode %#o, want %#o", nm, got, tc.want)
+				}
+			}
+			if len(root.modes) != 3 {
+				t.Errorf("got modes %v, want 3 entries", root.modes)
+			}
+		})
+	}
+}
+
+// TestUmaskLoopback checks that the loopback, which should not set
+// ApplyUmask, gets the raw mode with DontMask, and the backing file
+// system applies the umask of the server process.
+func TestUmaskLoopback(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{}
+	opts.DontMask = true
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	if err := syscall.Mkdir(filepath.Join(mntDir, "dir"), 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(dir, "dir"), &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got, want := st.Mode&07777, uint32(0755); got != want {
+		t.Errorf("got mode %#o, want %#o", got, want)
+	}
+}
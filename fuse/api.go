@@ -94,7 +94,8 @@
 // Does not need root permissions but needs `fusermount` installed.
 //
 // 2) If `MountOptions.DirectMount` is set, go-fuse calls `mount(2)` itself.
-// Needs root permissions, but works without `fusermount`.
+// Needs root permissions (CAP_SYS_ADMIN), but works without `fusermount`.
+// Without the permissions, it falls back to 1).
 //
 // 3) If `mountPoint` has the magic `/dev/fd/N` syntax, it means that that a
 // privileged parent process:
@@ -122,6 +123,8 @@
 // [2] https://sylabs.io/guides/3.7/user-guide/bind_paths_and_mounts.html#fuse-mounts
 package fuse
 
+import "time"
+
 // Types for users to implement.
 
 // The result of Read is an array of bytes, but for performance
@@ -145,20 +148,30 @@ type ReadResult interface {
 type MountOptions struct {
 	AllowOther bool
 
-	// Options are passed as -o string to fusermount.
+	// Options are passed as -o string to fusermount. With
+	// "auto_unmount", fusermount unmounts the filesystem once
+	// the process exits, even if it crashes.
 	Options []string
 
 	// Default is _DEFAULT_BACKGROUND_TASKS, 12.  This numbers
 	// controls the allowed number of requests that relate to
 	// async I/O.  Concurrency for synchronous I/O is not limited.
+	// It is capped at 65535.
 	MaxBackground int
 
-	// Write size to use.  If 0, use default. This number is
-	// capped at the kernel maximum.
+	// Write size to use.  If 0, use default (64k). This number is
+	// rounded up to whole pages, and capped at
+	// MAX_KERNEL_MAX_PAGES_WRITE. Sizes over MAX_KERNEL_WRITE need
+	// CAP_MAX_PAGES (Linux 4.20+), and are capped at
+	// MAX_KERNEL_WRITE otherwise; buffers for requests are sized
+	// from the negotiated value. A large MaxWrite also allows
+	// larger reads; spliced read results then need pipes of that
+	// size, and fall back to copying if pipes cannot grow that
+	// far (see /proc/sys/fs/pipe-max-size).
 	MaxWrite int
 
 	// Max read ahead to use.  If 0, use default. This number is
-	// capped at the kernel maximum.
+	// rounded up to whole pages, and capped at the kernel maximum.
 	MaxReadAhead int
 
 	// If IgnoreSecurityLabels is set, all security related xattr
@@ -190,9 +203,57 @@ type MountOptions struct {
 	Debug bool
 
 	// If set, ask kernel to forward file locks to FUSE. If using,
-	// you must implement the GetLk/SetLk/SetLkw methods.
+	// you must implement the GetLk/SetLk/SetLkw methods. Both
+	// POSIX record locks and flock(2) locks are forwarded, the
+	// latter with FUSE_LK_FLOCK in LkIn.LkFlags. On the last close
+	// of a flock(2)ed file, Release is called with
+	// RELEASE_FLOCK_UNLOCK set.
 	EnableLocks bool
 
+	// If set, the kernel sends poll requests to the file system,
+	// which must implement Poll. By default, a poll request is
+	// issued and answered with ENOSYS on mount, because a file
+	// system that is accessed through the Go runtime poller from
+	// within its own process can deadlock on it, and this stops
+	// the kernel from sending further poll requests. Poll
+	// requests that arrive anyway are answered with ENOSYS
+	// without calling the file system.
+	EnablePoll bool
+
+	// If set, ask the kernel to send ioctl(2) calls on
+	// directories too, rather than failing them with ENOTTY.
+	EnableIoctlDir bool
+
+	// If set, ask the kernel to cache the targets of symlinks in
+	// its page cache, so repeated path resolution does not issue
+	// READLINK again. Invalidate the cached target like file
+	// content, eg. with Server.InodeNotify.
+	EnableSymlinkCaching bool
+
+	// If set, ask the kernel to use READDIRPLUS only when it
+	// helps, ie. when a listing is followed by lookups, and use
+	// plain READDIR otherwise.
+	EnableReaddirplusAuto bool
+
+	// If set, ask the kernel not to apply the umask of the caller
+	// to the mode of new files, directories and device nodes.
+	// The unmasked mode is passed along with the umask, so the
+	// file system can apply it, eg. only if the parent directory
+	// has no default ACL.
+	DontMask bool
+
+	// If set, ask the kernel to buffer writes in its page cache,
+	// and write them back later, eg. on close(2), fsync(2) or
+	// under memory pressure. This turns small writes into large
+	// ones, but the kernel then owns the file size and times: it
+	// ignores the size returned by GETATTR, appends at its own
+	// idea of the end of file, may read from files opened
+	// write-only to fill partially written pages, and sends
+	// modification and change times in a SETATTR that can come
+	// well after the writes. Don't use it for files that change
+	// behind the kernel's back.
+	EnableWritebackCache bool
+
 	// If set, ask kernel not to do automatic data cache invalidation.
 	// The filesystem is fully responsible for invalidating data cache.
 	ExplicitDataCacheControl bool
@@ -216,19 +277,64 @@ type MountOptions struct {
 
 	// If set, fuse will first attempt to use syscall.Mount instead of
 	// fusermount to mount the filesystem. This will not update /etc/mtab
-	// but might be needed if fusermount is not available.
+	// but might be needed if fusermount is not available. It needs
+	// CAP_SYS_ADMIN; if mount(2) fails with EPERM, fusermount is used
+	// after all. Options that fusermount handles itself, like "ro" and
+	// "dev", are translated to mount flags. The "auto_unmount" option
+	// needs fusermount. Linux only.
 	DirectMount bool
 
-	// Options passed to syscall.Mount, the default value used by fusermount
-	// is syscall.MS_NOSUID|syscall.MS_NODEV
+	// Options passed to syscall.Mount. If zero, the value that
+	// fusermount uses, syscall.MS_NOSUID|syscall.MS_NODEV, is used.
 	DirectMountFlags uintptr
 
+	// directMounted is set if DirectMount succeeded, so unmounting
+	// needs no fusermount either.
+	directMounted bool
+
+	// fusermount is the helper that stays around for
+	// "auto_unmount". It is nil otherwise.
+	fusermount *fusermountHelper
+
 	// EnableAcls enables kernel ACL support.
 	//
 	// See the comments to FUSE_CAP_POSIX_ACL
 	// in https://github.com/libfuse/libfuse/blob/master/include/fuse_common.h
 	// for details.
 	EnableAcl bool
+
+	// If set, read requests from and write replies to the kernel
+	// through an io_uring (Linux 5.1+), rather than with read(2)
+	// and write(2). If the kernel does not support it, the normal
+	// loop is used. Replies that are spliced are written as
+	// before. The kernel reads the device from worker threads,
+	// so whether this is faster depends on the load and the
+	// number of CPUs; compare the IOUring benchmarks in the
+	// benchmark package.
+	EnableIOUring bool
+
+	// If set, read requests from the kernel through a pipe
+	// (Linux only), so the data of a WRITE can be spliced into
+	// the file descriptor a WriteFder file system returns,
+	// rather than copied into a buffer first. The pipe must hold
+	// a whole request, so this is ignored if MaxWrite exceeds
+	// the maximum pipe size, and with EnableIOUring. Other
+	// requests cost an extra system call to read.
+	EnableSpliceWrite bool
+
+	// ReleaseTimeout is how long Server.Unmount, and DESTROY,
+	// wait for the kernel to release the open file and directory
+	// handles. The kernel sends RELEASE asynchronously after the
+	// last close, and drops it if the mount goes away first. If
+	// 0, don't wait. The wait ends as soon as no handles are
+	// open. Handles that are still open afterwards are orphaned,
+	// see HandleOrphaner.
+	ReleaseTimeout time.Duration
+
+	// RetrieveTimeout bounds how long Server.InodeRetrieveCache
+	// waits for the kernel to send the data. If 0, it waits until
+	// the data arrives or the file system is unmounted.
+	RetrieveTimeout time.Duration
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -255,7 +361,8 @@ type MountOptions struct {
 // `cancel` channel), the API call should return EINTR. In this case,
 // the outstanding request data is not reused, so the API call may
 // return EINTR without ensuring that child contexts have successfully
-// completed.
+// completed. Canceled calls that fail otherwise are answered with
+// EINTR too.
 type RawFileSystem interface {
 	String() string
 
@@ -280,6 +387,12 @@ type RawFileSystem interface {
 	GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) (code Status)
 	SetAttr(cancel <-chan struct{}, input *SetAttrIn, out *AttrOut) (code Status)
 
+	// Statx is the statx(2) counterpart of GetAttr, which may
+	// also return the birth time. It needs no init flag:
+	// kernels predating protocol version 39 never send it, and
+	// newer ones use GetAttr instead once it returns ENOSYS.
+	Statx(cancel <-chan struct{}, in *StatxIn, out *StatxOut) (code Status)
+
 	// Modifying structure.
 	Mknod(cancel <-chan struct{}, input *MknodIn, name string, out *EntryOut) (code Status)
 	Mkdir(cancel <-chan struct{}, input *MkdirIn, name string, out *EntryOut) (code Status)
@@ -312,10 +425,23 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(cancel <-chan struct{}, input *CreateIn, name string, out *CreateOut) (code Status)
+
+	// Tmpfile creates an unnamed file in a directory, for
+	// open(2) with O_TMPFILE, and opens it like Create. The file
+	// can be given a name later with Link. Returning ENOSYS
+	// disables O_TMPFILE for the mount, and the kernel fails it
+	// with EOPNOTSUPP.
+	Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status)
 	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
 	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
 	Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status
 
+	// Poll reports the ready events for a file. If
+	// in.Flags has FUSE_POLL_SCHEDULE_NOTIFY, the kernel waits
+	// for Server.PollNotify with in.Kh before polling again.
+	// Returning ENOSYS disables polling for the mount.
+	Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status
+
 	// File locking
 	GetLk(cancel <-chan struct{}, input *LkIn, out *LkOut) (code Status)
 	SetLk(cancel <-chan struct{}, input *LkIn) (code Status)
@@ -329,6 +455,14 @@ type RawFileSystem interface {
 	Fsync(cancel <-chan struct{}, input *FsyncIn) (code Status)
 	Fallocate(cancel <-chan struct{}, input *FallocateIn) (code Status)
 
+	// Ioctl handles ioctl(2) on an open file. inbuf holds the
+	// input argument (input.InSize bytes), and the reply data is
+	// bufOut, which has input.OutSize bytes. The return value of
+	// ioctl(2) is output.Result. For regular files, the kernel
+	// sizes the buffers from input.Cmd (see IoctlSize); for
+	// unrestricted ioctls, see IoctlRetrier.
+	Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) (code Status)
+
 	// Directory handling
 	OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
 	ReadDir(cancel <-chan struct{}, input *ReadIn, out *DirEntryList) Status
@@ -342,4 +476,48 @@ type RawFileSystem interface {
 	// filesystem implementation can use the server argument to
 	// talk back to the kernel (through notify methods).
 	Init(*Server)
+
+	// OnUnmount is called by Serve after the file system was
+	// unmounted and all requests were handled.
+	OnUnmount()
+}
+
+// BatchForgetter may be implemented by a RawFileSystem to handle the
+// forgets of a BATCH_FORGET request in one call, rather than with a
+// Forget call for each node. The kernel sends these batches with up
+// to thousands of entries when it drops its caches.
+type BatchForgetter interface {
+	BatchForget(forgets []ForgetOne)
+}
+
+// WriteFder is implemented by file systems that can take the data of
+// a WRITE as a file descriptor. If EnableSpliceWrite is set and
+// WriteFd returns true, the server splices the data from the kernel
+// straight into fd at input.Offset, without a call to Write. If the
+// splice fails or falls short, the rest of the data is passed to
+// Write as usual.
+type WriteFder interface {
+	WriteFd(cancel <-chan struct{}, input *WriteIn) (fd int, ok bool)
+}
+
+// IoctlRetrier may be implemented by a RawFileSystem that serves
+// unrestricted ioctls (CUSE only) whose arguments the command number
+// does not describe, eg. because they hold pointers. IoctlIovecs
+// returns the buffers of the caller to copy in and out. If they are
+// larger than what the kernel sent, it retries the ioctl with them,
+// and inbuf then holds the in buffers back to back, so the buffers
+// of a following retry can depend on it. Returning no buffers uses
+// the sizes encoded in input.Cmd.
+type IoctlRetrier interface {
+	IoctlIovecs(cancel <-chan struct{}, input *IoctlIn, inbuf []byte) (in, out []IoctlIovec)
+}
+
+// HandleOrphaner may be implemented by a RawFileSystem to clean up
+// the handles that the kernel did not release in time. Server.Unmount
+// calls OrphanHandles if it detached a direct mount, as files in it
+// were still open. The kernel then releases the handles only once
+// they are closed, if at all, as it may drop the RELEASE requests
+// when the mount finally goes away.
+type HandleOrphaner interface {
+	OrphanHandles()
 }
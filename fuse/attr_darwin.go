@@ -24,3 +24,20 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Gid = uint32(s.Gid)
 	a.Rdev = uint32(s.Rdev)
 }
+
+// FromAttr sets the basic fields of statx from 'a'.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.Mode = uint16(a.Mode)
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: a.Atime, Nsec: a.Atimensec}
+	s.Ctime = SxTime{Sec: a.Ctime, Nsec: a.Ctimensec}
+	s.Mtime = SxTime{Sec: a.Mtime, Nsec: a.Mtimensec}
+	s.RdevMajor = a.Rdev >> 24
+	s.RdevMinor = a.Rdev & 0xffffff
+}
@@ -6,6 +6,8 @@ package fuse
 
 import (
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func (a *Attr) FromStat(s *syscall.Stat_t) {
@@ -25,3 +27,44 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Rdev = uint32(s.Rdev)
 	a.Blksize = uint32(s.Blksize)
 }
+
+// FromStatx sets statx from the result of unix.Statx.
+func (s *Statx) FromStatx(st *unix.Statx_t) {
+	s.Mask = st.Mask
+	s.Blksize = st.Blksize
+	s.Attributes = st.Attributes
+	s.Nlink = st.Nlink
+	s.Uid = st.Uid
+	s.Gid = st.Gid
+	s.Mode = st.Mode
+	s.Ino = st.Ino
+	s.Size = st.Size
+	s.Blocks = st.Blocks
+	s.AttributesMask = st.Attributes_mask
+	s.Atime = SxTime{Sec: uint64(st.Atime.Sec), Nsec: st.Atime.Nsec}
+	s.Btime = SxTime{Sec: uint64(st.Btime.Sec), Nsec: st.Btime.Nsec}
+	s.Ctime = SxTime{Sec: uint64(st.Ctime.Sec), Nsec: st.Ctime.Nsec}
+	s.Mtime = SxTime{Sec: uint64(st.Mtime.Sec), Nsec: st.Mtime.Nsec}
+	s.RdevMajor = st.Rdev_major
+	s.RdevMinor = st.Rdev_minor
+	s.DevMajor = st.Dev_major
+	s.DevMinor = st.Dev_minor
+}
+
+// FromAttr sets the basic fields of statx from 'a'.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS
+	s.Blksize = a.Blksize
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.Mode = uint16(a.Mode)
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: a.Atime, Nsec: a.Atimensec}
+	s.Ctime = SxTime{Sec: a.Ctime, Nsec: a.Ctimensec}
+	s.Mtime = SxTime{Sec: a.Mtime, Nsec: a.Mtimensec}
+	s.RdevMajor = a.Rdev >> 8 & 0xfff
+	s.RdevMinor = a.Rdev&0xff | a.Rdev>>12&0xfff00
+}
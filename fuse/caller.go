@@ -0,0 +1,77 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// groupsCacheTTL is how long the groups of a process are cached, to
+// save reading them for each request of a busy process.
+const groupsCacheTTL = time.Second
+
+// groupsCacheMax bounds the number of cached processes.
+const groupsCacheMax = 1024
+
+type groupsCacheEntry struct {
+	groups []uint32
+	expiry time.Time
+}
+
+var groupsCache = struct {
+	mu      sync.Mutex
+	entries map[Caller]groupsCacheEntry
+}{entries: map[Caller]groupsCacheEntry{}}
+
+// Groups returns the supplementary groups of the calling process. On
+// Linux, they are read from /proc/<pid>/status, which requires the
+// server to see the PID namespace of the mount. The kernel only
+// passes supplementary groups in requests from protocol version
+// 7.39, and then only one of them for creating files, so it is not
+// a replacement.
+//
+// The result is cached per process for a second. If the process has
+// already exited, or Pid is 0 as for requests that the kernel makes
+// on its own behalf, it returns syscall.ESRCH.
+//
+// The groups are a snapshot: the process may change its credentials
+// after the request was sent, or while it is served, and a recycled
+// PID may name another process. Access decisions based on them are
+// subject to these races; for security, prefer mounting with the
+// kernel's "default_permissions" option.
+func (c *Caller) Groups() ([]uint32, error) {
+	if c.Pid == 0 {
+		return nil, syscall.ESRCH
+	}
+	now := time.Now()
+	groupsCache.mu.Lock()
+	e, ok := groupsCache.entries[*c]
+	groupsCache.mu.Unlock()
+	if ok && now.Before(e.expiry) {
+		return e.groups, nil
+	}
+
+	groups, err := readGroups(c.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	groupsCache.mu.Lock()
+	defer groupsCache.mu.Unlock()
+	if len(groupsCache.entries) >= groupsCacheMax {
+		for k, e := range groupsCache.entries {
+			if !now.Before(e.expiry) {
+				delete(groupsCache.entries, k)
+			}
+		}
+		if len(groupsCache.entries) >= groupsCacheMax {
+			groupsCache.entries = map[Caller]groupsCacheEntry{}
+		}
+	}
+	groupsCache.entries[*c] = groupsCacheEntry{groups, now.Add(groupsCacheTTL)}
+	return groups, nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import "syscall"
+
+// readGroups is not implemented on darwin.
+func readGroups(pid uint32) ([]uint32, error) {
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// readGroups parses the "Groups:" line of /proc/<pid>/status.
+func readGroups(pid uint32) ([]uint32, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if os.IsNotExist(err) {
+		return nil, syscall.ESRCH
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefix := []byte("Groups:")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		fields := bytes.Fields(line[len(prefix):])
+		groups := make([]uint32, 0, len(fields))
+		for _, field := range fields {
+			g, err := strconv.ParseUint(string(field), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("/proc/%d/status: bad group %q", pid, field)
+			}
+			groups = append(groups, uint32(g))
+		}
+		return groups, nil
+	}
+	if err := scanner.Err(); err != nil {
+		// Reading the status of a process that exited after
+		// the open fails with ESRCH.
+		if errors.Is(err, syscall.ESRCH) {
+			return nil, syscall.ESRCH
+		}
+		return nil, err
+	}
+	return nil, fmt.Errorf("/proc/%d/status: no Groups line", pid)
+}
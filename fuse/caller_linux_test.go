@@ -0,0 +1,57 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+func TestCallerGroups(t *testing.T) {
+	want, err := os.Getgroups()
+	if err != nil {
+		t.Fatalf("Getgroups: %v", err)
+	}
+	c := &Caller{
+		Owner: Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+		Pid:   uint32(os.Getpid()),
+	}
+	groups, err := c.Groups()
+	if err != nil {
+		t.Fatalf("Groups: %v", err)
+	}
+	var got []int
+	for _, g := range groups {
+		got = append(got, int(g))
+	}
+	sort.Ints(got)
+	sort.Ints(want)
+	if len(got) != len(want) {
+		t.Fatalf("got groups %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got groups %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCallerGroupsExited(t *testing.T) {
+	if _, err := (&Caller{}).Groups(); err != syscall.ESRCH {
+		t.Errorf("Groups for pid 0: got %v, want ESRCH", err)
+	}
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	c := &Caller{Pid: uint32(cmd.Process.Pid)}
+	if _, err := c.Groups(); err != syscall.ESRCH {
+		t.Errorf("Groups for exited process: got %v, want ESRCH", err)
+	}
+}
@@ -15,7 +15,8 @@ import (
 // interface.
 //
 // When a FUSE request is canceled, the API routine should respond by
-// returning the EINTR status code.
+// returning the EINTR status code. The server replies EINTR to
+// canceled requests that fail with any other code.
 type Context struct {
 	Caller
 	Cancel <-chan struct{}
@@ -0,0 +1,189 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+)
+
+// CuseDevice is a character device that is implemented in user space
+// through CUSE (Linux only). The requests are those of RawFileSystem
+// for open files. The NodeId of the requests is always 0.
+type CuseDevice interface {
+	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
+	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
+	Write(cancel <-chan struct{}, input *WriteIn, data []byte) (written uint32, code Status)
+	Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) (code Status)
+
+	// Poll is as RawFileSystem.Poll. Wake up waiters with
+	// Server.PollNotify.
+	Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status
+	Release(cancel <-chan struct{}, input *ReleaseIn)
+}
+
+// CuseOptions describes the device that NewCuseServer creates.
+type CuseOptions struct {
+	// Of the MountOptions, those for the request loop, such as
+	// MaxWrite, Debug and SingleThreaded, apply to devices.
+	MountOptions
+
+	// DevName is the name of the device. Usually, udev creates
+	// it as /dev/DevName.
+	DevName string
+
+	// DevMajor and DevMinor are the device number. If DevMajor
+	// is 0, the kernel picks one.
+	DevMajor uint32
+	DevMinor uint32
+
+	// If set, ioctls are unrestricted: the kernel does not derive
+	// the sizes of their arguments from the command number, see
+	// IoctlRetrier.
+	UnrestrictedIoctl bool
+}
+
+// NewCuseServer creates the character device described by opts,
+// served by dev. Like a mounted file system, the device is served by
+// Serve, and removed with Unmount or when the process exits. Opening
+// /dev/cuse usually needs root.
+func NewCuseServer(dev CuseDevice, opts *CuseOptions) (*Server, error) {
+	if opts.DevName == "" || strings.ContainsAny(opts.DevName, "/\x00") ||
+		len("DEVNAME=")+len(opts.DevName) >= CUSE_INIT_INFO_MAX {
+		return nil, fmt.Errorf("invalid device name %q", opts.DevName)
+	}
+	mo := opts.MountOptions
+	// The device answers poll requests itself, and there is no
+	// mount to run the poll hack on.
+	mo.EnablePoll = true
+	ms, err := newServer(&cuseRawFileSystem{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		dev:           dev,
+	}, &mo)
+	if err != nil {
+		return nil, err
+	}
+	o := *opts
+	ms.cuse = &o
+
+	fd, err := syscall.Open("/dev/cuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/cuse: %v", err)
+	}
+	if err := ms.start(fd); err != nil {
+		return nil, err
+	}
+	ms.ready <- nil
+	return ms, nil
+}
+
+// cuseUnmount aborts the connection of a CUSE device, which removes
+// the device, and waits for Serve to return.
+func (ms *Server) cuseUnmount() error {
+	abort := "/sys/class/cuse/" + ms.cuse.DevName + "/abort"
+	if err := ioutil.WriteFile(abort, []byte("1"), 0); err != nil {
+		return err
+	}
+	ms.loops.Wait()
+	ms.serving.Wait()
+	ms.cuse = nil
+	return nil
+}
+
+func doCuseInit(server *Server, req *request) {
+	input := (*_CuseInitIn)(req.inData)
+	if input.Major != _FUSE_KERNEL_VERSION {
+		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, _FUSE_KERNEL_VERSION)
+		req.status = EIO
+		return
+	}
+	if input.Minor < _MINIMUM_MINOR_VERSION {
+		log.Printf("Minor version is less than we support. Given %d, want at least %d\n", input.Minor, _MINIMUM_MINOR_VERSION)
+		req.status = EIO
+		return
+	}
+
+	dev := server.cuse
+	out := (*_CuseInitOut)(req.outData())
+	*out = _CuseInitOut{
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _OUR_MINOR_VERSION,
+		MaxRead:  uint32(server.opts.MaxWrite),
+		MaxWrite: uint32(server.opts.MaxWrite),
+		DevMajor: dev.DevMajor,
+		DevMinor: dev.DevMinor,
+	}
+	if out.Minor > input.Minor {
+		out.Minor = input.Minor
+	}
+	if dev.UnrestrictedIoctl {
+		out.Flags |= CUSE_UNRESTRICTED_IOCTL
+	}
+
+	server.reqMu.Lock()
+	// The CUSE flags are not CAP_* flags.
+	server.kernelSettings = InitIn{
+		InHeader: input.InHeader,
+		Major:    input.Major,
+		Minor:    input.Minor,
+	}
+	server.negotiated = InitOut{
+		Major:    out.Major,
+		Minor:    out.Minor,
+		MaxWrite: out.MaxWrite,
+	}
+	if input.Minor >= 13 {
+		server.setSplice()
+	}
+	server.reqMu.Unlock()
+
+	req.flatData = []byte("DEVNAME=" + dev.DevName + "\x00")
+	req.status = OK
+}
+
+// cuseRawFileSystem serves a CuseDevice.
+type cuseRawFileSystem struct {
+	RawFileSystem
+
+	dev CuseDevice
+}
+
+func (fs *cuseRawFileSystem) String() string {
+	return "cuse"
+}
+
+func (fs *cuseRawFileSystem) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	return fs.dev.Open(cancel, input, out)
+}
+
+func (fs *cuseRawFileSystem) Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status) {
+	return fs.dev.Read(cancel, input, buf)
+}
+
+func (fs *cuseRawFileSystem) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (uint32, Status) {
+	return fs.dev.Write(cancel, input, data)
+}
+
+func (fs *cuseRawFileSystem) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) Status {
+	return fs.dev.Ioctl(cancel, input, inbuf, output, bufOut)
+}
+
+func (fs *cuseRawFileSystem) IoctlIovecs(cancel <-chan struct{}, input *IoctlIn, inbuf []byte) (in, out []IoctlIovec) {
+	if r, ok := fs.dev.(IoctlRetrier); ok {
+		return r.IoctlIovecs(cancel, input, inbuf)
+	}
+	return nil, nil
+}
+
+func (fs *cuseRawFileSystem) Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status {
+	return fs.dev.Poll(cancel, in, out)
+}
+
+func (fs *cuseRawFileSystem) Release(cancel <-chan struct{}, input *ReleaseIn) {
+	fs.dev.Release(cancel, input)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// echoDevice reads back what was written to it.
+type echoDevice struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (d *echoDevice) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	out.OpenFlags = FOPEN_DIRECT_IO | FOPEN_NONSEEKABLE
+	return OK
+}
+
+func (d *echoDevice) Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := copy(buf, d.data)
+	d.data = d.data[n:]
+	return ReadResultData(buf[:n]), OK
+}
+
+func (d *echoDevice) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (uint32, Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data = append(d.data, data...)
+	return uint32(len(data)), OK
+}
+
+func (d *echoDevice) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) Status {
+	return Status(syscall.ENOTTY)
+}
+
+func (d *echoDevice) Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status {
+	return ENOSYS
+}
+
+func (d *echoDevice) Release(cancel <-chan struct{}, input *ReleaseIn) {
+}
+
+// cuseDevNode returns a path to the device node of the CUSE device
+// name. Without udev, it creates one in dir.
+func cuseDevNode(t *testing.T, dir, name string) string {
+	path := "/dev/" + name
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	content, err := ioutil.ReadFile("/sys/class/cuse/" + name + "/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(content)), "%d:%d", &major, &minor); err != nil {
+		t.Fatalf("parse %q: %v", content, err)
+	}
+	path = dir + "/" + name
+	if err := syscall.Mknod(path, syscall.S_IFCHR|0600, int(unix.Mkdev(major, minor))); err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+	return path
+}
+
+func TestCuse(t *testing.T) {
+	fd, err := syscall.Open("/dev/cuse", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("cannot open /dev/cuse: %v", err)
+	}
+	syscall.Close(fd)
+
+	name := fmt.Sprintf("go-fuse-test-%d", os.Getpid())
+	srv, err := NewCuseServer(&echoDevice{}, &CuseOptions{DevName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer func() {
+		if err := srv.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+	}()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.OpenFile(cuseDevNode(t, dir, name), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 100)
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("Read: got %q, %v, want %q", buf[:n], err, "hello")
+	}
+}
@@ -19,6 +19,9 @@ type defaultRawFileSystem struct{}
 func (fs *defaultRawFileSystem) Init(*Server) {
 }
 
+func (fs *defaultRawFileSystem) OnUnmount() {
+}
+
 func (fs *defaultRawFileSystem) String() string {
 	return os.Args[0]
 }
@@ -105,6 +108,10 @@ func (fs *defaultRawFileSystem) Create(cancel <-chan struct{}, input *CreateIn,
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status) {
 	return ENOSYS
 }
@@ -159,10 +166,22 @@ func (fs *defaultRawFileSystem) Fallocate(cancel <-chan struct{}, in *FallocateI
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) (code Status) {
+	return ENOTTY
+}
+
 func (fs *defaultRawFileSystem) CopyFileRange(cancel <-chan struct{}, input *CopyFileRangeIn) (written uint32, code Status) {
 	return 0, ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Statx(cancel <-chan struct{}, in *StatxIn, out *StatxOut) Status {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status {
 	return ENOSYS
 }
+
+func (fs *defaultRawFileSystem) Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status {
+	return ENOSYS
+}
@@ -68,34 +68,57 @@ func (l *DirEntryList) AddDirEntry(e DirEntry) bool {
 // Add adds a direntry to the DirEntryList, returning whether it
 // succeeded.
 func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) bool {
+	dst := l.reserve(prefix, len(name), inode, mode)
+	if dst == nil {
+		return false
+	}
+	copy(dst, name)
+	return true
+}
+
+// AddBytes is like AddDirEntry, but takes the name as a byte slice,
+// so a listing read into a buffer can be added without converting
+// each name to a string. The name is copied.
+func (l *DirEntryList) AddBytes(name []byte, inode uint64, mode uint32) bool {
+	dst := l.reserve(0, len(name), inode, mode)
+	if dst == nil {
+		return false
+	}
+	copy(dst, name)
+	return true
+}
+
+// reserve serializes a _Dirent after 'prefix' bytes, and returns the
+// space for its name, or nil if the entry does not fit.
+func (l *DirEntryList) reserve(prefix int, nameLen int, inode uint64, mode uint32) []byte {
 	if inode == 0 {
 		inode = FUSE_UNKNOWN_INO
 	}
-	padding := (8 - len(name)&7) & 7
-	delta := padding + direntSize + len(name) + prefix
+	padding := (8 - nameLen&7) & 7
+	delta := padding + direntSize + nameLen + prefix
 	oldLen := len(l.buf)
 	newLen := delta + oldLen
 
 	if newLen > l.size {
-		return false
+		return nil
 	}
 	l.buf = l.buf[:newLen]
 	oldLen += prefix
 	dirent := (*_Dirent)(unsafe.Pointer(&l.buf[oldLen]))
 	dirent.Off = l.offset + 1
 	dirent.Ino = inode
-	dirent.NameLen = uint32(len(name))
+	dirent.NameLen = uint32(nameLen)
 	dirent.Typ = modeToType(mode)
 	oldLen += direntSize
-	copy(l.buf[oldLen:], name)
-	oldLen += len(name)
+	name := l.buf[oldLen : oldLen+nameLen]
+	oldLen += nameLen
 
 	if padding > 0 {
 		copy(l.buf[oldLen:], eightPadding[:padding])
 	}
 
 	l.offset = dirent.Off
-	return true
+	return name
 }
 
 // AddDirLookupEntry is used for ReadDirPlus. If reserves and zeroizes space
@@ -0,0 +1,106 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestIoctlDirection(t *testing.T) {
+	for _, tc := range []struct {
+		cmd       uint32
+		dir, size uint32
+	}{
+		{0x5401, IOC_NONE, 0},                  // TCGETS, _IO
+		{0x80086601, IOC_READ, 8},              // FS_IOC_GETFLAGS, _IOR('f', 1, long)
+		{0x40086602, IOC_WRITE, 8},             // FS_IOC_SETFLAGS, _IOW('f', 2, long)
+		{0xc0306201, IOC_READ | IOC_WRITE, 48}, // _IOWR('b', 1, [48]byte)
+	} {
+		if got := IoctlDirection(tc.cmd); got != tc.dir {
+			t.Errorf("IoctlDirection(%#x): got %d, want %d", tc.cmd, got, tc.dir)
+		}
+		if got := IoctlSize(tc.cmd); got != tc.size {
+			t.Errorf("IoctlSize(%#x): got %d, want %d", tc.cmd, got, tc.size)
+		}
+	}
+}
+
+// ioctlPtrFS answers an ioctl whose argument is the address of a
+// buffer, preceded by its length.
+type ioctlPtrFS struct {
+	RawFileSystem
+
+	got []byte
+}
+
+func (fs *ioctlPtrFS) IoctlIovecs(cancel <-chan struct{}, input *IoctlIn, inbuf []byte) (in, out []IoctlIovec) {
+	in = []IoctlIovec{{Base: input.Arg, Len: 16}}
+	if len(inbuf) < 16 {
+		return in, nil
+	}
+	ptr := binary.LittleEndian.Uint64(inbuf)
+	n := binary.LittleEndian.Uint64(inbuf[8:])
+	return append(in, IoctlIovec{Base: ptr, Len: n}), nil
+}
+
+func (fs *ioctlPtrFS) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, bufOut []byte) Status {
+	fs.got = append([]byte{}, inbuf[16:]...)
+	output.Result = int32(len(fs.got))
+	return OK
+}
+
+// TestIoctlRetry drives an unrestricted ioctl through the retries the
+// kernel would do.
+func TestIoctlRetry(t *testing.T) {
+	fs := &ioctlPtrFS{RawFileSystem: NewDefaultRawFileSystem()}
+	server := &Server{fileSystem: fs}
+	call := func(in *IoctlIn, arg []byte) (*request, *IoctlOut) {
+		req := &request{
+			inHeader: &in.InHeader,
+			inData:   unsafe.Pointer(in),
+			arg:      arg,
+		}
+		doIoctl(server, req)
+		if !req.status.Ok() {
+			t.Fatalf("doIoctl: %v", req.status)
+		}
+		return req, (*IoctlOut)(req.outData())
+	}
+	iovecs := func(req *request, out *IoctlOut) []IoctlIovec {
+		if out.Flags&FUSE_IOCTL_RETRY == 0 {
+			t.Fatalf("got flags %x, want FUSE_IOCTL_RETRY", out.Flags)
+		}
+		var iovs []IoctlIovec
+		sz := int(unsafe.Sizeof(IoctlIovec{}))
+		for i := 0; i < int(out.InIovs+out.OutIovs); i++ {
+			iovs = append(iovs, *(*IoctlIovec)(unsafe.Pointer(&req.flatData[i*sz])))
+		}
+		return iovs
+	}
+
+	in := &IoctlIn{Flags: FUSE_IOCTL_UNRESTRICTED, Cmd: 0x4242, Arg: 0x1000}
+	got := iovecs(call(in, nil))
+	if want := []IoctlIovec{{0x1000, 16}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first retry: got %v, want %v", got, want)
+	}
+
+	arg := make([]byte, 16)
+	binary.LittleEndian.PutUint64(arg, 0x2000)
+	binary.LittleEndian.PutUint64(arg[8:], 5)
+	in.InSize = 16
+	got = iovecs(call(in, arg))
+	if want := []IoctlIovec{{0x1000, 16}, {0x2000, 5}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second retry: got %v, want %v", got, want)
+	}
+
+	in.InSize = 21
+	_, out := call(in, append(arg, "hello"...))
+	if out.Flags != 0 || out.Result != 5 || string(fs.got) != "hello" {
+		t.Errorf("got flags %x, result %d, data %q", out.Flags, out.Result, fs.got)
+	}
+}
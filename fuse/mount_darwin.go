@@ -86,10 +86,19 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	return fd, err
 }
 
+// fusermountHelper is not used on darwin, which has no
+// "auto_unmount".
+type fusermountHelper struct{}
+
 func unmount(dir string, opts *MountOptions) error {
 	return syscall.Unmount(dir, 0)
 }
 
+// detach is not implemented on darwin.
+func detach(dir string, opts *MountOptions) error {
+	return syscall.ENOTSUP
+}
+
 func getConnection(local *os.File) (int, error) {
 	var data [4]byte
 	control := make([]byte, 4*256)
@@ -27,37 +27,83 @@ func unixgramSocketpair() (l, r *os.File, err error) {
 	return
 }
 
-// Create a FUSE FS on the specified mount point without using
-// fusermount.
-func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
-	fd, err = syscall.Open("/dev/fuse", os.O_RDWR, 0) // use syscall.Open since we want an int fd
-	if err != nil {
-		return
-	}
+// mountFlags maps the generic mount options, which fusermount
+// handles itself, to mount(2) flags. The kernel rejects them in the
+// data string.
+var mountFlags = map[string]struct {
+	set   bool
+	flags uintptr
+}{
+	"rw":      {false, syscall.MS_RDONLY},
+	"ro":      {true, syscall.MS_RDONLY},
+	"suid":    {false, syscall.MS_NOSUID},
+	"nosuid":  {true, syscall.MS_NOSUID},
+	"dev":     {false, syscall.MS_NODEV},
+	"nodev":   {true, syscall.MS_NODEV},
+	"exec":    {false, syscall.MS_NOEXEC},
+	"noexec":  {true, syscall.MS_NOEXEC},
+	"async":   {false, syscall.MS_SYNCHRONOUS},
+	"sync":    {true, syscall.MS_SYNCHRONOUS},
+	"atime":   {false, syscall.MS_NOATIME},
+	"noatime": {true, syscall.MS_NOATIME},
+	"dirsync": {true, syscall.MS_DIRSYNC},
+}
 
-	// managed to open dev/fuse, attempt to mount
-	source := opts.FsName
+// directMountArgs returns the arguments for mount(2) that mount the
+// FUSE connection fd, like fusermount does.
+func directMountArgs(opts *MountOptions, fd int) (source, fstype string, flags uintptr, data string) {
+	source = opts.FsName
 	if source == "" {
 		source = opts.Name
 	}
+	fstype = "fuse." + opts.Name
 
-	var flags uintptr
-	flags |= syscall.MS_NOSUID | syscall.MS_NODEV
+	flags = opts.DirectMountFlags
+	if flags == 0 {
+		flags = syscall.MS_NOSUID | syscall.MS_NODEV
+	}
 
-	// some values we need to pass to mount, but override possible since opts.Options comes after
-	var r = []string{
+	// Options can override these, as they come later.
+	r := []string{
 		fmt.Sprintf("fd=%d", fd),
 		"rootmode=40000",
-		"user_id=0",
-		"group_id=0",
+		fmt.Sprintf("user_id=%d", os.Getuid()),
+		fmt.Sprintf("group_id=%d", os.Getgid()),
+	}
+	for _, o := range opts.Options {
+		if f, ok := mountFlags[o]; ok {
+			if f.set {
+				flags |= f.flags
+			} else {
+				flags &^= f.flags
+			}
+		} else if strings.HasPrefix(o, "fsname=") {
+			source = strings.TrimPrefix(o, "fsname=")
+		} else if strings.HasPrefix(o, "subtype=") {
+			fstype = "fuse." + strings.TrimPrefix(o, "subtype=")
+		} else {
+			r = append(r, o)
+		}
 	}
-	r = append(r, opts.Options...)
-
 	if opts.AllowOther {
 		r = append(r, "allow_other")
 	}
+	return source, fstype, flags, strings.Join(r, ",")
+}
+
+// Create a FUSE FS on the specified mount point without using
+// fusermount.
+func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
+	fd, err = syscall.Open("/dev/fuse", os.O_RDWR|syscall.O_CLOEXEC, 0) // use syscall.Open since we want an int fd
+	if err != nil {
+		return
+	}
 
-	err = syscall.Mount(opts.FsName, mountPoint, "fuse."+opts.Name, opts.DirectMountFlags, strings.Join(r, ","))
+	source, fstype, flags, data := directMountArgs(opts, fd)
+	if opts.Debug {
+		log.Printf("mountDirect: mount(%q, %q, %q, %#x, %q)", source, mountPoint, fstype, flags, data)
+	}
+	err = syscall.Mount(source, mountPoint, fstype, flags, data)
 	if err != nil {
 		syscall.Close(fd)
 		return
@@ -68,23 +114,47 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	return
 }
 
+// fusermountHelper is a fusermount process that was started with
+// "auto_unmount". It keeps running after passing us the file
+// descriptor, and unmounts the file system once the socket conn is
+// closed. The Server owns conn: Unmount closes it with close() once
+// the file system is unmounted. If the process exits without
+// unmounting, the kernel closes conn, and fusermount unmounts.
+type fusermountHelper struct {
+	conn *os.File
+	proc *os.Process
+}
+
+// close closes the socket to fusermount, and waits for it to exit.
+func (h *fusermountHelper) close() {
+	h.conn.Close()
+	h.proc.Wait()
+}
+
 // callFusermount calls the `fusermount` suid helper with the right options so
 // that it:
 // * opens `/dev/fuse`
 // * mount()s this file descriptor to `mountPoint`
 // * passes this file descriptor back to us via a unix domain socket
-// This file descriptor is returned as `fd`.
+// This file descriptor is returned as `fd`. With "auto_unmount",
+// the still running fusermount is stored in opts.fusermount.
 func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 	local, remote, err := unixgramSocketpair()
 	if err != nil {
 		return
 	}
 
-	defer local.Close()
+	autoUnmount := opts.hasOption("auto_unmount")
+	if !autoUnmount {
+		defer local.Close()
+	}
 	defer remote.Close()
 
 	bin, err := fusermountBinary()
 	if err != nil {
+		if autoUnmount {
+			local.Close()
+		}
 		return 0, err
 	}
 
@@ -102,9 +172,28 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, remote}})
 
 	if err != nil {
+		if autoUnmount {
+			local.Close()
+		}
 		return
 	}
 
+	if autoUnmount {
+		// fusermount only exits once local is closed, so we
+		// can't wait for it here. Close our copy of the remote
+		// end, so getConnection fails rather than blocks if
+		// fusermount exits without sending the file descriptor.
+		remote.Close()
+		h := &fusermountHelper{conn: local, proc: proc}
+		fd, err = getConnection(local)
+		if err != nil {
+			h.close()
+			return -1, err
+		}
+		opts.fusermount = h
+		return fd, nil
+	}
+
 	w, err := proc.Wait()
 	if err != nil {
 		return
@@ -125,11 +214,21 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 // Create a FUSE FS on the specified mount point.  The returned
 // mount point is always absolute.
 func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
-	if opts.DirectMount {
+	// fusermount implements auto_unmount by staying around, so
+	// it needs fusermount.
+	if opts.DirectMount && !opts.hasOption("auto_unmount") {
 		fd, err := mountDirect(mountPoint, opts, ready)
 		if err == nil {
+			opts.directMounted = true
 			return fd, nil
-		} else if opts.Debug {
+		}
+		// Without CAP_SYS_ADMIN, mount(2) fails with EPERM, and
+		// the fusermount helper may still succeed. Other errors,
+		// eg. a missing /dev/fuse, would fail there too.
+		if err != syscall.EPERM && err != syscall.EACCES {
+			return -1, fmt.Errorf("direct mount: %v", err)
+		}
+		if opts.Debug {
 			log.Printf("mount: failed to do direct mount: %s", err)
 		}
 	}
@@ -157,12 +256,10 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 }
 
 func unmount(mountPoint string, opts *MountOptions) (err error) {
-	if opts.DirectMount {
-		// Attempt to directly unmount, if fails fallback to fusermount method
-		err := syscall.Unmount(mountPoint, 0)
-		if err == nil {
-			return nil
-		}
+	if opts.directMounted {
+		// We mounted it ourselves, so we can unmount it
+		// ourselves.
+		return syscall.Unmount(mountPoint, 0)
 	}
 
 	bin, err := fusermountBinary()
@@ -180,9 +277,24 @@ func unmount(mountPoint string, opts *MountOptions) (err error) {
 		return fmt.Errorf("%s (code %v)\n",
 			errBuf.String(), err)
 	}
+	if err == nil && opts.fusermount != nil {
+		// The auto_unmount helper has nothing left to do.
+		opts.fusermount.close()
+		opts.fusermount = nil
+	}
 	return err
 }
 
+// detach lazily unmounts a direct mount that stays busy: it leaves
+// the namespace now, and the kernel ends the connection once the
+// open files are closed.
+func detach(mountPoint string, opts *MountOptions) error {
+	if !opts.directMounted {
+		return syscall.ENOTSUP
+	}
+	return syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+}
+
 func getConnection(local *os.File) (int, error) {
 	var data [4]byte
 	control := make([]byte, 4*256)
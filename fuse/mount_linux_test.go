@@ -3,8 +3,11 @@ package fuse
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 )
 
 // TestMountDevFd tests the special `/dev/fd/N` mountpoint syntax, where a
@@ -98,3 +101,336 @@ func TestMountMaxWrite(t *testing.T) {
 		})
 	}
 }
+
+// TestNegotiatedSettings checks that the limits in MountOptions are
+// rounded, and reported after INIT.
+func TestNegotiatedSettings(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{
+		MaxWrite:      999*1024 + 1,
+		MaxReadAhead:  5000,
+		MaxBackground: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.NegotiatedSettings()
+	in := srv.KernelSettings()
+	wantWrite := uint32(roundUpToPage(999*1024 + 1))
+	if got.Flags&CAP_MAX_PAGES == 0 {
+		wantWrite = MAX_KERNEL_WRITE
+	} else if want := uint16(wantWrite / uint32(pageSize)); got.MaxPages != want {
+		t.Errorf("MaxPages: got %d, want %d", got.MaxPages, want)
+	}
+	if got.MaxWrite != wantWrite {
+		t.Errorf("MaxWrite: got %d, want %d", got.MaxWrite, wantWrite)
+	}
+	if got, want := srv.readBufferSize(), int(wantWrite)+int(maxInputSize); got != want {
+		t.Errorf("readBufferSize: got %d, want %d", got, want)
+	}
+	wantReadAhead := uint32(roundUpToPage(5000))
+	if in.MaxReadAhead < wantReadAhead {
+		wantReadAhead = in.MaxReadAhead
+	}
+	if got.MaxReadAhead != wantReadAhead {
+		t.Errorf("MaxReadAhead: got %d, want %d", got.MaxReadAhead, wantReadAhead)
+	}
+	if got.MaxBackground != 100 || got.CongestionThreshold != 75 {
+		t.Errorf("got MaxBackground %d, CongestionThreshold %d, want 100, 75",
+			got.MaxBackground, got.CongestionThreshold)
+	}
+}
+
+// TestMountAutoUnmount checks that mounting does not wait for fusermount to
+// exit when it is asked to unmount on our exit, and that Unmount
+// reaps it.
+func TestMountAutoUnmount(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	fs := NewDefaultRawFileSystem()
+	srv, err := NewServer(fs, mnt, &MountOptions{Options: []string{"auto_unmount"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt, &st); err != syscall.ENOSYS {
+		t.Errorf("expected ENOSYS, got %v", err)
+	}
+	h := srv.opts.fusermount
+	if h == nil {
+		t.Fatal("fusermount helper not kept")
+	}
+	if err := srv.Unmount(); err != nil {
+		t.Error(err)
+	}
+	if srv.opts.fusermount != nil {
+		t.Error("fusermount helper still set after Unmount")
+	}
+	if err := syscall.Kill(h.proc.Pid, 0); err != syscall.ESRCH {
+		t.Errorf("fusermount still running after Unmount: %v", err)
+	}
+}
+
+// TestMountAutoUnmountOnExit checks that fusermount unmounts the file
+// system once the socket is closed, like it is when the process
+// exits.
+func TestMountAutoUnmountOnExit(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	var before syscall.Stat_t
+	if err := syscall.Stat(mnt, &before); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewDefaultRawFileSystem()
+	srv, err := NewServer(fs, mnt, &MountOptions{Options: []string{"auto_unmount"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.opts.fusermount.close()
+
+	// The unmount ends the connection, so the server stops.
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running after fusermount exited")
+	}
+
+	var after syscall.Stat_t
+	if err := syscall.Stat(mnt, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Dev != before.Dev {
+		t.Errorf("%s still mounted", mnt)
+	}
+}
+
+func TestDirectMountArgs(t *testing.T) {
+	opts := &MountOptions{
+		Name:       "myfs",
+		FsName:     "source",
+		AllowOther: true,
+		Options:    []string{"ro", "dev", "default_permissions", "subtype=other", "max_read=4096"},
+	}
+	source, fstype, flags, data := directMountArgs(opts, 7)
+	if source != "source" || fstype != "fuse.other" {
+		t.Errorf("got source %q, type %q, want \"source\", \"fuse.other\"", source, fstype)
+	}
+	if want := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID); flags != want {
+		t.Errorf("got flags %#x, want %#x", flags, want)
+	}
+	want := fmt.Sprintf("fd=7,rootmode=40000,user_id=%d,group_id=%d,default_permissions,max_read=4096,allow_other",
+		os.Getuid(), os.Getgid())
+	if data != want {
+		t.Errorf("got data %q, want %q", data, want)
+	}
+
+	opts = &MountOptions{Name: "myfs", DirectMountFlags: syscall.MS_NOEXEC}
+	if source, _, flags, _ := directMountArgs(opts, 7); source != "myfs" || flags != syscall.MS_NOEXEC {
+		t.Errorf("got source %q, flags %#x, want \"myfs\", %#x", source, flags, syscall.MS_NOEXEC)
+	}
+}
+
+// mountInfo returns the per-mount options, the file system type and
+// the source of the mount at mnt, from /proc/self/mountinfo.
+func mountInfo(t *testing.T, mnt string) (opts, fstype, source string, ok bool) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// 36 35 0:42 / /mnt rw,nosuid - fuse.myfs source rw,user_id=0
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[4] != mnt {
+			continue
+		}
+		for i, f := range fields {
+			if f == "-" && i+2 < len(fields) {
+				return fields[5], fields[i+1], fields[i+2], true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+func TestDirectMount(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need CAP_SYS_ADMIN to call mount(2)")
+	}
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{
+		DirectMount: true,
+		FsName:      "directsource",
+		Name:        "directfs",
+		Options:     []string{"ro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.opts.directMounted {
+		t.Errorf("mounted with fusermount")
+	}
+
+	opts, fstype, source, ok := mountInfo(t, mnt)
+	if !ok {
+		t.Fatalf("%s not in /proc/self/mountinfo", mnt)
+	}
+	if fstype != "fuse.directfs" || source != "directsource" {
+		t.Errorf("got type %q, source %q, want \"fuse.directfs\", \"directsource\"", fstype, source)
+	}
+	for _, want := range []string{"ro", "nosuid", "nodev"} {
+		found := false
+		for _, o := range strings.Split(opts, ",") {
+			found = found || o == want
+		}
+		if !found {
+			t.Errorf("got mount options %q, want %q", opts, want)
+		}
+	}
+
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if _, _, _, ok := mountInfo(t, mnt); ok {
+		t.Errorf("%s still mounted", mnt)
+	}
+}
+
+// dirRawFS has a root directory that can be opened.
+type dirRawFS struct {
+	RawFileSystem
+}
+
+func (fs *dirRawFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	out.Mode = S_IFDIR | 0755
+	return OK
+}
+
+func (fs *dirRawFS) OpenDir(cancel <-chan struct{}, in *OpenIn, out *OpenOut) Status {
+	return OK
+}
+
+func TestDirectMountDetach(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need CAP_SYS_ADMIN to call mount(2)")
+	}
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(&dirRawFS{NewDefaultRawFileSystem()}, mnt, &MountOptions{
+		DirectMount: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An open file keeps the mount busy.
+	fd, err := syscall.Open(mnt, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if _, _, _, ok := mountInfo(t, mnt); ok {
+		t.Errorf("%s still mounted", mnt)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Errorf("Fstat after detach: %v", err)
+	}
+
+	syscall.Close(fd)
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server still running after the last user is gone")
+	}
+}
+
+func TestDirectMountFallback(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("mount(2) does not fail for root")
+	}
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{DirectMount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.opts.directMounted {
+		t.Errorf("mount(2) succeeded without privileges")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt, &st); err != syscall.ENOSYS {
+		t.Errorf("expected ENOSYS, got %v", err)
+	}
+	if err := srv.Unmount(); err != nil {
+		t.Error(err)
+	}
+}
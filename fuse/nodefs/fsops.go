@@ -61,6 +61,9 @@ func (c *rawBridge) Init(s *fuse.Server) {
 	c.rootNode.Node().OnMount((*FileSystemConnector)(c))
 }
 
+func (c *rawBridge) OnUnmount() {
+}
+
 func (c *FileSystemConnector) lookupMountUpdate(out *fuse.Attr, mount *fileSystemMount) (node *Inode, code fuse.Status) {
 	code = mount.mountInode.Node().GetAttr(out, nil, nil)
 	if !code.Ok() {
@@ -363,6 +366,10 @@ func (c *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	return code
 }
 
+func (c *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
 func (c *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	if input.Fh != 0 {
 		node := c.toInode(input.NodeId)
@@ -500,6 +507,18 @@ func (c *rawBridge) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRa
 	return 0, fuse.ENOSYS
 }
 
+func (c *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (fs *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	return fuse.ENOSYS
 }
+
+func (fs *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, bufOut []byte) fuse.Status {
+	return fuse.ENOTTY
+}
@@ -10,7 +10,6 @@ import (
 	"log"
 	"reflect"
 	"runtime"
-	"syscall"
 	"time"
 	"unsafe"
 )
@@ -61,6 +60,8 @@ const (
 	_OP_RENAME2         = uint32(45) // protocol version 23.
 	_OP_LSEEK           = uint32(46) // protocol version 24
 	_OP_COPY_FILE_RANGE = uint32(47) // protocol version 28.
+	_OP_TMPFILE         = uint32(51) // protocol version 37.
+	_OP_STATX           = uint32(52) // protocol version 39.
 
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_INVAL_ENTRY    = uint32(100)
@@ -68,8 +69,9 @@ const (
 	_OP_NOTIFY_STORE_CACHE    = uint32(102)
 	_OP_NOTIFY_RETRIEVE_CACHE = uint32(103)
 	_OP_NOTIFY_DELETE         = uint32(104) // protocol version 18
+	_OP_NOTIFY_POLL           = uint32(105)
 
-	_OPCODE_COUNT = uint32(105)
+	_OPCODE_COUNT = uint32(106)
 )
 
 ////////////////////////////////////////////////////////////////
@@ -93,7 +95,31 @@ func doInit(server *Server, req *request) {
 		CAP_READDIRPLUS | CAP_NO_OPEN_SUPPORT | CAP_PARALLEL_DIROPS)
 
 	if server.opts.EnableLocks {
-		server.kernelSettings.Flags |= CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS
+		server.kernelSettings.Flags |= input.Flags & (CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS)
+	}
+
+	if server.opts.EnableIoctlDir {
+		server.kernelSettings.Flags |= input.Flags & CAP_IOCTL_DIR
+	}
+
+	if server.opts.EnableReaddirplusAuto {
+		server.kernelSettings.Flags |= input.Flags & CAP_READDIRPLUS_AUTO
+	}
+
+	if server.opts.EnableWritebackCache {
+		server.kernelSettings.Flags |= input.Flags & CAP_WRITEBACK_CACHE
+	}
+
+	if server.opts.DontMask {
+		server.kernelSettings.Flags |= input.Flags & CAP_DONT_MASK
+	}
+
+	if server.opts.EnableSymlinkCaching {
+		server.kernelSettings.Flags |= input.Flags & CAP_CACHE_SYMLINKS
+	}
+
+	if server.opts.MaxWrite > MAX_KERNEL_WRITE {
+		server.kernelSettings.Flags |= input.Flags & CAP_MAX_PAGES
 	}
 
 	if server.opts.EnableAcl {
@@ -115,10 +141,6 @@ func doInit(server *Server, req *request) {
 		}
 	}
 	server.kernelSettings.Flags |= dataCacheMode
-
-	if input.Minor >= 13 {
-		server.setSplice()
-	}
 	server.reqMu.Unlock()
 
 	out := (*InitOut)(req.outData())
@@ -135,9 +157,24 @@ func doInit(server *Server, req *request) {
 	if server.opts.MaxReadAhead != 0 && uint32(server.opts.MaxReadAhead) < out.MaxReadAhead {
 		out.MaxReadAhead = uint32(server.opts.MaxReadAhead)
 	}
+	if server.opts.MaxWrite > MAX_KERNEL_WRITE {
+		if out.Flags&CAP_MAX_PAGES != 0 {
+			out.MaxPages = uint16(server.opts.MaxWrite / pageSize)
+		} else {
+			out.MaxWrite = MAX_KERNEL_WRITE
+		}
+	}
 	if out.Minor > input.Minor {
 		out.Minor = input.Minor
 	}
+	server.reqMu.Lock()
+	// Buffers for requests are sized from the negotiated
+	// MaxWrite, so set it before setSplice sizes the pipes.
+	server.negotiated = *out
+	if input.Minor >= 13 {
+		server.setSplice()
+	}
+	server.reqMu.Unlock()
 
 	if out.Minor <= 22 {
 		tweaked := *req.handler
@@ -165,6 +202,11 @@ func doCreate(server *Server, req *request) {
 	req.status = status
 }
 
+func doTmpfile(server *Server, req *request) {
+	out := (*CreateOut)(req.outData())
+	req.status = server.fileSystem.Tmpfile(req.cancel, (*CreateIn)(req.inData), out)
+}
+
 func doReadDir(server *Server, req *request) {
 	in := (*ReadIn)(req.inData)
 	buf := server.allocOut(req, in.Size)
@@ -197,7 +239,13 @@ func doSetattr(server *Server, req *request) {
 }
 
 func doWrite(server *Server, req *request) {
-	n, status := server.fileSystem.Write(req.cancel, (*WriteIn)(req.inData), req.arg)
+	var n uint32
+	var status Status
+	if req.inPipe != nil {
+		n, status = server.spliceWrite(req)
+	} else {
+		n, status = server.fileSystem.Write(req.cancel, (*WriteIn)(req.inData), req.arg)
+	}
 	o := (*WriteOut)(req.outData())
 	o.Size = n
 	req.status = status
@@ -265,6 +313,20 @@ func doGetXAttr(server *Server, req *request) {
 	req.flatData = server.allocOut(req, input.Size)
 	out := (*GetXAttrOut)(req.outData())
 
+	if pos := input.position(); pos != 0 && req.inHeader.Opcode == _OP_GETXATTR {
+		var n uint32
+		n, req.status = getXAttrAt(server, req, req.filenames[0], pos, req.flatData)
+		if req.status.Ok() {
+			if len(req.flatData) > 0 {
+				req.flatData = req.flatData[:n]
+			}
+			out.Size = n
+		} else {
+			req.flatData = req.flatData[:0]
+		}
+		return
+	}
+
 	var n uint32
 	switch req.inHeader.Opcode {
 	case _OP_GETXATTR:
@@ -297,6 +359,11 @@ func doGetAttr(server *Server, req *request) {
 	req.status = s
 }
 
+func doStatx(server *Server, req *request) {
+	out := (*StatxOut)(req.outData())
+	req.status = server.fileSystem.Statx(req.cancel, (*StatxIn)(req.inData), out)
+}
+
 // doForget - forget one NodeId
 func doForget(server *Server, req *request) {
 	if !server.opts.RememberInodes {
@@ -307,7 +374,7 @@ func doForget(server *Server, req *request) {
 // doBatchForget - forget a list of NodeIds
 func doBatchForget(server *Server, req *request) {
 	in := (*_BatchForgetIn)(req.inData)
-	wantBytes := uintptr(in.Count) * unsafe.Sizeof(_ForgetOne{})
+	wantBytes := uintptr(in.Count) * unsafe.Sizeof(ForgetOne{})
 	if uintptr(len(req.arg)) < wantBytes {
 		// We have no return value to complain, so log an error.
 		log.Printf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
@@ -320,7 +387,8 @@ func doBatchForget(server *Server, req *request) {
 		Cap:  int(in.Count),
 	}
 
-	forgets := *(*[]_ForgetOne)(unsafe.Pointer(h))
+	forgets := *(*[]ForgetOne)(unsafe.Pointer(h))
+	batch := make([]ForgetOne, 0, len(forgets))
 	for i, f := range forgets {
 		if server.opts.Debug {
 			log.Printf("doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
@@ -329,6 +397,16 @@ func doBatchForget(server *Server, req *request) {
 		if f.NodeId == pollHackInode {
 			continue
 		}
+		batch = append(batch, f)
+	}
+	if server.opts.RememberInodes {
+		return
+	}
+	if bf, ok := server.fileSystem.(BatchForgetter); ok {
+		bf.BatchForget(batch)
+		return
+	}
+	for _, f := range batch {
 		server.fileSystem.Forget(f.NodeId, f.Nlookup)
 	}
 }
@@ -402,7 +480,60 @@ func doFsyncDir(server *Server, req *request) {
 
 func doSetXAttr(server *Server, req *request) {
 	splits := bytes.SplitN(req.arg, []byte{0}, 2)
-	req.status = server.fileSystem.SetXAttr(req.cancel, (*SetXAttrIn)(req.inData), string(splits[0]), splits[1])
+	input := (*SetXAttrIn)(req.inData)
+	if pos := input.position(); pos != 0 {
+		req.status = setXAttrAt(server, req, input, string(splits[0]), pos, splits[1])
+		return
+	}
+	req.status = server.fileSystem.SetXAttr(req.cancel, input, string(splits[0]), splits[1])
+}
+
+// readXAttr reads the whole value of attr.
+func readXAttr(server *Server, req *request, attr string) ([]byte, Status) {
+	sz, st := server.fileSystem.GetXAttr(req.cancel, req.inHeader, attr, nil)
+	if !st.Ok() && st != ERANGE {
+		return nil, st
+	}
+	val := make([]byte, sz)
+	n, st := server.fileSystem.GetXAttr(req.cancel, req.inHeader, attr, val)
+	if !st.Ok() {
+		return nil, st
+	}
+	return val[:n], OK
+}
+
+// getXAttrAt reads attr from offset pos into dest. OSX reads large
+// resource forks in chunks; as the RawFileSystem API has no offset,
+// the whole value is read and the requested part is copied. An empty
+// dest asks for the size of the remainder.
+func getXAttrAt(server *Server, req *request, attr string, pos uint32, dest []byte) (uint32, Status) {
+	val, st := readXAttr(server, req, attr)
+	if !st.Ok() {
+		return 0, st
+	}
+	if pos > uint32(len(val)) {
+		pos = uint32(len(val))
+	}
+	val = val[pos:]
+	if len(dest) == 0 {
+		return uint32(len(val)), OK
+	}
+	return uint32(copy(dest, val)), OK
+}
+
+// setXAttrAt writes data at offset pos into attr, by reading the
+// current value, splicing in data, and writing back the whole value.
+// Like OSX, data written past the end extends the value with zeros.
+func setXAttrAt(server *Server, req *request, input *SetXAttrIn, attr string, pos uint32, data []byte) Status {
+	val, st := readXAttr(server, req, attr)
+	if !st.Ok() {
+		return st
+	}
+	if end := int(pos) + len(data); end > len(val) {
+		val = append(val, make([]byte, end-len(val))...)
+	}
+	copy(val[pos:], data)
+	return server.fileSystem.SetXAttr(req.cancel, input, attr, val)
 }
 
 func doRemoveXAttr(server *Server, req *request) {
@@ -443,10 +574,109 @@ func doStatFs(server *Server, req *request) {
 }
 
 func doIoctl(server *Server, req *request) {
-	req.status = Status(syscall.ENOTTY)
+	in := (*IoctlIn)(req.inData)
+	out := (*IoctlOut)(req.outData())
+
+	var inBuf []byte
+	if int(in.InSize) <= len(req.arg) {
+		inBuf = req.arg[:in.InSize]
+	}
+	if in.Flags&FUSE_IOCTL_UNRESTRICTED != 0 {
+		// The kernel doesn't know the argument sizes, so ask
+		// it to retry with the buffers that the file system
+		// declares, or else that the command number implies,
+		// as it does itself for restricted ioctls.
+		var inIovs, outIovs []IoctlIovec
+		if r, ok := server.fileSystem.(IoctlRetrier); ok {
+			inIovs, outIovs = r.IoctlIovecs(req.cancel, in, inBuf)
+		}
+		if inIovs == nil && outIovs == nil {
+			inSize, outSize := ioctlSizes(in.Cmd)
+			if inSize > 0 {
+				inIovs = []IoctlIovec{{Base: in.Arg, Len: uint64(inSize)}}
+			}
+			if outSize > 0 {
+				outIovs = []IoctlIovec{{Base: in.Arg, Len: uint64(outSize)}}
+			}
+		}
+		if len(inIovs)+len(outIovs) > FUSE_IOCTL_MAX_IOV {
+			req.status = EINVAL
+			return
+		}
+		if uint64(in.InSize) < iovecsLen(inIovs) || uint64(in.OutSize) < iovecsLen(outIovs) {
+			out.Flags = FUSE_IOCTL_RETRY
+			out.InIovs = uint32(len(inIovs))
+			out.OutIovs = uint32(len(outIovs))
+			sz := int(unsafe.Sizeof(IoctlIovec{}))
+			req.flatData = make([]byte, (len(inIovs)+len(outIovs))*sz)
+			for i, iov := range append(inIovs, outIovs...) {
+				*(*IoctlIovec)(unsafe.Pointer(&req.flatData[i*sz])) = iov
+			}
+			req.status = OK
+			return
+		}
+	}
+
+	outBuf := server.allocOut(req, in.OutSize)
+	for i := range outBuf {
+		outBuf[i] = 0
+	}
+	req.status = server.fileSystem.Ioctl(req.cancel, in, inBuf, out, outBuf)
+	if req.status.Ok() {
+		req.flatData = outBuf
+	}
+}
+
+func iovecsLen(iovs []IoctlIovec) uint64 {
+	var n uint64
+	for _, iov := range iovs {
+		n += iov.Len
+	}
+	return n
+}
+
+// Directions of the argument of an ioctl, see IoctlDirection.
+const (
+	IOC_NONE  = 0
+	IOC_WRITE = 1 // from the caller to the file system
+	IOC_READ  = 2 // from the file system to the caller
+)
+
+// IoctlDirection returns the direction of the argument that is
+// encoded in an ioctl command number by the _IO, _IOR, _IOW and
+// _IOWR macros of <asm-generic/ioctl.h>: a combination of IOC_WRITE
+// and IOC_READ.
+func IoctlDirection(cmd uint32) uint32 {
+	return cmd >> 30
+}
+
+// IoctlSize returns the size of the argument that is encoded in an
+// ioctl command number, see IoctlDirection.
+func IoctlSize(cmd uint32) uint32 {
+	return (cmd >> 16) & (1<<14 - 1)
+}
+
+// ioctlSizes decodes the sizes of the argument that the kernel copies
+// in and out from an ioctl command number.
+func ioctlSizes(cmd uint32) (in, out uint32) {
+	size := IoctlSize(cmd)
+	dir := IoctlDirection(cmd)
+	if dir&IOC_WRITE != 0 {
+		in = size
+	}
+	if dir&IOC_READ != 0 {
+		out = size
+	}
+	return in, out
 }
 
 func doDestroy(server *Server, req *request) {
+	// The kernel unmounts once we reply, so give outstanding
+	// RELEASEs a chance. They cannot be handled while this
+	// request holds the lock of SingleThreaded.
+	if !server.opts.SingleThreaded {
+		server.waitReleased()
+	}
 	req.status = OK
 }
 
@@ -472,6 +702,19 @@ func doLseek(server *Server, req *request) {
 	req.status = server.fileSystem.Lseek(req.cancel, in, out)
 }
 
+func doPoll(server *Server, req *request) {
+	if !server.opts.EnablePoll {
+		// The poll hack cannot run for some mounts, eg. on
+		// /dev/fd/N. The kernel remembers ENOSYS, and stops
+		// sending POLL.
+		req.status = ENOSYS
+		return
+	}
+	in := (*PollIn)(req.inData)
+	out := (*PollOut)(req.outData())
+	req.status = server.fileSystem.Poll(req.cancel, in, out)
+}
+
 func doCopyFileRange(server *Server, req *request) {
 	in := (*CopyFileRangeIn)(req.inData)
 	out := (*WriteOut)(req.outData())
@@ -494,7 +737,9 @@ func doInterrupt(server *Server, req *request) {
 		}
 	}
 
-	// not found; wait for a bit
+	// Not found: the request may have been read by another
+	// goroutine that did not register it yet. Wait for a bit, and
+	// reply EAGAIN so the kernel sends the interrupt again.
 	time.Sleep(10 * time.Microsecond)
 	req.status = EAGAIN
 }
@@ -525,7 +770,21 @@ func operationName(op uint32) string {
 	return h.Name
 }
 
+// cuseInitHandler handles CUSE_INIT, which is outside the range of
+// operationHandlers.
+var cuseInitHandler = &operationHandler{
+	Name:       "CUSE_INIT",
+	Func:       doCuseInit,
+	InputSize:  unsafe.Sizeof(_CuseInitIn{}),
+	OutputSize: unsafe.Sizeof(_CuseInitOut{}),
+	DecodeIn:   func(ptr unsafe.Pointer) interface{} { return (*_CuseInitIn)(ptr) },
+	DecodeOut:  func(ptr unsafe.Pointer) interface{} { return (*_CuseInitOut)(ptr) },
+}
+
 func getHandler(o uint32) *operationHandler {
+	if o == CUSE_INIT {
+		return cuseInitHandler
+	}
 	if o >= _OPCODE_COUNT {
 		return nil
 	}
@@ -576,14 +835,16 @@ func init() {
 		_OP_CREATE:          unsafe.Sizeof(CreateIn{}),
 		_OP_INTERRUPT:       unsafe.Sizeof(InterruptIn{}),
 		_OP_BMAP:            unsafe.Sizeof(_BmapIn{}),
-		_OP_IOCTL:           unsafe.Sizeof(_IoctlIn{}),
-		_OP_POLL:            unsafe.Sizeof(_PollIn{}),
+		_OP_IOCTL:           unsafe.Sizeof(IoctlIn{}),
+		_OP_POLL:            unsafe.Sizeof(PollIn{}),
 		_OP_NOTIFY_REPLY:    unsafe.Sizeof(NotifyRetrieveIn{}),
 		_OP_FALLOCATE:       unsafe.Sizeof(FallocateIn{}),
 		_OP_READDIRPLUS:     unsafe.Sizeof(ReadIn{}),
 		_OP_RENAME2:         unsafe.Sizeof(RenameIn{}),
 		_OP_LSEEK:           unsafe.Sizeof(LseekIn{}),
 		_OP_COPY_FILE_RANGE: unsafe.Sizeof(CopyFileRangeIn{}),
+		_OP_TMPFILE:         unsafe.Sizeof(CreateIn{}),
+		_OP_STATX:           unsafe.Sizeof(StatxIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 		if sz > maxInputSize {
@@ -609,15 +870,18 @@ func init() {
 		_OP_GETLK:                 unsafe.Sizeof(LkOut{}),
 		_OP_CREATE:                unsafe.Sizeof(CreateOut{}),
 		_OP_BMAP:                  unsafe.Sizeof(_BmapOut{}),
-		_OP_IOCTL:                 unsafe.Sizeof(_IoctlOut{}),
-		_OP_POLL:                  unsafe.Sizeof(_PollOut{}),
+		_OP_IOCTL:                 unsafe.Sizeof(IoctlOut{}),
+		_OP_POLL:                  unsafe.Sizeof(PollOut{}),
 		_OP_NOTIFY_INVAL_ENTRY:    unsafe.Sizeof(NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INVAL_INODE:    unsafe.Sizeof(NotifyInvalInodeOut{}),
 		_OP_NOTIFY_STORE_CACHE:    unsafe.Sizeof(NotifyStoreOut{}),
 		_OP_NOTIFY_RETRIEVE_CACHE: unsafe.Sizeof(NotifyRetrieveOut{}),
 		_OP_NOTIFY_DELETE:         unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_NOTIFY_POLL:           unsafe.Sizeof(NotifyPollWakeupOut{}),
 		_OP_LSEEK:                 unsafe.Sizeof(LseekOut{}),
 		_OP_COPY_FILE_RANGE:       unsafe.Sizeof(WriteOut{}),
+		_OP_TMPFILE:               unsafe.Sizeof(CreateOut{}),
+		_OP_STATX:                 unsafe.Sizeof(StatxOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
@@ -668,11 +932,14 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    "NOTIFY_STORE",
 		_OP_NOTIFY_RETRIEVE_CACHE: "NOTIFY_RETRIEVE",
 		_OP_NOTIFY_DELETE:         "NOTIFY_DELETE",
+		_OP_NOTIFY_POLL:           "NOTIFY_POLL",
 		_OP_FALLOCATE:             "FALLOCATE",
 		_OP_READDIRPLUS:           "READDIRPLUS",
 		_OP_RENAME2:               "RENAME2",
 		_OP_LSEEK:                 "LSEEK",
 		_OP_COPY_FILE_RANGE:       "COPY_FILE_RANGE",
+		_OP_TMPFILE:               "TMPFILE",
+		_OP_STATX:                 "STATX",
 	} {
 		operationHandlers[op].Name = v
 	}
@@ -720,7 +987,10 @@ func init() {
 		_OP_RENAME2:         doRename2,
 		_OP_INTERRUPT:       doInterrupt,
 		_OP_COPY_FILE_RANGE: doCopyFileRange,
+		_OP_TMPFILE:         doTmpfile,
 		_OP_LSEEK:           doLseek,
+		_OP_POLL:            doPoll,
+		_OP_STATX:           doStatx,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -742,11 +1012,16 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    func(ptr unsafe.Pointer) interface{} { return (*NotifyStoreOut)(ptr) },
 		_OP_NOTIFY_RETRIEVE_CACHE: func(ptr unsafe.Pointer) interface{} { return (*NotifyRetrieveOut)(ptr) },
 		_OP_NOTIFY_DELETE:         func(ptr unsafe.Pointer) interface{} { return (*NotifyInvalDeleteOut)(ptr) },
+		_OP_NOTIFY_POLL:           func(ptr unsafe.Pointer) interface{} { return (*NotifyPollWakeupOut)(ptr) },
 		_OP_STATFS:                func(ptr unsafe.Pointer) interface{} { return (*StatfsOut)(ptr) },
 		_OP_SYMLINK:               func(ptr unsafe.Pointer) interface{} { return (*EntryOut)(ptr) },
 		_OP_GETLK:                 func(ptr unsafe.Pointer) interface{} { return (*LkOut)(ptr) },
 		_OP_LSEEK:                 func(ptr unsafe.Pointer) interface{} { return (*LseekOut)(ptr) },
+		_OP_POLL:                  func(ptr unsafe.Pointer) interface{} { return (*PollOut)(ptr) },
+		_OP_IOCTL:                 func(ptr unsafe.Pointer) interface{} { return (*IoctlOut)(ptr) },
 		_OP_COPY_FILE_RANGE:       func(ptr unsafe.Pointer) interface{} { return (*WriteOut)(ptr) },
+		_OP_TMPFILE:               func(ptr unsafe.Pointer) interface{} { return (*CreateOut)(ptr) },
+		_OP_STATX:                 func(ptr unsafe.Pointer) interface{} { return (*StatxOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -760,7 +1035,7 @@ func init() {
 		_OP_LISTXATTR:       func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
 		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
 		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
-		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*_IoctlIn)(ptr) },
+		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*IoctlIn)(ptr) },
 		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
 		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
 		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
@@ -784,7 +1059,10 @@ func init() {
 		_OP_RENAME2:         func(ptr unsafe.Pointer) interface{} { return (*RenameIn)(ptr) },
 		_OP_INTERRUPT:       func(ptr unsafe.Pointer) interface{} { return (*InterruptIn)(ptr) },
 		_OP_LSEEK:           func(ptr unsafe.Pointer) interface{} { return (*LseekIn)(ptr) },
+		_OP_POLL:            func(ptr unsafe.Pointer) interface{} { return (*PollIn)(ptr) },
 		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*CopyFileRangeIn)(ptr) },
+		_OP_TMPFILE:         func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
+		_OP_STATX:           func(ptr unsafe.Pointer) interface{} { return (*StatxIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -48,7 +48,8 @@ var (
 		CAP_EXPLICIT_INVAL_DATA: "EXPLICIT_INVAL_DATA",
 	}
 	releaseFlagNames = map[int64]string{
-		RELEASE_FLUSH: "FLUSH",
+		RELEASE_FLUSH:        "FLUSH",
+		RELEASE_FLOCK_UNLOCK: "FLOCK_UNLOCK",
 	}
 	openFlagNames = map[int64]string{
 		int64(os.O_WRONLY):        "WRONLY",
@@ -174,6 +175,15 @@ func (o *InitOut) string() string {
 		o.TimeGran, o.MaxPages)
 }
 
+func (in *_CuseInitIn) string() string {
+	return fmt.Sprintf("{%d.%d Flags 0x%x}", in.Major, in.Minor, in.Flags)
+}
+
+func (o *_CuseInitOut) string() string {
+	return fmt.Sprintf("{%d.%d Flags 0x%x Rd %d Wr %d Dev %d:%d}",
+		o.Major, o.Minor, o.Flags, o.MaxRead, o.MaxWrite, o.DevMajor, o.DevMinor)
+}
+
 func (s *FsyncIn) string() string {
 	return fmt.Sprintf("{Fh %d Flags %x}", s.Fh, s.FsyncFlags)
 }
@@ -207,6 +217,17 @@ func (o *AttrOut) string() string {
 		ft(o.AttrValid, o.AttrValidNsec), &o.Attr)
 }
 
+func (in *StatxIn) string() string {
+	return fmt.Sprintf("{Fh %d sx 0x%x mask 0x%x}", in.Fh, in.SxFlags, in.SxMask)
+}
+
+func (o *StatxOut) string() string {
+	return fmt.Sprintf(
+		"{tA=%gs mask 0x%x M0%o SZ=%d L=%d %d:%d i%d B %f}",
+		ft(o.AttrValid, o.AttrValidNsec), o.Mask, o.Mode, o.Size, o.Nlink,
+		o.Uid, o.Gid, o.Ino, ft(o.Btime.Sec, o.Btime.Nsec))
+}
+
 // ft converts (seconds , nanoseconds) -> float(seconds)
 func ft(tsec uint64, tnsec uint32) float64 {
 	return float64(tsec) + float64(tnsec)*1E-9
@@ -293,6 +314,27 @@ func (o *LseekOut) string() string {
 	return fmt.Sprintf("{%d}", o.Offset)
 }
 
+func (in *IoctlIn) string() string {
+	return fmt.Sprintf("{Fh %d cmd 0x%x arg 0x%x flags 0x%x in %d out %d}",
+		in.Fh, in.Cmd, in.Arg, in.Flags, in.InSize, in.OutSize)
+}
+
+func (o *IoctlOut) string() string {
+	return fmt.Sprintf("{result %d flags 0x%x iovs %d/%d}", o.Result, o.Flags, o.InIovs, o.OutIovs)
+}
+
+func (in *PollIn) string() string {
+	return fmt.Sprintf("{Fh %d Kh %d flags 0x%x events 0x%x}", in.Fh, in.Kh, in.Flags, in.Events)
+}
+
+func (o *PollOut) string() string {
+	return fmt.Sprintf("{revents 0x%x}", o.Revents)
+}
+
+func (o *NotifyPollWakeupOut) string() string {
+	return fmt.Sprintf("{Kh %d}", o.Kh)
+}
+
 // Print pretty prints FUSE data types for kernel communication
 func Print(obj interface{}) string {
 	t, ok := obj.(interface {
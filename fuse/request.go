@@ -33,6 +33,10 @@ type request struct {
 
 	filenames []string // filename arguments
 
+	// inPipe holds the data of a WRITE that was read through
+	// splice, see Server.readSplice.
+	inPipe *requestPipe
+
 	// Output data.
 	status   Status
 	flatData []byte
@@ -61,6 +65,9 @@ type request struct {
 
 	// Input, if small enough to fit here.
 	smallInputBuf [128]byte
+
+	// Backing for filenames.
+	filenameBuf [2]string
 }
 
 func (r *request) clear() {
@@ -69,6 +76,7 @@ func (r *request) clear() {
 	r.inData = nil
 	r.arg = nil
 	r.filenames = nil
+	r.filenameBuf = [2]string{}
 	r.status = OK
 	r.flatData = nil
 	r.fdData = nil
@@ -200,14 +208,19 @@ func (r *request) parse() {
 			// SETXATTR is special: the only opcode with a file name AND a
 			// binary argument.
 			splits := bytes.SplitN(r.arg, []byte{0}, 2)
-			r.filenames = []string{string(splits[0])}
+			r.filenameBuf[0] = string(splits[0])
+			r.filenames = r.filenameBuf[:1]
 		} else if count == 1 {
-			r.filenames = []string{string(r.arg[:len(r.arg)-1])}
+			r.filenameBuf[0] = string(r.arg[:len(r.arg)-1])
+			r.filenames = r.filenameBuf[:1]
 		} else {
 			names := bytes.SplitN(r.arg[:len(r.arg)-1], []byte{0}, count)
-			r.filenames = make([]string, len(names))
-			for i, n := range names {
-				r.filenames[i] = string(n)
+			r.filenames = r.filenameBuf[:0]
+			if len(names) > len(r.filenameBuf) {
+				r.filenames = make([]string, 0, len(names))
+			}
+			for _, n := range names {
+				r.filenames = append(r.filenames, string(n))
 			}
 			if len(names) != count {
 				log.Println("filename argument mismatch", names, count)
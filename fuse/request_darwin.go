@@ -4,7 +4,8 @@
 
 package fuse
 
-const outputHeaderSize = 200
+// outputHeaderSize fits the largest reply, the one to STATX.
+const outputHeaderSize = 304
 
 const (
 	_FUSE_KERNEL_VERSION   = 7
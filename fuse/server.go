@@ -21,9 +21,14 @@ import (
 )
 
 const (
-	// The kernel caps writes at 128k.
+	// The kernel caps writes at 128k, unless CAP_MAX_PAGES
+	// (Linux 4.20+) is negotiated.
 	MAX_KERNEL_WRITE = 128 * 1024
 
+	// With CAP_MAX_PAGES, the kernel caps writes at 1M (256
+	// pages).
+	MAX_KERNEL_MAX_PAGES_WRITE = 1024 * 1024
+
 	// Linux kernel constant from include/uapi/linux/fuse.h
 	// Reads from /dev/fuse that are smaller fail with EINVAL.
 	_FUSE_MIN_READ_BUFFER = 8192
@@ -42,6 +47,10 @@ type Server struct {
 	// writeMu serializes close and notify writes
 	writeMu sync.Mutex
 
+	// ring, if set, does the reads and writes of the device,
+	// see MountOptions.EnableIOUring.
+	ring *ioUring
+
 	// I/O with kernel and daemon.
 	mountFd int
 
@@ -65,6 +74,19 @@ type Server struct {
 	reqInflight    []*request
 	kernelSettings InitIn
 
+	// openHandles counts the handles that the kernel holds: those
+	// from successful OPEN, OPENDIR, CREATE and TMPFILE replies,
+	// minus the RELEASE and RELEASEDIR requests. Protected by
+	// reqMu.
+	openHandles int
+
+	// handlesReleased, if set, is closed once openHandles drops
+	// to 0. Protected by reqMu.
+	handlesReleased chan struct{}
+
+	// negotiated holds the INIT reply; protected by reqMu.
+	negotiated InitOut
+
 	// in-flight notify-retrieve queries
 	retrieveMu   sync.Mutex
 	retrieveNext uint64
@@ -72,7 +94,16 @@ type Server struct {
 
 	singleReader bool
 	canSplice    bool
-	loops        sync.WaitGroup
+	// cuse is set for a CUSE device, see NewCuseServer.
+	cuse *CuseOptions
+
+	// inPipeSize, if set, is the size of the pipes that requests
+	// are read through, see MountOptions.EnableSpliceWrite.
+	inPipeSize int
+	loops      sync.WaitGroup
+
+	// serving is held until Serve has called OnUnmount.
+	serving sync.WaitGroup
 
 	ready chan error
 
@@ -97,6 +128,27 @@ func (ms *Server) KernelSettings() *InitIn {
 	return &s
 }
 
+// NegotiatedSettings returns the INIT reply that was sent to the
+// kernel. It holds the effective limits, such as MaxWrite,
+// MaxReadAhead and MaxBackground, which can be lower than the values
+// in MountOptions if the kernel does not support them. It is zero
+// before the kernel has sent INIT, ie. before WaitMount returns.
+func (ms *Server) NegotiatedSettings() *InitOut {
+	ms.reqMu.Lock()
+	s := ms.negotiated
+	ms.reqMu.Unlock()
+
+	return &s
+}
+
+// roundUpToPage rounds sz up to a multiple of the page size.
+func roundUpToPage(sz int) int {
+	if rem := sz % pageSize; rem != 0 {
+		sz += pageSize - rem
+	}
+	return sz
+}
+
 const _MAX_NAME_LEN = 20
 
 // This type may be provided for recording latencies of each FUSE
@@ -105,6 +157,13 @@ type LatencyMap interface {
 	Add(name string, dt time.Duration)
 }
 
+// StatusMap may be implemented by the LatencyMap passed to
+// RecordLatencies to also record the status each request was
+// answered with.
+type StatusMap interface {
+	AddStatus(name string, status Status)
+}
+
 // RecordLatencies switches on collection of timing for each request
 // coming from the kernel.P assing a nil argument switches off the
 func (ms *Server) RecordLatencies(l LatencyMap) {
@@ -115,6 +174,19 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 // shutting down the filesystem. After the Server is unmounted, it
 // should be discarded.
 //
+// If the mount was made with MountOptions.DirectMount, it calls
+// umount(2) instead. If the file system stays busy, it is then
+// detached (MNT_DETACH): Unmount returns, and the server keeps
+// serving the open files until they are closed.
+//
+// If MountOptions.ReleaseTimeout is set, Unmount first waits up to
+// that long for the kernel to release the open handles, as RELEASE
+// is sent asynchronously after close(2), and is lost if the mount
+// goes first. If a direct mount is detached, as files are still open,
+// the file system is asked to orphan them (see HandleOrphaner).
+//
+// For a CUSE device, Unmount removes the device.
+//
 // Does not work when we were mounted with the magic /dev/fd/N mountpoint syntax,
 // as we do not know the real mountpoint. Unmount using
 //
@@ -122,12 +194,16 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 //
 /// in this case.
 func (ms *Server) Unmount() (err error) {
+	if ms.cuse != nil {
+		return ms.cuseUnmount()
+	}
 	if ms.mountPoint == "" {
 		return nil
 	}
 	if parseFuseFd(ms.mountPoint) >= 0 {
 		return fmt.Errorf("Cannot unmount magic mountpoint %q. Please use `fusermount -u REALMOUNTPOINT` instead.", ms.mountPoint)
 	}
+	ms.waitReleased()
 	delay := time.Duration(0)
 	for try := 0; try < 5; try++ {
 		err = unmount(ms.mountPoint, ms.opts)
@@ -142,20 +218,105 @@ func (ms *Server) Unmount() (err error) {
 		time.Sleep(delay)
 	}
 	if err != nil {
-		return
+		if detach(ms.mountPoint, ms.opts) != nil {
+			return
+		}
+		if o, ok := ms.fileSystem.(HandleOrphaner); ok && ms.OpenHandles() > 0 {
+			o.OrphanHandles()
+		}
+		// The kernel keeps the connection, and the loops,
+		// until the last file is closed.
+		ms.mountPoint = ""
+		return nil
 	}
 	// Wait for event loops to exit.
 	ms.loops.Wait()
+	ms.serving.Wait()
 	ms.mountPoint = ""
 	return err
 }
 
+// OpenHandles returns the number of file and directory handles
+// that the kernel holds, ie. that were opened and not released yet.
+func (ms *Server) OpenHandles() int {
+	ms.reqMu.Lock()
+	defer ms.reqMu.Unlock()
+	return ms.openHandles
+}
+
+func (ms *Server) addOpenHandles(delta int) {
+	if delta == 0 {
+		return
+	}
+	ms.reqMu.Lock()
+	ms.openHandles += delta
+	if ms.openHandles == 0 && ms.handlesReleased != nil {
+		close(ms.handlesReleased)
+		ms.handlesReleased = nil
+	}
+	ms.reqMu.Unlock()
+}
+
+// waitReleased waits until the kernel released all handles, or
+// MountOptions.ReleaseTimeout passed.
+func (ms *Server) waitReleased() {
+	timeout := ms.opts.ReleaseTimeout
+	if timeout <= 0 {
+		return
+	}
+	ms.reqMu.Lock()
+	if ms.openHandles == 0 {
+		ms.reqMu.Unlock()
+		return
+	}
+	if ms.handlesReleased == nil {
+		ms.handlesReleased = make(chan struct{})
+	}
+	released := ms.handlesReleased
+	ms.reqMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-released:
+	case <-timer.C:
+	}
+}
+
 // NewServer creates a FUSE server and attaches ("mounts") it to the
 // `mountPoint` directory.
 //
 // See the "Mount styles" section in the package documentation if you want to
 // know about the inner workings of the mount process. Usually you do not.
 func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint = filepath.Clean(mountPoint)
+	if !filepath.IsAbs(mountPoint) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	}
+	fd, err := mount(mountPoint, ms.opts, ms.ready)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mountPoint = mountPoint
+	if err := ms.start(fd); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// newServer sets up a Server with normalized options, that is not
+// connected to the kernel yet.
+func newServer(fs RawFileSystem, opts *MountOptions) (*Server, error) {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -169,8 +330,20 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	if o.MaxWrite == 0 {
 		o.MaxWrite = 1 << 16
 	}
-	if o.MaxWrite > MAX_KERNEL_WRITE {
-		o.MaxWrite = MAX_KERNEL_WRITE
+	if o.MaxWrite > MAX_KERNEL_MAX_PAGES_WRITE {
+		o.MaxWrite = MAX_KERNEL_MAX_PAGES_WRITE
+	}
+	// The kernel transfers data in pages, so round up to whole pages.
+	o.MaxWrite = roundUpToPage(o.MaxWrite)
+	if o.MaxReadAhead < 0 {
+		o.MaxReadAhead = 0
+	}
+	o.MaxReadAhead = roundUpToPage(o.MaxReadAhead)
+	if o.MaxBackground < 0 {
+		o.MaxBackground = 0
+	}
+	if o.MaxBackground > math.MaxUint16 {
+		o.MaxBackground = math.MaxUint16
 	}
 	if o.Name == "" {
 		name := fs.String()
@@ -211,40 +384,30 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		}
 	}
 	ms.readPool.New = func() interface{} {
-		targetSize := o.MaxWrite + int(maxInputSize)
-		if targetSize < _FUSE_MIN_READ_BUFFER {
-			targetSize = _FUSE_MIN_READ_BUFFER
-		}
-		buf := make([]byte, targetSize+logicalBlockSize)
-		buf = alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(targetSize))
-		return buf
-	}
-	mountPoint = filepath.Clean(mountPoint)
-	if !filepath.IsAbs(mountPoint) {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
-	}
-	fd, err := mount(mountPoint, &o, ms.ready)
-	if err != nil {
-		return nil, err
+		return ms.newReadBuffer()
 	}
+	return ms, nil
+}
 
-	ms.mountPoint = mountPoint
+// start handles INIT on the device fd, and prepares for Serve.
+func (ms *Server) start(fd int) error {
 	ms.mountFd = fd
+	if ms.opts.EnableIOUring {
+		// Without io_uring, use read(2) and write(2).
+		ms.ring, _ = newIOUring(fd, 2*ms.maxReaders, ms.newReadBuffer)
+	}
 
 	if code := ms.handleInit(); !code.Ok() {
 		syscall.Close(fd)
 		// TODO - unmount as well?
-		return nil, fmt.Errorf("init: %s", code)
+		return fmt.Errorf("init: %s", code)
 	}
 
 	// This prepares for Serve being called somewhere, either
 	// synchronously or asynchronously.
 	ms.loops.Add(1)
-	return ms, nil
+	ms.serving.Add(1)
+	return nil
 }
 
 func (o *MountOptions) optionsStrings() []string {
@@ -265,6 +428,17 @@ func (o *MountOptions) optionsStrings() []string {
 	return r
 }
 
+// hasOption reports whether 'name' is among the options passed to
+// fusermount.
+func (o *MountOptions) hasOption(name string) bool {
+	for _, opt := range o.Options {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
 // DebugData returns internal status information for debugging
 // purposes.
 func (ms *Server) DebugData() string {
@@ -276,6 +450,47 @@ func (ms *Server) DebugData() string {
 	return fmt.Sprintf("readers: %d", r)
 }
 
+// readBufferSize returns the size of the largest request. Until the
+// kernel has accepted a MaxWrite in INIT, this assumes the requested
+// one.
+func (ms *Server) readBufferSize() int {
+	maxWrite := ms.opts.MaxWrite
+	if w := int(ms.negotiated.MaxWrite); w > 0 && w < maxWrite {
+		maxWrite = w
+	}
+	sz := maxWrite + int(maxInputSize)
+	if sz < _FUSE_MIN_READ_BUFFER {
+		sz = _FUSE_MIN_READ_BUFFER
+	}
+	return sz
+}
+
+// newReadBuffer allocates a buffer for reading a request, aligned
+// so the data of WRITE requests starts on a block boundary.
+func (ms *Server) newReadBuffer() []byte {
+	targetSize := ms.readBufferSize()
+	buf := make([]byte, targetSize+logicalBlockSize)
+	return alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(targetSize))
+}
+
+// getReadBuffer returns a buffer for reading a request: one that is
+// registered with the ring, if possible.
+func (ms *Server) getReadBuffer() []byte {
+	if ms.ring != nil {
+		if buf := ms.ring.getBuffer(); buf != nil {
+			return buf
+		}
+	}
+	return ms.readPool.Get().([]byte)
+}
+
+func (ms *Server) putReadBuffer(buf []byte) {
+	if ms.ring != nil && ms.ring.putBuffer(buf) {
+		return
+	}
+	ms.readPool.Put(buf)
+}
+
 // handleEINTR retries the given function until it doesn't return syscall.EINTR.
 // This is similar to the HANDLE_EINTR() macro from Chromium ( see
 // https://code.google.com/p/chromium/codesearch#chromium/src/base/posix/eintr_wrapper.h
@@ -299,25 +514,35 @@ func handleEINTR(fn func() error) (err error) {
 // nil, OK if we have too many readers already.
 func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	req = ms.reqPool.Get().(*request)
-	dest := ms.readPool.Get().([]byte)
+	dest := ms.getReadBuffer()
 
 	ms.reqMu.Lock()
 	if ms.reqReaders > ms.maxReaders {
 		ms.reqMu.Unlock()
+		ms.putReadBuffer(dest)
 		return nil, OK
 	}
 	ms.reqReaders++
+	// inPipeSize is set by INIT, which may run concurrently.
+	spliceIn := ms.inPipeSize > 0
 	ms.reqMu.Unlock()
 
 	var n int
 	err := handleEINTR(func() error {
 		var err error
-		n, err = syscall.Read(ms.mountFd, dest)
+		if ms.ring != nil {
+			n, err = ms.ring.read(dest)
+		} else if spliceIn {
+			n, req.inPipe, err = ms.readSplice(dest)
+		} else {
+			n, err = syscall.Read(ms.mountFd, dest)
+		}
 		return err
 	})
 	if err != nil {
 		code = ToStatus(err)
 		ms.reqPool.Put(req)
+		ms.putReadBuffer(dest)
 		ms.reqMu.Lock()
 		ms.reqReaders--
 		ms.reqMu.Unlock()
@@ -333,12 +558,14 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	defer ms.reqMu.Unlock()
 	// Must parse request.Unique under lock
 	if status := req.parseHeader(); !status.Ok() {
+		ms.putReadBuffer(dest)
+		ms.dropInPipe(req)
 		return nil, status
 	}
 	req.inflightIndex = len(ms.reqInflight)
 	ms.reqInflight = append(ms.reqInflight, req)
 	if !gobbled {
-		ms.readPool.Put(dest)
+		ms.putReadBuffer(dest)
 		dest = nil
 	}
 	ms.reqReaders--
@@ -365,6 +592,7 @@ func (ms *Server) returnRequest(req *request) {
 	ms.reqMu.Unlock()
 
 	ms.recordStats(req)
+	ms.dropInPipe(req)
 	if interrupted {
 		// Don't reposses data, because someone might still
 		// be looking at it
@@ -380,7 +608,7 @@ func (ms *Server) returnRequest(req *request) {
 
 	if p := req.bufferPoolInputBuf; p != nil {
 		req.bufferPoolInputBuf = nil
-		ms.readPool.Put(p)
+		ms.putReadBuffer(p)
 	}
 	ms.reqPool.Put(req)
 }
@@ -390,6 +618,9 @@ func (ms *Server) recordStats(req *request) {
 		dt := time.Now().Sub(req.startTime)
 		opname := operationName(req.inHeader.Opcode)
 		ms.latencies.Add(opname, dt)
+		if statuses, ok := ms.latencies.(StatusMap); ok {
+			statuses.AddStatus(opname, req.status)
+		}
 	}
 }
 
@@ -397,12 +628,17 @@ func (ms *Server) recordStats(req *request) {
 // and wait for it to exit, but tests will want to run this in a
 // goroutine.
 //
-// Each filesystem operation executes in a separate goroutine.
+// Each filesystem operation executes in a separate goroutine. Once
+// the file system is unmounted, Serve calls OnUnmount on the
+// RawFileSystem and returns.
 func (ms *Server) Serve() {
 	ms.loop(false)
 	ms.loops.Wait()
 
 	ms.writeMu.Lock()
+	if ms.ring != nil {
+		ms.ring.close()
+	}
 	syscall.Close(ms.mountFd)
 	ms.writeMu.Unlock()
 
@@ -422,12 +658,16 @@ func (ms *Server) Serve() {
 		reading.st = ENODEV
 		close(reading.ready)
 	}
+
+	ms.fileSystem.OnUnmount()
+	ms.serving.Done()
 }
 
 // Wait waits for the serve loop to exit. This should only be called
 // after Serve has been called, or it will hang indefinitely.
 func (ms *Server) Wait() {
 	ms.loops.Wait()
+	ms.serving.Wait()
 }
 
 func (ms *Server) handleInit() Status {
@@ -506,8 +746,35 @@ func (ms *Server) handleRequest(req *request) Status {
 	} else if req.status.Ok() {
 		req.handler.Func(ms, req)
 	}
+	if !req.status.Ok() && req.inHeader.Opcode != _OP_INTERRUPT {
+		ms.reqMu.Lock()
+		if req.interrupted {
+			// Whatever failed was likely due to the cancellation, so
+			// tell the caller it was interrupted. Successful results
+			// are kept, as the kernel must learn about the nodes and
+			// handles they hand out.
+			req.status = EINTR
+		}
+		ms.reqMu.Unlock()
+	}
 
+	// Count the handle before the kernel sees it, and take it
+	// back if the reply did not arrive: only handles that the
+	// kernel received are released.
+	opened := 0
+	switch req.inHeader.Opcode {
+	case _OP_OPEN, _OP_OPENDIR, _OP_CREATE, _OP_TMPFILE:
+		if req.status.Ok() {
+			opened = 1
+		}
+	case _OP_RELEASE, _OP_RELEASEDIR:
+		opened = -1
+	}
+	ms.addOpenHandles(opened)
 	errNo := ms.write(req)
+	if errNo != 0 && opened > 0 {
+		ms.addOpenHandles(-opened)
+	}
 	if errNo != 0 {
 		// Unless debugging is enabled, ignore ENOENT for INTERRUPT responses
 		// which indicates that the referred request is no longer known by the
@@ -670,15 +937,24 @@ func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte
 //
 // The kernel returns ENOENT if it does not currently have entry for this inode
 // in its dentry cache.
+//
+// The kernel replies asynchronously, so this blocks until the data
+// arrives. Concurrent calls are matched to their replies by a
+// notify unique. If MountOptions.RetrieveTimeout passes first,
+// ETIMEDOUT is returned.
 func (ms *Server) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n int, st Status) {
 	// the kernel won't send us in one go more then what we negotiated as MaxWrite.
 	// retrieve the data in chunks.
 	// TODO spawn some number of readahead retrievers in parallel.
+	maxChunk := int(ms.NegotiatedSettings().MaxWrite)
+	if maxChunk == 0 {
+		maxChunk = ms.opts.MaxWrite
+	}
 	ntotal := 0
 	for {
 		chunkSize := len(dest)
-		if chunkSize > ms.opts.MaxWrite {
-			chunkSize = ms.opts.MaxWrite
+		if chunkSize > maxChunk {
+			chunkSize = maxChunk
 		}
 		n, st = ms.inodeRetrieveCache1(node, offset, dest[:chunkSize])
 		if st != OK || n == 0 {
@@ -771,7 +1047,27 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 	// NotifyRetrieveOut sent to the kernel successfully. Now the kernel
 	// have to return data in a separate write-style NotifyReply request.
 	// Wait for the result.
-	<-reading.ready
+	if ms.opts.RetrieveTimeout <= 0 {
+		<-reading.ready
+		return reading.n, reading.st
+	}
+	timer := time.NewTimer(ms.opts.RetrieveTimeout)
+	defer timer.Stop()
+	select {
+	case <-reading.ready:
+	case <-timer.C:
+		ms.retrieveMu.Lock()
+		pending := ms.retrieveTab[q.NotifyUnique] == reading
+		if pending {
+			delete(ms.retrieveTab, q.NotifyUnique)
+		}
+		ms.retrieveMu.Unlock()
+		if pending {
+			return 0, Status(syscall.ETIMEDOUT)
+		}
+		// The reply is being copied into dest; wait for it.
+		<-reading.ready
+	}
 	return reading.n, reading.st
 }
 
@@ -787,13 +1083,51 @@ type retrieveCacheRequest struct {
 	ready chan struct{}
 }
 
-// DeleteNotify notifies the kernel that an entry is removed from a
-// directory.  In many cases, this is equivalent to EntryNotify,
-// except when the directory is in use, eg. as working directory of
-// some process. You should not hold any FUSE filesystem locks, as that
-// can lead to deadlock.
+// PollNotify wakes up the poll waiters that registered the kernel
+// poll handle kh through a Poll request with
+// FUSE_POLL_SCHEDULE_NOTIFY. The kernel then polls again.
+func (ms *Server) PollNotify(kh uint64) Status {
+	if !ms.kernelSettings.SupportsNotify(NOTIFY_POLL) {
+		return ENOSYS
+	}
+
+	req := request{
+		inHeader: &InHeader{
+			Opcode: _OP_NOTIFY_POLL,
+		},
+		handler: operationHandlers[_OP_NOTIFY_POLL],
+		status:  NOTIFY_POLL,
+	}
+
+	out := (*NotifyPollWakeupOut)(req.outData())
+	out.Kh = kh
+
+	// Protect against concurrent close.
+	ms.writeMu.Lock()
+	result := ms.write(&req)
+	ms.writeMu.Unlock()
+
+	if ms.opts.Debug {
+		log.Printf("Response: POLL_NOTIFY: %v", result)
+	}
+	return result
+}
+
+// DeleteNotify notifies the kernel that the entry name, pointing to
+// child, is removed from parent. Unlike EntryNotify, the kernel only
+// drops the entry if it still points to child, and returns ENOENT
+// otherwise, so a file that was created under the same name in the
+// meantime keeps its entry. It also tells inotify watchers about the
+// deletion, and works when child is a directory in use, eg. as
+// working directory of some process.
+//
+// Use DeleteNotify when a known node was removed, and EntryNotify
+// when the node behind a name is unknown or changed for other
+// reasons. If the negotiated protocol predates NOTIFY_DELETE (7.18),
+// this falls back to EntryNotify. You should not hold any FUSE
+// filesystem locks, as that can lead to deadlock.
 func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status {
-	if ms.kernelSettings.Minor < 18 {
+	if ms.NegotiatedSettings().Minor < 18 {
 		return ms.EntryNotify(parent, name)
 	}
 
@@ -874,6 +1208,8 @@ func (in *InitIn) SupportsVersion(maj, min uint32) bool {
 // supported. Pass any of the NOTIFY_* types as argument.
 func (in *InitIn) SupportsNotify(notifyType int) bool {
 	switch notifyType {
+	case NOTIFY_POLL:
+		return in.SupportsVersion(7, 11)
 	case NOTIFY_INVAL_ENTRY:
 		return in.SupportsVersion(7, 12)
 	case NOTIFY_INVAL_INODE:
@@ -899,6 +1235,9 @@ func (ms *Server) WaitMount() error {
 		// we cannot run the poll hack.
 		return nil
 	}
+	if ms.opts.EnablePoll {
+		return nil
+	}
 	return pollHack(ms.mountPoint)
 }
 
@@ -12,7 +12,12 @@ import (
 func (ms *Server) systemWrite(req *request, header []byte) Status {
 	if req.flatDataSize() == 0 {
 		err := handleEINTR(func() error {
-			_, err := syscall.Write(ms.mountFd, header)
+			var err error
+			if ms.ring != nil {
+				_, err = ms.ring.writev(header, nil)
+			} else {
+				_, err = syscall.Write(ms.mountFd, header)
+			}
 			return err
 		})
 		return ToStatus(err)
@@ -34,7 +39,12 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 		header = req.serializeHeader(len(req.flatData))
 	}
 
-	_, err := writev(ms.mountFd, [][]byte{header, req.flatData})
+	var err error
+	if ms.ring != nil {
+		_, err = ms.ring.writev(header, req.flatData)
+	} else {
+		_, err = writev(ms.mountFd, [][]byte{header, req.flatData})
+	}
 	if req.readResult != nil {
 		req.readResult.Done()
 	}
@@ -0,0 +1,53 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitReleased(t *testing.T) {
+	ms := &Server{opts: &MountOptions{ReleaseTimeout: time.Minute}}
+
+	// Nothing open: no wait.
+	start := time.Now()
+	ms.waitReleased()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waitReleased without open handles took %v", d)
+	}
+
+	// The wait ends when the last handle is released.
+	ms.addOpenHandles(2)
+	go func() {
+		ms.addOpenHandles(-1)
+		time.Sleep(10 * time.Millisecond)
+		ms.addOpenHandles(-1)
+	}()
+	start = time.Now()
+	ms.waitReleased()
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("waitReleased took %v", d)
+	}
+	if got := ms.OpenHandles(); got != 0 {
+		t.Errorf("got %d open handles, want 0", got)
+	}
+
+	// Without ReleaseTimeout, don't wait at all.
+	ms.opts.ReleaseTimeout = 0
+	ms.addOpenHandles(1)
+	start = time.Now()
+	ms.waitReleased()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waitReleased without ReleaseTimeout took %v", d)
+	}
+
+	// The timeout bounds the wait.
+	ms.opts.ReleaseTimeout = 10 * time.Millisecond
+	ms.waitReleased()
+	if got := ms.OpenHandles(); got != 1 {
+		t.Errorf("got %d open handles, want 1", got)
+	}
+}
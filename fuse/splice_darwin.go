@@ -6,6 +6,7 @@ package fuse
 
 import (
 	"fmt"
+	"syscall"
 )
 
 func (s *Server) setSplice() {
@@ -15,3 +16,17 @@ func (s *Server) setSplice() {
 func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) error {
 	return fmt.Errorf("unimplemented")
 }
+
+type requestPipe struct{}
+
+func (ms *Server) readSplice(dest []byte) (int, *requestPipe, error) {
+	n, err := syscall.Read(ms.mountFd, dest)
+	return n, nil, err
+}
+
+func (ms *Server) spliceWrite(req *request) (uint32, Status) {
+	return 0, ENOSYS
+}
+
+func (ms *Server) dropInPipe(req *request) {
+}
@@ -6,13 +6,25 @@ package fuse
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"syscall"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/splice"
 )
 
 func (s *Server) setSplice() {
 	s.canSplice = splice.Resizable()
+	if s.canSplice && s.opts.EnableSpliceWrite && s.ring == nil {
+		// The kernel fails the read if the request does not fit
+		// in the pipe, and the data may straddle a page.
+		sz := roundUpToPage(s.readBufferSize()) + pageSize
+		if sz <= splice.MaxPipeSize() {
+			s.inPipeSize = sz
+		}
+	}
 }
 
 // trySplice:  Zero-copy read from fdData.Fd into /dev/fuse
@@ -95,3 +107,106 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 
 	return nil
 }
+
+// requestPipe holds the data of a request in the kernel.
+type requestPipe = splice.Pair
+
+// readSplice reads a request from the kernel through a pipe. For a
+// WRITE, only the headers are read into dest, and the data is left in
+// the returned pipe, for doWrite to splice onwards.
+func (ms *Server) readSplice(dest []byte) (int, *requestPipe, error) {
+	p, err := splice.Get()
+	if err == nil {
+		if err = p.Grow(ms.inPipeSize); err != nil {
+			splice.Drop(p)
+		}
+	}
+	if err != nil {
+		n, err := syscall.Read(ms.mountFd, dest)
+		return n, nil, err
+	}
+
+	sz, err := syscall.Splice(ms.mountFd, nil, int(p.WriteFd()), nil, len(dest), 0)
+	if err != nil {
+		splice.Done(p)
+		return 0, nil, err
+	}
+	n := int(sz)
+	hdr := 0
+	if n > int(unsafe.Sizeof(WriteIn{})) {
+		hdr = int(unsafe.Sizeof(WriteIn{}))
+		if err := readPipe(p, dest[:hdr]); err != nil {
+			splice.Done(p)
+			return 0, nil, err
+		}
+		if (*InHeader)(unsafe.Pointer(&dest[0])).Opcode == _OP_WRITE {
+			return hdr, p, nil
+		}
+	}
+	err = readPipe(p, dest[hdr:n])
+	splice.Done(p)
+	return n, nil, err
+}
+
+// readPipe reads len(dest) bytes, which must be in the pipe already.
+func readPipe(p *requestPipe, dest []byte) error {
+	for len(dest) > 0 {
+		n, err := p.Read(dest)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		dest = dest[n:]
+	}
+	return nil
+}
+
+// spliceWrite handles a WRITE whose data was left in req.inPipe. It
+// splices as much of the data as it can into the file descriptor of
+// the file system, and passes the rest to Write.
+func (ms *Server) spliceWrite(req *request) (uint32, Status) {
+	in := (*WriteIn)(req.inData)
+	size := int(in.Size)
+	written := 0
+	if fder, ok := ms.fileSystem.(WriteFder); ok && in.Flags&syscall.O_DIRECT == 0 {
+		if fd, ok := fder.WriteFd(req.cancel, in); ok {
+			off := int64(in.Offset)
+			n, err := syscall.Splice(int(req.inPipe.ReadFd()), nil, fd, &off, size, 0)
+			if err == nil {
+				written = int(n)
+			}
+		}
+	}
+	if written == size {
+		return uint32(written), OK
+	}
+
+	rest := *in
+	rest.Offset += uint64(written)
+	rest.Size -= uint32(written)
+	buf := ms.buffers.AllocBuffer(rest.Size)
+	defer ms.buffers.FreeBuffer(buf)
+	if err := readPipe(req.inPipe, buf); err != nil {
+		log.Printf("spliceWrite: reading data: %v", err)
+		if written > 0 {
+			return uint32(written), OK
+		}
+		return 0, EIO
+	}
+	n, status := ms.fileSystem.Write(req.cancel, &rest, buf)
+	if written > 0 && !status.Ok() {
+		// Report the short write, like write(2) would.
+		return uint32(written), OK
+	}
+	return uint32(written) + n, status
+}
+
+// dropInPipe returns the pipe holding the data of a WRITE, if any.
+func (ms *Server) dropInPipe(req *request) {
+	if req.inPipe != nil {
+		splice.Done(req.inPipe)
+		req.inPipe = nil
+	}
+}
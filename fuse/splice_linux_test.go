@@ -0,0 +1,169 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// spliceFS has files that write into a backing file: "fd" by giving
+// out its descriptor, "nofd" only through Write, and "badfd" with a
+// descriptor that cannot be written.
+type spliceFS struct {
+	RawFileSystem
+
+	backing *os.File
+	badFd   int
+
+	mu     sync.Mutex
+	writes int
+}
+
+var spliceFSNames = map[string]uint64{"fd": 2, "nofd": 3, "badfd": 4}
+
+func (fs *spliceFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	id, ok := spliceFSNames[name]
+	if !ok {
+		return ENOENT
+	}
+	out.NodeId = id
+	out.Ino = id
+	out.Mode = syscall.S_IFREG | 0644
+	return OK
+}
+
+func (fs *spliceFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Ino = input.NodeId
+	out.Mode = syscall.S_IFREG | 0644
+	if input.NodeId == FUSE_ROOT_ID {
+		out.Mode = syscall.S_IFDIR | 0755
+	}
+	return OK
+}
+
+func (fs *spliceFS) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	out.Fh = input.NodeId
+	return OK
+}
+
+func (fs *spliceFS) WriteFd(cancel <-chan struct{}, input *WriteIn) (int, bool) {
+	switch input.Fh {
+	case 2:
+		return int(fs.backing.Fd()), true
+	case 4:
+		return fs.badFd, true
+	}
+	return -1, false
+}
+
+func (fs *spliceFS) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (uint32, Status) {
+	fs.mu.Lock()
+	fs.writes++
+	fs.mu.Unlock()
+	n, err := fs.backing.WriteAt(data, int64(input.Offset))
+	return uint32(n), ToStatus(err)
+}
+
+func (fs *spliceFS) takeWrites() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := fs.writes
+	fs.writes = 0
+	return n
+}
+
+func TestSpliceWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mnt := dir + "/mnt"
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	backing, err := os.Create(dir + "/backing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backing.Close()
+	bad, err := os.Open(dir + "/backing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+
+	fs := &spliceFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		backing:       backing,
+		badFd:         int(bad.Fd()),
+	}
+	srv, err := NewServer(fs, mnt, &MountOptions{EnableSpliceWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.inPipeSize == 0 {
+		t.Skip("cannot splice requests")
+	}
+
+	data := make([]byte, 300*1024+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, tc := range []struct {
+		name   string
+		flags  int
+		writes bool
+	}{
+		{"fd", 0, false},
+		{"nofd", 0, true},
+		{"badfd", 0, true},
+		{"fd", syscall.O_DIRECT, true},
+	} {
+		if err := backing.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(mnt+"/"+tc.name, os.O_WRONLY|tc.flags, 0)
+		if err != nil {
+			t.Fatalf("Open %s: %v", tc.name, err)
+		}
+		// The first write is not aligned to a page.
+		_, err = f.WriteAt(data[:5], 3)
+		if err == nil {
+			_, err = f.WriteAt(data[5:], 8)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatalf("Write %s: %v", tc.name, err)
+		}
+
+		if got := fs.takeWrites(); (got > 0) != tc.writes {
+			t.Errorf("%s, flags %x: got %d calls to Write", tc.name, tc.flags, got)
+		}
+		got, err := ioutil.ReadFile(dir + "/backing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(make([]byte, 3), data...)) {
+			t.Errorf("%s, flags %x: got wrong %d bytes of content", tc.name, tc.flags, len(got))
+		}
+	}
+
+	// Other requests are read from the pipe as a whole.
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/fd", &st); err != nil || st.Ino != 2 {
+		t.Errorf("Stat: got ino %d, %v", st.Ino, err)
+	}
+}
@@ -73,6 +73,9 @@ const (
 
 	// EROFS Read-only file system
 	EROFS = Status(syscall.EROFS)
+
+	// ENOTTY Inappropriate ioctl for device
+	ENOTTY = Status(syscall.ENOTTY)
 )
 
 type ForgetIn struct {
@@ -81,8 +84,9 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
-// batch forget is handled internally.
-type _ForgetOne struct {
+// ForgetOne is an entry of a BATCH_FORGET request; see
+// BatchForgetter.
+type ForgetOne struct {
 	NodeId  uint64
 	Nlookup uint64
 }
@@ -98,7 +102,8 @@ type MkdirIn struct {
 	InHeader
 
 	// The mode for the new directory. The calling process' umask
-	// is already factored into the mode.
+	// is already factored into the mode, unless
+	// MountOptions.DontMask is set.
 	Mode  uint32
 	Umask uint32
 }
@@ -233,7 +238,14 @@ func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 	return t, false
 }
 
-const RELEASE_FLUSH = (1 << 0)
+const (
+	RELEASE_FLUSH = (1 << 0)
+
+	// RELEASE_FLOCK_UNLOCK is set on the last release of a file
+	// that was flock(2)ed. The file system should drop the
+	// flock locks held by LockOwner.
+	RELEASE_FLOCK_UNLOCK = (1 << 1)
+)
 
 type ReleaseIn struct {
 	InHeader
@@ -251,11 +263,17 @@ type OpenIn struct {
 
 const (
 	// OpenOut.Flags
-	FOPEN_DIRECT_IO   = (1 << 0)
-	FOPEN_KEEP_CACHE  = (1 << 1)
+
+	// FOPEN_DIRECT_IO bypasses the page cache for reads and writes.
+	FOPEN_DIRECT_IO = (1 << 0)
+	// FOPEN_KEEP_CACHE keeps the page cache of the file on open.
+	FOPEN_KEEP_CACHE = (1 << 1)
+	// FOPEN_NONSEEKABLE makes the file not seekable.
 	FOPEN_NONSEEKABLE = (1 << 2)
-	FOPEN_CACHE_DIR   = (1 << 3)
-	FOPEN_STREAM      = (1 << 4)
+	// FOPEN_CACHE_DIR caches the entries of an opened directory.
+	FOPEN_CACHE_DIR = (1 << 3)
+	// FOPEN_STREAM opens the file as a stream, without a position.
+	FOPEN_STREAM = (1 << 4)
 )
 
 type OpenOut struct {
@@ -364,9 +382,11 @@ const (
 	FUSE_IOCTL_COMPAT       = (1 << 0)
 	FUSE_IOCTL_UNRESTRICTED = (1 << 1)
 	FUSE_IOCTL_RETRY        = (1 << 2)
+	FUSE_IOCTL_32BIT        = (1 << 3)
+	FUSE_IOCTL_DIR          = (1 << 4)
 )
 
-type _IoctlIn struct {
+type IoctlIn struct {
 	InHeader
 	Fh      uint64
 	Flags   uint32
@@ -376,27 +396,34 @@ type _IoctlIn struct {
 	OutSize uint32
 }
 
-type _IoctlOut struct {
+type IoctlOut struct {
 	Result  int32
 	Flags   uint32
 	InIovs  uint32
 	OutIovs uint32
 }
 
-type _PollIn struct {
+// IoctlIovec describes a buffer in the memory of the caller of an
+// unrestricted ioctl, for FUSE_IOCTL_RETRY.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+type PollIn struct {
 	InHeader
-	Fh      uint64
-	Kh      uint64
-	Flags   uint32
-	Padding uint32
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32
 }
 
-type _PollOut struct {
+type PollOut struct {
 	Revents uint32
 	Padding uint32
 }
 
-type _NotifyPollWakeupOut struct {
+type NotifyPollWakeupOut struct {
 	Kh uint64
 }
 
@@ -419,9 +446,18 @@ type FileLock struct {
 
 type LkIn struct {
 	InHeader
-	Fh      uint64
-	Owner   uint64
-	Lk      FileLock
+	Fh uint64
+
+	// Owner identifies the lock owner. For POSIX locks, it is
+	// derived from the file table of the locking process; for
+	// flock(2) locks, it is derived from the open file, and it
+	// equals the LockOwner of the corresponding FlushIn and
+	// ReleaseIn.
+	Owner uint64
+	Lk    FileLock
+
+	// LkFlags has FUSE_LK_FLOCK set for flock(2) locks, which
+	// always cover the whole file.
 	LkFlags uint32
 	Padding uint32
 }
@@ -502,7 +538,7 @@ type NotifyRetrieveIn struct {
 }
 
 const (
-	//	NOTIFY_POLL         = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
+	NOTIFY_POLL           = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
 	NOTIFY_INVAL_INODE    = -2 // notify kernel that an inode should be invalidated
 	NOTIFY_INVAL_ENTRY    = -3 // notify kernel that a directory entry should be invalidated
 	NOTIFY_STORE_CACHE    = -4 // store data into kernel cache of an inode
@@ -595,6 +631,78 @@ func (o *AttrOut) SetTimeout(dt time.Duration) {
 	o.AttrValid = uint64(ns / 1e9)
 }
 
+// Masks for Statx.Mask and StatxIn.SxMask. See statx(2).
+const (
+	STATX_BASIC_STATS = 0x7ff
+	STATX_BTIME       = 0x800
+)
+
+// SxTime is a timestamp in Statx.
+type SxTime struct {
+	Sec      uint64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx holds the attributes returned by statx(2). Mask tells which
+// of the fields are set.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type StatxIn struct {
+	InHeader
+
+	// GetattrFlags may have FUSE_GETATTR_FH set, in which case Fh
+	// is set.
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+
+	// SxFlags are the AT_STATX_* sync flags of statx(2), and SxMask
+	// the attributes asked for.
+	SxFlags uint32
+	SxMask  uint32
+}
+
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Statx
+}
+
+func (o *StatxOut) Timeout() time.Duration {
+	return time.Duration(uint64(o.AttrValidNsec) + o.AttrValid*1e9)
+}
+
+func (o *StatxOut) SetTimeout(dt time.Duration) {
+	ns := int64(dt)
+	o.AttrValidNsec = uint32(ns % 1e9)
+	o.AttrValid = uint64(ns / 1e9)
+}
+
 type CreateOut struct {
 	EntryOut
 	OpenOut
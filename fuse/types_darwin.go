@@ -125,6 +125,16 @@ type GetXAttrIn struct {
 	Padding2 uint32
 }
 
+// position returns the offset into the attribute. OSX only uses it
+// for com.apple.ResourceFork.
+func (in *GetXAttrIn) position() uint32 {
+	return in.Position
+}
+
+func (in *SetXAttrIn) position() uint32 {
+	return in.Position
+}
+
 const (
 	CAP_CASE_INSENSITIVE = (1 << 29)
 	CAP_VOL_RENAME       = (1 << 30)
@@ -70,7 +70,8 @@ type CreateIn struct {
 	InHeader
 	Flags uint32
 
-	// Mode for the new file; already takes Umask into account.
+	// Mode for the new file; already takes Umask into account,
+	// unless MountOptions.DontMask is set.
 	Mode uint32
 
 	// Umask used for this create call.
@@ -81,7 +82,8 @@ type CreateIn struct {
 type MknodIn struct {
 	InHeader
 
-	// Mode to use, including the Umask value
+	// Mode to use, including the Umask value, unless
+	// MountOptions.DontMask is set
 	Mode    uint32
 	Rdev    uint32
 	Umask   uint32
@@ -122,6 +124,16 @@ type GetXAttrIn struct {
 	Padding uint32
 }
 
+// position returns the offset into the attribute, which is always 0
+// on Linux.
+func (in *GetXAttrIn) position() uint32 {
+	return 0
+}
+
+func (in *SetXAttrIn) position() uint32 {
+	return 0
+}
+
 func (s *StatfsOut) FromStatfsT(statfs *syscall.Statfs_t) {
 	s.Blocks = statfs.Blocks
 	s.Bsize = uint32(statfs.Bsize)
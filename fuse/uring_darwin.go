@@ -0,0 +1,22 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import "syscall"
+
+// ioUring is Linux only.
+type ioUring struct{}
+
+func newIOUring(devFd int, nbuf int, newBuf func() []byte) (*ioUring, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (r *ioUring) getBuffer() []byte { return nil }
+
+func (r *ioUring) putBuffer(buf []byte) bool { return false }
+
+func (r *ioUring) read(buf []byte) (int, error) { return 0, syscall.ENOSYS }
+
+func (r *ioUring) close() {}
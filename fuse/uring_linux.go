@@ -0,0 +1,462 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Constants from include/uapi/linux/io_uring.h. The system call
+// numbers are the same on all architectures.
+const (
+	sysIOUringSetup    = 425
+	sysIOUringEnter    = 426
+	sysIOUringRegister = 427
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringEnterGetevents = 1
+	ioringRegisterBufs   = 0
+	ioringUnregisterBufs = 1
+
+	ioringOpNop       = 0
+	ioringOpReadv     = 1
+	ioringOpWritev    = 2
+	ioringOpReadFixed = 4
+
+	// ioUringEntries bounds the submitted operations. Each reader
+	// or writer has at most one in flight, so this is ample.
+	ioUringEntries = 256
+)
+
+type ioSqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSqringOffsets
+	cqOff                                                                  ioCqringOffsets
+}
+
+type ioUringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type ioUringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioUring reads requests from and writes replies to the fuse
+// device through an io_uring (see io_uring(7)), which many
+// goroutines share. Reads go to registered buffers if one is free.
+// Completions are reaped by a dedicated goroutine, and handed to
+// the goroutine waiting for them.
+type ioUring struct {
+	fd     int
+	devFd  int
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []ioUringSqe
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []ioUringCqe
+
+	// mu protects the submission queue and the fields below.
+	mu      sync.Mutex
+	closed  bool
+	nextID  uint64
+	waiters map[uint64]*ioUringOp
+
+	// bufs are the registered buffers, by index. They are
+	// dropped if the device does not take them. bufMu protects
+	// bufs and freeBufs.
+	bufs     [][]byte
+	bufMu    sync.Mutex
+	freeBufs []uint16
+
+	reaped chan struct{}
+}
+
+// ioUringOp is an operation that waits for its completion.
+type ioUringOp struct {
+	done chan int32
+	// iov is referenced by the kernel until the operation
+	// completed.
+	iov [2]syscall.Iovec
+}
+
+var ioUringOpPool = sync.Pool{
+	New: func() interface{} {
+		return &ioUringOp{done: make(chan int32, 1)}
+	},
+}
+
+func ioUringSetup(entries uint32, p *ioUringParams) (int, error) {
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func ioUringEnter(fd int, toSubmit, minComplete, flags uint32) (int, error) {
+	n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return int(n), errno
+	}
+	return int(n), nil
+}
+
+// newIOUring sets up a ring for the fuse device devFd. It tries to
+// register nbuf buffers from newBuf for reading requests; reads use
+// unregistered buffers if that fails, eg. because the buffers exceed
+// RLIMIT_MEMLOCK. It returns an error if the kernel lacks io_uring.
+func newIOUring(devFd int, nbuf int, newBuf func() []byte) (*ioUring, error) {
+	var p ioUringParams
+	fd, err := ioUringSetup(ioUringEntries, &p)
+	if err != nil {
+		return nil, err
+	}
+	r := &ioUring{
+		fd:      fd,
+		devFd:   devFd,
+		nextID:  1,
+		waiters: map[uint64]*ioUringOp{},
+		reaped:  make(chan struct{}),
+	}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		syscall.Close(fd)
+		return nil, err
+	}
+	r.registerBuffers(nbuf, newBuf)
+	go r.reap()
+	return r, nil
+}
+
+func (r *ioUring) mmap(p *ioUringParams) error {
+	var err error
+	r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, int(p.sqOff.array+p.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+	r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ioUringCqe{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+	r.sqeMem, err = syscall.Mmap(r.fd, ioringOffSqes, int(p.sqEntries*uint32(unsafe.Sizeof(ioUringSqe{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	r.sqes = (*[1 << 20]ioUringSqe)(unsafe.Pointer(&r.sqeMem[0]))[:p.sqEntries:p.sqEntries]
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = (*[1 << 20]ioUringCqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+	return nil
+}
+
+func (r *ioUring) unmap() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+	r.sqRing, r.cqRing, r.sqeMem = nil, nil, nil
+}
+
+func (r *ioUring) registerBuffers(nbuf int, newBuf func() []byte) {
+	if nbuf <= 0 {
+		return
+	}
+	bufs := make([][]byte, nbuf)
+	iovs := make([]syscall.Iovec, nbuf)
+	for i := range bufs {
+		bufs[i] = newBuf()
+		iovs[i].Base = &bufs[i][0]
+		iovs[i].SetLen(len(bufs[i]))
+	}
+	_, _, errno := syscall.Syscall6(sysIOUringRegister, uintptr(r.fd), ioringRegisterBufs,
+		uintptr(unsafe.Pointer(&iovs[0])), uintptr(nbuf), 0, 0)
+	if errno != 0 {
+		return
+	}
+	r.bufs = bufs
+	for i := range bufs {
+		r.freeBufs = append(r.freeBufs, uint16(i))
+	}
+}
+
+// getBuffer returns a free registered buffer, or nil.
+func (r *ioUring) getBuffer() []byte {
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	if len(r.freeBufs) == 0 {
+		return nil
+	}
+	last := len(r.freeBufs) - 1
+	idx := r.freeBufs[last]
+	r.freeBufs = r.freeBufs[:last]
+	return r.bufs[idx]
+}
+
+// dropBuffers unregisters the buffers. Those in use are then
+// returned to the read pool of the server.
+func (r *ioUring) dropBuffers() {
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	if r.bufs == nil {
+		return
+	}
+	r.bufs = nil
+	r.freeBufs = nil
+	syscall.Syscall6(sysIOUringRegister, uintptr(r.fd), ioringUnregisterBufs, 0, 0, 0, 0)
+}
+
+// bufferIndex returns the index of buf among the registered
+// buffers, or -1.
+func (r *ioUring) bufferIndex(buf []byte) int {
+	if cap(buf) == 0 {
+		return -1
+	}
+	p := &buf[:1][0]
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	for i, b := range r.bufs {
+		if &b[0] == p {
+			return i
+		}
+	}
+	return -1
+}
+
+// putBuffer returns buf to the free registered buffers, and reports
+// whether it was one.
+func (r *ioUring) putBuffer(buf []byte) bool {
+	if cap(buf) == 0 {
+		return false
+	}
+	p := &buf[:1][0]
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	for i, b := range r.bufs {
+		if &b[0] == p {
+			r.freeBufs = append(r.freeBufs, uint16(i))
+			return true
+		}
+	}
+	return false
+}
+
+// submit queues sqe, and waits for its result.
+func (r *ioUring) submit(sqe *ioUringSqe, op *ioUringOp) (int, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, syscall.EBADF
+	}
+	id := r.nextID
+	r.nextID++
+	r.waiters[id] = op
+	sqe.userData = id
+
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & r.sqMask
+	r.sqes[idx] = *sqe
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	var err error
+	for {
+		var n int
+		n, err = ioUringEnter(r.fd, 1, 0, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil && n != 1 {
+			err = syscall.EAGAIN
+		}
+		break
+	}
+	if err != nil {
+		// The kernel did not take the entry, so take it back.
+		atomic.StoreUint32(r.sqTail, tail)
+		delete(r.waiters, id)
+		r.mu.Unlock()
+		return 0, err
+	}
+	r.mu.Unlock()
+
+	res := <-op.done
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// reap hands completions to their waiters, until the NOP from close
+// completes.
+func (r *ioUring) reap() {
+	defer close(r.reaped)
+	for {
+		// Let the goroutines that were handed completions run
+		// first, as the blocking call below keeps the P until
+		// the runtime retakes it.
+		runtime.Gosched()
+		if _, err := ioUringEnter(r.fd, 0, 1, ioringEnterGetevents); err != nil && err != syscall.EINTR {
+			return
+		}
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		exit := false
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			if cqe.userData == 0 {
+				exit = true
+				continue
+			}
+			r.mu.Lock()
+			op := r.waiters[cqe.userData]
+			delete(r.waiters, cqe.userData)
+			r.mu.Unlock()
+			if op != nil {
+				op.done <- cqe.res
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		if exit {
+			return
+		}
+	}
+}
+
+// read reads a request from the device into buf.
+func (r *ioUring) read(buf []byte) (int, error) {
+	op := ioUringOpPool.Get().(*ioUringOp)
+	defer ioUringOpPool.Put(op)
+
+	if idx := r.bufferIndex(buf); idx >= 0 {
+		sqe := ioUringSqe{
+			opcode:   ioringOpReadFixed,
+			fd:       int32(r.devFd),
+			addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+			len:      uint32(len(buf)),
+			bufIndex: uint16(idx),
+		}
+		n, err := r.submit(&sqe, op)
+		if err != syscall.EINVAL {
+			return n, err
+		}
+		// The fuse device only reads into user memory, not
+		// into registered buffers, at least up to Linux 6.x.
+		r.dropBuffers()
+	}
+
+	op.iov[0].Base = &buf[0]
+	op.iov[0].SetLen(len(buf))
+	sqe := ioUringSqe{
+		opcode: ioringOpReadv,
+		fd:     int32(r.devFd),
+		addr:   uint64(uintptr(unsafe.Pointer(&op.iov[0]))),
+		len:    1,
+	}
+	n, err := r.submit(&sqe, op)
+	op.iov[0] = syscall.Iovec{}
+	return n, err
+}
+
+// writev writes a reply, made of header and data, to the device.
+func (r *ioUring) writev(header, data []byte) (int, error) {
+	op := ioUringOpPool.Get().(*ioUringOp)
+	defer ioUringOpPool.Put(op)
+
+	op.iov[0].Base = &header[0]
+	op.iov[0].SetLen(len(header))
+	nvec := 1
+	if len(data) > 0 {
+		op.iov[1].Base = &data[0]
+		op.iov[1].SetLen(len(data))
+		nvec = 2
+	}
+	sqe := ioUringSqe{
+		opcode: ioringOpWritev,
+		fd:     int32(r.devFd),
+		addr:   uint64(uintptr(unsafe.Pointer(&op.iov[0]))),
+		len:    uint32(nvec),
+	}
+	n, err := r.submit(&sqe, op)
+	op.iov = [2]syscall.Iovec{}
+	return n, err
+}
+
+// close stops the reaper and releases the ring. Operations that
+// come later fail with EBADF.
+func (r *ioUring) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & r.sqMask
+	r.sqes[idx] = ioUringSqe{opcode: ioringOpNop}
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	_, err := ioUringEnter(r.fd, 1, 0, 0)
+	r.mu.Unlock()
+
+	// Without the NOP, the reaper stays blocked, and must keep
+	// the ring.
+	if err != nil {
+		return
+	}
+	<-r.reaped
+	r.unmap()
+	syscall.Close(r.fd)
+}
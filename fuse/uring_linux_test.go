@@ -0,0 +1,100 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func newTestRing(t *testing.T, fd int) *ioUring {
+	r, err := newIOUring(fd, 2, func() []byte { return make([]byte, 4096) })
+	if err == syscall.ENOSYS || err == syscall.EPERM {
+		t.Skipf("no io_uring: %v", err)
+	} else if err != nil {
+		t.Fatalf("newIOUring: %v", err)
+	}
+	return r
+}
+
+func TestIOUringReadWrite(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	r := newTestRing(t, fds[0])
+	defer r.close()
+
+	if n, err := r.writev([]byte("head"), []byte("data")); err != nil || n != 8 {
+		t.Fatalf("writev: %d, %v", n, err)
+	}
+	got := make([]byte, 100)
+	if n, err := syscall.Read(fds[1], got); err != nil || string(got[:n]) != "headdata" {
+		t.Errorf("read: got %q, %v", got[:n], err)
+	}
+
+	registered := r.getBuffer()
+	if registered == nil {
+		t.Fatal("no registered buffers")
+	}
+	for _, buf := range [][]byte{registered, make([]byte, 4096)} {
+		if _, err := syscall.Write(fds[1], []byte("request")); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.read(buf); err != nil || !bytes.Equal(buf[:n], []byte("request")) {
+			t.Errorf("read: got %q, %v", buf[:n], err)
+		}
+	}
+	if !r.putBuffer(registered) || r.putBuffer(make([]byte, 10)) {
+		t.Errorf("putBuffer did not recognize the registered buffer")
+	}
+
+	// The errors of the operations are returned.
+	syscall.Close(fds[1])
+	if _, err := r.writev([]byte("head"), nil); err != syscall.EPIPE {
+		t.Errorf("writev after close: got %v, want EPIPE", err)
+	}
+
+	r.close()
+	if _, err := r.writev([]byte("head"), nil); err != syscall.EBADF {
+		t.Errorf("writev on a closed ring: got %v, want EBADF", err)
+	}
+}
+
+func TestIOUringMount(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{
+		EnableIOUring: true,
+		Debug:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.ring == nil {
+		t.Skip("no io_uring")
+	}
+
+	// The request and the reply pass the ring.
+	var st syscall.Stat_t
+	for i := 0; i < 10; i++ {
+		if err := syscall.Stat(mnt+"/file", &st); err != syscall.ENOSYS {
+			t.Fatalf("Stat: got %v, want ENOSYS", err)
+		}
+	}
+}
@@ -7,54 +7,70 @@ package internal
 import (
 	"os/user"
 	"strconv"
+	"syscall"
 )
 
 // HasAccess tests if a caller can access a file with permissions
-// `perm` in mode `mask`
+// `perm` in mode `mask`. Like the kernel, it only uses the bits of
+// the first class (owner, group, other) that the caller belongs to,
+// and all bits of mask must be granted. Root may read and write
+// anything, but may only execute files that have an execute bit set.
 func HasAccess(callerUid, callerGid, fileUid, fileGid uint32, perm uint32, mask uint32) bool {
-	if callerUid == 0 {
-		// root can do anything.
-		return true
-	}
+	return HasAccessGroups(callerUid, callerGid, func() []uint32 { return UserGroups(callerUid) },
+		fileUid, fileGid, perm, mask)
+}
+
+// HasAccessGroups is like HasAccess, but takes the supplementary
+// groups of the caller from 'groups', rather than from the user
+// database. It is only called if the group matters.
+func HasAccessGroups(callerUid, callerGid uint32, groups func() []uint32, fileUid, fileGid uint32, perm uint32, mask uint32) bool {
 	mask = mask & 7
 	if mask == 0 {
 		return true
 	}
+	if callerUid == 0 {
+		// root can do anything, except executing
+		// non-executable files.
+		return mask&1 == 0 || perm&syscall.S_IFMT == syscall.S_IFDIR || perm&0111 != 0
+	}
 
 	if callerUid == fileUid {
-		if perm&(mask<<6) != 0 {
-			return true
-		}
+		return perm&(mask<<6) == mask<<6
 	}
+	groupOK := perm&(mask<<3) == mask<<3
 	if callerGid == fileGid {
-		if perm&(mask<<3) != 0 {
-			return true
-		}
+		return groupOK
 	}
-	if perm&mask != 0 {
-		return true
+	otherOK := perm&mask == mask
+	if groupOK == otherOK {
+		// avoid expensive lookup if the group does not matter
+		return otherOK
 	}
 
 	// Check other groups.
-	if perm&(mask<<3) == 0 {
-		// avoid expensive lookup if it's not allowed anyway
-		return false
+	for _, g := range groups() {
+		if g == fileGid {
+			return groupOK
+		}
 	}
+	return otherOK
+}
 
-	u, err := user.LookupId(strconv.Itoa(int(callerUid)))
+// UserGroups returns the groups of user uid from the user database.
+func UserGroups(uid uint32) []uint32 {
+	u, err := user.LookupId(strconv.Itoa(int(uid)))
 	if err != nil {
-		return false
+		return nil
 	}
 	gs, err := u.GroupIds()
 	if err != nil {
-		return false
+		return nil
 	}
-
-	fileGidStr := strconv.Itoa(int(fileGid))
+	var groups []uint32
 	for _, gidStr := range gs {
-		if gidStr == fileGidStr {
-			return true
+		if g, err := strconv.ParseUint(gidStr, 10, 32); err == nil {
+			groups = append(groups, uint32(g))
 		}
 	}
-	return false
+	return groups
 }
@@ -7,6 +7,7 @@ package internal
 import (
 	"os/user"
 	"strconv"
+	"syscall"
 	"testing"
 )
 
@@ -74,3 +75,61 @@ func TestHasAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestHasAccessClasses(t *testing.T) {
+	// These IDs are not in the user database, so there are no
+	// supplementary groups.
+	const fuid, fgid, other = 4242, 4343, 4444
+	for i, tc := range []struct {
+		uid, gid   uint32
+		perm, mask uint32
+		want       bool
+	}{
+		// All bits of the mask must be granted.
+		{fuid, other, 0400, 06, false},
+		{fuid, other, 0600, 06, true},
+		// Only the first matching class counts.
+		{fuid, fgid, 0077, 04, false},
+		{other, fgid, 0707, 04, false},
+		{other, fgid, 0040, 04, true},
+		{other, other, 0770, 04, false},
+		{other, other, 0004, 04, true},
+		// Root can only execute executable files.
+		{0, 0, 0000, 06, true},
+		{0, 0, syscall.S_IFREG | 0600, 01, false},
+		{0, 0, syscall.S_IFREG | 0001, 01, true},
+		{0, 0, syscall.S_IFDIR | 0000, 01, true},
+	} {
+		got := HasAccess(tc.uid, tc.gid, fuid, fgid, tc.perm, tc.mask)
+		if got != tc.want {
+			t.Errorf("%d: HasAccess(%v): got %v, want %v", i, tc, got, tc.want)
+		}
+	}
+}
+
+func TestHasAccessGroups(t *testing.T) {
+	const fuid, fgid, other = 4242, 4343, 4444
+	calls := 0
+	groups := func() []uint32 {
+		calls++
+		return []uint32{other + 1, fgid}
+	}
+	if !HasAccessGroups(other, other, groups, fuid, fgid, 0040, 04) {
+		t.Errorf("supplementary group %d not granted access", fgid)
+	}
+	if HasAccessGroups(other, other, groups, fuid, fgid+1, 0040, 04) {
+		t.Errorf("group %d granted access", fgid+1)
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls for the groups, want 2", calls)
+	}
+
+	// The owner and primary group do not need the supplementary
+	// groups.
+	calls = 0
+	HasAccessGroups(fuid, other, groups, fuid, fgid, 0400, 04)
+	HasAccessGroups(other, fgid, groups, fuid, fgid, 0040, 04)
+	if calls != 0 {
+		t.Errorf("got %d calls for the groups, want 0", calls)
+	}
+}
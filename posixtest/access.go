@@ -0,0 +1,142 @@
+// Copyright 2022 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package posixtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Access checks access(2) for R, W and X against each permission
+// class, and for root. It needs root, and a mount with allow_other
+// so other users can reach the file system.
+func Access(t *testing.T, mnt string) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run test as root")
+	}
+	if !allowOther(mnt) {
+		t.Skip("mount does not have allow_other")
+	}
+
+	// These IDs are not in the user database, so there are no
+	// supplementary groups.
+	const fileUid, fileGid, otherId = 4242, 4343, 4444
+	fn := filepath.Join(mnt, "file")
+	if err := ioutil.WriteFile(fn, nil, 0); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chown(fn, fileUid, fileGid); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+	// The other users cannot traverse the directories above the
+	// mount, so they look up the file relative to the mount.
+	dir, err := os.Open(mnt)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer dir.Close()
+
+	chmod := func(mode uint32) {
+		if err := os.Chmod(fn, os.FileMode(mode)); err != nil {
+			t.Fatalf("Chmod: %v", err)
+		}
+	}
+	for _, class := range []struct {
+		name     string
+		uid, gid int
+		shift    uint
+	}{
+		{"owner", fileUid, otherId, 6},
+		{"group", otherId, fileGid, 3},
+		{"other", otherId, otherId, 0},
+	} {
+		for _, mask := range []uint32{unix.R_OK, unix.W_OK, unix.X_OK} {
+			bit := mask << class.shift
+			// The bit of the class is necessary and
+			// sufficient; the other classes do not matter.
+			for _, tc := range []struct {
+				mode uint32
+				want error
+			}{
+				{bit, nil},
+				{0777 &^ bit, syscall.EACCES},
+			} {
+				chmod(tc.mode)
+				if got := accessAs(class.uid, class.gid, int(dir.Fd()), "file", mask); got != tc.want {
+					t.Errorf("%s: access(%d) for mode %#o: got %v, want %v", class.name, mask, tc.mode, got, tc.want)
+				}
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		mode, mask uint32
+		want       error
+	}{
+		{0, unix.R_OK | unix.W_OK, nil},
+		{0600, unix.X_OK, syscall.EACCES},
+		{0001, unix.X_OK, nil},
+	} {
+		chmod(tc.mode)
+		if got := unix.Access(fn, tc.mask); got != tc.want {
+			t.Errorf("root: access(%d) for mode %#o: got %v, want %v", tc.mask, tc.mode, got, tc.want)
+		}
+	}
+}
+
+// accessAs calls faccessat(2) with the given real uid and gid.
+func accessAs(uid, gid int, dirfd int, name string, mask uint32) error {
+	result := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the
+		// goroutine, and nothing else runs with its
+		// credentials. Raw syscalls only change the current
+		// thread, and keeping the effective uid keeps it root.
+		runtime.LockOSThread()
+		keep := ^uintptr(0)
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+			result <- fmt.Errorf("setgroups: %v", errno)
+			return
+		}
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESGID, uintptr(gid), keep, keep); errno != 0 {
+			result <- fmt.Errorf("setresgid: %v", errno)
+			return
+		}
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, uintptr(uid), keep, keep); errno != 0 {
+			result <- fmt.Errorf("setresuid: %v", errno)
+			return
+		}
+		result <- unix.Faccessat(dirfd, name, mask, 0)
+	}()
+	return <-result
+}
+
+// allowOther reports whether mnt is mounted with allow_other.
+func allowOther(mnt string) bool {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 5 || fields[4] != mnt {
+			continue
+		}
+		for _, opt := range strings.Split(fields[len(fields)-1], ",") {
+			if opt == "allow_other" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -16,10 +16,12 @@ import (
 	"testing"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 // All holds a map of all test functions
 var All = map[string]func(*testing.T, string){
+	"Access":                     Access,
 	"AppendWrite":                AppendWrite,
 	"SymlinkReadlink":            SymlinkReadlink,
 	"FileBasic":                  FileBasic,
@@ -35,12 +37,16 @@ var All = map[string]func(*testing.T, string){
 	"RenameOverwriteDestNoExist": RenameOverwriteDestNoExist,
 	"RenameOverwriteDestExist":   RenameOverwriteDestExist,
 	"RenameOpenDir":              RenameOpenDir,
+	"RenameNoReplace":            RenameNoReplace,
+	"RenameExchange":             RenameExchange,
+	"RenameWhiteout":             RenameWhiteout,
 	"ReadDir":                    ReadDir,
 	"ReadDirPicksUpCreate":       ReadDirPicksUpCreate,
 	"DirectIO":                   DirectIO,
 	"OpenAt":                     OpenAt,
 	"Fallocate":                  Fallocate,
 	"DirSeek":                    DirSeek,
+	"SeekHole":                   SeekHole,
 }
 
 func DirectIO(t *testing.T, mnt string) {
@@ -462,6 +468,128 @@ func RenameOpenDir(t *testing.T, mnt string) {
 
 // ReadDir creates 110 files one by one, checking that we get the expected
 // entries after each file creation.
+// RenameNoReplace checks that RENAME_NOREPLACE refuses to clobber
+// an existing destination.
+func RenameNoReplace(t *testing.T, mnt string) {
+	if err := ioutil.WriteFile(mnt+"/src", []byte("src"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dst", []byte("dst"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, mnt+"/src", unix.AT_FDCWD, mnt+"/dst", unix.RENAME_NOREPLACE)
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		t.Skipf("RENAME_NOREPLACE not supported: %v", err)
+	}
+	if err != syscall.EEXIST {
+		t.Errorf("Renameat2 to existing file: got %v, want EEXIST", err)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/dst"); err != nil || string(got) != "dst" {
+		t.Errorf("dst: got %q, %v, want \"dst\"", got, err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, mnt+"/src", unix.AT_FDCWD, mnt+"/new", unix.RENAME_NOREPLACE); err != nil {
+		t.Fatalf("Renameat2 to new file: %v", err)
+	}
+	if _, err := os.Lstat(mnt + "/src"); !os.IsNotExist(err) {
+		t.Errorf("Lstat src: got %v, want ENOENT", err)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/new"); err != nil || string(got) != "src" {
+		t.Errorf("new: got %q, %v, want \"src\"", got, err)
+	}
+}
+
+// RenameExchange checks that RENAME_EXCHANGE swaps a file and a
+// directory, including their inode numbers.
+func RenameExchange(t *testing.T, mnt string) {
+	if err := os.Mkdir(mnt+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Mkdir(mnt+"/other", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	var fileSt, otherSt syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/dir/file", &fileSt); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if err := syscall.Lstat(mnt+"/other", &otherSt); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, mnt+"/dir/file", unix.AT_FDCWD, mnt+"/other", unix.RENAME_EXCHANGE)
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		t.Skipf("RENAME_EXCHANGE not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Renameat2: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/other", &st); err != nil {
+		t.Fatalf("Lstat other: %v", err)
+	}
+	if st.Ino != fileSt.Ino || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("other: got ino %d mode %o, want ino %d, regular file", st.Ino, st.Mode, fileSt.Ino)
+	}
+	if err := syscall.Lstat(mnt+"/dir/file", &st); err != nil {
+		t.Fatalf("Lstat dir/file: %v", err)
+	}
+	if st.Ino != otherSt.Ino || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("dir/file: got ino %d mode %o, want ino %d, directory", st.Ino, st.Mode, otherSt.Ino)
+	}
+	if got, err := ioutil.ReadFile(mnt + "/other"); err != nil || string(got) != "hello" {
+		t.Errorf("other: got %q, %v, want \"hello\"", got, err)
+	}
+
+	// Swapping back restores the original tree.
+	if err := unix.Renameat2(unix.AT_FDCWD, mnt+"/other", unix.AT_FDCWD, mnt+"/dir/file", unix.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("Renameat2 back: %v", err)
+	}
+	if err := syscall.Lstat(mnt+"/dir/file", &st); err != nil || st.Ino != fileSt.Ino {
+		t.Errorf("dir/file: got ino %d (%v), want %d", st.Ino, err, fileSt.Ino)
+	}
+}
+
+// RenameWhiteout checks that RENAME_WHITEOUT leaves a whiteout (a
+// 0/0 character device) in place of the source.
+func RenameWhiteout(t *testing.T, mnt string) {
+	if err := ioutil.WriteFile(mnt+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var before syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/file", &before); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, mnt+"/file", unix.AT_FDCWD, mnt+"/renamed", unix.RENAME_WHITEOUT)
+	if err == syscall.EINVAL || err == syscall.ENOSYS || err == syscall.EPERM {
+		// Creating whiteouts needs CAP_MKNOD.
+		t.Skipf("RENAME_WHITEOUT not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Renameat2: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/renamed", &st); err != nil {
+		t.Fatalf("Lstat renamed: %v", err)
+	}
+	if st.Ino != before.Ino {
+		t.Errorf("renamed: got ino %d, want %d", st.Ino, before.Ino)
+	}
+	if err := syscall.Lstat(mnt+"/file", &st); err != nil {
+		t.Fatalf("Lstat whiteout: %v", err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout: got mode %o rdev %d, want character device 0/0", st.Mode, st.Rdev)
+	}
+}
+
 func ReadDir(t *testing.T, mnt string) {
 	want := map[string]bool{}
 	// 40 bytes of filename, so 110 entries overflows a
@@ -626,3 +754,43 @@ func Fallocate(t *testing.T, mnt string) {
 			fi.Size())
 	}
 }
+
+// SeekHole checks that SEEK_HOLE and SEEK_DATA find a hole between
+// two writes.
+func SeekHole(t *testing.T, mnt string) {
+	f, err := os.OpenFile(mnt+"/file", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+
+	const dataOff = 1 << 20
+	data := []byte("hello")
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := f.WriteAt(data, dataOff); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	size := int64(dataOff + len(data))
+
+	fd := int(f.Fd())
+	hole, err := unix.Seek(fd, 0, unix.SEEK_HOLE)
+	if err != nil {
+		t.Fatalf("Seek(SEEK_HOLE): %v", err)
+	}
+	if hole == size {
+		t.Skip("FS does not report holes")
+	}
+	if hole < int64(len(data)) || hole >= dataOff {
+		t.Errorf("got hole at %d, want it in [%d, %d)", hole, len(data), dataOff)
+	}
+	if next, err := unix.Seek(fd, hole, unix.SEEK_DATA); err != nil {
+		t.Errorf("Seek(SEEK_DATA): %v", err)
+	} else if next <= hole || next > dataOff {
+		t.Errorf("got data at %d, want it in (%d, %d]", next, hole, dataOff)
+	}
+	if _, err := unix.Seek(fd, size, unix.SEEK_DATA); err != unix.ENXIO {
+		t.Errorf("Seek(SEEK_DATA) at EOF: got %v, want ENXIO", err)
+	}
+}
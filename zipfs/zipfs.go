@@ -2,6 +2,11 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package zipfs serves zip and tar archives as read-only file
+// systems. They are built on the fs package: the root creates the
+// whole tree as persistent inodes in OnAdd. Files in a zip archive
+// unpack their content when they are first opened; tar archives can
+// only be read sequentially, so their content is read in OnAdd.
 package zipfs
 
 import (